@@ -0,0 +1,72 @@
+package inventory
+
+import (
+	"encoding/json"
+	log "github.com/golang/glog"
+	"net/http"
+)
+
+/*
+   Apply version retention policies POST /_admin/prune?type=<asset_type>&dry_run=true
+   All asset types are pruned if no type is given.  With dry_run the report
+   of what would be removed is returned and nothing is removed.
+*/
+func (ir *Inventory) VersionPruneHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		headers = map[string]string{"Content-Type": "text/plain"}
+		params  = r.URL.Query()
+		dryRun  = params.Get("dry_run") == "true"
+	)
+
+	reqUser, code, err := ir.authorizeAdmin(r)
+	if err != nil {
+		WriteAndLogResponse(w, r, code, headers, []byte(err.Error()))
+		return
+	}
+
+	assetTypes := make([]string, len(params["type"]))
+	for i, t := range params["type"] {
+		assetTypes[i] = ir.normalizeAssetType(t)
+	}
+
+	report, err := ir.pruner.Prune(dryRun, assetTypes...)
+	if err != nil {
+		WriteAndLogResponse(w, r, 500, headers, []byte(err.Error()))
+		return
+	}
+	log.V(6).Infof("Prune by '%s' (dry run: %v): %d of %d versions\n", reqUser, dryRun,
+		report.Pruned, report.Examined)
+
+	headers["Content-Type"] = "application/json"
+	b, _ := json.Marshal(report)
+	WriteAndLogResponse(w, r, 200, headers, b)
+}
+
+/*
+   Report existing asset ids breaking the id rules of their type
+   GET /_admin/ids?type=<asset_type>.  All types are checked if none are given.
+*/
+func (ir *Inventory) AssetIdReportHandler(w http.ResponseWriter, r *http.Request) {
+	headers := map[string]string{"Content-Type": "text/plain"}
+
+	if _, code, err := ir.authorizeAdmin(r); err != nil {
+		WriteAndLogResponse(w, r, code, headers, []byte(err.Error()))
+		return
+	}
+
+	params := r.URL.Query()
+	assetTypes := make([]string, len(params["type"]))
+	for i, t := range params["type"] {
+		assetTypes[i] = ir.normalizeAssetType(t)
+	}
+
+	report, err := ir.ReportAssetIds(assetTypes...)
+	if err != nil {
+		WriteAndLogResponse(w, r, 500, headers, []byte(err.Error()))
+		return
+	}
+
+	headers["Content-Type"] = "application/json"
+	b, _ := json.Marshal(report)
+	WriteAndLogResponse(w, r, 200, headers, b)
+}
@@ -0,0 +1,194 @@
+package inventory
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+/*
+   Aggregation over the assets matching a filter.  By are nested term
+   fields i.e. counts per value of By[0] then per value of By[1] within each
+   of those and so on.  Histograms maps numeric fields to their bucket
+   interval.  Histograms and Stats are computed for every bucket.  Term
+   buckets with fewer than MinCount assets are left out.
+*/
+type Aggregation struct {
+	By         []string           `json:"by,omitempty"`
+	Histograms map[string]float64 `json:"histograms,omitempty"`
+	Stats      []string           `json:"stats,omitempty"`
+	MinCount   int64              `json:"min_count,omitempty"`
+}
+
+/* Counts for a set of assets.  Buckets are the values of Field. */
+type AggregationResult struct {
+	Count      int64                        `json:"count"`
+	Field      string                       `json:"field,omitempty"`
+	Buckets    []AggregationBucket          `json:"buckets,omitempty"`
+	Histograms map[string][]HistogramBucket `json:"histograms,omitempty"`
+	Stats      map[string]FieldStats        `json:"stats,omitempty"`
+}
+
+type AggregationBucket struct {
+	Key interface{} `json:"key"`
+	AggregationResult
+}
+
+/* Key is the lower bound of the bucket */
+type HistogramBucket struct {
+	Key   float64 `json:"key"`
+	Count int64   `json:"count"`
+}
+
+/* Stats of the numeric values of a field.  Count is the number of values. */
+type FieldStats struct {
+	Count int64   `json:"count"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+	Sum   float64 `json:"sum"`
+}
+
+func (agg Aggregation) Validate() error {
+	for field, interval := range agg.Histograms {
+		if interval <= 0 {
+			return fmt.Errorf("Invalid histogram for '%s': interval must be greater than 0", field)
+		}
+	}
+	return nil
+}
+
+/* Aggregate assets in process.  Used by backends without native aggregations. */
+func aggregateAssets(assets []Asset, agg Aggregation) AggregationResult {
+	docs := make([]map[string]interface{}, len(assets))
+	for i, a := range assets {
+		docs[i] = a.Data
+	}
+	return aggregateDocs(docs, agg, agg.By)
+}
+
+func aggregateDocs(docs []map[string]interface{}, agg Aggregation, by []string) AggregationResult {
+	rslt := AggregationResult{Count: int64(len(docs))}
+
+	if len(agg.Histograms) > 0 {
+		rslt.Histograms = map[string][]HistogramBucket{}
+		for field, interval := range agg.Histograms {
+			rslt.Histograms[field] = histogramBuckets(docs, field, interval)
+		}
+	}
+	if len(agg.Stats) > 0 {
+		rslt.Stats = map[string]FieldStats{}
+		for _, field := range agg.Stats {
+			rslt.Stats[field] = fieldStats(docs, field)
+		}
+	}
+	if len(by) < 1 {
+		return rslt
+	}
+
+	type group struct {
+		key  interface{}
+		docs []map[string]interface{}
+	}
+	var (
+		groups = map[string]*group{}
+		order  = []*group{}
+	)
+	for _, doc := range docs {
+		// Arrays count once per distinct value
+		seen := map[string]bool{}
+		for _, v := range fieldValues(doc, by[0]) {
+			switch v.(type) {
+			case map[string]interface{}, []interface{}, nil:
+				continue
+			}
+			k := fmt.Sprintf("%T:%v", v, v)
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			if _, ok := groups[k]; !ok {
+				groups[k] = &group{key: v}
+				order = append(order, groups[k])
+			}
+			groups[k].docs = append(groups[k].docs, doc)
+		}
+	}
+
+	if agg.MinCount > 1 {
+		kept := order[:0]
+		for _, g := range order {
+			if int64(len(g.docs)) >= agg.MinCount {
+				kept = append(kept, g)
+			}
+		}
+		order = kept
+	}
+
+	// Most common first, ties by value
+	sort.SliceStable(order, func(i, j int) bool {
+		if len(order[i].docs) != len(order[j].docs) {
+			return len(order[i].docs) > len(order[j].docs)
+		}
+		if c, ok := compareValues(order[i].key, order[j].key); ok {
+			return c < 0
+		}
+		return fmt.Sprint(order[i].key) < fmt.Sprint(order[j].key)
+	})
+
+	rslt.Field = by[0]
+	rslt.Buckets = make([]AggregationBucket, len(order))
+	for i, g := range order {
+		rslt.Buckets[i] = AggregationBucket{Key: g.key, AggregationResult: aggregateDocs(g.docs, agg, by[1:])}
+	}
+	return rslt
+}
+
+/* Non empty buckets of the numeric values of field ordered by key */
+func histogramBuckets(docs []map[string]interface{}, field string, interval float64) []HistogramBucket {
+	counts := map[float64]int64{}
+	for _, doc := range docs {
+		for _, v := range numericValues(doc, field) {
+			counts[math.Floor(v/interval)*interval]++
+		}
+	}
+
+	buckets := make([]HistogramBucket, 0, len(counts))
+	for k, n := range counts {
+		buckets = append(buckets, HistogramBucket{Key: k, Count: n})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Key < buckets[j].Key })
+	return buckets
+}
+
+func fieldStats(docs []map[string]interface{}, field string) (stats FieldStats) {
+	for _, doc := range docs {
+		for _, v := range numericValues(doc, field) {
+			if stats.Count == 0 || v < stats.Min {
+				stats.Min = v
+			}
+			if stats.Count == 0 || v > stats.Max {
+				stats.Max = v
+			}
+			stats.Sum += v
+			stats.Count++
+		}
+	}
+	if stats.Count > 0 {
+		stats.Avg = stats.Sum / float64(stats.Count)
+	}
+	return
+}
+
+/* Numbers of a field.  Other values are ignored. */
+func numericValues(doc map[string]interface{}, field string) []float64 {
+	nums := []float64{}
+	for _, v := range fieldValues(doc, field) {
+		switch v.(type) {
+		case float64, int64, int:
+			nums = append(nums, toFloat(v))
+			break
+		}
+	}
+	return nums
+}
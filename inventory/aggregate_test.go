@@ -0,0 +1,103 @@
+package inventory
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+var testAggAssets = []Asset{
+	{Id: "a", Data: map[string]interface{}{"env": "prod", "status": "running", "cpus": float64(2)}},
+	{Id: "b", Data: map[string]interface{}{"env": "prod", "status": "running", "cpus": float64(8)}},
+	{Id: "c", Data: map[string]interface{}{"env": "prod", "status": "stopped", "cpus": float64(4)}},
+	{Id: "d", Data: map[string]interface{}{"env": "dev", "status": "running", "cpus": "many"}},
+	{Id: "e", Data: map[string]interface{}{"status": "running", "tags": []interface{}{"x", "y", "x"}}},
+}
+
+func Test_aggregateAssets(t *testing.T) {
+	rslt := aggregateAssets(testAggAssets, Aggregation{
+		By:         []string{"env", "status"},
+		Histograms: map[string]float64{"cpus": 4},
+		Stats:      []string{"cpus"},
+	})
+
+	if rslt.Count != 5 || rslt.Field != "env" || len(rslt.Buckets) != 2 {
+		t.Fatalf("Wrong result: %#v", rslt)
+	}
+	// missing field not counted, most common first
+	prod, dev := rslt.Buckets[0], rslt.Buckets[1]
+	if prod.Key != "prod" || prod.Count != 3 || dev.Key != "dev" || dev.Count != 1 {
+		t.Fatalf("Wrong buckets: %#v", rslt.Buckets)
+	}
+	if prod.Field != "status" || len(prod.Buckets) != 2 || prod.Buckets[0].Key != "running" ||
+		prod.Buckets[0].Count != 2 || prod.Buckets[1].Count != 1 {
+		t.Fatalf("Wrong nested buckets: %#v", prod.Buckets)
+	}
+
+	// non numbers are ignored
+	if s := rslt.Stats["cpus"]; s.Count != 3 || s.Min != 2 || s.Max != 8 || s.Avg != 14.0/3 || s.Sum != 14 {
+		t.Fatalf("Wrong stats: %#v", s)
+	}
+	if s := dev.Stats["cpus"]; s.Count != 0 {
+		t.Fatalf("Wrong nested stats: %#v", s)
+	}
+	hist := []HistogramBucket{{Key: 0, Count: 1}, {Key: 4, Count: 1}, {Key: 8, Count: 1}}
+	if !reflect.DeepEqual(rslt.Histograms["cpus"], hist) || !reflect.DeepEqual(prod.Buckets[0].Histograms["cpus"],
+		[]HistogramBucket{{Key: 0, Count: 1}, {Key: 8, Count: 1}}) {
+		t.Fatalf("Wrong histogram: %#v", rslt.Histograms)
+	}
+
+	// array values count once per asset
+	rslt = aggregateAssets(testAggAssets, Aggregation{By: []string{"tags"}})
+	if len(rslt.Buckets) != 2 || rslt.Buckets[0].Key != "x" || rslt.Buckets[0].Count != 1 {
+		t.Fatalf("Wrong array buckets: %#v", rslt.Buckets)
+	}
+
+	rslt = aggregateAssets(testAggAssets, Aggregation{By: []string{"env"}, MinCount: 2})
+	if len(rslt.Buckets) != 1 || rslt.Buckets[0].Key != "prod" {
+		t.Fatalf("Wrong buckets with min count: %#v", rslt.Buckets)
+	}
+}
+
+func Test_essAggregationResult(t *testing.T) {
+	agg := Aggregation{By: []string{"env"}, Histograms: map[string]float64{"cpus": 4}, Stats: []string{"cpus"}}
+
+	body := essAggregateBody(Terms("status", "running"), agg)
+	terms := body["aggs"].(map[string]interface{})["by:env"].(map[string]interface{})
+	if body["size"] != 0 || body["query"] == nil || terms["aggs"].(map[string]interface{})["stats:cpus"] == nil {
+		t.Fatalf("Wrong body: %#v", body)
+	}
+	agg.MinCount = 2
+	opts := essAggregateBody(nil, agg)["aggs"].(map[string]interface{})["by:env"].(map[string]interface{})["terms"].(map[string]interface{})
+	if opts["min_doc_count"] != int64(2) {
+		t.Fatalf("Wrong terms with min count: %#v", opts)
+	}
+	agg.MinCount = 0
+
+	resp := `{
+		"histogram:cpus": {"buckets": [{"key": 0, "doc_count": 1}, {"key": 8, "doc_count": 1}]},
+		"stats:cpus": {"count": 2, "min": 2, "max": 8, "avg": 5, "sum": 10},
+		"by:env": {"buckets": [{
+			"key": "prod", "doc_count": 2,
+			"histogram:cpus": {"buckets": [{"key": 0, "doc_count": 1}, {"key": 8, "doc_count": 1}]},
+			"stats:cpus": {"count": 2, "min": 2, "max": 8, "avg": 5, "sum": 10}
+		}]}
+	}`
+	raw := map[string]json.RawMessage{}
+	json.Unmarshal([]byte(resp), &raw)
+
+	rslt, err := essAggregationResult(4, raw, agg, agg.By)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	expected := aggregateAssets(testAggAssets[:2], agg)
+	expected.Count = 4
+	if !reflect.DeepEqual(rslt, expected) {
+		t.Fatalf("Wrong result:\n%#v\n%#v", rslt, expected)
+	}
+
+	delete(raw, "stats:cpus")
+	if _, err = essAggregationResult(4, raw, agg, agg.By); err == nil {
+		t.Fatalf("Missing aggregation not reported")
+	}
+}
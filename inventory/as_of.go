@@ -0,0 +1,74 @@
+package inventory
+
+import (
+	"time"
+)
+
+/* Current asset, nil if deleted, and its versions ordered by version */
+type assetHistory struct {
+	Current  *Asset
+	Versions []Asset
+}
+
+/*
+   Time the state held by the asset was written.  Taken from the updated_at
+   field set on writes, falling back to the record timestamp for current
+   assets.  Zero if unknown.
+*/
+func assetUpdatedAt(asset Asset) time.Time {
+	if str, ok := asset.Data["updated_at"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, str); err == nil {
+			return t
+		}
+	}
+	if asset.Version == 0 {
+		return asset.Timestamp
+	}
+	return time.Time{}
+}
+
+/*
+   State of an asset at time t.  A version holds the state that was current
+   until the version was recorded, so the first version recorded after t
+   holds the state at t.  If none was, the current asset does.  States that
+   did not replace a live one, i.e. creates and re-creates, only count if
+   they were written by t.
+*/
+func (h *assetHistory) asOf(t time.Time) (asset Asset, ok bool) {
+	var prev *Asset
+	for i := range h.Versions {
+		if h.Versions[i].Timestamp.After(t) {
+			asset = h.Versions[i]
+			break
+		}
+		prev = &h.Versions[i]
+	}
+
+	if asset.Version == 0 {
+		if h.Current == nil {
+			return
+		}
+		asset = *h.Current
+	}
+
+	if prev == nil || prev.Deleted {
+		if created := assetUpdatedAt(asset); !created.IsZero() && created.After(t) {
+			return Asset{}, false
+		}
+	}
+
+	// The tombstone holds the asset as it was before the delete
+	asset.Deleted, asset.DeletedBy, asset.DeletedAt = false, "", nil
+	return asset, true
+}
+
+/* Search the state of assets at time t */
+func searchAsOf(histories map[string]*assetHistory, t time.Time, query Query) SearchResult {
+	assets := []Asset{}
+	for _, h := range histories {
+		if asset, ok := h.asOf(t); ok && query.Filter.Match(asset.Data) {
+			assets = append(assets, asset)
+		}
+	}
+	return pageAssets(assets, query)
+}
@@ -9,9 +9,14 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func (ir *Inventory) checkWriteRequest(r *http.Request) (data map[string]interface{}, err error) {
+/*
+   Parse the body of a write.  requiredFields must be non empty strings and
+   are all required by a POST.
+*/
+func (ir *Inventory) checkWriteRequest(r *http.Request, requiredFields []string) (data map[string]interface{}, err error) {
 	var body []byte
 	if body, err = ioutil.ReadAll(r.Body); err != nil {
 		return
@@ -26,7 +31,7 @@ func (ir *Inventory) checkWriteRequest(r *http.Request) (data map[string]interfa
 	for k, v := range bmap {
 
 		updated := false
-		for _, rField := range ir.cfg.AssetCfg.RequiredFields {
+		for _, rField := range requiredFields {
 
 			if strings.EqualFold(k, rField) {
 				val, ok := v.(string)
@@ -52,7 +57,7 @@ func (ir *Inventory) checkWriteRequest(r *http.Request) (data map[string]interfa
 	}
 
 	if r.Method == "POST" {
-		for _, v := range ir.cfg.AssetCfg.RequiredFields {
+		for _, v := range requiredFields {
 			if _, ok := data[v]; !ok {
 				err = fmt.Errorf("'%s' field required!\n", v)
 				return
@@ -62,6 +67,40 @@ func (ir *Inventory) checkWriteRequest(r *http.Request) (data map[string]interfa
 	return
 }
 
+/*
+   Normalize the asset id from a request by the rules of its type.  Ids of
+   new assets must follow the rules.  Existing assets stored before the
+   rules were given are still found by their id as is.
+*/
+func (ir *Inventory) resolveAssetId(assetType, assetId string, create bool) (id string, code int, err error) {
+	t, _, err := ir.getAssetType(assetType)
+	if err != nil {
+		return assetId, 500, err
+	}
+
+	id, err = t.NormalizeId(assetId)
+	if create {
+		if err != nil {
+			return assetId, 400, err
+		}
+		return id, 200, nil
+	}
+
+	if err != nil || (id != assetId && !ir.assetKnown(assetType, id) && ir.assetKnown(assetType, assetId)) {
+		return assetId, 200, nil
+	}
+	return id, 200, nil
+}
+
+/* Whether the asset exists or has versions i.e. was deleted */
+func (ir *Inventory) assetKnown(assetType, assetId string) bool {
+	if _, err := ir.datastore.GetAsset(assetType, assetId); err == nil {
+		return true
+	}
+	versions, err := ir.datastore.GetAssetVersions(assetType, assetId, 1, 0)
+	return err == nil && len(versions.Assets) > 0
+}
+
 /*
    Handle getting assets GET /<asset_type>/<asset>
 */
@@ -72,13 +111,7 @@ func (ir *Inventory) assetGetHandler(assetType, assetId string) (code int, heade
 		headers = map[string]string{"Content-Type": "text/plain"}
 		data = []byte(err.Error())
 	} else {
-		rsp, err := AssembleResponseFromBaseResponse(ans)
-		if err != nil {
-			code = 400
-			data = []byte(err.Error())
-			headers = map[string]string{"Content-Type": "text/plain"}
-			return
-		}
+		rsp := AssembleResponseFromAsset(ans)
 
 		if data, err = json.Marshal(rsp); err != nil {
 			code = 500
@@ -112,28 +145,65 @@ func (ir *Inventory) assetPostPutHandler(assetType, assetId string, r *http.Requ
 		return
 	}
 
-	if reqData, err = ir.checkWriteRequest(r); err != nil {
+	assetTypeDef, _, err := ir.getAssetType(assetType)
+	var schema *Schema
+	if err == nil {
+		schema, err = assetTypeDef.CompiledSchema()
+	}
+	if err != nil {
+		code = 500
+		data = []byte(err.Error())
+		headers = map[string]string{"Content-Type": "text/plain"}
+		return
+	}
+
+	if reqData, err = ir.checkWriteRequest(r, assetTypeDef.Required(ir.cfg.AssetCfg.RequiredFields)); err != nil {
 		code = 400
 		data = []byte(err.Error())
 		headers = map[string]string{"Content-Type": "text/plain"}
 		return
 	}
 
+	if schema != nil {
+		if code, headers, data = ir.validateAssetWrite(schema, assetType, assetId, r.Method, reqData); code != 0 {
+			return
+		}
+	}
+
+	if err = ir.checkRelationships(assetTypeDef, reqData); err != nil {
+		code = 400
+		data = []byte(err.Error())
+		headers = map[string]string{"Content-Type": "text/plain"}
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
 	switch r.Method {
 	case "POST":
 		reqData["created_by"] = reqUser
 		reqData["updated_by"] = reqUser
+		reqData["created_at"] = now
+		reqData["updated_at"] = now
 		// Allow admins to autocreate types
-		id, err = ir.datastore.CreateAsset(assetType, assetId, reqData,
-			ir.localAuthGroups.UserHasGroupMembership(reqUser, "admin"))
+		createType := validAssetTypeName(assetType) && ir.isAdmin(reqUser)
+		if len(assetId) > 0 {
+			id, err = ir.datastore.CreateAsset(assetType, assetId, reqData, createType)
+		} else {
+			id, err = ir.createAssetWithGeneratedId(assetTypeDef, reqData, createType)
+		}
 		break
 	case "PUT":
 		reqData["updated_by"] = reqUser
+		reqData["updated_at"] = now
 		id, err = ir.datastore.EditAsset(assetType, assetId, reqData)
 		break
 	}
 
-	if err != nil {
+	if isConflict(err) {
+		code = 409
+		headers = map[string]string{"Content-Type": "application/json"}
+		data = conflictResponse(err.(*ConflictError))
+	} else if err != nil {
 		code = 400
 		headers = map[string]string{"Content-Type": "text/plain"}
 		data = []byte(err.Error())
@@ -145,6 +215,56 @@ func (ir *Inventory) assetPostPutHandler(assetType, assetId string, r *http.Requ
 	return
 }
 
+/* Response to a write conflicting with another asset on a unique field */
+func conflictResponse(conflict *ConflictError) []byte {
+	b, _ := json.Marshal(map[string]interface{}{"error": conflict.Error(), "conflict": conflict})
+	return b
+}
+
+/*
+   Create the asset with an id generated from the id template of its type.
+   Ids of existing and deleted assets are skipped.
+*/
+func (ir *Inventory) createAssetWithGeneratedId(t AssetType, data map[string]interface{}, createType bool) (string, error) {
+	tmpl, err := t.idTemplate()
+	if err != nil {
+		return "", err
+	}
+	nextSeq := func(sequence string) (int64, error) {
+		return ir.datastore.NextSequence(t.Name + "/" + sequence)
+	}
+
+	for i := 0; i < maxIdAttempts; i++ {
+		id, err := tmpl.Render(data, nextSeq)
+		if err != nil {
+			return "", err
+		}
+		if id, err = t.NormalizeId(id); err != nil {
+			return "", err
+		}
+
+		if ir.assetKnown(t.Name, id) {
+			if !tmpl.Generates() {
+				return "", fmt.Errorf("Asset already exists: %s", id)
+			}
+			log.V(6).Infof("Skipping generated id of existing asset: %s/%s\n", t.Name, id)
+			continue
+		}
+		return ir.datastore.CreateAsset(t.Name, id, data, createType)
+	}
+	return "", fmt.Errorf("No free id from %s after %d attempts", tmpl.Template, maxIdAttempts)
+}
+
+/*
+   Handle adding assets with a generated id POST /<asset_type>
+   The id is returned as with POST /<asset_type>/<asset>.
+*/
+func (ir *Inventory) AssetCreateHandler(w http.ResponseWriter, r *http.Request) {
+	assetType := ir.normalizeAssetType(mux.Vars(r)["asset_type"])
+	code, headers, data := ir.assetPostPutHandler(assetType, "", r)
+	WriteAndLogResponse(w, r, code, headers, data)
+}
+
 /*
    Handle getting assets by version GET /<asset_type>/<asset>?version=<version>
 */
@@ -161,13 +281,7 @@ func (ir *Inventory) assetGetVersionHandler(assetType, assetId, versionStr strin
 			data = []byte(err.Error())
 			headers = map[string]string{"Content-Type": "text/plain"}
 		} else {
-			rsp, err := AssembleResponseFromBaseResponse(asset)
-			if err != nil {
-				code = 400
-				data = []byte(err.Error())
-				headers = map[string]string{"Content-Type": "text/plain"}
-				return
-			}
+			rsp := AssembleResponseFromAsset(asset)
 			code = 200
 			data, _ = json.Marshal(rsp)
 			headers = map[string]string{"Content-Type": "application/json"}
@@ -176,26 +290,53 @@ func (ir *Inventory) assetGetVersionHandler(assetType, assetId, versionStr strin
 	return
 }
 
+/*
+   Handle getting the asset as it was at a point in time GET /<asset_type>/<asset>?as_of=<RFC3339>
+*/
+func (ir *Inventory) assetGetAsOfHandler(assetType, assetId, asOfStr string) (code int, headers map[string]string, data []byte) {
+	headers = map[string]string{"Content-Type": "text/plain"}
+
+	asOf, err := time.Parse(time.RFC3339, asOfStr)
+	if err != nil {
+		return 400, headers, []byte(fmt.Sprintf("Invalid as_of: %s", err))
+	}
+
+	asset, err := ir.datastore.GetAssetAsOf(assetType, assetId, asOf)
+	if err != nil {
+		return 404, headers, []byte(err.Error())
+	}
+
+	headers["Content-Type"] = "application/json"
+	data, _ = json.Marshal(AssembleResponseFromAsset(asset))
+	return 200, headers, data
+}
+
 /*
    Handler for all methods to endpoint: /<asset_type>/<asset>
 */
 func (ir *Inventory) AssetHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		headers = map[string]string{}
-		code    int
 		data    = make([]byte, 0)
 
 		restVars = mux.Vars(r)
 
 		assetType = ir.normalizeAssetType(restVars["asset_type"])
-		assetId   = restVars["asset"]
 	)
 
+	assetId, code, err := ir.resolveAssetId(assetType, restVars["asset"], r.Method == "POST")
+	if err != nil {
+		WriteAndLogResponse(w, r, code, map[string]string{"Content-Type": "text/plain"}, []byte(err.Error()))
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		queryParams := r.URL.Query()
 		if versionArr, ok := queryParams["version"]; ok {
 			code, headers, data = ir.assetGetVersionHandler(assetType, assetId, versionArr[0])
+		} else if asOf, ok := queryParams["as_of"]; ok {
+			code, headers, data = ir.assetGetAsOfHandler(assetType, assetId, asOf[0])
 		} else {
 			code, headers, data = ir.assetGetHandler(assetType, assetId)
 		}
@@ -204,11 +345,7 @@ func (ir *Inventory) AssetHandler(w http.ResponseWriter, r *http.Request) {
 		code, headers, data = ir.assetPostPutHandler(assetType, assetId, r)
 		break
 	case "DELETE":
-		if ir.datastore.RemoveAsset(assetType, assetId) {
-			code = 200
-		} else {
-			code = 500
-		}
+		code, headers, data = ir.assetDeleteHandler(assetType, assetId, r)
 		break
 	}
 
@@ -229,24 +366,36 @@ func (ir *Inventory) AssetVersionsHandler(w http.ResponseWriter, r *http.Request
 		assetId   = restVars["asset"]
 	)
 
-	// the count should come from a query param
-	assetVersions, err := ir.datastore.GetAssetVersions(assetType, assetId, 10)
+	assetId, code, err := ir.resolveAssetId(assetType, assetId, false)
+	if err != nil {
+		WriteAndLogResponse(w, r, code, map[string]string{"Content-Type": "text/plain"}, []byte(err.Error()))
+		return
+	}
+
+	count, err := parseIntParam(r, "count", 10)
+	if err != nil {
+		WriteAndLogResponse(w, r, 400, map[string]string{"Content-Type": "text/plain"}, []byte(err.Error()))
+		return
+	}
+	offset, err := parseIntParam(r, "offset", 0)
+	if err != nil {
+		WriteAndLogResponse(w, r, 400, map[string]string{"Content-Type": "text/plain"}, []byte(err.Error()))
+		return
+	}
+
+	assetVersions, err := ir.datastore.GetAssetVersions(assetType, assetId, count, offset)
 	if err != nil {
 		code = 404
 		data = []byte(err.Error())
 		headers["Content-Type"] = "text/plain"
 	} else {
-		log.V(11).Infof("Found versions: %d\n", assetVersions.Hits.Len())
+		log.V(11).Infof("Found versions: %d\n", len(assetVersions.Assets))
 
 		if _, ok := r.URL.Query()["diff"]; ok {
 			// Generates diffs for versions
-			maplist := make([]map[string]interface{}, assetVersions.Hits.Len())
-			for i, ver := range assetVersions.Hits.Hits {
-				var m map[string]interface{}
-				if err := json.Unmarshal(*ver.Source, &m); err != nil {
-					log.Errorf("%s\n", err)
-				}
-				maplist[i] = m
+			maplist := make([]map[string]interface{}, len(assetVersions.Assets))
+			for i, ver := range assetVersions.Assets {
+				maplist[i] = AssembleResponseFromAsset(ver).Data.(map[string]interface{})
 			}
 
 			diffs, err := GenerateVersionDiffs(maplist...)
@@ -255,6 +404,12 @@ func (ir *Inventory) AssetVersionsHandler(w http.ResponseWriter, r *http.Request
 				code = 400
 				headers["Content-Type"] = "text/plain"
 			} else {
+				// JSON Patch only on ?diff=json
+				if r.URL.Query().Get("diff") != "json" {
+					for i := range diffs {
+						diffs[i].Patch = nil
+					}
+				}
 				code = 200
 				data, _ = json.Marshal(diffs)
 				headers["Content-Type"] = "application/json"
@@ -262,7 +417,7 @@ func (ir *Inventory) AssetVersionsHandler(w http.ResponseWriter, r *http.Request
 		} else {
 			// Return full versions
 			code = 200
-			rsp, _ := AssembleResponseFromHits(assetVersions.Hits.Hits)
+			rsp := AssembleResponseFromAssets(assetVersions.Assets)
 			data, _ = json.Marshal(rsp)
 			headers["Content-Type"] = "application/json"
 		}
@@ -270,3 +425,189 @@ func (ir *Inventory) AssetVersionsHandler(w http.ResponseWriter, r *http.Request
 
 	WriteAndLogResponse(w, r, code, headers, data)
 }
+
+/*
+   Handle diffing any 2 versions GET /<asset_type>/<asset>/diff?from=<version>&to=<version|current>
+*/
+func (ir *Inventory) AssetDiffHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		headers = map[string]string{"Content-Type": "text/plain"}
+		code    = 200
+		data    []byte
+
+		restVars  = mux.Vars(r)
+		assetType = ir.normalizeAssetType(restVars["asset_type"])
+		assetId   = restVars["asset"]
+		params    = r.URL.Query()
+	)
+
+	assetId, code, err := ir.resolveAssetId(assetType, assetId, false)
+	if err != nil {
+		WriteAndLogResponse(w, r, code, map[string]string{"Content-Type": "text/plain"}, []byte(err.Error()))
+		return
+	}
+
+	var from, to Asset
+	if len(params.Get("from")) < 1 || len(params.Get("to")) < 1 {
+		code, data = 400, []byte("Invalid request: from and to required")
+	} else if code, data, from = ir.getAssetAtVersion(assetType, assetId, params.Get("from")); code == 200 {
+		code, data, to = ir.getAssetAtVersion(assetType, assetId, params.Get("to"))
+	}
+
+	if code == 200 {
+		diff, err := GenerateAssetDiff(params.Get("from"), from.Data, params.Get("to"), to.Data)
+		if err != nil {
+			code, data = 500, []byte(err.Error())
+		} else {
+			data, _ = json.Marshal(diff)
+			headers["Content-Type"] = "application/json"
+		}
+	}
+
+	WriteAndLogResponse(w, r, code, headers, data)
+}
+
+/* Get a version by number or the current asset for "current" */
+func (ir *Inventory) getAssetAtVersion(assetType, assetId, versionStr string) (code int, data []byte, asset Asset) {
+	var err error
+	if versionStr == "current" {
+		asset, err = ir.datastore.GetAsset(assetType, assetId)
+	} else {
+		var version int64
+		if version, err = strconv.ParseInt(versionStr, 10, 64); err != nil {
+			return 400, []byte(fmt.Sprintf("Invalid version: %s", versionStr)), asset
+		}
+		asset, err = ir.datastore.GetAssetVersion(assetType, assetId, version)
+	}
+	if err != nil {
+		return 404, []byte(err.Error()), asset
+	}
+	return 200, nil, asset
+}
+
+/*
+   Make a previous version the current asset. POST /<asset_type>/<asset>/versions/<version>/restore
+   The asset being replaced is versioned as with any other write.  Also
+   restores deleted assets.
+*/
+func (ir *Inventory) AssetVersionRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		headers = map[string]string{"Content-Type": "text/plain"}
+		code    int
+		data    = make([]byte, 0)
+
+		restVars  = mux.Vars(r)
+		assetType = ir.normalizeAssetType(restVars["asset_type"])
+		assetId   = restVars["asset"]
+	)
+
+	assetId, code, err := ir.resolveAssetId(assetType, assetId, false)
+	if err != nil {
+		WriteAndLogResponse(w, r, code, map[string]string{"Content-Type": "text/plain"}, []byte(err.Error()))
+		return
+	}
+
+	code, headers, data = ir.restoreAssetVersion(assetType, assetId, restVars["version"], r)
+
+	WriteAndLogResponse(w, r, code, headers, data)
+}
+
+func (ir *Inventory) restoreAssetVersion(assetType, assetId, versionStr string, r *http.Request) (code int, headers map[string]string, data []byte) {
+	reqUser, _, err := ir.authenticateRequest(r)
+	if err != nil {
+		return 401, textHeaders(), []byte(err.Error())
+	}
+
+	version, err := strconv.ParseInt(versionStr, 10, 64)
+	if err != nil {
+		return 400, textHeaders(), []byte(err.Error())
+	}
+
+	asset, err := ir.datastore.GetAssetVersion(assetType, assetId, version)
+	if err != nil {
+		return 404, textHeaders(), []byte(err.Error())
+	}
+
+	return ir.replaceWithVersion(asset, reqUser)
+}
+
+/* Make the version the current asset */
+func (ir *Inventory) replaceWithVersion(asset Asset, reqUser string) (code int, headers map[string]string, data []byte) {
+	// targets of its relationships may have been removed since
+	t, _, err := ir.getAssetType(asset.Type)
+	if err != nil {
+		return 500, textHeaders(), []byte(err.Error())
+	}
+	if err = ir.checkRelationships(t, asset.Data); err != nil {
+		return 409, textHeaders(), []byte(err.Error())
+	}
+	// as may the schema
+	schema, err := t.CompiledSchema()
+	if err != nil {
+		return 500, textHeaders(), []byte(err.Error())
+	}
+	if schema != nil {
+		if code, headers, data = ir.validateAssetWrite(schema, asset.Type, asset.Id, "POST", asset.Data); code != 0 {
+			return
+		}
+	}
+
+	asset.Data["updated_by"] = reqUser
+	asset.Data["updated_at"] = time.Now().UTC().Format(time.RFC3339Nano)
+	id, err := ir.datastore.ReplaceAsset(asset.Type, asset.Id, asset.Data)
+	if isConflict(err) {
+		return 409, jsonHeaders(), conflictResponse(err.(*ConflictError))
+	} else if err != nil {
+		return 400, textHeaders(), []byte(err.Error())
+	}
+	log.V(6).Infof("Restored %s/%s to version %d by '%s'\n", asset.Type, id, asset.Version, reqUser)
+
+	data, _ = json.Marshal(map[string]interface{}{"id": id, "restored_version": asset.Version})
+	return 200, jsonHeaders(), data
+}
+
+/*
+   Re-create a deleted asset from its last version. POST /<asset_type>/<asset>/undelete
+*/
+func (ir *Inventory) AssetUndeleteHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		headers = map[string]string{"Content-Type": "text/plain"}
+		code    int
+		data    = make([]byte, 0)
+
+		restVars  = mux.Vars(r)
+		assetType = ir.normalizeAssetType(restVars["asset_type"])
+		assetId   = restVars["asset"]
+	)
+
+	assetId, code, err := ir.resolveAssetId(assetType, assetId, false)
+	if err != nil {
+		WriteAndLogResponse(w, r, code, map[string]string{"Content-Type": "text/plain"}, []byte(err.Error()))
+		return
+	}
+
+	code, headers, data = ir.undeleteAsset(assetType, assetId, r)
+
+	WriteAndLogResponse(w, r, code, headers, data)
+}
+
+func (ir *Inventory) undeleteAsset(assetType, assetId string, r *http.Request) (code int, headers map[string]string, data []byte) {
+	reqUser, _, err := ir.authenticateRequest(r)
+	if err != nil {
+		return 401, textHeaders(), []byte(err.Error())
+	}
+
+	if _, err = ir.datastore.GetAsset(assetType, assetId); err == nil {
+		return 409, textHeaders(), []byte(fmt.Sprintf("Asset not deleted: %s/%s", assetType, assetId))
+	}
+
+	versions, err := ir.datastore.GetAssetVersions(assetType, assetId, 1, 0)
+	if err != nil {
+		return 500, textHeaders(), []byte(err.Error())
+	}
+	if len(versions.Assets) < 1 || !versions.Assets[0].Deleted {
+		return 404, textHeaders(), []byte(fmt.Sprintf("No deleted asset: %s/%s", assetType, assetId))
+	}
+
+	return ir.replaceWithVersion(versions.Assets[0], reqUser)
+}
@@ -0,0 +1,200 @@
+package inventory
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/* System document kind asset type definitions are stored under */
+const systemDocTypes = "types"
+
+/* Names starting with _ are reserved for endpoints e.g. /_search */
+var assetTypeNameExpr = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+/* Canonical forms asset ids can be given in by id_format */
+var assetIdFormats = map[string]func(string) (string, error){
+	"fqdn": canonicalFqdn,
+	"mac":  canonicalMac,
+}
+
+/*
+   Definition of an asset type.  Types without one, e.g. those created by
+   an admin POSTing the first asset, behave as if it were empty.
+
+   A Schema replaces the configured required fields unless RequiredFields
+   is also given.  No 2 assets of the type may share a value of any of the,
+   dotted, UniqueFields.  Relationships are those assets of the type may
+   have to other assets, by name e.g. runs_on.
+
+   Asset ids are normalized by converting them to IdFormat, then to IdCase
+   i.e. lower or upper.  The result must be at most IdMaxLength long and
+   match the regular expression IdPattern in full.  Assets POSTed without
+   an id are given one generated from IdTemplate, see IdTemplate.
+*/
+type AssetType struct {
+	Name           string                  `json:"name"`
+	Description    string                  `json:"description,omitempty"`
+	Owner          string                  `json:"owner,omitempty"`
+	Schema         map[string]interface{}  `json:"schema,omitempty"`
+	RequiredFields []string                `json:"required_fields,omitempty"`
+	UniqueFields   []string                `json:"unique_fields,omitempty"`
+	Relationships  map[string]Relationship `json:"relationships,omitempty"`
+	IdPattern      string                  `json:"id_pattern,omitempty"`
+	IdCase         string                  `json:"id_case,omitempty"`
+	IdMaxLength    int                     `json:"id_max_length,omitempty"`
+	IdFormat       string                  `json:"id_format,omitempty"`
+	IdTemplate     string                  `json:"id_template,omitempty"`
+
+	CreatedAt string `json:"created_at,omitempty"`
+	CreatedBy string `json:"created_by,omitempty"`
+	UpdatedAt string `json:"updated_at,omitempty"`
+	UpdatedBy string `json:"updated_by,omitempty"`
+}
+
+/* Asset type as listed, with the number of assets of the type */
+type AssetTypeInfo struct {
+	AssetType
+	Count int64 `json:"count"`
+}
+
+func validAssetTypeName(name string) bool {
+	return assetTypeNameExpr.MatchString(name)
+}
+
+func (t *AssetType) Validate() error {
+	if !validAssetTypeName(t.Name) {
+		return fmt.Errorf("Invalid asset type name: '%s'", t.Name)
+	}
+	if _, err := t.CompiledSchema(); err != nil {
+		return err
+	}
+	if _, err := t.idExpr(); err != nil {
+		return err
+	}
+	switch t.IdCase {
+	case "", "lower", "upper":
+		break
+	default:
+		return fmt.Errorf("Invalid id_case: '%s' expected lower or upper", t.IdCase)
+	}
+	if t.IdMaxLength < 0 {
+		return fmt.Errorf("Invalid id_max_length: %d", t.IdMaxLength)
+	}
+	if _, ok := assetIdFormats[t.IdFormat]; !ok && len(t.IdFormat) > 0 {
+		return fmt.Errorf("Invalid id_format: '%s' expected fqdn or mac", t.IdFormat)
+	}
+	if _, err := t.idTemplate(); err != nil {
+		return err
+	}
+	for _, f := range t.RequiredFields {
+		if len(strings.TrimSpace(f)) < 1 {
+			return fmt.Errorf("Invalid required field: '%s'", f)
+		}
+	}
+	for _, f := range t.UniqueFields {
+		if len(strings.TrimSpace(f)) < 1 {
+			return fmt.Errorf("Invalid unique field: '%s'", f)
+		}
+	}
+	for name, rel := range t.Relationships {
+		if err := rel.validate(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Compiled schema of the type.  nil if it has none. */
+func (t *AssetType) CompiledSchema() (*Schema, error) {
+	if t.Schema == nil {
+		return nil, nil
+	}
+	return CompileSchema(t.Schema)
+}
+
+/* Fields a POST must give.  defaults are the configured required fields. */
+func (t *AssetType) Required(defaults []string) []string {
+	if len(t.RequiredFields) > 0 {
+		return t.RequiredFields
+	}
+	if t.Schema != nil {
+		return nil
+	}
+	return defaults
+}
+
+/* IdPattern anchored so the whole id must match.  nil if there is none. */
+func (t *AssetType) idExpr() (*regexp.Regexp, error) {
+	if len(t.IdPattern) < 1 {
+		return nil, nil
+	}
+	expr, err := regexp.Compile("^(?:" + t.IdPattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid id_pattern: %s", err)
+	}
+	return expr, nil
+}
+
+/* IdTemplate parsed.  Random uuids if the type has none. */
+func (t *AssetType) idTemplate() (*IdTemplate, error) {
+	if len(t.IdTemplate) < 1 {
+		return ParseIdTemplate(defaultIdTemplate)
+	}
+	return ParseIdTemplate(t.IdTemplate)
+}
+
+/* Normalize the asset id.  Returns an error if the id breaks the rules. */
+func (t *AssetType) NormalizeId(assetId string) (string, error) {
+	id := assetId
+	if canonical, ok := assetIdFormats[t.IdFormat]; ok {
+		var err error
+		if id, err = canonical(id); err != nil {
+			return assetId, fmt.Errorf("Invalid %s id: '%s' %s", t.Name, assetId, err)
+		}
+	}
+
+	switch t.IdCase {
+	case "lower":
+		id = strings.ToLower(id)
+		break
+	case "upper":
+		id = strings.ToUpper(id)
+		break
+	}
+
+	if t.IdMaxLength > 0 && len(id) > t.IdMaxLength {
+		return assetId, fmt.Errorf("Invalid %s id: '%s' is longer than %d", t.Name, id, t.IdMaxLength)
+	}
+	expr, err := t.idExpr()
+	if err != nil {
+		return assetId, err
+	}
+	if expr != nil && !expr.MatchString(id) {
+		return assetId, fmt.Errorf("Invalid %s id: '%s' must match %s", t.Name, id, t.IdPattern)
+	}
+	return id, nil
+}
+
+/* Lower case without a trailing dot */
+func canonicalFqdn(id string) (string, error) {
+	id = strings.ToLower(strings.TrimSuffix(id, "."))
+	if len(id) > 253 || !hostnameExpr.MatchString(id) {
+		return id, fmt.Errorf("is not a valid fqdn")
+	}
+	return id, nil
+}
+
+/* Lower case colon separated e.g. AABB.CCDD.EEFF is aa:bb:cc:dd:ee:ff */
+func canonicalMac(id string) (string, error) {
+	hex := strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(id))
+	if len(hex) != 12 || strings.Trim(hex, "0123456789abcdef") != "" {
+		return id, fmt.Errorf("is not a valid mac address")
+	}
+
+	octets := make([]string, 6)
+	for i := range octets {
+		octets[i] = hex[i*2 : i*2+2]
+	}
+	return strings.Join(octets, ":"), nil
+}
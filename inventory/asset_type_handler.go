@@ -20,29 +20,124 @@ func (ir *Inventory) AssetTypeHandler(w http.ResponseWriter, r *http.Request) {
 	)
 	log.V(15).Infof("%#v\n", reqVars)
 
-	essResp, err := ir.executeSearchQuery(assetType, r)
+	if deleted := r.URL.Query().Get("deleted"); deleted == "true" {
+		ir.deletedAssetsHandler(assetType, w, r)
+		return
+	}
+
+	if format := r.URL.Query().Get("format"); len(format) > 0 && format != "json" {
+		ir.exportHandler([]string{assetType}, format, w, r)
+		return
+	}
+
+	rslt, err := ir.executeSearchQuery([]string{assetType}, r)
+	if err != nil {
+		data = []byte(err.Error())
+		code = 400
+		headers["Content-Type"] = "text/plain"
+	} else {
+		setSearchResultHeaders(r, rslt, headers)
+		data, _ = json.Marshal(AssembleResponseFromAssets(rslt.Assets))
+	}
+
+	WriteAndLogResponse(w, r, code, headers, data)
+}
+
+/*
+   Handle searches across asset types i.e. GET or POST /_search?types=<type>,<type>
+   All types are searched if none are given.  Takes the same body and
+   parameters as a search within a type.
+*/
+func (ir *Inventory) SearchHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		code    = 200
+		headers = map[string]string{"Content-Type": "application/json"}
+		data    []byte
+	)
+
+	if format := r.URL.Query().Get("format"); len(format) > 0 && format != "json" {
+		ir.exportHandler(ir.parseTypesParam(r), format, w, r)
+		return
+	}
+
+	rslt, err := ir.executeSearchQuery(ir.parseTypesParam(r), r)
 	if err != nil {
 		data = []byte(err.Error())
 		code = 400
 		headers["Content-Type"] = "text/plain"
 	} else {
-		data, _ = json.Marshal(essResp.Hits.Hits)
+		setSearchResultHeaders(r, rslt, headers)
+		data, _ = json.Marshal(AssembleResponseFromAssets(rslt.Assets))
 	}
 
 	WriteAndLogResponse(w, r, code, headers, data)
 }
 
 /*
-   Handle requests to list asset type i.e GET /
+   Handle aggregations i.e. GET /<asset_type>/_aggregate?by=environment,status
+   or across types GET /_aggregate?types=<type>,<type>.  Assets are filtered
+   the same as searches.  See parseAggregation for the params.
+*/
+func (ir *Inventory) AggregateHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		reqVars = mux.Vars(r)
+		headers = map[string]string{"Content-Type": "text/plain"}
+	)
+
+	assetTypes := ir.parseTypesParam(r)
+	if assetType, ok := reqVars["asset_type"]; ok {
+		assetTypes = []string{ir.normalizeAssetType(assetType)}
+	}
+
+	agg, err := ir.parseAggregation(r)
+	if err != nil {
+		WriteAndLogResponse(w, r, 400, headers, []byte(err.Error()))
+		return
+	}
+	filter, err := ir.parseSearchFilter(r)
+	if err != nil {
+		WriteAndLogResponse(w, r, 400, headers, []byte(err.Error()))
+		return
+	}
+
+	rslt, err := ir.datastore.Aggregate(assetTypes, filter, agg)
+	if err != nil {
+		WriteAndLogResponse(w, r, 500, headers, []byte(err.Error()))
+		return
+	}
+
+	headers["Content-Type"] = "application/json"
+	b, _ := json.Marshal(rslt)
+	WriteAndLogResponse(w, r, 200, headers, b)
+}
+
+/*
+   Handle listing deleted assets i.e. GET /<asset_type>?deleted=true
+*/
+func (ir *Inventory) deletedAssetsHandler(assetType string, w http.ResponseWriter, r *http.Request) {
+	assets, err := ir.datastore.ListDeletedAssets(assetType)
+	if err != nil {
+		WriteAndLogResponse(w, r, 500, map[string]string{"Content-Type": "text/plain"},
+			[]byte(err.Error()))
+		return
+	}
+
+	b, _ := json.Marshal(AssembleResponseFromAssets(assets))
+	WriteAndLogResponse(w, r, 200, map[string]string{"Content-Type": "application/json"}, b)
+}
+
+/*
+   Handle requests to list asset types i.e GET / or GET /_types
+   Each type is listed with its definition and number of assets.
 */
 func (ir *Inventory) ListAssetTypesHandler(w http.ResponseWriter, r *http.Request) {
 	var (
-		types []string
+		types []AssetTypeInfo
 		err   error
 		b     []byte
 	)
 
-	if types, err = ir.datastore.ListAssetTypes(); err != nil {
+	if types, err = ir.listAssetTypes(); err != nil {
 		WriteAndLogResponse(w, r, 500, map[string]string{"Content-Type": "text/plain"},
 			[]byte(err.Error()))
 		return
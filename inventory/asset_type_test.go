@@ -0,0 +1,77 @@
+package inventory
+
+import (
+	"testing"
+)
+
+func Test_AssetType_NormalizeId(t *testing.T) {
+	tests := []struct {
+		def        AssetType
+		id         string
+		normalized string
+		valid      bool
+	}{
+		{AssetType{}, "Web01.Example.com", "Web01.Example.com", true},
+		{AssetType{IdCase: "lower"}, "Web01.Example.com", "web01.example.com", true},
+		{AssetType{IdCase: "upper"}, "sn-123a", "SN-123A", true},
+		{AssetType{IdFormat: "fqdn"}, "Web01.Example.com.", "web01.example.com", true},
+		{AssetType{IdFormat: "fqdn"}, "web_01.example.com", "", false},
+		{AssetType{IdFormat: "mac"}, "AABB.CCDD.EEFF", "aa:bb:cc:dd:ee:ff", true},
+		{AssetType{IdFormat: "mac"}, "aa-bb-cc-dd-ee-ff", "aa:bb:cc:dd:ee:ff", true},
+		{AssetType{IdFormat: "mac"}, "aabbccddeeff", "aa:bb:cc:dd:ee:ff", true},
+		{AssetType{IdFormat: "mac"}, "aa:bb:cc:dd:ee", "", false},
+		{AssetType{IdFormat: "mac"}, "aa:bb:cc:dd:ee:fg", "", false},
+		{AssetType{IdMaxLength: 5}, "abcde", "abcde", true},
+		{AssetType{IdMaxLength: 5}, "abcdef", "", false},
+		{AssetType{IdPattern: "[a-z]+-[0-9]{4}"}, "web-0042", "web-0042", true},
+		{AssetType{IdPattern: "[a-z]+-[0-9]{4}"}, "web-0042x", "", false},
+		{AssetType{IdPattern: "[a-z]+|[0-9]+"}, "web42", "", false},
+		// the pattern applies to the normalized id
+		{AssetType{IdCase: "lower", IdPattern: "[a-z]+"}, "WEB", "web", true},
+	}
+	for i, tst := range tests {
+		tst.def.Name = "test"
+		if err := tst.def.Validate(); err != nil {
+			t.Fatalf("t%d: %s", i, err)
+		}
+		id, err := tst.def.NormalizeId(tst.id)
+		if tst.valid && (err != nil || id != tst.normalized) {
+			t.Fatalf("t%d: %s %s %v", i, tst.id, id, err)
+		} else if !tst.valid && err == nil {
+			t.Fatalf("t%d: %s should be invalid got %s", i, tst.id, id)
+		}
+	}
+
+	for _, def := range []AssetType{{IdCase: "title"}, {IdFormat: "uuid"}, {IdMaxLength: -1}, {IdPattern: "["}} {
+		def.Name = "test"
+		if def.Validate() == nil {
+			t.Fatalf("Invalid id rules not rejected: %#v", def)
+		}
+	}
+}
+
+func Test_AssetType_Cache(t *testing.T) {
+	ds := NewMemoryDatastore()
+	ir := &Inventory{datastore: ds}
+
+	if _, defined, err := ir.getAssetType("rack"); err != nil || defined {
+		t.Fatalf("Undefined type: %v %v", defined, err)
+	}
+	ds.PutSystemDoc(systemDocTypes, "rack", AssetType{Name: "rack", Owner: "a"})
+	if _, defined, _ := ir.getAssetType("rack"); defined {
+		t.Fatalf("Undefined type not cached")
+	}
+
+	ir.invalidateAssetType("rack")
+	if def, defined, err := ir.getAssetType("rack"); err != nil || !defined || def.Owner != "a" {
+		t.Fatalf("Not invalidated: %#v %v %v", def, defined, err)
+	}
+	ds.PutSystemDoc(systemDocTypes, "rack", AssetType{Name: "rack", Owner: "b"})
+	if def, _, _ := ir.getAssetType("rack"); def.Owner != "a" {
+		t.Fatalf("Not cached: %#v", def)
+	}
+	ir.invalidateAssetType("rack")
+	if def, _, _ := ir.getAssetType("rack"); def.Owner != "b" {
+		t.Fatalf("Not invalidated: %#v", def)
+	}
+}
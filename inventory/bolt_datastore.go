@@ -0,0 +1,142 @@
+package inventory
+
+import (
+	"bytes"
+	log "github.com/golang/glog"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+   KVStore backed by a single bolt database file.  Holds assets, versions
+   and asset types.
+*/
+type BoltStore struct {
+	DB *bolt.DB
+}
+
+func NewBoltStore(dbfile string) (*BoltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(dbfile), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(dbfile, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{DB: db}, nil
+}
+
+/* IDatastore backed by a bolt database file */
+func NewBoltDatastore(dbfile string) (*KVDatastore, error) {
+	store, err := NewBoltStore(dbfile)
+	if err != nil {
+		return nil, err
+	}
+	ds := NewKVDatastore(store)
+	if migrated, err := ds.migrateVersionKeys(); err != nil {
+		store.Close()
+		return nil, err
+	} else if migrated > 0 {
+		log.Infof("Migrated version keys: %d\n", migrated)
+	}
+	return ds, nil
+}
+
+func (b *BoltStore) View(fn func(KVTx) error) error {
+	return b.DB.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx})
+	})
+}
+
+func (b *BoltStore) Update(fn func(KVTx) error) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx})
+	})
+}
+
+func (b *BoltStore) Close() error {
+	return b.DB.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t *boltTx) Get(bucket, key string) []byte {
+	bkt := t.tx.Bucket([]byte(bucket))
+	if bkt == nil {
+		return nil
+	}
+	v := bkt.Get([]byte(key))
+	if v == nil {
+		return nil
+	}
+	// only valid for the life of the transaction
+	cp := make([]byte, len(v))
+	copy(cp, v)
+	return cp
+}
+
+func (t *boltTx) Put(bucket, key string, value []byte) error {
+	bkt, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	return bkt.Put([]byte(key), value)
+}
+
+func (t *boltTx) Delete(bucket, key string) error {
+	bkt := t.tx.Bucket([]byte(bucket))
+	if bkt == nil {
+		return nil
+	}
+	return bkt.Delete([]byte(key))
+}
+
+func (t *boltTx) ForEach(bucket, prefix string, fn func(key string, value []byte) error) error {
+	bkt := t.tx.Bucket([]byte(bucket))
+	if bkt == nil {
+		return nil
+	}
+
+	// Collect first as fn may modify the bucket
+	var keys, vals [][]byte
+	p := []byte(prefix)
+	c := bkt.Cursor()
+	for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+		vals = append(vals, append([]byte{}, v...))
+	}
+
+	for i, k := range keys {
+		if err := fn(string(k), vals[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *boltTx) Range(bucket, prefix, after string, limit int) (keys []string, values [][]byte) {
+	bkt := t.tx.Bucket([]byte(bucket))
+	if bkt == nil {
+		return
+	}
+
+	p := []byte(prefix)
+	start := p
+	if after > prefix {
+		start = []byte(after)
+	}
+	c := bkt.Cursor()
+	for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, p) && len(keys) < limit; k, v = c.Next() {
+		if string(k) == after {
+			continue
+		}
+		keys = append(keys, string(k))
+		values = append(values, append([]byte{}, v...))
+	}
+	return
+}
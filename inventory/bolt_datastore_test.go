@@ -0,0 +1,144 @@
+package inventory
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_BoltDatastore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	dbfile := filepath.Join(dir, "db", "inventory.db")
+
+	ds, err := NewBoltDatastore(dbfile)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if _, err = ds.CreateAsset(testAssetType, testAssetId, testData, true); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err = ds.CreateAsset(testAssetType, testAssetId, testData, true); err == nil {
+		t.Fatalf("Should fail on existing asset")
+	}
+	if _, err = ds.EditAsset(testAssetType, testAssetId, testUpdateData); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err = ds.CreateAsset(testAssetType, testAssetId2, testData2, false); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !ds.RemoveAsset(testAssetType, testAssetId2, "tester") {
+		t.Fatalf("Failed to remove asset")
+	}
+	testSystemDocs(t, ds)
+	testSequences(t, ds)
+	ds.Close()
+
+	// Everything should survive a reopen
+	if ds, err = NewBoltDatastore(dbfile); err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer ds.Close()
+
+	asset, err := ds.GetAsset(testAssetType, testAssetId)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	d := asset.Data
+	if d["host"] != testUpdateData["host"] || d["name"] != testAssetId {
+		t.Fatalf("Wrong data: %#v", d)
+	}
+
+	if _, err = ds.GetAsset(testAssetType, testAssetId2); err == nil {
+		t.Fatalf("Did not remove asset")
+	}
+
+	rslt, err := ds.GetAssetVersions(testAssetType, testAssetId, 10, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(rslt.Assets) != 1 {
+		t.Fatalf("Wrong version count: %d", len(rslt.Assets))
+	}
+	// Must not pick up versions of test2
+	if rslt, _ = ds.GetAssetVersions(testAssetType, "test", 10, 0); len(rslt.Assets) != 1 {
+		t.Fatalf("Wrong version count: %d", len(rslt.Assets))
+	}
+
+	types, err := ds.ListAssetTypes()
+	if err != nil || len(types) != 1 {
+		t.Fatalf("Wrong types: %v %s", types, err)
+	}
+
+	query := Query{Filter: Terms("name", testAssetId)}
+	if rslt, err = ds.Search([]string{testAssetType}, query); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(rslt.Assets) != 1 || rslt.Assets[0].Id != testAssetId {
+		t.Fatalf("Wrong results: %#v", rslt.Assets)
+	}
+
+	var view View
+	if err = ds.GetSystemDoc("views", "a", &view); err != nil || view.Name != "a" {
+		t.Fatalf("System doc not persisted: %v %#v", err, view)
+	}
+	if seq, err := ds.NextSequence("a"); err != nil || seq != 4 {
+		t.Fatalf("Sequence not persisted: %d %v", seq, err)
+	}
+
+	testForEachAsset(t, ds)
+	testUniqueFields(t, ds)
+	testBatch(t, ds)
+	testSlashIds(t, ds)
+}
+
+func Test_BoltDatastore_MigrateVersionKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	dbfile := filepath.Join(dir, "inventory.db")
+
+	// versions as stored before ids were escaped
+	store, err := NewBoltStore(dbfile)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	err = store.Update(func(tx KVTx) error {
+		for _, id := range []string{"a", "a/x"} {
+			for v := int64(1); v <= 2; v++ {
+				rec := &kvRecord{Id: id, Type: "slashed", Version: v, Data: map[string]interface{}{"n": v}}
+				if err := kvPutRecord(tx, kvVersionsBucket, fmt.Sprintf("slashed/%s/%020d", id, v), rec); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	store.Close()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	ds, err := NewBoltDatastore(dbfile)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer ds.Close()
+	for _, id := range []string{"a", "a/x"} {
+		rslt, err := ds.GetAssetVersions("slashed", id, 10, 0)
+		if err != nil || len(rslt.Assets) != 2 || rslt.Assets[0].Id != id {
+			t.Fatalf("Versions of %s not migrated: %#v %v", id, rslt.Assets, err)
+		}
+	}
+	if migrated, err := ds.migrateVersionKeys(); err != nil || migrated != 0 {
+		t.Fatalf("Migrated twice: %d %v", migrated, err)
+	}
+}
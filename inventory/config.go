@@ -32,25 +32,60 @@ type EssDatastoreConfig struct {
 	MappingFile string `json:"mapping_file"`
 }
 
+type BoltDatastoreConfig struct {
+	Path string `json:"path"`
+}
+
 type EndpointsConfig struct {
 	Prefix string `json:"prefix"`
 }
 
 type DatastoreConfig struct {
-	Type      string             `json:"type"`
-	Config    EssDatastoreConfig `json:"config"`
-	BackupDir string             `json:"backup_dir"`
+	Type      string              `json:"type"`
+	Config    EssDatastoreConfig  `json:"config"`
+	Bolt      BoltDatastoreConfig `json:"bolt"`
+	BackupDir string              `json:"backup_dir"`
 }
 
 type AssetConfig struct {
 	RequiredFields []string `json:"required_fields"`
 }
 
+/*
+   Versions to keep.  Limits that are not set (0) are not applied.  The
+   newest version of an asset is always kept.
+*/
+type RetentionPolicy struct {
+	// Keep only the newest N versions
+	KeepLast int64 `json:"keep_last"`
+	// Remove versions older than N days
+	KeepDays int64 `json:"keep_days"`
+	// Keep only the newest version per day for versions older than N days
+	ThinAfterDays int64 `json:"thin_after_days"`
+}
+
+type VersionsConfig struct {
+	// Applies to asset types without their own policy
+	Retention RetentionPolicy            `json:"retention"`
+	Types     map[string]RetentionPolicy `json:"types"`
+	// Seconds between background pruning runs. 0 disables it.
+	PruneInterval int64 `json:"prune_interval"`
+}
+
+/* Retention policy for the asset type */
+func (c *VersionsConfig) Policy(assetType string) RetentionPolicy {
+	if p, ok := c.Types[assetType]; ok {
+		return p
+	}
+	return c.Retention
+}
+
 type InventoryConfig struct {
 	Auth      AuthConfig      `json:"auth"`
 	Datastore DatastoreConfig `json:"datastore"`
 	Endpoints EndpointsConfig `json:"endpoints"`
 	AssetCfg  AssetConfig     `json:"asset"`
+	Versions  VersionsConfig  `json:"versions"`
 }
 
 func LoadConfig(cfgfile string) (cfg *InventoryConfig, err error) {
@@ -72,6 +107,10 @@ func LoadConfig(cfgfile string) (cfg *InventoryConfig, err error) {
 		cfg.Datastore.Config.MappingFile, _ = filepath.Abs(cfg.Datastore.Config.MappingFile)
 	}
 
+	if len(cfg.Datastore.Bolt.Path) > 0 && !filepath.IsAbs(cfg.Datastore.Bolt.Path) {
+		cfg.Datastore.Bolt.Path, _ = filepath.Abs(cfg.Datastore.Bolt.Path)
+	}
+
 	if !filepath.IsAbs(cfg.Datastore.BackupDir) {
 		cfg.Datastore.BackupDir, _ = filepath.Abs(cfg.Datastore.BackupDir)
 	}
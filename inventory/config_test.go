@@ -25,5 +25,9 @@ func Test_LoadConfig(t *testing.T) {
 	if !filepath.IsAbs(cfg.Auth.GroupsFile) {
 		t.Fatalf("Groups file not abs path: %s", cfg.Auth.GroupsFile)
 	}
+	// upgrades must not start removing history
+	if cfg.Versions.PruneInterval != 0 || cfg.Versions.Retention != (RetentionPolicy{}) || len(cfg.Versions.Types) > 0 {
+		t.Fatalf("Sample prunes versions: %#v", cfg.Versions)
+	}
 	t.Logf("%#v\n", *cfg)
 }
@@ -7,21 +7,90 @@ import (
 	elastigo "github.com/mattbaird/elastigo/lib"
 	"io/ioutil"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type IDatastore interface {
-	GetAsset(assetType, assetId string) (elastigo.BaseResponse, error)
-	GetAssetVersion(assetType, assetId string, version int64) (elastigo.BaseResponse, error)
-	GetAssetVersions(assetType, assetId string, count int64) (elastigo.SearchResult, error)
+	GetAsset(assetType, assetId string) (Asset, error)
+	GetAssetVersion(assetType, assetId string, version int64) (Asset, error)
+	// `count` versions newest first skipping the newest `offset`
+	GetAssetVersions(assetType, assetId string, count, offset int64) (SearchResult, error)
 
-	CreateAsset(assetType, assetId string, data interface{}, createType bool) (string, error)
-	EditAsset(assetType, assetId string, data interface{}) (string, error)
-	RemoveAsset(assetType, assetId string) bool
+	CreateAsset(assetType, assetId string, data map[string]interface{}, createType bool) (string, error)
+	EditAsset(assetType, assetId string, data map[string]interface{}) (string, error)
+	// Overwrite the whole asset, versioning the existing one. Creates it if it does not exist.
+	ReplaceAsset(assetType, assetId string, data map[string]interface{}) (string, error)
+	// Records a tombstone version before removing the asset
+	RemoveAsset(assetType, assetId, deletedBy string) bool
+	// Tombstones of assets that are currently deleted
+	ListDeletedAssets(assetType string) ([]Asset, error)
+	// State of the asset at the given time rebuilt from its versions
+	GetAssetAsOf(assetType, assetId string, asOf time.Time) (Asset, error)
+	// Search the state of assets of the given types at the given time.  No types searches all of them.
+	SearchAsOf(assetTypes []string, asOf time.Time, query Query) (SearchResult, error)
+	// Call fn with the versions of each asset of the type, oldest first.  fn must not write.
+	ForEachAssetVersions(assetType string, fn func(assetId string, versions []Asset) error) error
+	// Delete versions.  The newest version should be kept so version numbers are not reused.
+	RemoveAssetVersions(assetType, assetId string, versions ...int64) error
 	//ListAssets(assetType string)
 	ListAssetTypes() ([]string, error)
-	Search(assetType string, query interface{}) (elastigo.SearchResult, error)
+	// Create an asset type with no assets.  Does nothing if it exists.
+	CreateAssetType(assetType string) error
+	// Remove an asset type along with its assets and their versions.  Returns a *NotFoundError
+	// if the type does not exist.
+	RemoveAssetType(assetType string) error
+	// Search assets of the given types.  No types searches all of them.
+	Search(assetTypes []string, query Query) (SearchResult, error)
+	// Call fn with every asset of the types matching the query, ignoring paging.  fn is called
+	// outside of any transaction and may write.
+	ForEachAsset(assetTypes []string, query Query, fn func(Asset) error) error
+	// Counts, histograms and stats of the assets of the types matching filter
+	Aggregate(assetTypes []string, filter *Filter, agg Aggregation) (AggregationResult, error)
+	// Documents kept by the inventory itself e.g. saved views.  Stored as JSON by kind and name.
+	// Get and Remove return a *NotFoundError if the document does not exist.
+	GetSystemDoc(kind, name string, doc interface{}) error
+	PutSystemDoc(kind, name string, doc interface{}) error
+	RemoveSystemDoc(kind, name string) error
+	// Sorted names of the documents of a kind
+	ListSystemDocs(kind string) ([]string, error)
+	// Atomically increment the named counter returning the new value.  Counters start at 1.
+	NextSequence(name string) (int64, error)
+}
+
+/*
+   Implemented by datastores that can apply several writes atomically.  fn
+   is called with a datastore whose writes are all kept if fn returns nil
+   and none are otherwise.  Its reads see the writes made so far and no
+   others, so checks made through it hold for the writes that follow.
+*/
+type IBatchDatastore interface {
+	Batch(fn func(IDatastore) error) error
+}
+
+/*
+   Implemented by datastores that may index relationship refs so they can
+   not be looked up exactly.  Fields are given as <type>.relationships.<name>.
+   Relationships of those types are not enforced while any are.
+*/
+type IRelationshipIndex interface {
+	AnalyzedRelationshipFields() ([]string, error)
+}
+
+/* Returned by the system document and asset type calls when what is asked for does not exist */
+type NotFoundError struct {
+	What string
+}
+
+func (e *NotFoundError) Error() string {
+	return "Not found: " + e.What
+}
+
+func isNotFound(err error) bool {
+	_, ok := err.(*NotFoundError)
+	return ok
 }
 
 type ElasticsearchVersion struct {
@@ -48,10 +117,40 @@ type EssMapping struct {
 	DynamicTemplates []interface{}          `json:"dynamic_templates"`
 }
 
+/*
+   Fields of version documents.  Lookups are exact matches on asset_id so
+   it must not be analyzed.
+*/
+var essVersionProperties = map[string]interface{}{
+	"asset_id":   map[string]interface{}{"type": "string", "index": "not_analyzed"},
+	"version":    map[string]interface{}{"type": "long"},
+	"timestamp":  map[string]interface{}{"type": "date"},
+	"deleted":    map[string]interface{}{"type": "boolean"},
+	"deleted_by": map[string]interface{}{"type": "string", "index": "not_analyzed"},
+	"deleted_at": map[string]interface{}{"type": "date"},
+}
+
+/*
+   Document stored in the versions index.  Timestamp is when the version was
+   recorded i.e. when the state it holds was replaced.
+*/
+type essVersionDoc struct {
+	AssetId   string                 `json:"asset_id"`
+	Version   int64                  `json:"version"`
+	Timestamp *time.Time             `json:"timestamp,omitempty"`
+	Data      map[string]interface{} `json:"data"`
+
+	Deleted   bool       `json:"deleted,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
 type ElasticsearchDatastore struct {
 	Conn         *elastigo.Conn
 	Index        string
 	VersionIndex string
+	// Documents kept by the inventory itself e.g. saved views
+	SystemIndex string
 }
 
 /*
@@ -64,6 +163,7 @@ func NewElasticsearchDatastore(esshost string, essport int, index string, mappin
 		Conn:         elastigo.NewConn(),
 		Index:        index,
 		VersionIndex: index + "_versions",
+		SystemIndex:  index + "_system",
 	}
 
 	ed.Conn.Domain = esshost
@@ -77,6 +177,12 @@ func NewElasticsearchDatastore(esshost string, essport int, index string, mappin
 			return &ed, ed.initializeIndex("")
 		}
 	}
+	// templates added to the mapping file since the index was created
+	if len(mappingfile) > 0 && len(mappingfile[0]) > 1 {
+		if err := ed.applyDynamicTemplates(mappingfile[0]); err != nil {
+			log.Errorf("Dynamic templates not applied: %s\n", err)
+		}
+	}
 	return &ed, nil
 }
 
@@ -129,33 +235,16 @@ func (e *ElasticsearchDatastore) applyMappingFile(mapfile string) (err error) {
 		return
 	}
 
-	if _, err = os.Stat(mapfile); err != nil {
-		err = fmt.Errorf("Not creating mapping. Mapping file not found (%s): %s", mapfile, err)
-		return
-	}
-	// Read mapping file to get map name
-	var mdb []byte
-	mdb, err = ioutil.ReadFile(mapfile)
-	if err != nil {
-		return
-	}
-
-	var mapData map[string]interface{}
-	if err = json.Unmarshal(mdb, &mapData); err != nil {
-		return
-	}
-	// Get map name from first key
 	var (
-		normMap  = map[string]interface{}{}
 		mapname  string
+		mapping  interface{}
 		mapbytes []byte
 	)
-	for k, _ := range mapData {
-		normMap[k] = mapData[k]
-		mapname = k
-		break
+	if mapname, mapping, err = readMappingFile(mapfile); err != nil {
+		err = fmt.Errorf("Not creating mapping. %s", err)
+		return
 	}
-
+	normMap := map[string]interface{}{mapname: mapping}
 	if mapbytes, err = json.Marshal(normMap); err != nil {
 		return
 	}
@@ -167,7 +256,7 @@ func (e *ElasticsearchDatastore) applyMappingFile(mapfile string) (err error) {
 		log.Infof("Updated '%s' mapping for index '%s'\n", mapname, e.Index)
 	}
 	// Versioning index
-	if err = e.Conn.PutMappingFromJSON(e.VersionIndex, mapname, mapbytes); err != nil {
+	if err = e.putVersionMapping(mapname, normMap[mapname]); err != nil {
 		return
 	} else {
 		log.Infof("Updated '%s' mapping for index '%s'\n", mapname, e.VersionIndex)
@@ -176,23 +265,447 @@ func (e *ElasticsearchDatastore) applyMappingFile(mapfile string) (err error) {
 	return
 }
 
+/* Name and mapping of the first mapping in the file */
+func readMappingFile(mapfile string) (mapname string, mapping interface{}, err error) {
+	if _, err = os.Stat(mapfile); err != nil {
+		err = fmt.Errorf("Mapping file not found (%s): %s", mapfile, err)
+		return
+	}
+	var mdb []byte
+	if mdb, err = ioutil.ReadFile(mapfile); err != nil {
+		return
+	}
+
+	var mapData map[string]interface{}
+	if err = json.Unmarshal(mdb, &mapData); err != nil {
+		return
+	}
+	for k, v := range mapData {
+		return k, v, nil
+	}
+	err = fmt.Errorf("No mapping in %s", mapfile)
+	return
+}
+
+/*
+   Put the dynamic templates of the mapping file on every mapping of an
+   existing index, including _default_ for types created later.  Only
+   fields not mapped yet take them up.  Fields mapped already keep their
+   mapping, see AnalyzedRelationshipFields.
+*/
+func (e *ElasticsearchDatastore) applyDynamicTemplates(mapfile string) (err error) {
+	var mapping interface{}
+	if _, mapping, err = readMappingFile(mapfile); err != nil {
+		return
+	}
+	m, _ := mapping.(map[string]interface{})
+	templates, ok := m["dynamic_templates"].([]interface{})
+	if !ok || len(templates) < 1 {
+		return
+	}
+	nested := make([]interface{}, len(templates))
+	for i, tmpl := range templates {
+		nested[i] = essNestDynamicTemplate(tmpl)
+	}
+
+	for index, tmpls := range map[string][]interface{}{e.Index: templates, e.VersionIndex: nested} {
+		var names []string
+		if names, err = e.mappingNames(index); err != nil {
+			return
+		}
+		for _, name := range names {
+			b, _ := json.Marshal(map[string]interface{}{name: map[string]interface{}{"dynamic_templates": tmpls}})
+			if err = e.Conn.PutMappingFromJSON(index, name, b); err != nil {
+				return fmt.Errorf("%s/%s: %s", index, name, err)
+			}
+		}
+		log.V(6).Infof("Dynamic templates applied to %d mappings of '%s'\n", len(names), index)
+	}
+	return
+}
+
+/* Names of the mappings of the index, with _default_ whether it exists or not */
+func (e *ElasticsearchDatastore) mappingNames(index string) (names []string, err error) {
+	var b []byte
+	if b, err = e.Conn.DoCommand("GET", "/"+index+"/_mapping", nil, nil); err != nil {
+		return
+	}
+	m := map[string]map[string]map[string]interface{}{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		return
+	}
+	names = []string{"_default_"}
+	for name := range m[index]["mappings"] {
+		if name != "_default_" {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+/*
+   Mapping of the versions index from that of the assets.  Version documents
+   hold the asset under data, so the asset properties and the paths of
+   dynamic templates are moved there.  The version document fields are
+   added at the top level.
+*/
+func essVersionMapping(mapping interface{}) map[string]interface{} {
+	m, _ := mapping.(map[string]interface{})
+	vmap := map[string]interface{}{}
+	for k, v := range m {
+		vmap[k] = v
+	}
+
+	dataProps := map[string]interface{}{}
+	props := map[string]interface{}{}
+	if p, ok := vmap["properties"].(map[string]interface{}); ok {
+		for k, v := range p {
+			// version document fields of an existing versions mapping
+			if _, isVersionField := essVersionProperties[k]; isVersionField {
+				continue
+			}
+			// already nested e.g. when migrating
+			if k == "data" {
+				dm, _ := v.(map[string]interface{})
+				if d, ok := dm["properties"].(map[string]interface{}); ok {
+					for dk, dv := range d {
+						dataProps[dk] = dv
+					}
+				}
+				continue
+			}
+			dataProps[k] = v
+		}
+	}
+	for k, v := range essVersionProperties {
+		props[k] = v
+	}
+	if len(dataProps) > 0 {
+		props["data"] = map[string]interface{}{"properties": dataProps}
+	}
+	vmap["properties"] = props
+
+	if templates, ok := vmap["dynamic_templates"].([]interface{}); ok {
+		nested := make([]interface{}, len(templates))
+		for i, tmpl := range templates {
+			nested[i] = essNestDynamicTemplate(tmpl)
+		}
+		vmap["dynamic_templates"] = nested
+	}
+	return vmap
+}
+
+/* Dynamic template with its path_match and path_unmatch under data */
+func essNestDynamicTemplate(tmpl interface{}) interface{} {
+	named, ok := tmpl.(map[string]interface{})
+	if !ok {
+		return tmpl
+	}
+	nested := map[string]interface{}{}
+	for name, def := range named {
+		d, ok := def.(map[string]interface{})
+		if !ok {
+			nested[name] = def
+			continue
+		}
+		nd := map[string]interface{}{}
+		for k, v := range d {
+			if path, isStr := v.(string); isStr && (k == "path_match" || k == "path_unmatch") && !strings.HasPrefix(path, "data.") {
+				v = "data." + path
+			}
+			nd[k] = v
+		}
+		nested[name] = nd
+	}
+	return nested
+}
+
+/*
+   Relationship fields of the index mapping, as <type>.relationships.<name>,
+   that are analyzed.  Refs in them are split into terms so exact lookups
+   of a <type>/<id> match nothing.
+*/
+func essAnalyzedRelationshipFields(index string, mapping []byte) (fields []string, err error) {
+	m := map[string]map[string]map[string]struct {
+		Properties map[string]struct {
+			Properties map[string]struct {
+				Type  string `json:"type"`
+				Index string `json:"index"`
+			} `json:"properties"`
+		} `json:"properties"`
+	}{}
+	if err = json.Unmarshal(mapping, &m); err != nil {
+		return
+	}
+
+	fields = []string{}
+	for name, typeMapping := range m[index]["mappings"] {
+		for rel, field := range typeMapping.Properties[relationshipsField].Properties {
+			if field.Type == "text" || (field.Type == "string" && field.Index != "not_analyzed") {
+				fields = append(fields, name+"."+relationshipsField+"."+rel)
+			}
+		}
+	}
+	sort.Strings(fields)
+	return
+}
+
+/* Put a mapping on the versions index adding the version document fields */
+func (e *ElasticsearchDatastore) putVersionMapping(mapname string, mapping interface{}) (err error) {
+	var b []byte
+	if b, err = json.Marshal(map[string]interface{}{mapname: essVersionMapping(mapping)}); err != nil {
+		return
+	}
+	log.V(10).Infof("Mapping (%s): %s\n", mapname, b)
+	return e.Conn.PutMappingFromJSON(e.VersionIndex, mapname, b)
+}
+
 func (e *ElasticsearchDatastore) initializeIndex(mappingFile string) error {
 	resp, err := e.Conn.CreateIndex(e.Index)
 	if err != nil {
 		return err
 	}
-	log.V(3).Infof("Index created: %s %s\n", e.Index, resp)
+	log.V(3).Infof("Index created: %s %v\n", e.Index, resp)
 	// Versioning index
 	resp, err = e.Conn.CreateIndex(e.VersionIndex)
 	if err != nil {
 		return err
 	}
-	log.V(3).Infof("Version index created: %s %s\n", e.Index, resp)
+	log.V(3).Infof("Version index created: %s %v\n", e.Index, resp)
+	resp, err = e.Conn.CreateIndex(e.SystemIndex)
+	if err != nil {
+		return err
+	}
+	log.V(3).Infof("System index created: %s %v\n", e.SystemIndex, resp)
 
 	if len(mappingFile) > 1 {
 		log.V(6).Infof("Applying mapping file: %s\n", mappingFile)
 		return e.applyMappingFile(mappingFile)
 	}
 
-	return nil
+	return e.putVersionMapping("_default_", nil)
+}
+
+/* Translate a filter tree to the elasticsearch filter dsl */
+func essFilter(f *Filter) map[string]interface{} {
+	switch f.Op {
+	case FilterAnd, FilterOr:
+		clauses := make([]interface{}, len(f.Filters))
+		for i, sf := range f.Filters {
+			clauses[i] = essFilter(sf)
+		}
+		if f.Op == FilterAnd {
+			return map[string]interface{}{"bool": map[string]interface{}{"must": clauses}}
+		}
+		return map[string]interface{}{"bool": map[string]interface{}{"should": clauses}}
+	case FilterNot:
+		return map[string]interface{}{"bool": map[string]interface{}{"must_not": essFilter(f.Filters[0])}}
+	case FilterTerms:
+		return map[string]interface{}{"terms": map[string]interface{}{f.Field: f.Values}}
+	case FilterGt, FilterGte, FilterLt, FilterLte:
+		return map[string]interface{}{"range": map[string]interface{}{
+			f.Field: map[string]interface{}{f.Op: f.Values[0]},
+		}}
+	case FilterExists:
+		return map[string]interface{}{"exists": map[string]interface{}{"field": f.Field}}
+	case FilterPrefix, FilterRegexp:
+		return map[string]interface{}{f.Op: map[string]interface{}{f.Field: f.Values[0]}}
+	case FilterWildcard:
+		// no wildcard filter so wrap the query
+		return map[string]interface{}{"query": map[string]interface{}{
+			"wildcard": map[string]interface{}{f.Field: f.Values[0]},
+		}}
+	}
+	return map[string]interface{}{"match_all": map[string]interface{}{}}
+}
+
+/* Build the elasticsearch search body for a query */
+func essSearchBody(q Query) map[string]interface{} {
+	size := q.Size
+	if size <= 0 {
+		size = DefaultSearchSize
+	}
+	body := map[string]interface{}{"from": q.From, "size": size}
+
+	if q.Filter != nil {
+		body["query"] = map[string]interface{}{
+			"filtered": map[string]interface{}{"filter": essFilter(q.Filter)},
+		}
+	}
+
+	if len(q.Fields) > 0 {
+		body["_source"] = q.Fields
+	}
+
+	if len(q.Sort) > 0 {
+		sorting := make([]interface{}, len(q.Sort))
+		for i, sf := range q.Sort {
+			order := "asc"
+			if sf.Desc {
+				order = "desc"
+			}
+			sorting[i] = map[string]interface{}{sf.Field: order}
+		}
+		body["sort"] = sorting
+	}
+	return body
+}
+
+/*
+   Build the elasticsearch body aggregating the assets matching filter.
+   Aggregations are named <kind>:<field> so results can be mapped back.
+*/
+func essAggregateBody(filter *Filter, agg Aggregation) map[string]interface{} {
+	body := map[string]interface{}{"size": 0, "aggs": essAggregations(agg, agg.By)}
+	if filter != nil {
+		body["query"] = map[string]interface{}{
+			"filtered": map[string]interface{}{"filter": essFilter(filter)},
+		}
+	}
+	return body
+}
+
+func essAggregations(agg Aggregation, by []string) map[string]interface{} {
+	aggs := map[string]interface{}{}
+	for field, interval := range agg.Histograms {
+		aggs["histogram:"+field] = map[string]interface{}{
+			"histogram": map[string]interface{}{"field": field, "interval": interval, "min_doc_count": 1},
+		}
+	}
+	for _, field := range agg.Stats {
+		aggs["stats:"+field] = map[string]interface{}{"stats": map[string]interface{}{"field": field}}
+	}
+	if len(by) > 0 {
+		// size 0 returns all terms
+		opts := map[string]interface{}{"field": by[0], "size": 0}
+		if agg.MinCount > 1 {
+			opts["min_doc_count"] = agg.MinCount
+		}
+		terms := map[string]interface{}{"terms": opts}
+		if sub := essAggregations(agg, by[1:]); len(sub) > 0 {
+			terms["aggs"] = sub
+		}
+		aggs["by:"+by[0]] = terms
+	}
+	return aggs
+}
+
+type essBucket struct {
+	Key      interface{} `json:"key"`
+	DocCount int64       `json:"doc_count"`
+}
+
+/* Convert elasticsearch aggregation results built by essAggregations */
+func essAggregationResult(count int64, raw map[string]json.RawMessage, agg Aggregation, by []string) (rslt AggregationResult, err error) {
+	rslt.Count = count
+
+	if len(agg.Histograms) > 0 {
+		rslt.Histograms = map[string][]HistogramBucket{}
+		for field := range agg.Histograms {
+			var h struct {
+				Buckets []essBucket `json:"buckets"`
+			}
+			if err = essUnmarshalAggregation(raw, "histogram:"+field, &h); err != nil {
+				return
+			}
+			buckets := make([]HistogramBucket, len(h.Buckets))
+			for i, b := range h.Buckets {
+				buckets[i] = HistogramBucket{Key: toFloat(b.Key), Count: b.DocCount}
+			}
+			rslt.Histograms[field] = buckets
+		}
+	}
+	if len(agg.Stats) > 0 {
+		rslt.Stats = map[string]FieldStats{}
+		for _, field := range agg.Stats {
+			var stats FieldStats
+			if err = essUnmarshalAggregation(raw, "stats:"+field, &stats); err != nil {
+				return
+			}
+			rslt.Stats[field] = stats
+		}
+	}
+	if len(by) < 1 {
+		return
+	}
+
+	var terms struct {
+		Buckets []map[string]json.RawMessage `json:"buckets"`
+	}
+	if err = essUnmarshalAggregation(raw, "by:"+by[0], &terms); err != nil {
+		return
+	}
+	rslt.Field = by[0]
+	rslt.Buckets = make([]AggregationBucket, len(terms.Buckets))
+	for i, tb := range terms.Buckets {
+		var b essBucket
+		if err = essUnmarshalAggregation(tb, "key", &b.Key); err != nil {
+			return
+		}
+		if err = essUnmarshalAggregation(tb, "doc_count", &b.DocCount); err != nil {
+			return
+		}
+		rslt.Buckets[i].Key = b.Key
+		if rslt.Buckets[i].AggregationResult, err = essAggregationResult(b.DocCount, tb, agg, by[1:]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func essUnmarshalAggregation(raw map[string]json.RawMessage, name string, v interface{}) error {
+	data, ok := raw[name]
+	if !ok {
+		return fmt.Errorf("Aggregation missing from response: %s", name)
+	}
+	return json.Unmarshal(data, v)
+}
+
+/* Convert an elasticsearch document to an asset */
+func essAsset(assetType, assetId string, src *json.RawMessage) (asset Asset, err error) {
+	asset = Asset{Id: assetId, Type: assetType}
+	if src == nil {
+		err = fmt.Errorf("No source: %s/%s", assetType, assetId)
+		return
+	}
+	err = json.Unmarshal(*src, &asset.Data)
+	return
+}
+
+/* Convert a document from the versions index to an asset */
+func essVersionAsset(assetType string, src *json.RawMessage) (asset Asset, err error) {
+	if src == nil {
+		err = fmt.Errorf("No source: %s", assetType)
+		return
+	}
+
+	var doc essVersionDoc
+	if err = json.Unmarshal(*src, &doc); err != nil {
+		return
+	}
+	if len(doc.AssetId) < 1 {
+		err = fmt.Errorf("Version document not migrated.  Run with -migrate-versions")
+		return
+	}
+	asset = Asset{Id: doc.AssetId, Type: assetType, Version: doc.Version, Data: doc.Data,
+		Deleted: doc.Deleted, DeletedBy: doc.DeletedBy, DeletedAt: doc.DeletedAt}
+	if doc.Timestamp != nil {
+		asset.Timestamp = *doc.Timestamp
+	}
+	return
+}
+
+func essSearchResult(rslt elastigo.SearchResult, from int, versioned bool) (sr SearchResult, err error) {
+	sr = SearchResult{Total: int64(rslt.Hits.Total), From: from, Assets: make([]Asset, len(rslt.Hits.Hits))}
+	for i, h := range rslt.Hits.Hits {
+		if versioned {
+			sr.Assets[i], err = essVersionAsset(h.Type, h.Source)
+		} else {
+			sr.Assets[i], err = essAsset(h.Type, h.Id, h.Source)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
 }
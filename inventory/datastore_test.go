@@ -2,6 +2,7 @@ package inventory
 
 import (
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -47,3 +48,75 @@ func Test_ElasticsearchDatastore_Info(t *testing.T) {
 	e.Conn.DeleteIndex(e.VersionIndex)
 	e.Conn.Close()
 }
+
+func Test_essVersionMapping(t *testing.T) {
+	mapping := map[string]interface{}{
+		"_timestamp": map[string]interface{}{"enabled": true},
+		"properties": map[string]interface{}{
+			"hostname": map[string]interface{}{"type": "string", "index": "not_analyzed"},
+			"data":     map[string]interface{}{"properties": map[string]interface{}{"os": map[string]interface{}{"type": "string"}}},
+			"version":  map[string]interface{}{"type": "string"},
+		},
+		"dynamic_templates": []interface{}{
+			map[string]interface{}{"rels": map[string]interface{}{"path_match": "relationships.*", "mapping": map[string]interface{}{}}},
+			map[string]interface{}{"os": map[string]interface{}{"match": "OSRevision"}},
+		},
+	}
+
+	vmap := essVersionMapping(mapping)
+	if _, ok := vmap["_timestamp"]; !ok {
+		t.Fatalf("Settings not copied: %v", vmap)
+	}
+	props := vmap["properties"].(map[string]interface{})
+	if _, ok := props["hostname"]; ok {
+		t.Fatalf("Asset property at top level: %v", props)
+	}
+	if props["version"].(map[string]interface{})["type"] != "long" || props["asset_id"] == nil {
+		t.Fatalf("Version fields not set: %v", props)
+	}
+	data := props["data"].(map[string]interface{})["properties"].(map[string]interface{})
+	if len(data) != 2 || data["hostname"] == nil || data["os"] == nil {
+		t.Fatalf("Asset properties not nested under data: %v", data)
+	}
+
+	templates := vmap["dynamic_templates"].([]interface{})
+	if path := templates[0].(map[string]interface{})["rels"].(map[string]interface{})["path_match"]; path != "data.relationships.*" {
+		t.Fatalf("path_match not nested: %v", path)
+	}
+	if match := templates[1].(map[string]interface{})["os"].(map[string]interface{})["match"]; match != "OSRevision" {
+		t.Fatalf("match changed: %v", match)
+	}
+	// the asset mapping is left as is
+	if _, ok := mapping["properties"].(map[string]interface{})["hostname"]; !ok {
+		t.Fatalf("Asset mapping modified")
+	}
+}
+
+func Test_essSequenceId(t *testing.T) {
+	a, b := essSequenceId("virtualserver/web-prod-{seq}"), essSequenceId("virtualserver/web-dev-{seq}")
+	if a == b || len(a) != 40 || strings.ContainsAny(a, "/{}") {
+		t.Fatalf("Wrong sequence ids: %s %s", a, b)
+	}
+}
+
+func Test_essAnalyzedRelationshipFields(t *testing.T) {
+	mapping := `{"inventory": {"mappings": {
+		"_default_": {},
+		"vm": {"properties": {"relationships": {"properties": {
+			"runs_on": {"type": "string"},
+			"member_of": {"type": "string", "index": "not_analyzed"}
+		}}}},
+		"service": {"properties": {"relationships": {"properties": {
+			"depends_on": {"type": "text"},
+			"owned_by": {"type": "keyword"}
+		}}}},
+		"rack": {"properties": {"name": {"type": "string"}}}
+	}}}`
+	fields, err := essAnalyzedRelationshipFields("inventory", []byte(mapping))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if strings.Join(fields, ",") != "service.relationships.depends_on,vm.relationships.runs_on" {
+		t.Fatalf("Wrong fields: %v", fields)
+	}
+}
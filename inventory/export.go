@@ -0,0 +1,218 @@
+package inventory
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	log "github.com/golang/glog"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+/* Number of assets fetched from the datastore at a time when exporting */
+const ExportBatchSize = 500
+
+/* Export formats */
+const (
+	ExportNDJSON = "ndjson"
+	ExportCSV    = "csv"
+)
+
+/* Writes assets one at a time in an export format */
+type assetExporter interface {
+	Write(asset Asset) error
+	Flush() error
+}
+
+/* One AssetResponse JSON document per line */
+type ndjsonExporter struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonExporter) Write(asset Asset) error {
+	return e.enc.Encode(AssembleResponseFromAsset(asset))
+}
+
+func (e *ndjsonExporter) Flush() error {
+	return nil
+}
+
+/*
+   Header row of id, type and the given dotted columns followed by a row per
+   asset.  Nested objects are flattened to their dotted fields, arrays are
+   written as JSON.
+*/
+type csvExporter struct {
+	w       *csv.Writer
+	columns []string
+	header  bool
+}
+
+func newCSVExporter(w io.Writer, columns []string) *csvExporter {
+	return &csvExporter{w: csv.NewWriter(w), columns: columns}
+}
+
+func (e *csvExporter) writeHeader() error {
+	if e.header {
+		return nil
+	}
+	e.header = true
+	return e.w.Write(append([]string{"id", "type"}, e.columns...))
+}
+
+func (e *csvExporter) Write(asset Asset) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+
+	flat := map[string]interface{}{}
+	flattenFields("", asset.Data, flat)
+
+	row := make([]string, len(e.columns)+2)
+	row[0], row[1] = asset.Id, asset.Type
+	for i, col := range e.columns {
+		row[i+2] = csvValue(flat[col])
+	}
+	return e.w.Write(row)
+}
+
+func (e *csvExporter) Flush() error {
+	// header even if there are no rows
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+/* Add the leaf values of doc to flat keyed by their dotted field */
+func flattenFields(prefix string, doc map[string]interface{}, flat map[string]interface{}) {
+	for k, v := range doc {
+		if sub, ok := v.(map[string]interface{}); ok {
+			flattenFields(prefix+k+".", sub, flat)
+			continue
+		}
+		flat[prefix+k] = v
+	}
+}
+
+func csvValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(val)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+/* Dotted columns of all assets matching the query, sorted */
+func (ir *Inventory) exportColumns(assetTypes []string, q Query) ([]string, error) {
+	seen := map[string]bool{}
+	err := ir.datastore.ForEachAsset(assetTypes, Query{Filter: q.Filter}, func(a Asset) error {
+		flat := map[string]interface{}{}
+		flattenFields("", a.Data, flat)
+		for k := range flat {
+			seen[k] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]string, 0, len(seen))
+	for k := range seen {
+		columns = append(columns, k)
+	}
+	sort.Strings(columns)
+	return columns, nil
+}
+
+/*
+   Stream all assets matching a search as ndjson or csv.  Takes the same body
+   and parameters as a search apart from paging.  CSV columns are the fields
+   param or else every field found in a first pass over the results.
+*/
+func (ir *Inventory) exportHandler(assetTypes []string, format string, w http.ResponseWriter, r *http.Request) {
+	headers := map[string]string{"Content-Type": "text/plain"}
+
+	q, err := ir.parseSearchQuery(r)
+	if err != nil {
+		WriteAndLogResponse(w, r, 400, headers, []byte(err.Error()))
+		return
+	}
+	ir.exportAssets(assetTypes, format, q, w, r)
+}
+
+/* Stream the results of a parsed query */
+func (ir *Inventory) exportAssets(assetTypes []string, format string, q Query, w http.ResponseWriter, r *http.Request) {
+	var (
+		headers = map[string]string{"Content-Type": "text/plain"}
+		err     error
+	)
+	if len(r.URL.Query().Get("as_of")) > 0 {
+		WriteAndLogResponse(w, r, 400, headers, []byte("Invalid request: as_of cannot be exported"))
+		return
+	}
+
+	var exp assetExporter
+	switch format {
+	case ExportNDJSON:
+		headers["Content-Type"] = "application/x-ndjson"
+		exp = &ndjsonExporter{enc: json.NewEncoder(w)}
+		break
+	case ExportCSV:
+		columns := q.Fields
+		if len(columns) < 1 {
+			if columns, err = ir.exportColumns(assetTypes, q); err != nil {
+				WriteAndLogResponse(w, r, 500, headers, []byte(err.Error()))
+				return
+			}
+		}
+		headers["Content-Type"] = "text/csv"
+		exp = newCSVExporter(w, columns)
+		break
+	default:
+		WriteAndLogResponse(w, r, 400, headers,
+			[]byte(fmt.Sprintf("Invalid request: format=%s expected %s or %s", format, ExportNDJSON, ExportCSV)))
+		return
+	}
+
+	for k, v := range headers {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(200)
+
+	flusher, _ := w.(http.Flusher)
+	count := 0
+	err = ir.datastore.ForEachAsset(assetTypes, q, func(a Asset) error {
+		if err := exp.Write(a); err != nil {
+			return err
+		}
+		if count++; count%ExportBatchSize == 0 {
+			if err := exp.Flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = exp.Flush()
+	}
+	// The status has already been sent
+	if err != nil {
+		log.Errorf("%s export failed after %d assets: %s\n", r.RequestURI, count, err)
+	}
+	log.Infof("%s %d %s %d assets\n", r.Method, 200, r.RequestURI, count)
+}
@@ -0,0 +1,321 @@
+package inventory
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var dateMathExpr = regexp.MustCompile(`^now((?:[+-]\d+[smhdwMy])*)(?:/([smhdMy]))?$`)
+
+var dateMathTerm = regexp.MustCompile(`([+-])(\d+)([smhdwMy])`)
+
+/*
+   Build a filter from a search document.  Every key is a, possibly dotted,
+   field and all of them must match.  Nested objects are the same as dotted
+   keys i.e. {"hw": {"cpus": 4}} is {"hw.cpus": 4}.  See parseFilterValue
+   for the values.
+*/
+func ParseFilterDocument(doc map[string]interface{}) (*Filter, error) {
+	filters, err := appendFilterDocument([]*Filter{}, "", doc)
+	if err != nil {
+		return nil, err
+	}
+	return And(filters...), nil
+}
+
+func appendFilterDocument(filters []*Filter, prefix string, doc map[string]interface{}) ([]*Filter, error) {
+	for _, k := range sortedFields(doc) {
+		field := prefix + k
+		if sub, ok := doc[k].(map[string]interface{}); ok {
+			if len(sub) < 1 {
+				return nil, fmt.Errorf("Invalid filter for '%s': empty object", field)
+			}
+			var err error
+			if filters, err = appendFilterDocument(filters, field+".", sub); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		f, err := parseFilterValue(field, doc[k])
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+func sortedFields(doc map[string]interface{}) []string {
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+   Filter for a single field.  Numbers and booleans match equal values, null
+   matches a missing field and arrays match any of their elements.  Strings
+   are one of:
+
+	value        equal to value
+	>x >=x <x <=x  range. Several may be given e.g. ">=2 <8".  x is a
+	             number, a date or date math e.g. now-7d, now/d
+	*            field exists
+	web*  w?b    wildcard, a trailing * only is a prefix match
+	/regex/      regular expression matching the whole value.  See
+	             checkRegexp for the syntax
+	!<any>       negation of any of the above
+	\<any>       the rest of the string taken literally
+*/
+func parseFilterValue(field string, v interface{}) (*Filter, error) {
+	switch val := v.(type) {
+	case nil:
+		return Not(Exists(field)), nil
+	case string:
+		return parseFilterString(field, val)
+	case float64, int64, int, bool:
+		return Terms(field, val), nil
+	case []interface{}:
+		if len(val) < 1 {
+			return nil, fmt.Errorf("Invalid filter for '%s': empty list", field)
+		}
+		var (
+			filters = make([]*Filter, len(val))
+			values  = []interface{}{}
+		)
+		for i, e := range val {
+			f, err := parseFilterValue(field, e)
+			if err != nil {
+				return nil, err
+			}
+			filters[i] = f
+			if f.Op == FilterTerms {
+				values = append(values, f.Values...)
+			}
+		}
+		// Plain values are a single terms lookup
+		if len(values) == len(val) {
+			return Terms(field, values...), nil
+		}
+		return Or(filters...), nil
+	}
+	return nil, fmt.Errorf("Invalid filter for '%s': unsupported value %#v", field, v)
+}
+
+func parseFilterString(field, val string) (*Filter, error) {
+	val = strings.TrimSpace(val)
+
+	switch {
+	case strings.HasPrefix(val, `\`):
+		return Terms(field, val[1:]), nil
+	case strings.HasPrefix(val, "!"):
+		if len(val) < 2 {
+			return nil, fmt.Errorf("Invalid filter for '%s': '!' requires a value", field)
+		}
+		f, err := parseFilterString(field, val[1:])
+		if err != nil {
+			return nil, err
+		}
+		return Not(f), nil
+	case strings.HasPrefix(val, ">") || strings.HasPrefix(val, "<"):
+		return parseFilterRanges(field, val)
+	case strings.HasPrefix(val, "/"):
+		if len(val) < 2 || !strings.HasSuffix(val, "/") {
+			return nil, fmt.Errorf("Invalid filter for '%s': unterminated regular expression %s", field, val)
+		}
+		expr := val[1 : len(val)-1]
+		if err := checkRegexp(expr); err != nil {
+			return nil, fmt.Errorf("Invalid filter for '%s': %s", field, err)
+		}
+		if _, err := regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("Invalid filter for '%s': %s", field, err)
+		}
+		return Regexp(field, expr), nil
+	case val == "*":
+		return Exists(field), nil
+	case strings.ContainsAny(val, "*?"):
+		if strings.Index(val, "*") == len(val)-1 && !strings.Contains(val, "?") {
+			return Prefix(field, val[:len(val)-1]), nil
+		}
+		return Wildcard(field, val), nil
+	}
+	return Terms(field, val), nil
+}
+
+/*
+   Regular expressions are run by Go in process and as a Lucene regexp by
+   elasticsearch, so only the syntax both read the same way is allowed:
+   characters, ., [] classes, * + ? {n,m}, | and () groups, with \ escaping
+   punctuation.  Expressions always match the whole value so there are no
+   ^ or $ anchors.  Shorthand classes such as \d or \w, (? flags, [:alpha:]
+   classes and the Lucene operators @ & ~ < > # " are rejected.  Escape the
+   latter to match them literally.
+*/
+func checkRegexp(expr string) error {
+	inClass := false
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c == '\\':
+			if i+1 >= len(expr) {
+				return fmt.Errorf("trailing \\ in regular expression")
+			}
+			if n := expr[i+1]; ('a' <= n && n <= 'z') || ('A' <= n && n <= 'Z') || ('0' <= n && n <= '9') {
+				return fmt.Errorf("\\%c is not supported in regular expressions, use a class e.g. [0-9]", n)
+			}
+			i++
+			break
+		case inClass:
+			if c == '[' && i+1 < len(expr) && expr[i+1] == ':' {
+				return fmt.Errorf("[: classes are not supported in regular expressions")
+			}
+			inClass = c != ']'
+			break
+		case c == '[':
+			inClass = true
+			// A leading ^ negates
+			if i+1 < len(expr) && expr[i+1] == '^' {
+				i++
+			}
+			if i+1 < len(expr) && expr[i+1] == ']' {
+				return fmt.Errorf("escape ] as \\] at the start of a class in regular expressions")
+			}
+			break
+		case c == '(' && i+1 < len(expr) && expr[i+1] == '?':
+			return fmt.Errorf("(? is not supported in regular expressions")
+		case strings.IndexByte(`^$@&~<>#"`, c) >= 0:
+			return fmt.Errorf("'%c' is not supported in regular expressions, escape it as \\%c to match it", c, c)
+		}
+	}
+	return nil
+}
+
+/* One or more space separated comparisons e.g. ">=2 <8" */
+func parseFilterRanges(field, val string) (*Filter, error) {
+	filters := []*Filter{}
+	for _, tok := range strings.Fields(val) {
+		var op string
+		switch {
+		case strings.HasPrefix(tok, ">="):
+			op = FilterGte
+			break
+		case strings.HasPrefix(tok, "<="):
+			op = FilterLte
+			break
+		case strings.HasPrefix(tok, ">"):
+			op = FilterGt
+			break
+		case strings.HasPrefix(tok, "<"):
+			op = FilterLt
+			break
+		default:
+			return nil, fmt.Errorf("Invalid filter for '%s': expected a comparison got '%s'", field, tok)
+		}
+
+		operand := strings.TrimLeft(tok, "<>=")
+		if len(operand) < 1 {
+			return nil, fmt.Errorf("Invalid filter for '%s': '%s' requires a value", field, tok)
+		}
+		cval, err := parseRangeValue(operand)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid filter for '%s': %s", field, err)
+		}
+		filters = append(filters, Compare(op, field, cval))
+	}
+
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return And(filters...), nil
+}
+
+/* Numbers are compared as numbers, date math is resolved to a timestamp */
+func parseRangeValue(val string) (interface{}, error) {
+	if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return n, nil
+	}
+	if n, err := strconv.ParseFloat(val, 64); err == nil {
+		return n, nil
+	}
+	if strings.HasPrefix(val, "now") {
+		t, err := parseDateMath(val, time.Now().UTC())
+		if err != nil {
+			return nil, err
+		}
+		return t.Format(time.RFC3339), nil
+	}
+	return val, nil
+}
+
+/*
+   Resolve date math relative to now e.g. now-7d, now+1h, now-1d/d.  Units are
+   s, m, h, d, w, M (month) and y.  /<unit> rounds down to the start of the
+   unit.
+*/
+func parseDateMath(expr string, now time.Time) (t time.Time, err error) {
+	m := dateMathExpr.FindStringSubmatch(expr)
+	if m == nil {
+		err = fmt.Errorf("invalid date math: %s", expr)
+		return
+	}
+
+	t = now
+	for _, term := range dateMathTerm.FindAllStringSubmatch(m[1], -1) {
+		n, _ := strconv.Atoi(term[2])
+		if term[1] == "-" {
+			n = -n
+		}
+		switch term[3] {
+		case "s":
+			t = t.Add(time.Duration(n) * time.Second)
+			break
+		case "m":
+			t = t.Add(time.Duration(n) * time.Minute)
+			break
+		case "h":
+			t = t.Add(time.Duration(n) * time.Hour)
+			break
+		case "d":
+			t = t.AddDate(0, 0, n)
+			break
+		case "w":
+			t = t.AddDate(0, 0, 7*n)
+			break
+		case "M":
+			t = t.AddDate(0, n, 0)
+			break
+		case "y":
+			t = t.AddDate(n, 0, 0)
+			break
+		}
+	}
+
+	switch m[2] {
+	case "s":
+		t = t.Truncate(time.Second)
+		break
+	case "m":
+		t = t.Truncate(time.Minute)
+		break
+	case "h":
+		t = t.Truncate(time.Hour)
+		break
+	case "d":
+		t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		break
+	case "M":
+		t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		break
+	case "y":
+		t = time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location())
+		break
+	}
+	return
+}
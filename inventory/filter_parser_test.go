@@ -0,0 +1,126 @@
+package inventory
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testFilterDoc = map[string]interface{}{
+	"status":  "running",
+	"cpus":    float64(4),
+	"online":  true,
+	"tags":    []interface{}{"web", "prod"},
+	"name":    "web01.example.com",
+	"created": "2016-03-01T10:00:00Z",
+	"hw": map[string]interface{}{
+		"vendor": "dell",
+		"mem":    float64(16.5),
+	},
+}
+
+func Test_ParseFilterDocument(t *testing.T) {
+	tests := []struct {
+		doc   string
+		match bool
+	}{
+		{`{"status": "running"}`, true},
+		{`{"status": "!running"}`, false},
+		{`{"status": ["stopped", "running"]}`, true},
+		{`{"cpus": 4}`, true},
+		{`{"cpus": 4.5}`, false},
+		{`{"online": true}`, true},
+		{`{"online": false}`, false},
+		{`{"cpus": ">=4"}`, true},
+		{`{"cpus": ">4"}`, false},
+		{`{"cpus": "<=4"}`, true},
+		{`{"cpus": ">=2 <4"}`, false},
+		{`{"cpus": ">2 <=4"}`, true},
+		{`{"cpus": "!>2"}`, false},
+		{`{"hw.mem": ">16"}`, true},
+		{`{"hw": {"vendor": "dell", "mem": "<16"}}`, false},
+		{`{"hw": {"vendor": "dell", "mem": "<17"}}`, true},
+		{`{"hw.vendor": "*"}`, true},
+		{`{"hw.serial": "*"}`, false},
+		{`{"hw.serial": "!*"}`, true},
+		{`{"hw.serial": null}`, true},
+		{`{"name": "web*"}`, true},
+		{`{"name": "*.example.com"}`, true},
+		{`{"name": "web0?.example.*"}`, true},
+		{`{"name": "db*"}`, false},
+		{`{"name": "/web[0-9]+\\..*/"}`, true},
+		{`{"name": "/web[0-9]+/"}`, false},
+		{`{"name": "/(web|db)[^a-z.]{2}\\.example\\.com/"}`, true},
+		{`{"name": "/[-\\]a-z0-9.]+/"}`, true},
+		{`{"tags": ["db", "pro*"]}`, true},
+		{`{"status": "\\!running"}`, false},
+		{`{"created": ">=2016-03-01"}`, true},
+		{`{"created": "<2016-03-01T09:59:59.5Z"}`, false},
+		{`{"created": ">now-1d"}`, false},
+		{`{"created": "<now"}`, true},
+	}
+
+	for _, tst := range tests {
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(tst.doc), &doc); err != nil {
+			t.Fatalf("%s: %s", tst.doc, err)
+		}
+		f, err := ParseFilterDocument(doc)
+		if err != nil {
+			t.Fatalf("%s: %s", tst.doc, err)
+		}
+		if f.Match(testFilterDoc) != tst.match {
+			b, _ := json.Marshal(f)
+			t.Fatalf("%s => %s should be %v", tst.doc, b, tst.match)
+		}
+	}
+}
+
+func Test_ParseFilterDocument_Errors(t *testing.T) {
+	tests := []struct {
+		doc string
+		err string
+	}{
+		{`{"cpus": ">="}`, "'>=' requires a value"},
+		{`{"cpus": ">2 x"}`, "expected a comparison got 'x'"},
+		{`{"status": "!"}`, "'!' requires a value"},
+		{`{"name": "/web"}`, "unterminated regular expression"},
+		{`{"name": "/web[/"}`, "missing closing ]"},
+		{`{"created": ">now-1x"}`, "invalid date math"},
+		{`{"tags": []}`, "empty list"},
+		{`{"hw": {}}`, "Invalid filter for 'hw': empty object"},
+		{`{"name": "/web\\d+.*/"}`, "\\d is not supported"},
+		{`{"name": "/^web.*/"}`, "'^' is not supported"},
+		{`{"name": "/web.*$/"}`, "'$' is not supported"},
+		{`{"name": "/(?i)web.*/"}`, "(? is not supported"},
+		{`{"name": "/[[:alpha:]]+/"}`, "[: classes are not supported"},
+		{`{"name": "/web@/"}`, "'@' is not supported"},
+	}
+
+	for _, tst := range tests {
+		var doc map[string]interface{}
+		json.Unmarshal([]byte(tst.doc), &doc)
+		if _, err := ParseFilterDocument(doc); err == nil || !strings.Contains(err.Error(), tst.err) {
+			t.Fatalf("%s: expected '%s' got %v", tst.doc, tst.err, err)
+		}
+	}
+}
+
+func Test_parseDateMath(t *testing.T) {
+	now := time.Date(2016, 3, 15, 13, 45, 30, 0, time.UTC)
+	tests := map[string]time.Time{
+		"now":        now,
+		"now-7d":     now.AddDate(0, 0, -7),
+		"now+1h-30m": now.Add(30 * time.Minute),
+		"now/d":      time.Date(2016, 3, 15, 0, 0, 0, 0, time.UTC),
+		"now-1M/M":   time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC),
+		"now-2w/h":   time.Date(2016, 3, 1, 13, 0, 0, 0, time.UTC),
+		"now+1y/y":   time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for expr, expected := range tests {
+		if tm, err := parseDateMath(expr, now); err != nil || !tm.Equal(expected) {
+			t.Fatalf("%s: expected %s got %s %v", expr, expected, tm, err)
+		}
+	}
+}
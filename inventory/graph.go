@@ -0,0 +1,232 @@
+package inventory
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/* Largest depth a graph may be requested with */
+const MaxGraphDepth = 10
+
+/* Field dependents are grouped by in impact reports besides their type */
+const impactGroupField = "environment"
+
+/* Directions relationships are followed in from an asset */
+const (
+	GraphOut  = "out"
+	GraphIn   = "in"
+	GraphBoth = "both"
+)
+
+/*
+   Which relationships to follow from the asset.  Depth is the number of
+   relationships followed, without limit if negative.  Relationships limits
+   those followed to the given names.
+*/
+type GraphOptions struct {
+	Depth         int
+	Direction     string
+	Relationships []string
+}
+
+func (opts GraphOptions) follows(relationship string) bool {
+	if len(opts.Relationships) < 1 {
+		return true
+	}
+	for _, r := range opts.Relationships {
+		if r == relationship {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+   Asset in a graph.  Depth is the number of relationships from the asset
+   the graph is of.  Missing is set for targets that do not exist.
+*/
+type GraphNode struct {
+	Type        string `json:"type"`
+	Id          string `json:"id"`
+	Environment string `json:"environment,omitempty"`
+	Depth       int    `json:"depth"`
+	Missing     bool   `json:"missing,omitempty"`
+}
+
+/* Relationship between 2 assets as <type>/<id> */
+type GraphEdge struct {
+	Relationship string `json:"relationship"`
+	From         string `json:"from"`
+	To           string `json:"to"`
+}
+
+/* Assets connected to Root, in the order they were reached */
+type AssetGraph struct {
+	Root  string      `json:"root"`
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+/*
+   Walk the relationships of the asset breadth first.  The incoming
+   relationships of each level are looked up with a single search.
+*/
+func (ir *Inventory) AssetGraph(assetType, assetId string, opts GraphOptions) (graph AssetGraph, err error) {
+	switch opts.Direction {
+	case GraphOut, GraphIn, GraphBoth:
+		break
+	default:
+		return graph, fmt.Errorf("Invalid direction: '%s' expected in, out or both", opts.Direction)
+	}
+
+	root := relationshipRef(assetType, assetId)
+	graph = AssetGraph{Root: root, Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+
+	var sources relationshipSources
+	if opts.Direction != GraphOut {
+		if sources, err = ir.loadRelationshipSources(); err != nil {
+			return
+		}
+	}
+
+	var (
+		depths = map[string]int{root: 0}
+		level  = []string{root}
+		seen   = map[GraphEdge]bool{}
+	)
+	for depth := 0; len(level) > 0; depth++ {
+		var (
+			data     = map[string]map[string]interface{}{}
+			expand   = []string{}
+			incoming = map[string][]AssetRelationship{}
+		)
+		for _, ref := range level {
+			node := GraphNode{Depth: depth}
+			node.Type, node.Id, _ = parseRelationshipRef(ref)
+			asset, gerr := ir.datastore.GetAsset(node.Type, node.Id)
+			if gerr != nil {
+				node.Missing = true
+			} else {
+				node.Environment, _ = asset.Data[impactGroupField].(string)
+			}
+			graph.Nodes = append(graph.Nodes, node)
+			if node.Missing || (opts.Depth >= 0 && node.Depth >= opts.Depth) {
+				continue
+			}
+			data[ref] = asset.Data
+			expand = append(expand, ref)
+		}
+		if opts.Direction != GraphOut && len(expand) > 0 {
+			if incoming, err = ir.incomingRelationshipsOf(sources, expand); err != nil {
+				return
+			}
+		}
+
+		next := []string{}
+		for _, ref := range expand {
+			edges := []GraphEdge{}
+			if opts.Direction != GraphIn {
+				for _, r := range assetRelationships(data[ref]) {
+					edges = append(edges, GraphEdge{Relationship: r.Relationship, From: ref, To: relationshipRef(r.Type, r.Id)})
+				}
+			}
+			for _, r := range incoming[ref] {
+				edges = append(edges, GraphEdge{Relationship: r.Relationship, From: relationshipRef(r.Type, r.Id), To: ref})
+			}
+
+			for _, e := range edges {
+				if !opts.follows(e.Relationship) || seen[e] {
+					continue
+				}
+				seen[e] = true
+				graph.Edges = append(graph.Edges, e)
+
+				other := e.To
+				if other == ref {
+					other = e.From
+				}
+				if _, ok := depths[other]; !ok {
+					depths[other] = depth + 1
+					next = append(next, other)
+				}
+			}
+		}
+		level = next
+	}
+	return
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+/* Graphviz DOT of the graph.  The root is drawn bold and missing assets dashed. */
+func (graph AssetGraph) Dot() string {
+	lines := []string{"digraph " + dotQuote(graph.Root) + " {"}
+	for _, n := range graph.Nodes {
+		ref := relationshipRef(n.Type, n.Id)
+		attrs := []string{"label=" + dotQuote(ref)}
+		if ref == graph.Root {
+			attrs = append(attrs, "style=bold")
+		} else if n.Missing {
+			attrs = append(attrs, "style=dashed")
+		}
+		lines = append(lines, fmt.Sprintf("  %s [%s];", dotQuote(ref), strings.Join(attrs, ", ")))
+	}
+	for _, e := range graph.Edges {
+		lines = append(lines, fmt.Sprintf("  %s -> %s [label=%s];", dotQuote(e.From), dotQuote(e.To), dotQuote(e.Relationship)))
+	}
+	return strings.Join(append(lines, "}"), "\n") + "\n"
+}
+
+/* Assets depending on an asset, directly or not, grouped by type and environment */
+type ImpactReport struct {
+	Asset  string        `json:"asset"`
+	Count  int           `json:"count"`
+	Groups []ImpactGroup `json:"groups"`
+}
+
+type ImpactGroup struct {
+	Type        string   `json:"type"`
+	Environment string   `json:"environment"`
+	Count       int      `json:"count"`
+	Ids         []string `json:"ids"`
+}
+
+/*
+   Everything that breaks if the asset goes away i.e. every asset with a
+   path of relationships to it.  relationships limits those followed.
+*/
+func (ir *Inventory) AssetImpact(assetType, assetId string, relationships []string) (report ImpactReport, err error) {
+	graph, err := ir.AssetGraph(assetType, assetId, GraphOptions{Depth: -1, Direction: GraphIn, Relationships: relationships})
+	if err != nil {
+		return
+	}
+
+	report = ImpactReport{Asset: graph.Root, Groups: []ImpactGroup{}}
+	groups := map[[2]string]*ImpactGroup{}
+	for _, n := range graph.Nodes[1:] {
+		key := [2]string{n.Type, n.Environment}
+		g, ok := groups[key]
+		if !ok {
+			g = &ImpactGroup{Type: n.Type, Environment: n.Environment, Ids: []string{}}
+			groups[key] = g
+		}
+		g.Count++
+		g.Ids = append(g.Ids, n.Id)
+		report.Count++
+	}
+
+	for _, g := range groups {
+		sort.Strings(g.Ids)
+		report.Groups = append(report.Groups, *g)
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		if report.Groups[i].Type != report.Groups[j].Type {
+			return report.Groups[i].Type < report.Groups[j].Type
+		}
+		return report.Groups[i].Environment < report.Groups[j].Environment
+	})
+	return
+}
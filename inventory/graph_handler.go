@@ -0,0 +1,125 @@
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+)
+
+/* Relationship names from rel params.  Each may be a comma separated list. */
+func relationshipParams(r *http.Request) []string {
+	names := []string{}
+	for _, param := range r.URL.Query()["rel"] {
+		for _, name := range strings.Split(param, ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+/*
+   Handle getting the assets connected to an asset
+   GET /<asset_type>/<asset>/graph?depth=<n>&direction=<in|out|both>&rel=<name>&format=<json|dot>
+   Relationships are followed in both directions to a depth of 1 by
+   default.  format=dot returns Graphviz DOT.
+*/
+func (ir *Inventory) AssetGraphHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		headers = map[string]string{"Content-Type": "text/plain"}
+
+		restVars  = mux.Vars(r)
+		assetType = ir.normalizeAssetType(restVars["asset_type"])
+		params    = r.URL.Query()
+	)
+
+	assetId, code, err := ir.resolveAssetId(assetType, restVars["asset"], false)
+	if err != nil {
+		WriteAndLogResponse(w, r, code, headers, []byte(err.Error()))
+		return
+	}
+
+	depth, err := parseIntParam(r, "depth", 1)
+	if err == nil && depth > MaxGraphDepth {
+		err = fmt.Errorf("Invalid request: depth must be at most %d", MaxGraphDepth)
+	}
+	if err != nil {
+		WriteAndLogResponse(w, r, 400, headers, []byte(err.Error()))
+		return
+	}
+	opts := GraphOptions{Depth: int(depth), Direction: params.Get("direction"), Relationships: relationshipParams(r)}
+	switch opts.Direction {
+	case "":
+		opts.Direction = GraphBoth
+		break
+	case GraphIn, GraphOut, GraphBoth:
+		break
+	default:
+		WriteAndLogResponse(w, r, 400, headers, []byte(fmt.Sprintf("Invalid direction: '%s' expected in, out or both", opts.Direction)))
+		return
+	}
+
+	if _, err = ir.datastore.GetAsset(assetType, assetId); err != nil {
+		WriteAndLogResponse(w, r, 404, headers, []byte(err.Error()))
+		return
+	}
+	graph, err := ir.AssetGraph(assetType, assetId, opts)
+	if err != nil {
+		WriteAndLogResponse(w, r, 500, headers, []byte(err.Error()))
+		return
+	}
+
+	var data []byte
+	switch params.Get("format") {
+	case "dot":
+		headers["Content-Type"] = "text/vnd.graphviz"
+		data = []byte(graph.Dot())
+		break
+	case "", "json":
+		headers["Content-Type"] = "application/json"
+		data, _ = json.Marshal(graph)
+		break
+	default:
+		WriteAndLogResponse(w, r, 400, headers, []byte(fmt.Sprintf("Invalid format: '%s' expected json or dot", params.Get("format"))))
+		return
+	}
+
+	WriteAndLogResponse(w, r, 200, headers, data)
+}
+
+/*
+   Handle listing the assets depending on an asset, directly or not, i.e.
+   its blast radius.  GET /<asset_type>/<asset>/impact?rel=<name>
+   Dependents are grouped by type and environment.
+*/
+func (ir *Inventory) AssetImpactHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		headers = map[string]string{"Content-Type": "text/plain"}
+
+		restVars  = mux.Vars(r)
+		assetType = ir.normalizeAssetType(restVars["asset_type"])
+	)
+
+	assetId, code, err := ir.resolveAssetId(assetType, restVars["asset"], false)
+	if err != nil {
+		WriteAndLogResponse(w, r, code, headers, []byte(err.Error()))
+		return
+	}
+
+	if _, err = ir.datastore.GetAsset(assetType, assetId); err != nil {
+		WriteAndLogResponse(w, r, 404, headers, []byte(err.Error()))
+		return
+	}
+	report, err := ir.AssetImpact(assetType, assetId, relationshipParams(r))
+	if err != nil {
+		WriteAndLogResponse(w, r, 500, headers, []byte(err.Error()))
+		return
+	}
+
+	headers["Content-Type"] = "application/json"
+	b, _ := json.Marshal(report)
+	WriteAndLogResponse(w, r, 200, headers, b)
+}
@@ -0,0 +1,72 @@
+package inventory
+
+import (
+	"testing"
+)
+
+func Test_AssetGraph_Dot(t *testing.T) {
+	graph := AssetGraph{
+		Root: "hypervisor/hv1",
+		Nodes: []GraphNode{
+			{Type: "hypervisor", Id: "hv1"},
+			{Type: "vm", Id: `vm"1`, Depth: 1},
+			{Type: "rack", Id: "r1", Depth: 1, Missing: true},
+		},
+		Edges: []GraphEdge{
+			{Relationship: "runs_on", From: `vm/vm"1`, To: "hypervisor/hv1"},
+			{Relationship: "member_of", From: "hypervisor/hv1", To: "rack/r1"},
+		},
+	}
+
+	expected := `digraph "hypervisor/hv1" {
+  "hypervisor/hv1" [label="hypervisor/hv1", style=bold];
+  "vm/vm\"1" [label="vm/vm\"1"];
+  "rack/r1" [label="rack/r1", style=dashed];
+  "vm/vm\"1" -> "hypervisor/hv1" [label="runs_on"];
+  "hypervisor/hv1" -> "rack/r1" [label="member_of"];
+}
+`
+	if dot := graph.Dot(); dot != expected {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", expected, dot)
+	}
+}
+
+/* Counts the searches made for incoming relationships */
+type searchCountingDatastore struct {
+	IDatastore
+	searches int
+}
+
+func (ds *searchCountingDatastore) ForEachAsset(assetTypes []string, q Query, fn func(Asset) error) error {
+	ds.searches++
+	return ds.IDatastore.ForEachAsset(assetTypes, q, fn)
+}
+
+func Test_AssetGraph_SearchPerLevel(t *testing.T) {
+	ds := &searchCountingDatastore{IDatastore: NewMemoryDatastore()}
+	ds.PutSystemDoc(systemDocTypes, "hypervisor", AssetType{Name: "hypervisor"})
+	ds.PutSystemDoc(systemDocTypes, "vm", AssetType{Name: "vm", Relationships: map[string]Relationship{"runs_on": {Targets: []string{"hypervisor"}}}})
+	ds.PutSystemDoc(systemDocTypes, "service", AssetType{Name: "service", Relationships: map[string]Relationship{"depends_on": {}}})
+
+	ds.CreateAsset("hypervisor", "hv1", map[string]interface{}{}, true)
+	for _, vm := range []string{"vm1", "vm2", "vm3"} {
+		ds.CreateAsset("vm", vm, map[string]interface{}{"relationships": map[string]interface{}{"runs_on": []interface{}{"hypervisor/hv1"}}}, true)
+		ds.CreateAsset("service", "svc-"+vm, map[string]interface{}{"relationships": map[string]interface{}{"depends_on": []interface{}{"vm/" + vm}}}, true)
+	}
+
+	ir := &Inventory{datastore: ds}
+	graph, err := ir.AssetGraph("hypervisor", "hv1", GraphOptions{Depth: -1, Direction: GraphIn})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(graph.Nodes) != 7 || len(graph.Edges) != 6 {
+		t.Fatalf("Wrong graph: %#v", graph)
+	}
+	if graph.Nodes[1].Id != "vm1" || graph.Nodes[4].Id != "svc-vm1" || graph.Nodes[6].Depth != 2 {
+		t.Fatalf("Wrong order: %#v", graph.Nodes)
+	}
+	// hv1, the vms and the services without any
+	if ds.searches != 3 {
+		t.Fatalf("Wrong search count: %d", ds.searches)
+	}
+}
@@ -1,10 +1,10 @@
 package inventory
 
 import (
-	"encoding/json"
+	"fmt"
 	log "github.com/golang/glog"
-	elastigo "github.com/mattbaird/elastigo/lib"
 	"net/http"
+	"strconv"
 )
 
 /* Auth handler to wrap any handler function */
@@ -35,36 +35,75 @@ func AuthOnWriteHandler(hFunc http.HandlerFunc) http.HandlerFunc {
 
 /* Helper function to write http data */
 func WriteAndLogResponse(w http.ResponseWriter, r *http.Request, code int, headers map[string]string, data []byte) {
-	w.WriteHeader(code)
-
+	// headers must be set before the status is written
 	if headers != nil {
 		for k, v := range headers {
 			w.Header().Set(k, v)
 		}
 	}
 
+	w.WriteHeader(code)
 	w.Write(data)
 	log.Infof("%s %d %s %d\n", r.Method, code, r.RequestURI, len(data))
 }
 
-func AssembleResponseFromBaseResponse(base elastigo.BaseResponse) (resp AssetResponse, err error) {
-	resp = AssetResponse{Id: base.Id, Type: base.Type}
-	err = json.Unmarshal(*base.Source, &resp.Data)
-	return
+/* Headers of plain text responses.  A new map each time as handlers may add to it. */
+func textHeaders() map[string]string {
+	return map[string]string{"Content-Type": "text/plain"}
 }
 
-func AssembleResponseFromHit(hit elastigo.Hit) (resp AssetResponse, err error) {
-	resp = AssetResponse{Id: hit.Id, Type: hit.Type}
-	err = json.Unmarshal(*hit.Source, &resp.Data)
+/* Headers of JSON responses */
+func jsonHeaders() map[string]string {
+	return map[string]string{"Content-Type": "application/json"}
+}
+
+/* Non-negative integer query param.  Returns def if not supplied. */
+func parseIntParam(r *http.Request, name string, def int64) (val int64, err error) {
+	str := r.URL.Query().Get(name)
+	if len(str) < 1 {
+		return def, nil
+	}
+	if val, err = strconv.ParseInt(str, 10, 64); err != nil || val < 0 {
+		err = fmt.Errorf("Invalid request: %s=%s", name, str)
+	}
 	return
 }
 
-func AssembleResponseFromHits(hits []elastigo.Hit) (resp []AssetResponse, err error) {
-	resp = make([]AssetResponse, len(hits))
-	for i, h := range hits {
-		if resp[i], err = AssembleResponseFromHit(h); err != nil {
-			return
-		}
+/*
+   Report the total number of hits and link to the next page, if any, in the
+   response headers.
+*/
+func setSearchResultHeaders(r *http.Request, rslt SearchResult, headers map[string]string) {
+	headers["X-Total-Count"] = strconv.FormatInt(rslt.Total, 10)
+
+	next := int64(rslt.From + len(rslt.Assets))
+	if len(rslt.Assets) > 0 && next < rslt.Total {
+		params := r.URL.Query()
+		params.Set("from", strconv.FormatInt(next, 10))
+		headers["Link"] = fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, params.Encode())
+	}
+}
+
+/* Versioned assets carry their version and tombstone info in the data */
+func AssembleResponseFromAsset(asset Asset) (resp AssetResponse) {
+	data := make(map[string]interface{}, len(asset.Data)+3)
+	for k, v := range asset.Data {
+		data[k] = v
+	}
+	if asset.Version > 0 {
+		data["version"] = asset.Version
+	}
+	if asset.Deleted {
+		data["deleted_by"] = asset.DeletedBy
+		data["deleted_at"] = asset.DeletedAt
+	}
+	return AssetResponse{Id: asset.Id, Type: asset.Type, Data: data}
+}
+
+func AssembleResponseFromAssets(assets []Asset) (resp []AssetResponse) {
+	resp = make([]AssetResponse, len(assets))
+	for i, a := range assets {
+		resp[i] = AssembleResponseFromAsset(a)
 	}
 	return
 }
@@ -0,0 +1,77 @@
+package inventory
+
+import (
+	"sort"
+)
+
+/* Existing asset ids breaking the id rules of their type */
+type IdReport struct {
+	Checked int         `json:"checked"`
+	Invalid int         `json:"invalid"`
+	Assets  []InvalidId `json:"assets"`
+}
+
+/*
+   Id breaking the rules.  Normalized is the id the asset should have if it
+   can be normalized, Error why not otherwise.  Conflict is set if another
+   asset already has the normalized id.
+*/
+type InvalidId struct {
+	Type       string `json:"type"`
+	Id         string `json:"id"`
+	Normalized string `json:"normalized,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Conflict   bool   `json:"conflict,omitempty"`
+}
+
+/* Check the ids of existing assets of the types.  All types if none are given. */
+func (ir *Inventory) ReportAssetIds(assetTypes ...string) (report IdReport, err error) {
+	report.Assets = []InvalidId{}
+
+	if len(assetTypes) < 1 {
+		if assetTypes, err = ir.datastore.ListAssetTypes(); err != nil {
+			return
+		}
+	}
+	sort.Strings(assetTypes)
+
+	for _, assetType := range assetTypes {
+		var t AssetType
+		if t, _, err = ir.getAssetType(assetType); err != nil {
+			return
+		}
+
+		ids := map[string]bool{}
+		err = ir.datastore.ForEachAsset([]string{assetType}, Query{}, func(a Asset) error {
+			ids[a.Id] = true
+			return nil
+		})
+		if err != nil {
+			return
+		}
+
+		sorted := make([]string, 0, len(ids))
+		for id := range ids {
+			sorted = append(sorted, id)
+		}
+		sort.Strings(sorted)
+
+		for _, id := range sorted {
+			report.Checked++
+			normalized, nerr := t.NormalizeId(id)
+			if nerr == nil && normalized == id {
+				continue
+			}
+
+			invalid := InvalidId{Type: assetType, Id: id}
+			if nerr != nil {
+				invalid.Error = nerr.Error()
+			} else {
+				invalid.Normalized, invalid.Conflict = normalized, ids[normalized]
+			}
+			report.Invalid++
+			report.Assets = append(report.Assets, invalid)
+		}
+	}
+	return
+}
@@ -0,0 +1,211 @@
+package inventory
+
+import (
+	"crypto/rand"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+/* Template used for types without an id_template */
+const defaultIdTemplate = "{uuid}"
+
+/* Generated ids already taken are skipped up to this many times */
+const maxIdAttempts = 100
+
+/* Characters not allowed in generated ids as they are not safe in a URL path */
+const idUnsafeChars = `/\?#%`
+
+/* printf integer verbs allowed for {seq:<format>} e.g. 04d */
+var seqFormatExpr = regexp.MustCompile(`^[0-9]*[dxX]$`)
+
+/*
+   Part of an id template.  Either literal text, a dotted field of the
+   asset, the sequence number or a random uuid.
+*/
+type idTemplatePart struct {
+	Literal   string
+	Field     string
+	Seq       bool
+	SeqFormat string
+	Uuid      bool
+}
+
+/*
+   Parsed id template e.g. {env}-{role}-{seq:04d}.  Placeholders are:
+
+	{<field>}       value of the, dotted, field of the asset
+	{seq}           next number of the sequence
+	{seq:<format>}  the same formatted as by printf e.g. 04d
+	{uuid}          random version 4 uuid
+
+   Ids with different field values have separate sequences, so web-prod-
+   and web-dev- are both numbered from 1.
+*/
+type IdTemplate struct {
+	Template string
+	Parts    []idTemplatePart
+}
+
+func ParseIdTemplate(tmpl string) (*IdTemplate, error) {
+	t := &IdTemplate{Template: tmpl}
+	rest := tmpl
+	for len(rest) > 0 {
+		open := strings.Index(rest, "{")
+		if open < 0 {
+			open = len(rest)
+		}
+		if close := strings.Index(rest[:open], "}"); close >= 0 {
+			return nil, fmt.Errorf("Invalid id_template: unexpected '}' at position %d", len(tmpl)-len(rest)+close)
+		}
+		if open > 0 {
+			if !idSafe(rest[:open]) {
+				return nil, fmt.Errorf("Invalid id_template: '%s' may not contain spaces or any of %s", rest[:open], idUnsafeChars)
+			}
+			t.Parts = append(t.Parts, idTemplatePart{Literal: rest[:open]})
+		}
+		if open == len(rest) {
+			break
+		}
+
+		close := strings.Index(rest[open:], "}")
+		if close < 0 {
+			return nil, fmt.Errorf("Invalid id_template: unclosed '{' at position %d", len(tmpl)-len(rest)+open)
+		}
+		part, err := parseIdTemplatePart(strings.TrimSpace(rest[open+1 : open+close]))
+		if err != nil {
+			return nil, err
+		}
+		t.Parts = append(t.Parts, part)
+		rest = rest[open+close+1:]
+	}
+
+	if len(t.Parts) < 1 {
+		return nil, fmt.Errorf("Invalid id_template: empty")
+	}
+	return t, nil
+}
+
+func parseIdTemplatePart(name string) (part idTemplatePart, err error) {
+	switch {
+	case name == "uuid":
+		part.Uuid = true
+		break
+	case name == "seq":
+		part.Seq, part.SeqFormat = true, "d"
+		break
+	case strings.HasPrefix(name, "seq:"):
+		part.Seq, part.SeqFormat = true, name[len("seq:"):]
+		if !seqFormatExpr.MatchString(part.SeqFormat) {
+			err = fmt.Errorf("Invalid id_template: {%s} format must be e.g. 04d", name)
+		}
+		break
+	case len(name) < 1 || strings.ContainsAny(name, "{:"):
+		err = fmt.Errorf("Invalid id_template: invalid placeholder {%s}", name)
+		break
+	default:
+		part.Field = name
+		break
+	}
+	return
+}
+
+/* Whether ids are unique without checking e.g. they have a sequence */
+func (t *IdTemplate) Generates() bool {
+	for _, p := range t.Parts {
+		if p.Seq || p.Uuid {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+   Fill in the template from the asset data.  nextSeq is called with the
+   name of the sequence if the template has one.  Field values must be safe
+   in a URL path, see idSafe.
+*/
+func (t *IdTemplate) Render(data map[string]interface{}, nextSeq func(sequence string) (int64, error)) (string, error) {
+	fields := make([]string, len(t.Parts))
+	for i, p := range t.Parts {
+		if len(p.Field) < 1 {
+			continue
+		}
+		v, ok := lookupField(data, p.Field)
+		if !ok || v == nil {
+			return "", fmt.Errorf("'%s' field required to generate the id", p.Field)
+		}
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			return "", fmt.Errorf("'%s' field must be a string or number to generate the id", p.Field)
+		}
+		fields[i] = fmt.Sprintf("%v", v)
+		if !idSafe(fields[i]) {
+			return "", fmt.Errorf("'%s' field may not contain spaces or any of %s to generate the id", p.Field, idUnsafeChars)
+		}
+	}
+
+	// sequence named after the id without the numbering
+	var sequence []string
+	for i, p := range t.Parts {
+		switch {
+		case p.Seq:
+			sequence = append(sequence, "{seq}")
+			break
+		case len(p.Field) > 0:
+			sequence = append(sequence, fields[i])
+			break
+		default:
+			sequence = append(sequence, p.Literal)
+			break
+		}
+	}
+
+	var (
+		id  []string
+		seq int64
+		err error
+	)
+	for i, p := range t.Parts {
+		switch {
+		case p.Seq:
+			if seq == 0 {
+				if seq, err = nextSeq(strings.Join(sequence, "")); err != nil {
+					return "", err
+				}
+			}
+			id = append(id, fmt.Sprintf("%"+p.SeqFormat, seq))
+			break
+		case p.Uuid:
+			id = append(id, newUuid())
+			break
+		case len(p.Field) > 0:
+			id = append(id, fields[i])
+			break
+		default:
+			id = append(id, p.Literal)
+			break
+		}
+	}
+	return strings.Join(id, ""), nil
+}
+
+/* Whether s can be part of an id without escaping it in a URL path */
+func idSafe(s string) bool {
+	for _, c := range s {
+		if unicode.IsSpace(c) || unicode.IsControl(c) || strings.ContainsRune(idUnsafeChars, c) {
+			return false
+		}
+	}
+	return true
+}
+
+/* Random version 4 uuid */
+func newUuid() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
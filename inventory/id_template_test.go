@@ -0,0 +1,86 @@
+package inventory
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func Test_IdTemplate_Render(t *testing.T) {
+	data := map[string]interface{}{
+		"env":  "prod",
+		"role": "web",
+		"hw":   map[string]interface{}{"rack": 12},
+		"tags": []interface{}{"a"},
+		"path": "web/db",
+		"desc": "web db",
+	}
+	sequences := map[string]int64{}
+	nextSeq := func(name string) (int64, error) {
+		sequences[name]++
+		return sequences[name], nil
+	}
+
+	tests := []struct {
+		tmpl string
+		id   string
+	}{
+		{"{env}-{role}-{seq:04d}", "prod-web-0001"},
+		{"{env}-{role}-{seq:04d}", "prod-web-0002"},
+		{"{role}-{env}-{seq:04d}", "web-prod-0001"},
+		{"r{hw.rack}-{seq}", "r12-1"},
+		{"{ role }{seq:x}.example.com", "web1.example.com"},
+		{"{env}-{seq:04d}-{seq:x}", "prod-0001-1"},
+		{"static", "static"},
+	}
+	for i, tst := range tests {
+		tmpl, err := ParseIdTemplate(tst.tmpl)
+		if err != nil {
+			t.Fatalf("t%d: %s", i, err)
+		}
+		id, err := tmpl.Render(data, nextSeq)
+		if err != nil || id != tst.id {
+			t.Fatalf("t%d: %s got %s expected %s %v", i, tst.tmpl, id, tst.id, err)
+		}
+	}
+	if sequences["prod-web-{seq}"] != 2 || sequences["prod-{seq}-{seq}"] != 1 {
+		t.Fatalf("Wrong sequences: %v", sequences)
+	}
+
+	tmpl, _ := ParseIdTemplate("host-{uuid}")
+	id, _ := tmpl.Render(data, nextSeq)
+	if !regexp.MustCompile(`^host-[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Fatalf("Wrong uuid: %s", id)
+	}
+
+	for tmplStr, msg := range map[string]string{
+		"{missing}-{seq}": "'missing' field required",
+		"{tags}-{seq}":    "'tags' field must be a string or number",
+		"{hw}":            "'hw' field must be a string or number",
+		"{path}-{seq}":    "'path' field may not contain spaces or any of /",
+		"{desc}":          "'desc' field may not contain spaces",
+	} {
+		tmpl, _ := ParseIdTemplate(tmplStr)
+		if _, err := tmpl.Render(data, nextSeq); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("%s: wrong error %v", tmplStr, err)
+		}
+	}
+}
+
+func Test_ParseIdTemplate_Errors(t *testing.T) {
+	for tmpl, msg := range map[string]string{
+		"":               "empty",
+		"{env":           "unclosed '{' at position 0",
+		"a}b":            "unexpected '}' at position 1",
+		"{}":             "invalid placeholder {}",
+		"{a{b}":          "invalid placeholder {a{b}",
+		"{seq:04s}":      "{seq:04s} format must be",
+		"{env}-{seq:%d}": "{seq:%d} format must be",
+		"{env}/{seq}":    "'/' may not contain spaces or any of /",
+		"a?b":            "'a?b' may not contain",
+	} {
+		if _, err := ParseIdTemplate(tmpl); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("%s: wrong error %v", tmpl, err)
+		}
+	}
+}
@@ -1,12 +1,21 @@
 package inventory
 
 import (
+	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	log "github.com/golang/glog"
 	elastigo "github.com/mattbaird/elastigo/lib"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+/* Number of locks writes to assets are spread across */
+const assetLockStripes = 64
+
 /* currently only used to version up */
 type AssetData struct {
 	CreatedBy  string `json:"created_by"`
@@ -20,45 +29,81 @@ type InventoryDatastore struct {
 	*ElasticsearchDatastore
 	// hold a list of asset types.
 	cachedAssetTypes []string
+	typesMu          sync.RWMutex
+	// serialize writes to the same asset within this process
+	assetLocks [assetLockStripes]sync.Mutex
 }
 
 func NewInventoryDatastore(ds *ElasticsearchDatastore) *InventoryDatastore {
-	return &InventoryDatastore{ds, []string{}}
+	return &InventoryDatastore{ElasticsearchDatastore: ds, cachedAssetTypes: []string{}}
+}
+
+/* Lock the asset for writing.  Returns the unlock function. */
+func (ds *InventoryDatastore) lockAsset(assetType, assetId string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(assetType + "/" + assetId))
+	l := &ds.assetLocks[h.Sum32()%assetLockStripes]
+	l.Lock()
+	return l.Unlock
 }
 
-func (ds *InventoryDatastore) GetAsset(assetType, assetId string) (asset elastigo.BaseResponse, err error) {
-	if asset, err = ds.Conn.Get(ds.Index, assetType, assetId, nil); err == nil && asset.Found {
+func (ds *InventoryDatastore) GetAsset(assetType, assetId string) (asset Asset, err error) {
+	asset, _, err = ds.getAsset(assetType, assetId)
+	return
+}
+
+/* Get the asset along with the elasticsearch document version */
+func (ds *InventoryDatastore) getAsset(assetType, assetId string) (asset Asset, docVersion int, err error) {
+	resp, err := ds.Conn.Get(ds.Index, assetType, assetId, nil)
+	if err == nil && resp.Found {
+		asset, err = essAsset(resp.Type, resp.Id, resp.Source)
+		docVersion = resp.Version
 		return
 	}
-	err = fmt.Errorf("Not found: %s/%s %s", assetType, assetId, err)
+	err = fmt.Errorf("Not found: %s/%s %v", assetType, assetId, err)
 	return
 }
 
-/* Check if the asset type exists */
-func (ds *InventoryDatastore) doesAssetTypeExist(assetType string) (err error) {
+func (ds *InventoryDatastore) isCachedAssetType(assetType string) bool {
+	ds.typesMu.RLock()
+	defer ds.typesMu.RUnlock()
 
 	for _, vt := range ds.cachedAssetTypes {
 		if vt == assetType {
-			return
+			return true
 		}
 	}
+	return false
+}
+
+/* Check if the asset type exists */
+func (ds *InventoryDatastore) doesAssetTypeExist(assetType string) (err error) {
+	if ds.isCachedAssetType(assetType) {
+		return
+	}
 	log.V(15).Infof("Refreshing asset type cache...\n")
-	if ds.cachedAssetTypes, err = ds.ListAssetTypes(); err != nil {
+	types, err := ds.ListAssetTypes()
+	if err != nil {
 		return
 	}
-	for _, vt := range ds.cachedAssetTypes {
+	ds.typesMu.Lock()
+	ds.cachedAssetTypes = types
+	ds.typesMu.Unlock()
+
+	for _, vt := range types {
 		if vt == assetType {
 			return
 		}
 	}
-	return fmt.Errorf("Invalid asset type: %s.  Available types: %v", assetType, ds.cachedAssetTypes)
+	return fmt.Errorf("Invalid asset type: %s.  Available types: %v", assetType, types)
 }
 
-func (ds *InventoryDatastore) CreateAsset(assetType, assetId string, data interface{}, createType bool) (string, error) {
+func (ds *InventoryDatastore) CreateAsset(assetType, assetId string, data map[string]interface{}, createType bool) (string, error) {
 	err := ds.doesAssetTypeExist(assetType)
-	if err != nil && !createType {
-		return "", err
-	} else {
+	if err != nil {
+		if !createType {
+			return "", err
+		}
 		log.V(6).Infof("Auto creating asset type: %s\n", assetType)
 	}
 
@@ -67,66 +112,500 @@ func (ds *InventoryDatastore) CreateAsset(assetType, assetId string, data interf
 		return "", fmt.Errorf("Asset already exists: %s", assetId)
 	}
 
-	resp, err := ds.Conn.Index(ds.Index, assetType, assetId, nil, data)
+	claims, err := ds.claimUniqueValues(assetType, assetId, data)
 	if err != nil {
-		log.Warningf("%s\n", err)
 		return "", err
 	}
 
-	if !resp.Created {
-		return "", fmt.Errorf("Failed: %s", resp)
+	// op_type=create fails if another writer created it in the meantime
+	resp, err := ds.Conn.Index(ds.Index, assetType, assetId, map[string]interface{}{"op_type": "create"}, data)
+	if err == nil && !resp.Created {
+		err = fmt.Errorf("Failed: %#v", resp)
+	}
+	if err != nil {
+		log.Warningf("%s\n", err)
+		ds.releaseUniqueClaims(claims)
+		return "", err
 	}
 
 	return resp.Id, nil
 }
 
-func (ds *InventoryDatastore) EditAsset(assetType, assetId string, data interface{}) (string, error) {
+/*
+   Snapshot the current asset and apply the update.  The update is only
+   applied if the asset has not changed since it was read.  If the version
+   cannot be recorded the update is not applied and vice versa.
+*/
+func (ds *InventoryDatastore) EditAsset(assetType, assetId string, data map[string]interface{}) (string, error) {
+	unlock := ds.lockAsset(assetType, assetId)
+	defer unlock()
 
-	asset, err := ds.GetAsset(assetType, assetId)
+	asset, docVersion, err := ds.getAsset(assetType, assetId)
 	if err != nil {
 		return "", err
 	}
 
-	resp, err := ds.Conn.Update(ds.Index, assetType, assetId, nil, map[string]interface{}{"doc": data})
+	merged, err := copyDocument(asset.Data)
+	if err != nil {
+		return "", err
+	}
+	mergeDocument(merged, data)
+	claims, err := ds.claimUniqueValues(assetType, assetId, merged)
 	if err != nil {
 		return "", err
 	}
 
 	nid, err := ds.CreateAssetVersion(asset)
 	if err != nil {
-		log.Errorf("%s", err)
-	} else {
+		ds.releaseUniqueClaims(claims)
+		return "", fmt.Errorf("Failed to create version: %s", err)
+	}
+	log.V(10).Infof("Version created: %s\n", nid)
+
+	resp, err := ds.Conn.Update(ds.Index, assetType, assetId,
+		map[string]interface{}{"version": docVersion}, map[string]interface{}{"doc": data})
+	if err != nil {
+		ds.removeVersionDoc(assetType, nid)
+		ds.releaseUniqueClaims(claims)
+		return "", err
+	}
+
+	ds.releaseUniqueValues(assetType, assetId, asset.Data, merged)
+	return resp.Id, nil
+}
+
+/*
+   Overwrite the asset with data.  The existing asset, if any, is versioned
+   the same way as EditAsset does.
+*/
+func (ds *InventoryDatastore) ReplaceAsset(assetType, assetId string, data map[string]interface{}) (string, error) {
+	unlock := ds.lockAsset(assetType, assetId)
+	defer unlock()
+
+	var (
+		args = map[string]interface{}{"op_type": "create"}
+		nid  string
+	)
+
+	claims, err := ds.claimUniqueValues(assetType, assetId, data)
+	if err != nil {
+		return "", err
+	}
+
+	asset, docVersion, err := ds.getAsset(assetType, assetId)
+	if err == nil {
+		if nid, err = ds.CreateAssetVersion(asset); err != nil {
+			ds.releaseUniqueClaims(claims)
+			return "", fmt.Errorf("Failed to create version: %s", err)
+		}
 		log.V(10).Infof("Version created: %s\n", nid)
+		args = map[string]interface{}{"version": docVersion}
 	}
 
+	resp, err := ds.Conn.Index(ds.Index, assetType, assetId, args, data)
+	if err != nil {
+		if len(nid) > 0 {
+			ds.removeVersionDoc(assetType, nid)
+		}
+		ds.releaseUniqueClaims(claims)
+		return "", err
+	}
+	if len(nid) > 0 {
+		ds.releaseUniqueValues(assetType, assetId, asset.Data, data)
+	}
 	return resp.Id, nil
 }
 
 //func (ds *InventoryDatastore) ListAssets(assetType string)                           {}
 
-func (ds *InventoryDatastore) RemoveAsset(assetType, assetId string) bool {
+func (ds *InventoryDatastore) RemoveAsset(assetType, assetId, deletedBy string) bool {
+	unlock := ds.lockAsset(assetType, assetId)
+	defer unlock()
+
 	// asset not found
-	asset, err := ds.GetAsset(assetType, assetId)
+	asset, docVersion, err := ds.getAsset(assetType, assetId)
 	if err != nil {
 		return false
 	}
+	// Tombstone
+	now := time.Now().UTC()
+	asset.Deleted, asset.DeletedBy, asset.DeletedAt = true, deletedBy, &now
 
-	resp, err := ds.Conn.Delete(ds.Index, assetType, assetId, nil)
+	nid, err := ds.CreateAssetVersion(asset)
 	if err != nil {
-		log.Errorf("%s\n", err)
+		log.Errorf("Failed to create version: %s\n", err)
 		return false
 	}
+	log.V(10).Infof("Version created: %s\n", nid)
 
-	nid, err := ds.CreateAssetVersion(asset)
+	resp, err := ds.Conn.Delete(ds.Index, assetType, assetId, map[string]interface{}{"version": docVersion})
 	if err != nil {
-		log.Errorf("%s", err)
-	} else {
-		log.V(10).Infof("Version created: %s\n", nid)
+		log.Errorf("%s\n", err)
+		ds.removeVersionDoc(assetType, nid)
+		return false
 	}
 
+	ds.releaseUniqueValues(assetType, assetId, asset.Data, nil)
 	return resp.Found
 }
 
+/*
+   Claim on a value of a unique field.  Claims are documents in the system
+   index created with op_type=create so only one writer can hold a value.
+*/
+type essUniqueClaim struct {
+	Type    string      `json:"type"`
+	Field   string      `json:"field"`
+	Value   interface{} `json:"value"`
+	AssetId string      `json:"asset_id"`
+}
+
+const essUniqueClaimType = "unique"
+
+/* Values may contain characters not allowed in ids so they are hashed */
+func essUniqueClaimId(assetType, field string, value interface{}) string {
+	b, _ := json.Marshal([]interface{}{assetType, field, value})
+	return fmt.Sprintf("%x", sha1.Sum(b))
+}
+
+/*
+   Claim the values of the unique fields of the asset type in data for the
+   asset.  Claims left by assets that no longer hold the value are taken
+   over.  Assets written before the field was unique have no claims so are
+   searched for as well.  Returns the ids of the claims made.
+*/
+func (ds *InventoryDatastore) claimUniqueValues(assetType, assetId string, data map[string]interface{}) (claims []string, err error) {
+	fields, err := datastoreUniqueFields(ds, assetType)
+	if err != nil || len(fields) < 1 {
+		return
+	}
+
+	for _, field := range fields {
+		for _, value := range uniqueValues(data, field) {
+			var claimed bool
+			claimId := essUniqueClaimId(assetType, field, value)
+			claim := essUniqueClaim{Type: assetType, Field: field, Value: value, AssetId: assetId}
+
+			if claimed, err = ds.claimUniqueValue(claimId, claim); err == nil && claimed {
+				claims = append(claims, claimId)
+				err = ds.findUniqueHolder(claim)
+			}
+			if err != nil {
+				ds.releaseUniqueClaims(claims)
+				return nil, err
+			}
+		}
+	}
+	return
+}
+
+/* claimed is false if the asset already held the claim */
+func (ds *InventoryDatastore) claimUniqueValue(claimId string, claim essUniqueClaim) (claimed bool, err error) {
+	if _, err = ds.Conn.Index(ds.SystemIndex, essUniqueClaimType, claimId,
+		map[string]interface{}{"op_type": "create", "refresh": true}, claim); err == nil {
+		return true, nil
+	}
+
+	resp, gerr := ds.Conn.Get(ds.SystemIndex, essUniqueClaimType, claimId, nil)
+	if gerr != nil || !resp.Found || resp.Source == nil {
+		// not a conflict
+		return false, err
+	}
+	var held essUniqueClaim
+	if err = json.Unmarshal(*resp.Source, &held); err != nil {
+		return false, err
+	}
+	if held.AssetId == claim.AssetId {
+		return false, nil
+	}
+
+	if holder, herr := ds.GetAsset(claim.Type, held.AssetId); herr == nil {
+		for _, v := range uniqueValues(holder.Data, claim.Field) {
+			if jsonEqual(v, claim.Value) {
+				return false, &ConflictError{Type: claim.Type, Id: held.AssetId, Field: claim.Field, Value: claim.Value}
+			}
+		}
+	}
+
+	// stale.  the version check fails if another writer took it over first.
+	if _, err = ds.Conn.Index(ds.SystemIndex, essUniqueClaimType, claimId,
+		map[string]interface{}{"version": resp.Version, "refresh": true}, claim); err != nil {
+		return false, fmt.Errorf("Failed to claim %s %v: %s", claim.Field, claim.Value, err)
+	}
+	return true, nil
+}
+
+/* Conflict if an asset other than the claimant has the value */
+func (ds *InventoryDatastore) findUniqueHolder(claim essUniqueClaim) error {
+	rslt, err := ds.Search([]string{claim.Type}, Query{Filter: Terms(claim.Field, claim.Value), Size: 2})
+	if err != nil {
+		return err
+	}
+	for _, a := range rslt.Assets {
+		if a.Id != claim.AssetId {
+			return &ConflictError{Type: claim.Type, Id: a.Id, Field: claim.Field, Value: claim.Value}
+		}
+	}
+	return nil
+}
+
+func (ds *InventoryDatastore) releaseUniqueClaims(claims []string) {
+	for _, claimId := range claims {
+		if _, err := ds.Conn.Delete(ds.SystemIndex, essUniqueClaimType, claimId,
+			map[string]interface{}{"refresh": true}); err != nil {
+			log.Errorf("Failed to release unique claim %s: %s\n", claimId, err)
+		}
+	}
+}
+
+/* Release the claims of the asset on unique values it had in old but not in current */
+func (ds *InventoryDatastore) releaseUniqueValues(assetType, assetId string, old, current map[string]interface{}) {
+	fields, err := datastoreUniqueFields(ds, assetType)
+	if err != nil {
+		log.Errorf("Not releasing unique claims of %s/%s: %s\n", assetType, assetId, err)
+		return
+	}
+
+	var release []string
+	for _, field := range fields {
+		for _, v := range uniqueValues(old, field) {
+			if current != nil && findUniqueConflict([]string{field}, map[string]interface{}{field: v}, current) != nil {
+				continue
+			}
+			claimId := essUniqueClaimId(assetType, field, v)
+			resp, err := ds.Conn.Get(ds.SystemIndex, essUniqueClaimType, claimId, nil)
+			if err != nil || !resp.Found || resp.Source == nil {
+				continue
+			}
+			var held essUniqueClaim
+			if json.Unmarshal(*resp.Source, &held) == nil && held.AssetId == assetId {
+				release = append(release, claimId)
+			}
+		}
+	}
+	ds.releaseUniqueClaims(release)
+}
+
+/*
+   Tombstones of currently deleted assets.  The latest tombstone of each asset
+   is returned if the asset has not been re-created since.
+*/
+func (ds *InventoryDatastore) ListDeletedAssets(assetType string) (assets []Asset, err error) {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"filtered": map[string]interface{}{
+				"filter": map[string]interface{}{"term": map[string]interface{}{"deleted": true}},
+			},
+		},
+		"sort": map[string]interface{}{
+			"version": map[string]interface{}{"order": "desc", "ignore_unmapped": true},
+		},
+		"size": 100,
+	}
+
+	seen := map[string]bool{}
+	assets = []Asset{}
+
+	err = ds.scrollAssets(ds.VersionIndex, assetType, query, func(a Asset) error {
+		if seen[a.Id] {
+			return nil
+		}
+		seen[a.Id] = true
+
+		if latest, lerr := ds.GetAssetVersions(assetType, a.Id, 1, 0); lerr != nil ||
+			len(latest.Assets) < 1 || latest.Assets[0].Version != a.Version {
+			return nil
+		}
+		if _, gerr := ds.GetAsset(assetType, a.Id); gerr == nil {
+			return nil
+		}
+		assets = append(assets, a)
+		return nil
+	})
+	return
+}
+
+/* Call fn for every asset matching the query in the main or versions index */
+func (ds *InventoryDatastore) scrollAssets(index, assetType string, query map[string]interface{}, fn func(Asset) error) error {
+	versioned := index == ds.VersionIndex
+
+	rslt, err := ds.Conn.Search(index, assetType, map[string]interface{}{"scroll": "1m"}, query)
+	for err == nil && len(rslt.Hits.Hits) > 0 {
+		var sr SearchResult
+		if sr, err = essSearchResult(rslt, 0, versioned); err != nil {
+			return err
+		}
+		for _, a := range sr.Assets {
+			if err = fn(a); err != nil {
+				return err
+			}
+		}
+		rslt, err = ds.Conn.Scroll(map[string]interface{}{"scroll": "1m"}, rslt.ScrollId)
+	}
+	return err
+}
+
+/* State of the asset at asOf rebuilt from the current asset and all of its versions */
+func (ds *InventoryDatastore) GetAssetAsOf(assetType, assetId string, asOf time.Time) (asset Asset, err error) {
+	h := &assetHistory{}
+	if current, gerr := ds.GetAsset(assetType, assetId); gerr == nil {
+		h.Current = &current
+	}
+
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"filtered": map[string]interface{}{
+				"filter": map[string]interface{}{"term": map[string]interface{}{"asset_id": assetId}},
+			},
+		},
+		"sort": map[string]interface{}{
+			"version": map[string]interface{}{"order": "asc", "ignore_unmapped": true},
+		},
+		"size": 100,
+	}
+	if err = ds.scrollAssets(ds.VersionIndex, assetType, query, func(a Asset) error {
+		h.Versions = append(h.Versions, a)
+		return nil
+	}); err != nil {
+		return
+	}
+
+	var ok bool
+	if asset, ok = h.asOf(asOf); !ok {
+		err = fmt.Errorf("Not found: %s/%s as of %s", assetType, assetId, asOf.Format(time.RFC3339))
+	}
+	return
+}
+
+/*
+   Search the state of all assets of the types at asOf.  Only the versions
+   either side of asOf are kept for each asset: the oldest recorded after it,
+   holding the state at asOf, and the newest recorded by then, telling
+   whether the asset existed.  Filtering is done in process.
+*/
+func (ds *InventoryDatastore) SearchAsOf(assetTypes []string, asOf time.Time, query Query) (rslt SearchResult, err error) {
+	var (
+		assetType = strings.Join(assetTypes, ",")
+		recorded  = map[string]interface{}{"range": map[string]interface{}{"timestamp": map[string]interface{}{
+			"gt": asOf.UTC().Format(time.RFC3339Nano)}}}
+		before = map[string]Asset{}
+		after  = map[string]Asset{}
+		assets = []Asset{}
+	)
+	// Ids are only unique within a type
+	key := func(a Asset) string { return a.Type + "/" + a.Id }
+	versionsQuery := func(filter map[string]interface{}, order string) map[string]interface{} {
+		return map[string]interface{}{
+			"query": map[string]interface{}{"filtered": map[string]interface{}{"filter": filter}},
+			"sort": map[string]interface{}{
+				"version": map[string]interface{}{"order": order, "ignore_unmapped": true},
+			},
+			"size": 100,
+		}
+	}
+	stateAt := func(h *assetHistory) {
+		if asset, ok := h.asOf(asOf); ok && query.Filter.Match(asset.Data) {
+			assets = append(assets, asset)
+		}
+	}
+
+	// Only whether it was a delete is needed.  Versions without a timestamp predate it being recorded.
+	beforeQuery := versionsQuery(map[string]interface{}{"bool": map[string]interface{}{"must_not": recorded}}, "desc")
+	beforeQuery["_source"] = []string{"asset_id", "version", "timestamp", "deleted"}
+	if err = ds.scrollAssets(ds.VersionIndex, assetType, beforeQuery, func(a Asset) error {
+		if _, ok := before[key(a)]; !ok {
+			before[key(a)] = a
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	if err = ds.scrollAssets(ds.VersionIndex, assetType, versionsQuery(recorded, "asc"), func(a Asset) error {
+		if _, ok := after[key(a)]; !ok {
+			after[key(a)] = a
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+
+	history := func(k string, current *Asset) *assetHistory {
+		h := &assetHistory{Current: current}
+		if prev, ok := before[k]; ok {
+			h.Versions = append(h.Versions, prev)
+		}
+		if next, ok := after[k]; ok {
+			h.Versions = append(h.Versions, next)
+		}
+		return h
+	}
+
+	if err = ds.scrollAssets(ds.Index, assetType, map[string]interface{}{"size": 100}, func(a Asset) error {
+		stateAt(history(key(a), &a))
+		delete(after, key(a))
+		return nil
+	}); err != nil {
+		return
+	}
+	// assets deleted since
+	for k := range after {
+		stateAt(history(k, nil))
+	}
+
+	rslt = pageAssets(assets, query)
+	return
+}
+
+func (ds *InventoryDatastore) ForEachAssetVersions(assetType string, fn func(assetId string, versions []Asset) error) error {
+	query := map[string]interface{}{
+		"sort": []interface{}{
+			map[string]interface{}{"asset_id": map[string]interface{}{"order": "asc"}},
+			map[string]interface{}{"version": map[string]interface{}{"order": "asc", "ignore_unmapped": true}},
+		},
+		"size": 100,
+	}
+
+	var versions []Asset
+	if err := ds.scrollAssets(ds.VersionIndex, assetType, query, func(a Asset) error {
+		if len(versions) > 0 && versions[0].Id != a.Id {
+			if err := fn(versions[0].Id, versions); err != nil {
+				return err
+			}
+			versions = nil
+		}
+		versions = append(versions, a)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(versions) > 0 {
+		return fn(versions[0].Id, versions)
+	}
+	return nil
+}
+
+/* Delete version documents refreshing the index once done */
+func (ds *InventoryDatastore) RemoveAssetVersions(assetType, assetId string, versions ...int64) error {
+	unlock := ds.lockAsset(assetType, assetId)
+	defer unlock()
+
+	for _, v := range versions {
+		if _, err := ds.Conn.Delete(ds.VersionIndex, assetType, versionDocId(assetId, v), nil); err != nil {
+			return fmt.Errorf("Failed to remove version %s/%s.%d: %s", assetType, assetId, v, err)
+		}
+	}
+	_, err := ds.Conn.DoCommand("POST", "/"+ds.VersionIndex+"/_refresh", nil, nil)
+	return err
+}
+
+/* Roll back a version snapshot whose write did not go through */
+func (ds *InventoryDatastore) removeVersionDoc(assetType, versionDocId string) {
+	if _, err := ds.Conn.Delete(ds.VersionIndex, assetType, versionDocId,
+		map[string]interface{}{"refresh": "true"}); err != nil {
+		log.Errorf("Failed to roll back version %s/%s: %s\n", assetType, versionDocId, err)
+	}
+}
+
 func (e *InventoryDatastore) ListAssetTypes() (types []string, err error) {
 	var (
 		b []byte
@@ -155,56 +634,309 @@ func (e *InventoryDatastore) ListAssetTypes() (types []string, err error) {
 	return
 }
 
-func (ds *InventoryDatastore) Search(assetType string, query interface{}) (elastigo.SearchResult, error) {
-	//elastigo.Search(ds.Index)
-	return ds.Conn.Search(ds.Index, assetType, nil, query)
+/*
+   Relationship fields mapped as analyzed strings, e.g. by an index created
+   before the relationships dynamic template.  They stay analyzed until the
+   index is rebuilt.
+*/
+func (ds *InventoryDatastore) AnalyzedRelationshipFields() ([]string, error) {
+	b, err := ds.Conn.DoCommand("GET", "/"+ds.Index+"/_mapping", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return essAnalyzedRelationshipFields(ds.Index, b)
 }
 
-func (ds *InventoryDatastore) CreateAssetVersion(asset elastigo.BaseResponse) (string, error) {
-	var src map[string]interface{}
-	if err := json.Unmarshal(*asset.Source, &src); err != nil {
-		return "", err
+/* Puts an empty mapping for the type on the asset and versions indexes */
+func (ds *InventoryDatastore) CreateAssetType(assetType string) (err error) {
+	if ds.doesAssetTypeExist(assetType) == nil {
+		return nil
 	}
 
-	versionedAssets, err := ds.GetAssetVersions(asset.Type, asset.Id, 1)
-	if err != nil || versionedAssets.Hits.Len() < 1 {
-		log.Warning("Creating new version anyway: Error=%s; Count=%d", err, versionedAssets.Hits.Len())
-		src["version"] = 1
-		//asset["_timestamp"] = asset.
-	} else {
-		var ba AssetData
-		err := json.Unmarshal(*versionedAssets.Hits.Hits[0].Source, &ba)
-		if err != nil {
-			return "", err
+	b, _ := json.Marshal(map[string]interface{}{assetType: map[string]interface{}{}})
+	if err = ds.Conn.PutMappingFromJSON(ds.Index, assetType, b); err != nil {
+		return
+	}
+	if err = ds.putVersionMapping(assetType, nil); err != nil {
+		return
+	}
+	ds.typesMu.Lock()
+	ds.cachedAssetTypes = append(ds.cachedAssetTypes, assetType)
+	ds.typesMu.Unlock()
+	log.V(6).Infof("Created asset type: %s\n", assetType)
+	return
+}
+
+/*
+   Deletes the mapping of the type, which deletes its documents with it.
+   Mappings can only be deleted on elasticsearch 1.x.
+*/
+func (ds *InventoryDatastore) RemoveAssetType(assetType string) (err error) {
+	if ds.doesAssetTypeExist(assetType) != nil {
+		return &NotFoundError{assetType}
+	}
+
+	if _, err = ds.Conn.DoCommand("DELETE", "/"+ds.Index+"/_mapping/"+assetType, nil, nil); err != nil {
+		return
+	}
+	// there is no versions mapping if nothing was ever versioned
+	if _, err := ds.Conn.DoCommand("DELETE", "/"+ds.VersionIndex+"/_mapping/"+assetType, nil, nil); err != nil {
+		log.V(6).Infof("Not removing %s versions: %s\n", assetType, err)
+	}
+
+	ds.typesMu.Lock()
+	types := []string{}
+	for _, t := range ds.cachedAssetTypes {
+		if t != assetType {
+			types = append(types, t)
+		}
+	}
+	ds.cachedAssetTypes = types
+	ds.typesMu.Unlock()
+	log.V(6).Infof("Removed asset type: %s\n", assetType)
+	return
+}
+
+/* Search the given types, comma separated in a single request.  No types searches the whole index. */
+func (ds *InventoryDatastore) Search(assetTypes []string, query Query) (SearchResult, error) {
+	rslt, err := ds.Conn.Search(ds.Index, strings.Join(assetTypes, ","), nil, essSearchBody(query))
+	if err != nil {
+		return SearchResult{}, err
+	}
+	return essSearchResult(rslt, query.From, false)
+}
+
+/* Scrolls through the results so memory use does not grow with the number of assets */
+func (ds *InventoryDatastore) ForEachAsset(assetTypes []string, query Query, fn func(Asset) error) error {
+	query.From, query.Size = 0, ExportBatchSize
+	return ds.scrollAssets(ds.Index, strings.Join(assetTypes, ","), essSearchBody(query), fn)
+}
+
+/* Aggregations are run by elasticsearch.  No hits are returned. */
+func (ds *InventoryDatastore) Aggregate(assetTypes []string, filter *Filter, agg Aggregation) (AggregationResult, error) {
+	rslt, err := ds.Conn.Search(ds.Index, strings.Join(assetTypes, ","), nil, essAggregateBody(filter, agg))
+	if err != nil {
+		return AggregationResult{}, err
+	}
+
+	raw := map[string]json.RawMessage{}
+	if len(rslt.Aggregations) > 0 {
+		if err = json.Unmarshal(rslt.Aggregations, &raw); err != nil {
+			return AggregationResult{}, err
 		}
-		src["version"] = ba.Version + 1
 	}
+	return essAggregationResult(int64(rslt.Hits.Total), raw, agg, agg.By)
+}
+
+/* System documents are stored as a JSON string so their fields are not mapped */
+type essSystemDoc struct {
+	Doc string `json:"doc"`
+}
+
+func (ds *InventoryDatastore) GetSystemDoc(kind, name string, doc interface{}) error {
+	resp, err := ds.Conn.Get(ds.SystemIndex, kind, name, nil)
+	if err == elastigo.RecordNotFound || (err == nil && (!resp.Found || resp.Source == nil)) {
+		return &NotFoundError{kind + "/" + name}
+	} else if err != nil {
+		return err
+	}
+
+	var sdoc essSystemDoc
+	if err = json.Unmarshal(*resp.Source, &sdoc); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(sdoc.Doc), doc)
+}
+
+func (ds *InventoryDatastore) PutSystemDoc(kind, name string, doc interface{}) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	// refresh so listing sees it straight away
+	_, err = ds.Conn.Index(ds.SystemIndex, kind, name, map[string]interface{}{"refresh": true},
+		essSystemDoc{Doc: string(b)})
+	return err
+}
+
+func (ds *InventoryDatastore) RemoveSystemDoc(kind, name string) error {
+	resp, err := ds.Conn.Delete(ds.SystemIndex, kind, name, map[string]interface{}{"refresh": true})
+	if err == elastigo.RecordNotFound || (err == nil && !resp.Found) {
+		return &NotFoundError{kind + "/" + name}
+	}
+	return err
+}
+
+func (ds *InventoryDatastore) ListSystemDocs(kind string) ([]string, error) {
+	names := []string{}
+	query := map[string]interface{}{"_source": false, "size": 100}
+
+	rslt, err := ds.Conn.Search(ds.SystemIndex, kind, map[string]interface{}{"scroll": "1m"}, query)
+	for err == nil && len(rslt.Hits.Hits) > 0 {
+		for _, h := range rslt.Hits.Hits {
+			names = append(names, h.Id)
+		}
+		rslt, err = ds.Conn.Scroll(map[string]interface{}{"scroll": "1m"}, rslt.ScrollId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
 
-	vresp, err := ds.Conn.Index(ds.VersionIndex, asset.Type,
-		fmt.Sprintf("%s.%d", asset.Id, src["version"]), nil, src)
+/*
+   Sequences are documents in the system index.  Each write increments the
+   document version, which elasticsearch does atomically, and is the value.
+   Names e.g. virtualserver/web-{seq} are hashed to give a document id that
+   is safe in a URL.
+*/
+func (ds *InventoryDatastore) NextSequence(name string) (int64, error) {
+	resp, err := ds.Conn.Index(ds.SystemIndex, "sequence", essSequenceId(name), nil, map[string]interface{}{"name": name})
+	if err != nil {
+		return 0, err
+	}
+	return int64(resp.Version), nil
+}
+
+func essSequenceId(name string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(name)))
+}
+
+/* Id of a version document.  Only used to address the document, lookups use its fields. */
+func versionDocId(assetId string, version int64) string {
+	return fmt.Sprintf("%s.%d", assetId, version)
+}
+
+/*
+   Copy the asset into the versions index as the next version.  The version
+   document is created with op_type=create so concurrent writers can never
+   record the same version number.  The index is refreshed so the next
+   writer sees the new version.
+*/
+func (ds *InventoryDatastore) CreateAssetVersion(asset Asset) (string, error) {
+	now := time.Now().UTC()
+	doc := essVersionDoc{AssetId: asset.Id, Version: 1, Timestamp: &now, Data: asset.Data,
+		Deleted: asset.Deleted, DeletedBy: asset.DeletedBy}
+	if asset.Deleted && asset.DeletedAt != nil {
+		doc.DeletedAt, doc.Timestamp = asset.DeletedAt, asset.DeletedAt
+	}
+
+	versionedAssets, err := ds.GetAssetVersions(asset.Type, asset.Id, 1, 0)
 	if err != nil {
 		return "", err
 	}
+	if len(versionedAssets.Assets) > 0 {
+		doc.Version = versionedAssets.Assets[0].Version + 1
+	}
 
-	log.V(12).Infof("Version created: %s/%s.%d", asset.Type, asset.Id, src["version"])
+	vresp, err := ds.Conn.Index(ds.VersionIndex, asset.Type, versionDocId(asset.Id, doc.Version),
+		map[string]interface{}{"op_type": "create", "refresh": "true"}, doc)
+	if err != nil {
+		return "", err
+	}
+
+	log.V(12).Infof("Version created: %s/%s.%d", asset.Type, asset.Id, doc.Version)
 	return vresp.Id, nil
 }
 
 /* Get a single version */
-func (ds *InventoryDatastore) GetAssetVersion(assetType, assetId string, version int64) (asset elastigo.BaseResponse, err error) {
+func (ds *InventoryDatastore) GetAssetVersion(assetType, assetId string, version int64) (asset Asset, err error) {
+	resp, err := ds.Conn.Get(ds.VersionIndex, assetType, versionDocId(assetId, version), nil)
+	if err == nil && resp.Found {
+		if asset, err = essVersionAsset(resp.Type, resp.Source); err == nil &&
+			asset.Id == assetId && asset.Version == version {
+			return
+		}
+	}
+	err = fmt.Errorf("Not found (%s/%s version %d): %v", assetType, assetId, version, err)
+	return
+}
 
-	if asset, err = ds.Conn.Get(ds.VersionIndex, assetType,
-		fmt.Sprintf("%s.%d", assetId, version), nil); err == nil && asset.Found {
+/* Get `count` versions, newest first, skipping the newest `offset` */
+func (ds *InventoryDatastore) GetAssetVersions(assetType, assetId string, count, offset int64) (SearchResult, error) {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"filtered": map[string]interface{}{
+				"filter": map[string]interface{}{"term": map[string]interface{}{"asset_id": assetId}},
+			},
+		},
+		"sort": map[string]interface{}{
+			"version": map[string]interface{}{"order": "desc", "ignore_unmapped": true},
+		},
+		"from": offset,
+		"size": count,
+	}
+	rslt, err := ds.Conn.Search(ds.VersionIndex, assetType, nil, query)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	return essSearchResult(rslt, int(offset), true)
+}
+
+/*
+   Rewrite version documents created before versions stored the asset id and
+   version as separate fields.  Old documents hold the asset data at the top
+   level and are addressed by <asset_id>.<version>.  Returns the number of
+   documents rewritten.
+*/
+func (ds *InventoryDatastore) MigrateVersions() (migrated int, err error) {
+	var b []byte
+	if b, err = ds.Conn.DoCommand("GET", "/"+ds.VersionIndex+"/_mapping", nil, nil); err != nil {
+		return
+	}
+	m := map[string]map[string]map[string]interface{}{}
+	if err = json.Unmarshal(b, &m); err != nil {
 		return
 	}
-	err = fmt.Errorf("Not found (%s/%s.%d): %s", assetType, assetId, version, err)
+	for mapname, mapping := range m[ds.VersionIndex]["mappings"] {
+		if err = ds.putVersionMapping(mapname, mapping); err != nil {
+			return
+		}
+	}
+
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"filtered": map[string]interface{}{
+				"filter": map[string]interface{}{"missing": map[string]interface{}{"field": "asset_id"}},
+			},
+		},
+		"size": 100,
+	}
+	rslt, err := ds.Conn.Search(ds.VersionIndex, "", map[string]interface{}{"scroll": "5m"}, query)
+	for err == nil && len(rslt.Hits.Hits) > 0 {
+		for _, h := range rslt.Hits.Hits {
+			if err = ds.migrateVersionDoc(h.Type, h.Id, h.Source); err != nil {
+				return
+			}
+			migrated++
+		}
+		rslt, err = ds.Conn.Scroll(map[string]interface{}{"scroll": "5m"}, rslt.ScrollId)
+	}
 	return
 }
 
-/* Get the last `count` versions */
-func (ds *InventoryDatastore) GetAssetVersions(assetType, assetId string, count int64) (elastigo.SearchResult, error) {
-	query := fmt.Sprintf(
-		`{"query":{"prefix":{"_id": "%s"}},"sort":{"version":"desc"},"from":0,"size": %d}`,
-		assetId, count)
-	return ds.Conn.Search(ds.VersionIndex, assetType, nil, query)
+func (ds *InventoryDatastore) migrateVersionDoc(assetType, docId string, src *json.RawMessage) (err error) {
+	var data map[string]interface{}
+	if err = json.Unmarshal(*src, &data); err != nil {
+		return
+	}
+
+	doc := essVersionDoc{Data: data}
+	if doc.Version, err = parseVersion(data["version"]); err != nil {
+		return fmt.Errorf("%s/%s: %s", assetType, docId, err)
+	}
+	delete(data, "version")
+
+	// The version is always the suffix so the asset id is everything before it
+	suffix := fmt.Sprintf(".%d", doc.Version)
+	if !strings.HasSuffix(docId, suffix) {
+		return fmt.Errorf("%s/%s: id does not end with version %d", assetType, docId, doc.Version)
+	}
+	doc.AssetId = strings.TrimSuffix(docId, suffix)
+
+	if _, err = ds.Conn.Index(ds.VersionIndex, assetType, docId, nil, doc); err == nil {
+		log.V(6).Infof("Migrated version: %s/%s => %s version %d\n", assetType, docId, doc.AssetId, doc.Version)
+	}
+	return
 }
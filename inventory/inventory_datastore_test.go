@@ -1,21 +1,25 @@
 package inventory
 
 import (
-	"encoding/json"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 )
 
 var (
 	testAssetType = "test_asset_type"
-	testData      = map[string]string{
-		"name": "test",
+	testAssetId   = "test"
+	testAssetId2  = "test2"
+	testData      = map[string]interface{}{
+		"name": testAssetId,
 		"host": "test.foo.bar",
 	}
-	testData2 = map[string]string{
-		"name": "test2",
+	testData2 = map[string]interface{}{
+		"name": testAssetId2,
 		"host": "test.foo.bar",
 	}
-	testUpdateData = map[string]string{
+	testUpdateData = map[string]interface{}{
 		"host": "test.foo.bar.updated",
 	}
 	testEds, _ = NewElasticsearchDatastore(testEssHost, testEssPort, testIndex, testMappingFile)
@@ -24,7 +28,7 @@ var (
 
 func Test_InventoryDatastore_CreateAsset(t *testing.T) {
 
-	id, err := testIds.CreateAsset(testAssetType, testData["name"], testData, true)
+	id, err := testIds.CreateAsset(testAssetType, testAssetId, testData, true)
 	if err != nil {
 		t.Fatalf("%s", err)
 	}
@@ -33,7 +37,7 @@ func Test_InventoryDatastore_CreateAsset(t *testing.T) {
 
 func Test_InventoryDatastore_GetAsset(t *testing.T) {
 
-	asset, err := testIds.GetAsset(testAssetType, testData["name"])
+	asset, err := testIds.GetAsset(testAssetType, testAssetId)
 	if err != nil {
 		t.Fatalf("%s", err)
 	}
@@ -42,22 +46,159 @@ func Test_InventoryDatastore_GetAsset(t *testing.T) {
 
 func Test_InventoryDatastore_EditAsset(t *testing.T) {
 
-	id, err := testIds.EditAsset(testAssetType, testData["name"], testUpdateData)
+	id, err := testIds.EditAsset(testAssetType, testAssetId, testUpdateData)
 	if err != nil {
 		t.Fatalf("%s", err)
 	}
 	t.Logf("%s", id)
 
-	asset, _ := testIds.GetAsset(testAssetType, testData["name"])
+	asset, _ := testIds.GetAsset(testAssetType, testAssetId)
 
-	var d map[string]interface{}
-	json.Unmarshal(*asset.Source, &d)
-	if _, ok := d["name"]; !ok {
+	if _, ok := asset.Data["name"]; !ok {
 		t.Fatalf("Overwrote exising object")
 	}
 	//testIds.Close()
 }
 
+/* Hammer one asset with parallel edits.  Every edit must produce exactly one version. */
+func testConcurrentEdits(t *testing.T, ds IDatastore, assetType, assetId string) {
+	before, err := ds.GetAssetVersions(assetType, assetId, 1000, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		edits   = 20
+		errs    = make(chan error, edits)
+		version = map[int64]bool{}
+	)
+	for i := 0; i < edits; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := ds.EditAsset(assetType, assetId, map[string]interface{}{"counter": i}); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	failed := 0
+	for err := range errs {
+		t.Logf("Edit failed: %s", err)
+		failed++
+	}
+
+	after, err := ds.GetAssetVersions(assetType, assetId, 1000, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if added := len(after.Assets) - len(before.Assets); added != edits-failed {
+		t.Fatalf("Lost history: %d edits succeeded, %d versions created", edits-failed, added)
+	}
+	for _, v := range after.Assets {
+		if version[v.Version] {
+			t.Fatalf("Duplicate version: %d", v.Version)
+		}
+		version[v.Version] = true
+	}
+	for i := 1; i <= len(after.Assets); i++ {
+		if !version[int64(i)] {
+			t.Fatalf("Missing version: %d", i)
+		}
+	}
+}
+
+func Test_InventoryDatastore_ConcurrentEdits(t *testing.T) {
+	testConcurrentEdits(t, testIds, testAssetType, testAssetId)
+}
+
+/* Versions of an asset must not include those of assets sharing its id as a prefix */
+func testVersionIsolation(t *testing.T, ds IDatastore, assetType string) {
+	ids := []string{"web1", "web10", "web1.example.com"}
+	for _, id := range ids {
+		if _, err := ds.CreateAsset(assetType, id, map[string]interface{}{"name": id}, true); err != nil {
+			t.Fatalf("%s", err)
+		}
+		if _, err := ds.EditAsset(assetType, id, map[string]interface{}{"status": "edited"}); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	for _, id := range ids {
+		rslt, err := ds.GetAssetVersions(assetType, id, 10, 0)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if len(rslt.Assets) != 1 || rslt.Assets[0].Id != id || rslt.Assets[0].Version != 1 {
+			t.Fatalf("Wrong versions for %s: %#v", id, rslt.Assets)
+		}
+
+		asset, err := ds.GetAssetVersion(assetType, id, 1)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if asset.Data["name"] != id {
+			t.Fatalf("Wrong version for %s: %#v", id, asset)
+		}
+	}
+}
+
+func Test_InventoryDatastore_VersionIsolation(t *testing.T) {
+	testVersionIsolation(t, testIds, testAssetType)
+}
+
+/* Create, edit, delete and re-create an asset checking its state in between */
+func testAsOf(t *testing.T, ds IDatastore, assetType string) {
+	stamp := func(status string) map[string]interface{} {
+		return map[string]interface{}{"status": status, "updated_at": time.Now().UTC().Format(time.RFC3339Nano)}
+	}
+	tick := func() time.Time {
+		time.Sleep(5 * time.Millisecond)
+		defer time.Sleep(5 * time.Millisecond)
+		return time.Now()
+	}
+
+	t0 := tick()
+	ds.CreateAsset(assetType, "asof", stamp("building"), true)
+	t1 := tick()
+	ds.EditAsset(assetType, "asof", stamp("running"))
+	t2 := tick()
+	ds.RemoveAsset(assetType, "asof", "tester")
+	t3 := tick()
+	ds.ReplaceAsset(assetType, "asof", stamp("rebuilt"))
+	t4 := tick()
+
+	expected := []struct {
+		at     time.Time
+		status string
+	}{{t0, ""}, {t1, "building"}, {t2, "running"}, {t3, ""}, {t4, "rebuilt"}}
+
+	for i, e := range expected {
+		asset, err := ds.GetAssetAsOf(assetType, "asof", e.at)
+		if len(e.status) < 1 {
+			if err == nil {
+				t.Fatalf("t%d: should not exist: %#v", i, asset)
+			}
+			continue
+		}
+		if err != nil || asset.Data["status"] != e.status || asset.Deleted {
+			t.Fatalf("t%d: %v %#v", i, err, asset)
+		}
+
+		rslt, err := ds.SearchAsOf([]string{assetType}, e.at, Query{Filter: Terms("status", e.status)})
+		if err != nil || rslt.Total != 1 || rslt.Assets[0].Id != "asof" {
+			t.Fatalf("t%d: search %v %#v", i, err, rslt)
+		}
+	}
+}
+
+func Test_InventoryDatastore_AsOf(t *testing.T) {
+	testAsOf(t, testIds, testAssetType)
+}
+
 func Test_InventoryDatastore_ListAssetTypes(t *testing.T) {
 	types, err := testIds.ListAssetTypes()
 	if err != nil {
@@ -69,10 +210,10 @@ func Test_InventoryDatastore_ListAssetTypes(t *testing.T) {
 
 func Test_InventoryDatastore_RemoveAsset(t *testing.T) {
 
-	if !testIds.RemoveAsset(testAssetType, testData["name"]) {
+	if !testIds.RemoveAsset(testAssetType, testAssetId, "tester") {
 		t.Fatalf("Failed to remove asset")
 	}
-	_, err := testIds.GetAsset(testAssetType, testData["name"])
+	_, err := testIds.GetAsset(testAssetType, testAssetId)
 	if err == nil {
 		t.Fatalf("Did not remove asset")
 	}
@@ -80,3 +221,246 @@ func Test_InventoryDatastore_RemoveAsset(t *testing.T) {
 	testIds.Conn.DeleteIndex(testIds.VersionIndex)
 	testIds.Close()
 }
+
+func testSystemDocs(t *testing.T, ds IDatastore) {
+	if err := ds.PutSystemDoc("views", "b", View{Name: "b", Query: "status:running"}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := ds.PutSystemDoc("views", "a", View{Name: "a"}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	ds.PutSystemDoc("other", "c", View{Name: "c"})
+
+	var view View
+	if err := ds.GetSystemDoc("views", "b", &view); err != nil || view.Query != "status:running" {
+		t.Fatalf("Get: %v %#v", err, view)
+	}
+	if names, err := ds.ListSystemDocs("views"); err != nil || len(names) != 2 || names[0] != "a" {
+		t.Fatalf("List: %v %v", err, names)
+	}
+
+	if err := ds.RemoveSystemDoc("views", "b"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := ds.GetSystemDoc("views", "b", &view); err == nil {
+		t.Fatalf("Not removed")
+	}
+	if err := ds.RemoveSystemDoc("views", "b"); err == nil {
+		t.Fatalf("Removing a missing document should fail")
+	}
+}
+
+func Test_InventoryDatastore_SystemDocs(t *testing.T) {
+	testSystemDocs(t, testIds)
+}
+
+func Test_InventoryDatastore_Sequences(t *testing.T) {
+	testSequences(t, testIds)
+}
+
+func Test_InventoryDatastore_UniqueFields(t *testing.T) {
+	testUniqueFields(t, testIds)
+}
+
+/* Sequences "a" and "virtualserver/web-prod-{seq}" must not have been used */
+func testSequences(t *testing.T, ds IDatastore) {
+	// names are as generated for id templates
+	b := "virtualserver/web-prod-{seq}"
+	for i, name := range []string{"a", "a", b, "a"} {
+		seq, err := ds.NextSequence(name)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if expected := map[int]int64{0: 1, 1: 2, 2: 1, 3: 3}[i]; seq != expected {
+			t.Fatalf("Sequence %s: %d expected %d", name, seq, expected)
+		}
+	}
+
+	// concurrent callers never get the same value
+	var (
+		seen = make(chan int64, 40)
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			seq, err := ds.NextSequence(b)
+			if err != nil {
+				t.Errorf("%s", err)
+			}
+			seen <- seq
+		}()
+	}
+	wg.Wait()
+	close(seen)
+
+	unique := map[int64]bool{}
+	for seq := range seen {
+		unique[seq] = true
+	}
+	if len(unique) != 40 || !unique[2] || !unique[41] {
+		t.Fatalf("Sequence values not unique: %v", unique)
+	}
+}
+
+/* Type "uniq" must not have been used */
+func testUniqueFields(t *testing.T, ds IDatastore) {
+	if err := ds.PutSystemDoc(systemDocTypes, "uniq", AssetType{Name: "uniq", UniqueFields: []string{"ip", "net.mac"}}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer ds.RemoveSystemDoc(systemDocTypes, "uniq")
+
+	if _, err := ds.CreateAsset("uniq", "a", map[string]interface{}{"ip": "10.0.0.1", "net": map[string]interface{}{"mac": "aa"}}, true); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := ds.CreateAsset("uniq", "b", map[string]interface{}{"ip": []interface{}{"10.0.0.2", "10.0.0.3"}}, true); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	expectConflict := func(err error, id, field string, value interface{}) {
+		c, ok := err.(*ConflictError)
+		if !ok || c.Type != "uniq" || c.Id != id || c.Field != field || c.Value != value {
+			t.Fatalf("Expected conflict with %s on %s %v got %v", id, field, value, err)
+		}
+	}
+
+	_, err := ds.CreateAsset("uniq", "c", map[string]interface{}{"ip": "10.0.0.3"}, true)
+	expectConflict(err, "b", "ip", "10.0.0.3")
+	if _, err = ds.GetAsset("uniq", "c"); err == nil {
+		t.Fatalf("Conflicting asset created")
+	}
+	_, err = ds.EditAsset("uniq", "b", map[string]interface{}{"net": map[string]interface{}{"mac": "aa"}})
+	expectConflict(err, "a", "net.mac", "aa")
+	if versions, _ := ds.GetAssetVersions("uniq", "b", 10, 0); len(versions.Assets) != 0 {
+		t.Fatalf("Version recorded for conflicting edit")
+	}
+	_, err = ds.ReplaceAsset("uniq", "a", map[string]interface{}{"ip": "10.0.0.2"})
+	expectConflict(err, "b", "ip", "10.0.0.2")
+
+	// an asset may keep its own values and other fields are not unique
+	if _, err = ds.EditAsset("uniq", "a", map[string]interface{}{"ip": "10.0.0.1", "os": "x"}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err = ds.CreateAsset("uniq", "c", map[string]interface{}{"os": "x", "ip": "10.0.0.4"}, true); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// values are free once changed or removed
+	if _, err = ds.EditAsset("uniq", "a", map[string]interface{}{"ip": "10.0.0.5"}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err = ds.CreateAsset("uniq", "d", map[string]interface{}{"ip": "10.0.0.1"}, true); err != nil {
+		t.Fatalf("%s", err)
+	}
+	ds.RemoveAsset("uniq", "b", "tester")
+	if _, err = ds.CreateAsset("uniq", "e", map[string]interface{}{"ip": "10.0.0.3"}, true); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// other types are not checked
+	if _, err = ds.CreateAsset("uniq2", "a", map[string]interface{}{"ip": "10.0.0.3"}, true); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// fields made unique later cover assets written before
+	if _, err = ds.CreateAsset("uniq", "f", map[string]interface{}{"serial": "s1"}, true); err != nil {
+		t.Fatalf("%s", err)
+	}
+	ds.PutSystemDoc(systemDocTypes, "uniq", AssetType{Name: "uniq", UniqueFields: []string{"serial"}})
+	_, err = ds.CreateAsset("uniq", "g", map[string]interface{}{"serial": "s1"}, true)
+	expectConflict(err, "f", "serial", "s1")
+	if _, err = ds.CreateAsset("uniq", "g", map[string]interface{}{"ip": "10.0.0.1"}, true); err != nil {
+		t.Fatalf("Field no longer unique: %s", err)
+	}
+}
+
+/* Type "batch" must not have been used */
+func testForEachAsset(t *testing.T, ds IDatastore) {
+	// more than a couple of batches of the kv datastores
+	for i := 0; i <= 2*kvBatchSize; i++ {
+		if _, err := ds.CreateAsset("batch", fmt.Sprintf("a%04d", i), map[string]interface{}{"even": i%2 == 0}, true); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	seen := map[string]bool{}
+	err := ds.ForEachAsset([]string{"batch"}, Query{Filter: Terms("even", true)}, func(a Asset) error {
+		if seen[a.Id] {
+			return fmt.Errorf("Seen twice: %s", a.Id)
+		}
+		seen[a.Id] = true
+		_, err := ds.EditAsset("batch", a.Id, map[string]interface{}{"seen": true})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(seen) != kvBatchSize+1 || !seen["a0000"] || !seen[fmt.Sprintf("a%04d", 2*kvBatchSize)] {
+		t.Fatalf("Wrong assets: %d", len(seen))
+	}
+}
+
+func testBatch(t *testing.T, ds IBatchDatastore) {
+	err := ds.Batch(func(tx IDatastore) error {
+		if _, err := tx.CreateAsset("batched", "b1", map[string]interface{}{"n": 1}, true); err != nil {
+			return err
+		}
+		if _, err := tx.GetAsset("batched", "b1"); err != nil {
+			return fmt.Errorf("Write not seen within the batch: %s", err)
+		}
+		return fmt.Errorf("rollback")
+	})
+	if err == nil || err.Error() != "rollback" {
+		t.Fatalf("Wrong error: %v", err)
+	}
+	if _, err = ds.(IDatastore).GetAsset("batched", "b1"); err == nil {
+		t.Fatalf("Write kept from a failed batch")
+	}
+
+	err = ds.Batch(func(tx IDatastore) error {
+		_, err := tx.CreateAsset("batched", "b1", map[string]interface{}{"n": 1}, true)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err = ds.(IDatastore).GetAsset("batched", "b1"); err != nil {
+		t.Fatalf("Write not kept: %s", err)
+	}
+}
+
+func testSlashIds(t *testing.T, ds IDatastore) {
+	for _, id := range []string{"a", "a/00000000000000000001", "a/x"} {
+		if _, err := ds.CreateAsset("slashed", id, map[string]interface{}{"n": 1}, true); err != nil {
+			t.Fatalf("%s", err)
+		}
+		for n := 2; n <= 3; n++ {
+			if _, err := ds.EditAsset("slashed", id, map[string]interface{}{"n": n}); err != nil {
+				t.Fatalf("%s", err)
+			}
+		}
+	}
+
+	rslt, err := ds.GetAssetVersions("slashed", "a", 10, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(rslt.Assets) != 2 {
+		t.Fatalf("Wrong versions of a: %d", len(rslt.Assets))
+	}
+	for _, a := range rslt.Assets {
+		if a.Id != "a" {
+			t.Fatalf("Version of another asset: %s", a.Id)
+		}
+	}
+
+	counts := map[string]int{}
+	err = ds.ForEachAssetVersions("slashed", func(assetId string, versions []Asset) error {
+		counts[assetId] += len(versions)
+		return nil
+	})
+	if err != nil || len(counts) != 3 || counts["a"] != 2 || counts["a/x"] != 2 {
+		t.Fatalf("Wrong versions: %v %v", counts, err)
+	}
+}
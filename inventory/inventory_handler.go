@@ -5,11 +5,11 @@ import (
 	"fmt"
 	"github.com/euforia/ldapclients-go"
 	log "github.com/golang/glog"
-	elastigo "github.com/mattbaird/elastigo/lib"
 	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type AssetResponse struct {
@@ -19,19 +19,28 @@ type AssetResponse struct {
 	Data interface{} `json:"data"`
 }
 
+/* Checks the credentials of users e.g. against active directory */
+type Authenticator interface {
+	Authenticate(username, password string) error
+}
+
 type Inventory struct {
 	datastore IDatastore
 	cfg       *InventoryConfig
+	pruner    *VersionPruner
 
-	authClient *ldapclients.ActiveDirectoryClient
+	authClient Authenticator
 	// Currently handles adding new asset types
 	localAuthGroups LocalAuthGroups
+
+	typeCache assetTypeCache
 }
 
 func NewInventory(cfg *InventoryConfig, datastore IDatastore) (ir *Inventory, err error) {
 	ir = &Inventory{
 		datastore: datastore,
 		cfg:       cfg,
+		pruner:    NewVersionPruner(datastore, &cfg.Versions),
 	}
 
 	if ir.localAuthGroups, err = LoadLocalAuthGroups(cfg.Auth.GroupsFile); err != nil {
@@ -42,14 +51,18 @@ func NewInventory(cfg *InventoryConfig, datastore IDatastore) (ir *Inventory, er
 		log.V(6).Infof("Auth setup: '%s'\n", cfg.Auth.Type)
 		switch cfg.Auth.Type {
 		case "activedirectory":
-			ir.authClient, err = ldapclients.NewActiveDirectoryClient(cfg.Auth.Config.Url, cfg.Auth.Config.BindDN,
-				cfg.Auth.Config.BindPassword, cfg.Auth.Config.SearchBase)
+			var adClient *ldapclients.ActiveDirectoryClient
+			if adClient, err = ldapclients.NewActiveDirectoryClient(cfg.Auth.Config.Url, cfg.Auth.Config.BindDN,
+				cfg.Auth.Config.BindPassword, cfg.Auth.Config.SearchBase); err != nil {
+				break
+			}
+			ir.authClient = adClient
 
 			log.V(7).Infof("Auth URL: %s\n", cfg.Auth.Config.Url)
 			log.V(7).Infof("Auth Bind DN: %s\n", cfg.Auth.Config.BindDN)
 			log.V(7).Infof("Auth SearchBase: %s\n", cfg.Auth.Config.SearchBase)
 
-			ir.authClient.EnableCaching(cfg.Auth.Caching.TTL)
+			adClient.EnableCaching(cfg.Auth.Caching.TTL)
 			log.V(7).Infof("Auth caching enabled - TTL: %d (0 = default value)\n", cfg.Auth.Caching.TTL)
 			break
 		default:
@@ -60,6 +73,22 @@ func NewInventory(cfg *InventoryConfig, datastore IDatastore) (ir *Inventory, er
 	return
 }
 
+/*
+   Run fn with an Inventory whose reads and writes are atomic where the
+   datastore supports it, see IBatchDatastore.  Elsewhere fn runs against
+   the datastore directly so writes made before an error are kept.
+*/
+func (ir *Inventory) batch(fn func(*Inventory) error) error {
+	bds, ok := ir.datastore.(IBatchDatastore)
+	if !ok {
+		return fn(ir)
+	}
+	return bds.Batch(func(ds IDatastore) error {
+		// type definitions are read within the batch rather than from the cache
+		return fn(&Inventory{datastore: ds, cfg: ir.cfg})
+	})
+}
+
 /* Normalize asset type input from user */
 func (ir *Inventory) normalizeAssetType(assetType string) string {
 	return strings.ToLower(assetType)
@@ -82,53 +111,146 @@ func (ir *Inventory) authenticateRequest(r *http.Request) (username, password st
 }
 
 /*
-	Returns:
-		should also return the params as elastic search globale args/opts
+   Whether the user is in the admin group.  Users can only be identified
+   with auth enabled, so there are no admins without it.
 */
-func (ir *Inventory) parseRequestQueryParams(r *http.Request) (err error) {
+func (ir *Inventory) isAdmin(username string) bool {
+	return ir.authClient != nil && len(username) > 0 &&
+		ir.localAuthGroups.UserHasGroupMembership(username, "admin")
+}
+
+/* Authenticate the request and check the user is an admin */
+func (ir *Inventory) authorizeAdmin(r *http.Request) (username string, code int, err error) {
+	if username, _, err = ir.authenticateRequest(r); err != nil {
+		return username, 401, err
+	}
+	if ir.authClient == nil {
+		return username, 403, fmt.Errorf("Forbidden: admin requests require auth to be enabled")
+	}
+	if !ir.isAdmin(username) {
+		return username, 403, fmt.Errorf("Forbidden: %s is not an admin", username)
+	}
+	return username, 200, nil
+}
+
+/* Prune versions in the background if an interval is configured */
+func (ir *Inventory) StartVersionPruner() {
+	if ir.cfg.Versions.PruneInterval > 0 {
+		interval := time.Duration(ir.cfg.Versions.PruneInterval) * time.Second
+		log.Infof("Pruning versions every %s\n", interval)
+		go ir.pruner.Run(interval)
+	}
+}
+
+/* Sort order from <field>:<asc|dsc> values */
+func parseSortParams(vals []string) (sort []SortField, err error) {
+	sort = make([]SortField, len(vals))
+	for i, v := range vals {
+		sarr := strings.Split(v, ":")
+		if len(sarr) != 2 {
+			err = fmt.Errorf("Invalid request: sortby=%s", v)
+			return
+		}
+
+		switch sarr[1] {
+		case "asc":
+			sort[i] = SortField{Field: sarr[0]}
+			break
+		case "dsc":
+			sort[i] = SortField{Field: sarr[0], Desc: true}
+			break
+		default:
+			err = fmt.Errorf("Invalid sort argument: %s", sarr[1])
+			return
+		}
+	}
+	return
+}
+
+/*
+	Returns a query with:
+		the sort order requested via sortby=<field>:<asc|dsc>
+		the page requested via from=<offset>&size=<count>
+		the fields requested via fields=<field>,<field>
+*/
+func (ir *Inventory) parseRequestQueryParams(r *http.Request) (q Query, err error) {
 
 	paramsQuery := r.URL.Query()
 	log.V(12).Infof("%#v\n", paramsQuery)
 
 	// Parse global query opts.
 	if vals, ok := paramsQuery["sortby"]; ok {
+		if q.Sort, err = parseSortParams(vals); err != nil {
+			return
+		}
+		b, _ := json.Marshal(q.Sort)
+		log.V(12).Infof("Query (sorting): %s\n", b)
+	}
 
-		sorting := make([]*elastigo.SortDsl, len(vals))
+	var from, size int64
+	if from, err = parseIntParam(r, "from", 0); err != nil {
+		return
+	}
+	if size, err = parseIntParam(r, "size", DefaultSearchSize); err != nil {
+		return
+	}
+	if size > MaxSearchSize {
+		err = fmt.Errorf("Invalid request: size=%d exceeds %d", size, MaxSearchSize)
+		return
+	}
+	q.From, q.Size = int(from), int(size)
 
-		for i, v := range vals {
-			sarr := strings.Split(v, ":")
-			if len(sarr) != 2 {
-				err = fmt.Errorf("Invalid request: sortby=%s", v)
+	if fields := paramsQuery.Get("fields"); len(fields) > 0 {
+		q.Fields = strings.Split(fields, ",")
+	}
+	return
+}
+
+/*
+   Parse aggregation params e.g.
+
+	by=environment,status&histogram=cpus:2,mem:1024&stats=cpus,mem
+
+   histogram fields are given as <field>:<interval>.
+*/
+func (ir *Inventory) parseAggregation(r *http.Request) (agg Aggregation, err error) {
+	params := r.URL.Query()
+	if by := params.Get("by"); len(by) > 0 {
+		agg.By = strings.Split(by, ",")
+	}
+	if stats := params.Get("stats"); len(stats) > 0 {
+		agg.Stats = strings.Split(stats, ",")
+	}
+	if hist := params.Get("histogram"); len(hist) > 0 {
+		agg.Histograms = map[string]float64{}
+		for _, h := range strings.Split(hist, ",") {
+			i := strings.LastIndex(h, ":")
+			if i < 1 {
+				err = fmt.Errorf("Invalid request: histogram=%s expected <field>:<interval>", h)
 				return
 			}
-			var sDsl *elastigo.SortDsl
-
-			switch sarr[1] {
-			case "asc":
-				sDsl = elastigo.Sort(sarr[0]).Asc()
-				break
-			case "dsc":
-				sDsl = elastigo.Sort(sarr[0]).Desc()
-				break
-			default:
-				err = fmt.Errorf("Invalid sort argument: %s", sarr[1])
+			var interval float64
+			if interval, err = strconv.ParseFloat(h[i+1:], 64); err != nil {
+				err = fmt.Errorf("Invalid request: histogram=%s expected <field>:<interval>", h)
 				return
 			}
-			sorting[i] = sDsl
+			agg.Histograms[h[:i]] = interval
 		}
-		b, _ := json.Marshal(sorting)
-		log.V(12).Infof("Query (sorting): %s\n", b)
 	}
+	err = agg.Validate()
 	return
 }
 
 /*
 {
 	"type": ["virtualserver", "physicalserver"],
-	"os": "ubuntu"
+	"os": "ubuntu",
+	"cpus": ">=4",
+	"hw": {"vendor": "!dell*"}
 }
+	See parseFilterValue for the filter grammar.
 */
-func (ir *Inventory) parseRequestBody(r *http.Request) (query interface{}, err error) {
+func (ir *Inventory) parseRequestBody(r *http.Request) (filter *Filter, err error) {
 
 	// check happens earlier
 	var body []byte
@@ -137,87 +259,79 @@ func (ir *Inventory) parseRequestBody(r *http.Request) (query interface{}, err e
 	}
 	defer r.Body.Close()
 
+	// No body matches everything
+	if len(strings.TrimSpace(string(body))) < 1 {
+		return
+	}
+
 	var req map[string]interface{}
 	if err = json.Unmarshal(body, &req); err != nil {
 		return
 	}
 
-	filterOps := []interface{}{}
-
-	for k, v := range req {
-		switch v.(type) {
-		case string:
-			val, _ := v.(string)
-			val = strings.TrimSpace(val)
-			if strings.HasPrefix(val, ">") || strings.HasPrefix(val, "<") {
-				// Parse number
-				aVal := ""
-				if strings.HasPrefix(val, ">=") || strings.HasPrefix(val, "<=") {
-					aVal = strings.TrimSpace(val[2:])
-				} else {
-					aVal = strings.TrimSpace(val[1:])
-				}
-				// Parse number for comparison
-				var nVal interface{}
-				nVal, ierr := strconv.ParseInt(aVal, 10, 64)
-				if ierr != nil {
-					ierr = nil
-					if nVal, ierr = strconv.ParseFloat(aVal, 64); ierr != nil {
-						err = ierr
-						return
-					}
-				}
-				// Add range filterop
-				if strings.HasPrefix(val, ">") {
-					filterOps = append(filterOps, elastigo.Range().Field(k).Gt(nVal))
-				} else {
-					filterOps = append(filterOps, elastigo.Range().Field(k).Lt(nVal))
-				}
-
-			} else {
-				filterOps = append(filterOps, elastigo.Filter().Terms(k, val))
-			}
-			break
-		case int:
-			//val, _ := v.(int)
-			break
-		case int64:
-			//val, _ := v.(int64)
-			break
-		case float64:
-			//val, _ := v.(float64)
-			break
-		case []interface{}:
-			vals, _ := v.([]interface{})
-			filterOps = append(filterOps, elastigo.Filter().Terms(k, vals...))
-			break
-		case interface{}:
-			//val, _ := v.(interface{})
-			break
-		default:
-			err = fmt.Errorf("invalid type: %#v", v)
+	return ParseFilterDocument(req)
+}
+
+/* Filter from the request body and the q parameter.  Both must match if given. */
+func (ir *Inventory) parseSearchFilter(r *http.Request) (filter *Filter, err error) {
+	if filter, err = ir.parseRequestBody(r); err != nil {
+		return
+	}
+	if qstr := r.URL.Query().Get("q"); len(qstr) > 0 {
+		var qf *Filter
+		if qf, err = ParseQueryString(qstr); err != nil {
 			return
 		}
+		filter = andFilters(filter, qf)
 	}
-
-	query = elastigo.Search(ir.cfg.Datastore.Config.Index).Filter(filterOps...)
-
 	return
 }
 
-func (ir *Inventory) executeSearchQuery(assetType string, r *http.Request) (rslt elastigo.SearchResult, err error) {
-	var q interface{}
+/* Query from the request params, body and q */
+func (ir *Inventory) parseSearchQuery(r *http.Request) (q Query, err error) {
+	if q, err = ir.parseRequestQueryParams(r); err != nil {
+		return
+	}
+	q.Filter, err = ir.parseSearchFilter(r)
+	return
+}
 
-	// IN PROGRESS
-	ir.parseRequestQueryParams(r)
+/* Asset types from types=<type>,<type>.  May also be repeated. */
+func (ir *Inventory) parseTypesParam(r *http.Request) []string {
+	assetTypes := []string{}
+	for _, param := range r.URL.Query()["types"] {
+		for _, t := range strings.Split(param, ",") {
+			if t = strings.TrimSpace(t); len(t) > 0 {
+				assetTypes = append(assetTypes, ir.normalizeAssetType(t))
+			}
+		}
+	}
+	return assetTypes
+}
 
-	if q, err = ir.parseRequestBody(r); err != nil {
+func (ir *Inventory) executeSearchQuery(assetTypes []string, r *http.Request) (rslt SearchResult, err error) {
+	var q Query
+	if q, err = ir.parseSearchQuery(r); err != nil {
 		return
 	}
+	return ir.runSearchQuery(assetTypes, q, r)
+}
 
+/* Run a parsed query.  as_of is taken from the request. */
+func (ir *Inventory) runSearchQuery(assetTypes []string, q Query, r *http.Request) (rslt SearchResult, err error) {
 	b, _ := json.MarshalIndent(q, " ", "  ")
 	log.V(15).Infof("%s ==> %s\n", r.RequestURI, b)
 
-	rslt, err = ir.datastore.Search(assetType, q)
+	if asOfStr := r.URL.Query().Get("as_of"); len(asOfStr) > 0 {
+		var asOf time.Time
+		if asOf, err = time.Parse(time.RFC3339, asOfStr); err != nil {
+			err = fmt.Errorf("Invalid as_of: %s", err)
+			return
+		}
+		rslt, err = ir.datastore.SearchAsOf(assetTypes, asOf, q)
+		return
+	}
+
+	rslt, err = ir.datastore.Search(assetTypes, q)
 	return
 }
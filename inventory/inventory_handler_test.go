@@ -0,0 +1,1343 @@
+package inventory
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* Accepts users with their password */
+type testAuthenticator map[string]string
+
+func (a testAuthenticator) Authenticate(username, password string) error {
+	if pass, ok := a[username]; !ok || pass != password {
+		return fmt.Errorf("Unauthorized!")
+	}
+	return nil
+}
+
+/* admin is in the admin group.  Requests are made as admin unless another user is given. */
+var testUsers = testAuthenticator{"admin": "secret", "user1": "secret"}
+
+/* Inventory on top of the memory datastore with the same routes as main */
+func newTestInventoryServer(t *testing.T) (*httptest.Server, *KVDatastore) {
+	return newTestInventoryServerWithAuth(t, testUsers)
+}
+
+/* Auth is disabled if auth is nil */
+func newTestInventoryServerWithAuth(t *testing.T, auth Authenticator) (*httptest.Server, *KVDatastore) {
+	gf, err := ioutil.TempFile("", "groups")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	gf.WriteString(`{"admin": ["admin"]}`)
+	gf.Close()
+	defer os.Remove(gf.Name())
+
+	cfg := &InventoryConfig{
+		Auth:      AuthConfig{GroupsFile: gf.Name()},
+		Datastore: DatastoreConfig{Type: "memory"},
+		Endpoints: EndpointsConfig{Prefix: "/v1"},
+		AssetCfg:  AssetConfig{RequiredFields: []string{"status", "environment"}},
+		Versions:  VersionsConfig{Types: map[string]RetentionPolicy{"pruned": {KeepLast: 2}}},
+	}
+
+	ds := NewMemoryDatastore()
+	inv, err := NewInventory(cfg, ds)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	inv.authClient = auth
+
+	rtr := mux.NewRouter()
+	rtr.HandleFunc("/v1/", inv.ListAssetTypesHandler).Methods("GET")
+	rtr.HandleFunc("/v1/_search", inv.SearchHandler).Methods("GET", "POST")
+	rtr.HandleFunc("/v1/_aggregate", inv.AggregateHandler).Methods("GET", "POST")
+	rtr.HandleFunc("/v1/_views", inv.ListViewsHandler).Methods("GET")
+	rtr.HandleFunc("/v1/_views/{name}", inv.ViewHandler).Methods("GET", "PUT", "DELETE")
+	rtr.HandleFunc("/v1/_views/{name}/results", inv.ViewResultsHandler).Methods("GET", "POST")
+	rtr.HandleFunc("/v1/_types", inv.ListAssetTypesHandler).Methods("GET")
+	rtr.HandleFunc("/v1/_types/{name}", inv.TypeHandler).Methods("GET", "POST", "PUT", "DELETE")
+	rtr.HandleFunc("/v1/_types/{name}/unique", inv.TypeUniqueHandler).Methods("GET")
+	rtr.HandleFunc("/v1/_schemas/{asset_type}", inv.SchemaHandler).Methods("GET", "PUT", "DELETE")
+	rtr.HandleFunc("/v1/_schemas/{asset_type}/audit", inv.SchemaAuditHandler).Methods("GET", "POST")
+	rtr.HandleFunc("/v1/_admin/prune", inv.VersionPruneHandler).Methods("POST")
+	rtr.HandleFunc("/v1/_admin/ids", inv.AssetIdReportHandler).Methods("GET")
+	rtr.HandleFunc("/v1/{asset_type}", inv.AssetTypeHandler).Methods("GET")
+	rtr.HandleFunc("/v1/{asset_type}", inv.AssetCreateHandler).Methods("POST")
+	rtr.HandleFunc("/v1/{asset_type}/_aggregate", inv.AggregateHandler).Methods("GET", "POST")
+	rtr.HandleFunc("/v1/{asset_type}/{asset}", inv.AssetHandler).Methods("GET", "POST", "PUT", "DELETE")
+	rtr.HandleFunc("/v1/{asset_type}/{asset}/versions", inv.AssetVersionsHandler).Methods("GET")
+	rtr.HandleFunc("/v1/{asset_type}/{asset}/diff", inv.AssetDiffHandler).Methods("GET")
+	rtr.HandleFunc("/v1/{asset_type}/{asset}/undelete", inv.AssetUndeleteHandler).Methods("POST")
+	rtr.HandleFunc("/v1/{asset_type}/{asset}/versions/{version}/restore", inv.AssetVersionRestoreHandler).Methods("POST")
+	rtr.HandleFunc("/v1/{asset_type}/{asset}/relationships", inv.AssetRelationshipsHandler).Methods("GET", "POST")
+	rtr.HandleFunc("/v1/{asset_type}/{asset}/relationships/{relationship}/{target_type}/{target}", inv.AssetRelationshipHandler).Methods("DELETE")
+	rtr.HandleFunc("/v1/{asset_type}/{asset}/graph", inv.AssetGraphHandler).Methods("GET")
+	rtr.HandleFunc("/v1/{asset_type}/{asset}/impact", inv.AssetImpactHandler).Methods("GET")
+
+	return httptest.NewServer(rtr), ds
+}
+
+func testRequest(t *testing.T, method, url string, body interface{}) (int, []byte) {
+	return testRequestAs(t, "admin", method, url, body)
+}
+
+/* Request made without credentials if user is empty */
+func testRequestAs(t *testing.T, user, method, url string, body interface{}) (int, []byte) {
+	var rdr *bytes.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		rdr = bytes.NewReader(b)
+	} else {
+		rdr = bytes.NewReader([]byte{})
+	}
+
+	req, _ := http.NewRequest(method, url, rdr)
+	if len(user) > 0 {
+		req.SetBasicAuth(user, testUsers[user])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, b
+}
+
+func Test_Inventory_MemoryDatastore_API(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+
+	// Only admins create types
+	ds.CreateAsset("virtualserver", "seed", map[string]interface{}{"status": "running", "environment": "dev"}, true)
+
+	code, b := testRequest(t, "POST", srv.URL+"/v1/virtualserver/foo.bar.org",
+		map[string]interface{}{"status": "running", "environment": "dev", "os": "ubuntu"})
+	if code != 200 {
+		t.Fatalf("POST %d %s", code, b)
+	}
+
+	code, b = testRequest(t, "POST", srv.URL+"/v1/virtualserver/missing.fields", map[string]interface{}{"os": "ubuntu"})
+	if code != 400 {
+		t.Fatalf("Required fields not enforced: %d %s", code, b)
+	}
+
+	code, b = testRequest(t, "PUT", srv.URL+"/v1/virtualserver/foo.bar.org", map[string]interface{}{"status": "stopped"})
+	if code != 200 {
+		t.Fatalf("PUT %d %s", code, b)
+	}
+
+	code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver/foo.bar.org", nil)
+	var asset AssetResponse
+	json.Unmarshal(b, &asset)
+	if code != 200 || asset.Data.(map[string]interface{})["status"] != "stopped" {
+		t.Fatalf("GET %d %s", code, b)
+	}
+
+	code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver/foo.bar.org?version=1", nil)
+	json.Unmarshal(b, &asset)
+	if code != 200 || asset.Data.(map[string]interface{})["status"] != "running" {
+		t.Fatalf("GET version %d %s", code, b)
+	}
+
+	code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver/foo.bar.org/versions?diff", nil)
+	if code != 200 {
+		t.Fatalf("GET versions %d %s", code, b)
+	}
+
+	testRequest(t, "PUT", srv.URL+"/v1/virtualserver/foo.bar.org", map[string]interface{}{"os": "centos"})
+	code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver/foo.bar.org/versions?diff=json", nil)
+	var diffs []VersionDiff
+	json.Unmarshal(b, &diffs)
+	if code != 200 || len(diffs) != 1 || len(diffs[0].Diff) < 1 || len(diffs[0].Patch) != 2 ||
+		diffs[0].Patch[0].Path != "/status" || diffs[0].Patch[1].Path != "/updated_at" {
+		t.Fatalf("GET versions diff=json %d %s", code, b)
+	}
+
+	code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver", map[string]interface{}{"status": "stopped"})
+	var hits []map[string]interface{}
+	json.Unmarshal(b, &hits)
+	if code != 200 || len(hits) != 1 {
+		t.Fatalf("Search %d %s", code, b)
+	}
+
+	code, b = testRequest(t, "GET", srv.URL+"/v1/", nil)
+	var types []AssetTypeInfo
+	if json.Unmarshal(b, &types); code != 200 || len(types) != 1 || types[0].Name != "virtualserver" || types[0].Count != 2 {
+		t.Fatalf("Types %d %s", code, b)
+	}
+
+	if code, b = testRequest(t, "DELETE", srv.URL+"/v1/virtualserver/foo.bar.org", nil); code != 200 {
+		t.Fatalf("DELETE %d %s", code, b)
+	}
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver/foo.bar.org", nil); code != 404 {
+		t.Fatalf("Not deleted %d %s", code, b)
+	}
+}
+
+func Test_Inventory_AssetVersionRestoreHandler(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+
+	ds.CreateAsset("virtualserver", "foo", map[string]interface{}{"status": "running", "environment": "dev"}, true)
+	ds.EditAsset("virtualserver", "foo", map[string]interface{}{"status": "stopped"})
+
+	code, b := testRequest(t, "POST", srv.URL+"/v1/virtualserver/foo/versions/1/restore", nil)
+	if code != 200 {
+		t.Fatalf("Restore %d %s", code, b)
+	}
+	asset, _ := ds.GetAsset("virtualserver", "foo")
+	if asset.Data["status"] != "running" {
+		t.Fatalf("Not restored: %#v", asset.Data)
+	}
+	// The replaced asset is versioned
+	if rslt, _ := ds.GetAssetVersions("virtualserver", "foo", 10, 0); len(rslt.Assets) != 2 ||
+		rslt.Assets[0].Data["status"] != "stopped" {
+		t.Fatalf("Restore not versioned: %#v", rslt.Assets)
+	}
+
+	// Deleted assets
+	ds.RemoveAsset("virtualserver", "foo", "tester")
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/virtualserver/foo/versions/2/restore", nil); code != 200 {
+		t.Fatalf("Restore deleted %d %s", code, b)
+	}
+	if asset, _ = ds.GetAsset("virtualserver", "foo"); asset.Data["status"] != "stopped" {
+		t.Fatalf("Not restored: %#v", asset.Data)
+	}
+
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/virtualserver/foo/versions/99/restore", nil); code != 404 {
+		t.Fatalf("Restored missing version %d %s", code, b)
+	}
+}
+
+func Test_Inventory_AssetUndeleteHandler(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+
+	ds.CreateAsset("virtualserver", "foo", map[string]interface{}{"status": "running", "environment": "dev"}, true)
+	ds.CreateAsset("virtualserver", "bar", map[string]interface{}{"status": "running", "environment": "dev"}, true)
+
+	if code, b := testRequest(t, "POST", srv.URL+"/v1/virtualserver/foo/undelete", nil); code != 409 {
+		t.Fatalf("Undeleted existing asset %d %s", code, b)
+	}
+
+	if code, b := testRequest(t, "DELETE", srv.URL+"/v1/virtualserver/foo", nil); code != 200 {
+		t.Fatalf("DELETE %d %s", code, b)
+	}
+
+	code, b := testRequest(t, "GET", srv.URL+"/v1/virtualserver?deleted=true", nil)
+	var deleted []AssetResponse
+	json.Unmarshal(b, &deleted)
+	if code != 200 || len(deleted) != 1 || deleted[0].Id != "foo" {
+		t.Fatalf("Deleted listing %d %s", code, b)
+	}
+	if _, ok := deleted[0].Data.(map[string]interface{})["deleted_at"]; !ok {
+		t.Fatalf("No tombstone info: %s", b)
+	}
+
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/virtualserver/foo/undelete", nil); code != 200 {
+		t.Fatalf("Undelete %d %s", code, b)
+	}
+	if asset, err := ds.GetAsset("virtualserver", "foo"); err != nil || asset.Data["status"] != "running" {
+		t.Fatalf("Not undeleted: %#v %v", asset, err)
+	}
+
+	code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver?deleted=true", nil)
+	if json.Unmarshal(b, &deleted); code != 200 || len(deleted) != 0 {
+		t.Fatalf("Deleted listing %d %s", code, b)
+	}
+
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/virtualserver/bar/undelete", nil); code != 409 {
+		t.Fatalf("Undeleted existing asset %d %s", code, b)
+	}
+}
+
+func Test_Inventory_AssetDiffHandler(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+
+	ds.CreateAsset("virtualserver", "foo", map[string]interface{}{"status": "running", "n": 0}, true)
+	for i := 1; i <= 5; i++ {
+		ds.EditAsset("virtualserver", "foo", map[string]interface{}{"n": i})
+	}
+
+	code, b := testRequest(t, "GET", srv.URL+"/v1/virtualserver/foo/diff?from=2&to=current", nil)
+	var diff AssetDiff
+	json.Unmarshal(b, &diff)
+	if code != 200 || len(diff.Diff) < 1 || len(diff.Patch) != 1 || diff.Patch[0].Value != float64(5) {
+		t.Fatalf("Diff %d %s", code, b)
+	}
+
+	code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver/foo/diff?from=4&to=1", nil)
+	json.Unmarshal(b, &diff)
+	if code != 200 || diff.From != "4" || diff.Patch[0].Value != float64(0) {
+		t.Fatalf("Diff %d %s", code, b)
+	}
+
+	for _, q := range []string{"from=1", "from=x&to=2", "from=1&to=99"} {
+		if code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver/foo/diff?"+q, nil); code == 200 {
+			t.Fatalf("Invalid diff request %s: %d %s", q, code, b)
+		}
+	}
+
+	code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver/foo/versions?count=2&offset=1", nil)
+	var versions []AssetResponse
+	json.Unmarshal(b, &versions)
+	if code != 200 || len(versions) != 2 || versions[0].Data.(map[string]interface{})["version"] != float64(4) {
+		t.Fatalf("Versions %d %s", code, b)
+	}
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver/foo/versions?count=-1", nil); code != 400 {
+		t.Fatalf("Invalid count %d %s", code, b)
+	}
+}
+
+func Test_Inventory_AsOf(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+
+	// only admins create types
+	ds.CreateAsset("virtualserver", "bar", map[string]interface{}{"status": "stopped"}, true)
+	testRequest(t, "POST", srv.URL+"/v1/virtualserver/foo", map[string]interface{}{"status": "running", "environment": "dev"})
+	time.Sleep(5 * time.Millisecond)
+	before := time.Now().UTC().Format(time.RFC3339Nano)
+	time.Sleep(5 * time.Millisecond)
+	testRequest(t, "PUT", srv.URL+"/v1/virtualserver/foo", map[string]interface{}{"status": "stopped"})
+
+	code, b := testRequest(t, "GET", srv.URL+"/v1/virtualserver/foo?as_of="+before, nil)
+	var asset AssetResponse
+	json.Unmarshal(b, &asset)
+	if code != 200 || asset.Data.(map[string]interface{})["status"] != "running" {
+		t.Fatalf("as_of %d %s", code, b)
+	}
+
+	code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver?as_of="+before, map[string]interface{}{"status": "running"})
+	var assets []AssetResponse
+	json.Unmarshal(b, &assets)
+	if code != 200 || len(assets) != 1 || assets[0].Id != "foo" {
+		t.Fatalf("Search as_of %d %s", code, b)
+	}
+
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver/foo?as_of=2000-01-01T00:00:00Z", nil); code != 404 {
+		t.Fatalf("Existed before creation %d %s", code, b)
+	}
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver/foo?as_of=yesterday", nil); code != 400 {
+		t.Fatalf("Invalid as_of %d %s", code, b)
+	}
+}
+
+func Test_Inventory_VersionPruneHandler(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+
+	for _, assetType := range []string{"pruned", "virtualserver"} {
+		ds.CreateAsset(assetType, "foo", map[string]interface{}{"n": 0}, true)
+		for i := 1; i <= 5; i++ {
+			ds.EditAsset(assetType, "foo", map[string]interface{}{"n": i})
+		}
+	}
+
+	code, b := testRequest(t, "POST", srv.URL+"/v1/_admin/prune?dry_run=true", nil)
+	var report PruneReport
+	json.Unmarshal(b, &report)
+	if code != 200 || !report.DryRun || report.Examined != 10 || report.Pruned != 3 ||
+		len(report.Assets) != 1 || report.Assets[0].Type != "pruned" {
+		t.Fatalf("Dry run %d %s", code, b)
+	}
+	if rslt, _ := ds.GetAssetVersions("pruned", "foo", 10, 0); rslt.Total != 5 {
+		t.Fatalf("Dry run removed versions: %d", rslt.Total)
+	}
+
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/_admin/prune?type=pruned", nil); code != 200 {
+		t.Fatalf("Prune %d %s", code, b)
+	}
+	rslt, _ := ds.GetAssetVersions("pruned", "foo", 10, 0)
+	if rslt.Total != 2 || rslt.Assets[0].Version != 5 || rslt.Assets[1].Version != 4 {
+		t.Fatalf("Wrong versions kept: %#v", rslt)
+	}
+
+	// numbering continues after pruning
+	ds.EditAsset("pruned", "foo", map[string]interface{}{"n": 6})
+	if rslt, _ = ds.GetAssetVersions("pruned", "foo", 1, 0); rslt.Assets[0].Version != 6 {
+		t.Fatalf("Version number reused: %#v", rslt.Assets[0])
+	}
+}
+
+func Test_Inventory_SearchPaging(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+
+	for i := 0; i < 25; i++ {
+		ds.CreateAsset("virtualserver", fmt.Sprintf("host%02d", i), map[string]interface{}{
+			"n": i, "status": "running", "hw": map[string]interface{}{"cpus": 2, "mem": 4},
+		}, true)
+	}
+
+	var (
+		next = srv.URL + "/v1/virtualserver?sortby=n:dsc&size=10&fields=n,hw.cpus"
+		seen = []float64{}
+	)
+	for pages := 0; len(next) > 0; pages++ {
+		resp, err := http.Get(next)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		var assets []AssetResponse
+		json.NewDecoder(resp.Body).Decode(&assets)
+		resp.Body.Close()
+
+		if resp.StatusCode != 200 || resp.Header.Get("X-Total-Count") != "25" || pages > 2 {
+			t.Fatalf("Page %d: %d %#v", pages, resp.StatusCode, resp.Header)
+		}
+		for _, a := range assets {
+			data := a.Data.(map[string]interface{})
+			if _, ok := data["status"]; ok || len(data) != 2 || len(data["hw"].(map[string]interface{})) != 1 {
+				t.Fatalf("Fields not projected: %#v", data)
+			}
+			seen = append(seen, data["n"].(float64))
+		}
+
+		next = ""
+		if link := resp.Header.Get("Link"); len(link) > 0 {
+			next = srv.URL + link[1:strings.Index(link, ">")]
+		}
+	}
+	if len(seen) != 25 || seen[0] != 24 || seen[24] != 0 {
+		t.Fatalf("Wrong results: %v", seen)
+	}
+
+	for _, q := range []string{"size=5000", "from=-1", "sortby=n:up"} {
+		if code, b := testRequest(t, "GET", srv.URL+"/v1/virtualserver?"+q, nil); code != 400 {
+			t.Fatalf("Invalid request %s: %d %s", q, code, b)
+		}
+	}
+
+	code, b := testRequest(t, "GET", srv.URL+"/v1/virtualserver?size=100", map[string]interface{}{"n": ">=20", "hw": map[string]interface{}{"cpus": 2}})
+	var assets []AssetResponse
+	if json.Unmarshal(b, &assets); code != 200 || len(assets) != 5 {
+		t.Fatalf("Filter %d %s", code, b)
+	}
+	q := url.Values{"q": {"n:[20 TO *] AND (hw.cpus:2 OR status:stopped)"}, "size": {"100"}}
+	code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver?"+q.Encode(), nil)
+	if json.Unmarshal(b, &assets); code != 200 || len(assets) != 5 {
+		t.Fatalf("Query string %d %s", code, b)
+	}
+	q = url.Values{"q": {"n:>=20 AND"}}
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver?"+q.Encode(), nil); code != 400 ||
+		!strings.Contains(string(b), "position 11") {
+		t.Fatalf("Query string syntax error %d %s", code, b)
+	}
+
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver", map[string]interface{}{"n": ">="}); code != 400 ||
+		!strings.Contains(string(b), "'>=' requires a value") {
+		t.Fatalf("Malformed operator %d %s", code, b)
+	}
+}
+
+func Test_Inventory_SearchHandler(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+
+	ds.CreateAsset("virtualserver", "web01", map[string]interface{}{"ip": "10.1.2.3", "status": "running"}, true)
+	ds.CreateAsset("dnsrecord", "web01", map[string]interface{}{"ip": "10.1.2.3"}, true)
+	ds.CreateAsset("loadbalancer", "lb01", map[string]interface{}{"ip": "10.1.2.4"}, true)
+
+	searchTypes := func(method, query string, body interface{}) map[string]string {
+		code, b := testRequest(t, method, srv.URL+"/v1/_search"+query, body)
+		var assets []AssetResponse
+		if err := json.Unmarshal(b, &assets); code != 200 || err != nil {
+			t.Fatalf("%s %s: %d %s", method, query, code, b)
+		}
+		found := map[string]string{}
+		for _, a := range assets {
+			found[a.Type] = a.Id
+		}
+		return found
+	}
+
+	// Same id in different types are separate hits
+	found := searchTypes("GET", "", map[string]interface{}{"ip": "10.1.2.3"})
+	if len(found) != 2 || found["virtualserver"] != "web01" || found["dnsrecord"] != "web01" {
+		t.Fatalf("All types: %v", found)
+	}
+
+	found = searchTypes("POST", "?types=LoadBalancer,dnsrecord&q=ip:10.1.2.*", nil)
+	if len(found) != 2 || found["loadbalancer"] != "lb01" || found["dnsrecord"] != "web01" {
+		t.Fatalf("Listed types: %v", found)
+	}
+	found = searchTypes("GET", "?types=loadbalancer&types=virtualserver", nil)
+	if len(found) != 2 || found["virtualserver"] != "web01" {
+		t.Fatalf("Repeated types: %v", found)
+	}
+
+	if code, b := testRequest(t, "GET", srv.URL+"/v1/_search?q=ip:", nil); code != 400 {
+		t.Fatalf("Invalid query %d %s", code, b)
+	}
+}
+
+func Test_Inventory_AggregateHandler(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+
+	for i, env := range []string{"prod", "prod", "prod", "dev"} {
+		ds.CreateAsset("virtualserver", fmt.Sprintf("vs%d", i), map[string]interface{}{
+			"environment": env, "status": "running", "cpus": 2 * (i + 1),
+		}, true)
+	}
+	ds.CreateAsset("physicalserver", "ps0", map[string]interface{}{"environment": "prod", "status": "stopped"}, true)
+
+	code, b := testRequest(t, "GET", srv.URL+"/v1/virtualserver/_aggregate?by=environment&stats=cpus&histogram=cpus:4&q=cpus:>2", nil)
+	var rslt AggregationResult
+	if json.Unmarshal(b, &rslt); code != 200 || rslt.Count != 3 || len(rslt.Buckets) != 2 ||
+		rslt.Buckets[0].Key != "prod" || rslt.Buckets[0].Count != 2 || rslt.Stats["cpus"].Max != 8 ||
+		len(rslt.Histograms["cpus"]) != 2 {
+		t.Fatalf("Aggregate %d %s", code, b)
+	}
+
+	code, b = testRequest(t, "GET", srv.URL+"/v1/_aggregate?by=environment,status", nil)
+	rslt = AggregationResult{}
+	if json.Unmarshal(b, &rslt); code != 200 || rslt.Count != 5 || rslt.Buckets[0].Count != 4 ||
+		len(rslt.Buckets[0].Buckets) != 2 || rslt.Buckets[0].Field != "status" {
+		t.Fatalf("Cross type %d %s", code, b)
+	}
+
+	code, b = testRequest(t, "GET", srv.URL+"/v1/_aggregate?types=physicalserver&by=status", nil)
+	rslt = AggregationResult{}
+	if json.Unmarshal(b, &rslt); code != 200 || rslt.Count != 1 || rslt.Buckets[0].Key != "stopped" {
+		t.Fatalf("Listed types %d %s", code, b)
+	}
+
+	for _, q := range []string{"histogram=cpus", "histogram=cpus:0", "histogram=cpus:x", "q=cpus:"} {
+		if code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver/_aggregate?"+q, nil); code != 400 {
+			t.Fatalf("Invalid request %s: %d %s", q, code, b)
+		}
+	}
+}
+
+func Test_Inventory_Export(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+
+	for i := 0; i < ExportBatchSize+5; i++ {
+		data := map[string]interface{}{"n": i, "status": "running"}
+		if i == 0 {
+			data["hw"] = map[string]interface{}{"cpus": 4}
+			data["tags"] = []interface{}{"a", "b,c"}
+		}
+		ds.CreateAsset("virtualserver", fmt.Sprintf("host%03d", i), data, true)
+	}
+
+	code, b := testRequest(t, "GET", srv.URL+"/v1/virtualserver?format=ndjson&q=n:<10&sortby=n:dsc", nil)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	var first AssetResponse
+	if json.Unmarshal([]byte(lines[0]), &first); code != 200 || len(lines) != 10 || first.Id != "host009" {
+		t.Fatalf("ndjson %d %s", code, b)
+	}
+
+	resp, err := http.Get(srv.URL + "/v1/virtualserver?format=csv")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/csv" {
+		t.Fatalf("csv %d %v %s", resp.StatusCode, resp.Header, err)
+	}
+	// paging does not apply
+	if len(rows) != ExportBatchSize+6 ||
+		strings.Join(rows[0], ",") != "id,type,hw.cpus,n,status,tags" ||
+		strings.Join(rows[1][:5], ",") != "host000,virtualserver,4,0,running" || rows[1][5] != `["a","b,c"]` ||
+		strings.Join(rows[2], ",") != "host001,virtualserver,,1,running," {
+		t.Fatalf("csv rows: %v %v", rows[0], rows[1])
+	}
+
+	code, b = testRequest(t, "GET", srv.URL+"/v1/_search?types=virtualserver&format=csv&fields=n,hw.cpus&q=hw.cpus:*", nil)
+	if code != 200 || string(b) != "id,type,n,hw.cpus\nhost000,virtualserver,0,4\n" {
+		t.Fatalf("csv fields %d %s", code, b)
+	}
+
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/virtualserver?format=xml", nil); code != 400 {
+		t.Fatalf("Invalid format %d %s", code, b)
+	}
+}
+
+func Test_Inventory_Views(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+
+	for i := 0; i < 15; i++ {
+		ds.CreateAsset("virtualserver", fmt.Sprintf("host%02d", i), map[string]interface{}{
+			"n": i, "status": "running", "environment": "prod",
+		}, true)
+	}
+	ds.CreateAsset("dnsrecord", "host00", map[string]interface{}{"n": 0, "status": "running"}, true)
+
+	view := map[string]interface{}{
+		"description": "Running prod servers",
+		"types":       []string{"VirtualServer"},
+		"filter":      map[string]interface{}{"environment": "prod"},
+		"q":           "status:running",
+		"sortby":      []string{"n:dsc"},
+		"fields":      []string{"n"},
+	}
+	code, b := testRequest(t, "PUT", srv.URL+"/v1/_views/prod-running", view)
+	var saved View
+	if json.Unmarshal(b, &saved); code != 200 || saved.Name != "prod-running" || saved.Types[0] != "virtualserver" {
+		t.Fatalf("PUT %d %s", code, b)
+	}
+
+	resp, err := http.Get(srv.URL + "/v1/_views/prod-running/results?size=10")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	var assets []AssetResponse
+	json.NewDecoder(resp.Body).Decode(&assets)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("X-Total-Count") != "15" || len(assets) != 10 ||
+		assets[0].Id != "host14" || len(assets[0].Data.(map[string]interface{})) != 1 ||
+		!strings.Contains(resp.Header.Get("Link"), "/v1/_views/prod-running/results?from=10") {
+		t.Fatalf("Results %d %#v %#v", resp.StatusCode, resp.Header, assets)
+	}
+
+	// request narrows and overrides the defaults
+	code, b = testRequest(t, "GET", srv.URL+"/v1/_views/prod-running/results?q=n:<2&sortby=n:asc&format=csv", nil)
+	if code != 200 || string(b) != "id,type,n\nhost00,virtualserver,0\nhost01,virtualserver,1\n" {
+		t.Fatalf("Results csv %d %s", code, b)
+	}
+
+	// editing the view changes results for the same request
+	view["q"] = "n:>=13"
+	if code, b = testRequest(t, "PUT", srv.URL+"/v1/_views/prod-running", view); code != 200 {
+		t.Fatalf("PUT %d %s", code, b)
+	}
+	code, b = testRequest(t, "GET", srv.URL+"/v1/_views/prod-running/results", nil)
+	if json.Unmarshal(b, &assets); code != 200 || len(assets) != 2 {
+		t.Fatalf("Edited results %d %s", code, b)
+	}
+
+	code, b = testRequest(t, "GET", srv.URL+"/v1/_views", nil)
+	var views []View
+	if json.Unmarshal(b, &views); code != 200 || len(views) != 1 || views[0].Description != "Running prod servers" {
+		t.Fatalf("List %d %s", code, b)
+	}
+
+	for name, bad := range map[string]interface{}{
+		"bad-filter": map[string]interface{}{"filter": map[string]interface{}{"n": ">="}},
+		"bad-query":  map[string]interface{}{"q": "n:>1 AND"},
+		"bad-sort":   map[string]interface{}{"sortby": []string{"n:up"}},
+		"bad name":   map[string]interface{}{},
+	} {
+		if code, b = testRequest(t, "PUT", srv.URL+"/v1/_views/"+url.PathEscape(name), bad); code != 400 {
+			t.Fatalf("Invalid view %s: %d %s", name, code, b)
+		}
+	}
+
+	if code, b = testRequest(t, "DELETE", srv.URL+"/v1/_views/prod-running", nil); code != 200 {
+		t.Fatalf("DELETE %d %s", code, b)
+	}
+	for _, path := range []string{"/v1/_views/prod-running", "/v1/_views/prod-running/results"} {
+		if code, b = testRequest(t, "GET", srv.URL+path, nil); code != 404 {
+			t.Fatalf("GET %s after delete %d %s", path, code, b)
+		}
+	}
+}
+
+func Test_Inventory_Schemas(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+
+	ds.CreateAsset("dnsrecord", "old", map[string]interface{}{"name": "old.foo.org", "ttl": 5}, true)
+	ds.CreateAsset("dnsrecord", "ok", map[string]interface{}{"name": "ok.foo.org", "ttl": 300}, true)
+
+	schema := map[string]interface{}{
+		"type":     "object",
+		"required": []string{"name", "ttl"},
+		"properties": map[string]interface{}{
+			"name": map[string]interface{}{"type": "string", "format": "hostname"},
+			"ttl":  map[string]interface{}{"type": "integer", "minimum": 60},
+		},
+	}
+
+	// try the schema before saving it
+	code, b := testRequest(t, "POST", srv.URL+"/v1/_schemas/dnsrecord/audit", schema)
+	var report SchemaAuditReport
+	if json.Unmarshal(b, &report); code != 200 || report.Checked != 2 || report.Invalid != 1 ||
+		report.Assets[0].Id != "old" || report.Assets[0].Errors[0].Field != "ttl" {
+		t.Fatalf("Audit %d %s", code, b)
+	}
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/_schemas/dnsrecord/audit", nil); code != 404 {
+		t.Fatalf("Audit without schema %d %s", code, b)
+	}
+
+	if code, b = testRequest(t, "PUT", srv.URL+"/v1/_schemas/DnsRecord", map[string]interface{}{"type": "text"}); code != 400 {
+		t.Fatalf("Invalid schema %d %s", code, b)
+	}
+	if code, b = testRequest(t, "PUT", srv.URL+"/v1/_schemas/DnsRecord", schema); code != 200 {
+		t.Fatalf("PUT schema %d %s", code, b)
+	}
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/_schemas/dnsrecord", nil); code != 200 ||
+		!strings.Contains(string(b), `"minimum":60`) {
+		t.Fatalf("GET schema %d %s", code, b)
+	}
+	code, b = testRequest(t, "GET", srv.URL+"/v1/_schemas/dnsrecord/audit?q=name:old*", nil)
+	if json.Unmarshal(b, &report); code != 200 || report.Checked != 1 || report.Invalid != 1 {
+		t.Fatalf("Audit stored schema %d %s", code, b)
+	}
+
+	// status and environment are not required by the schema
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/dnsrecord/new", map[string]interface{}{"name": "new.foo.org", "ttl": 60}); code != 200 {
+		t.Fatalf("Valid POST %d %s", code, b)
+	}
+	code, b = testRequest(t, "POST", srv.URL+"/v1/dnsrecord/bad", map[string]interface{}{"name": "bad name", "ttl": 1.5})
+	var rsp SchemaErrorResponse
+	if json.Unmarshal(b, &rsp); code != 400 || len(rsp.Errors) != 2 || rsp.Errors[0].Field != "name" ||
+		rsp.Errors[1].Message != "must be integer got number" {
+		t.Fatalf("Invalid POST %d %s", code, b)
+	}
+
+	// the merged document is validated
+	if code, b = testRequest(t, "PUT", srv.URL+"/v1/dnsrecord/ok", map[string]interface{}{"comment": "x"}); code != 200 {
+		t.Fatalf("Valid PUT %d %s", code, b)
+	}
+	if code, b = testRequest(t, "PUT", srv.URL+"/v1/dnsrecord/old", map[string]interface{}{"comment": "x"}); code != 400 ||
+		!strings.Contains(string(b), "ttl: must be at least 60") {
+		t.Fatalf("Invalid merged PUT %d %s", code, b)
+	}
+	if code, b = testRequest(t, "PUT", srv.URL+"/v1/dnsrecord/old", map[string]interface{}{"ttl": 120}); code != 200 {
+		t.Fatalf("Fixing PUT %d %s", code, b)
+	}
+
+	// restored and undeleted versions are validated
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/dnsrecord/old/versions/1/restore", nil); code != 400 || !isSchemaErrorResponse(b) {
+		t.Fatalf("Restoring invalid version %d %s", code, b)
+	}
+	ds.CreateAsset("dnsrecord", "gone", map[string]interface{}{"name": "gone.foo.org", "ttl": 5}, true)
+	ds.RemoveAsset("dnsrecord", "gone", "tester")
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/dnsrecord/gone/undelete", nil); code != 400 || !isSchemaErrorResponse(b) {
+		t.Fatalf("Undeleting invalid asset %d %s", code, b)
+	}
+
+	// types without a schema still use the required fields
+	ds.CreateAsset("virtualserver", "seed", map[string]interface{}{"status": "running", "environment": "dev"}, true)
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/virtualserver/vs", map[string]interface{}{"ttl": 1}); code != 400 {
+		t.Fatalf("Required fields not enforced %d %s", code, b)
+	}
+
+	if code, b = testRequest(t, "DELETE", srv.URL+"/v1/_schemas/dnsrecord", nil); code != 200 {
+		t.Fatalf("DELETE schema %d %s", code, b)
+	}
+	if code, b = testRequest(t, "DELETE", srv.URL+"/v1/_schemas/dnsrecord", nil); code != 404 {
+		t.Fatalf("DELETE missing schema %d %s", code, b)
+	}
+}
+
+func Test_Inventory_Types(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+
+	ds.CreateAsset("virtualserver", "vs1", map[string]interface{}{"status": "running", "environment": "dev"}, true)
+
+	for _, name := range []string{"_search", "bad name", "-x"} {
+		if code, b := testRequest(t, "POST", srv.URL+"/v1/_types/"+url.PathEscape(name), nil); code != 400 {
+			t.Fatalf("Reserved type name %s %d %s", name, code, b)
+		}
+	}
+	if code, b := testRequest(t, "POST", srv.URL+"/v1/_types/rack", map[string]interface{}{"id_pattern": "("}); code != 400 {
+		t.Fatalf("Invalid id_pattern %d %s", code, b)
+	}
+
+	rack := map[string]interface{}{
+		"description":     "Datacenter racks",
+		"owner":           "dcops",
+		"required_fields": []string{"location"},
+		"id_pattern":      "[a-z]+-r[0-9]+",
+	}
+	code, b := testRequest(t, "POST", srv.URL+"/v1/_types/Rack", rack)
+	var def AssetType
+	if json.Unmarshal(b, &def); code != 200 || def.Name != "rack" || def.Owner != "dcops" || len(def.CreatedAt) < 1 {
+		t.Fatalf("POST type %d %s", code, b)
+	}
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/_types/rack", rack); code != 409 {
+		t.Fatalf("POST existing type %d %s", code, b)
+	}
+
+	// the type exists without any assets so anyone may add them
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/rack/sjc-r1", map[string]interface{}{"location": "sjc"}); code != 200 {
+		t.Fatalf("POST to defined type %d %s", code, b)
+	}
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/rack/sjc-r2", map[string]interface{}{"status": "up"}); code != 400 ||
+		!strings.Contains(string(b), "'location' field required") {
+		t.Fatalf("Type required fields %d %s", code, b)
+	}
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/rack/SJC_R2", map[string]interface{}{"location": "sjc"}); code != 400 {
+		t.Fatalf("id_pattern %d %s", code, b)
+	}
+
+	// types without a definition are listed too
+	code, b = testRequest(t, "GET", srv.URL+"/v1/_types", nil)
+	var types []AssetTypeInfo
+	if json.Unmarshal(b, &types); code != 200 || len(types) != 2 || types[0].Name != "rack" || types[0].Count != 1 ||
+		types[0].Description != "Datacenter racks" || types[1].Name != "virtualserver" || types[1].Count != 1 {
+		t.Fatalf("List types %d %s", code, b)
+	}
+	code, b = testRequest(t, "GET", srv.URL+"/v1/_types/virtualserver", nil)
+	var info AssetTypeInfo
+	if json.Unmarshal(b, &info); code != 200 || info.Name != "virtualserver" || info.Count != 1 {
+		t.Fatalf("GET undefined type %d %s", code, b)
+	}
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/_types/missing", nil); code != 404 {
+		t.Fatalf("GET missing type %d %s", code, b)
+	}
+
+	// PUT replaces the definition keeping when and by whom it was created
+	code, b = testRequest(t, "PUT", srv.URL+"/v1/_types/rack", map[string]interface{}{"description": "Racks"})
+	var updated AssetType
+	if json.Unmarshal(b, &updated); code != 200 || updated.Description != "Racks" || updated.CreatedAt != def.CreatedAt ||
+		len(updated.RequiredFields) != 0 {
+		t.Fatalf("PUT type %d %s", code, b)
+	}
+	if code, b = testRequest(t, "PUT", srv.URL+"/v1/_types/missing", map[string]interface{}{}); code != 404 {
+		t.Fatalf("PUT missing type %d %s", code, b)
+	}
+
+	// the schema is part of the definition
+	schema := map[string]interface{}{"required": []string{"rows"}}
+	if code, b = testRequest(t, "PUT", srv.URL+"/v1/_schemas/virtualserver", schema); code != 200 {
+		t.Fatalf("PUT schema %d %s", code, b)
+	}
+	code, b = testRequest(t, "GET", srv.URL+"/v1/_types/virtualserver", nil)
+	if json.Unmarshal(b, &info); code != 200 || info.Schema == nil {
+		t.Fatalf("Schema not in type %d %s", code, b)
+	}
+
+	if code, b = testRequest(t, "DELETE", srv.URL+"/v1/_types/rack", nil); code != 409 ||
+		!strings.Contains(string(b), "has 1 assets") {
+		t.Fatalf("DELETE type with assets %d %s", code, b)
+	}
+	if code, b = testRequest(t, "DELETE", srv.URL+"/v1/_types/rack?force=true", nil); code != 200 {
+		t.Fatalf("DELETE type %d %s", code, b)
+	}
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/rack/sjc-r1", nil); code != 404 {
+		t.Fatalf("Asset not removed with type %d %s", code, b)
+	}
+	if code, b = testRequest(t, "DELETE", srv.URL+"/v1/_types/rack", nil); code != 404 {
+		t.Fatalf("DELETE missing type %d %s", code, b)
+	}
+
+	// deleting an empty type needs no force
+	testRequest(t, "POST", srv.URL+"/v1/_types/empty", nil)
+	if code, b = testRequest(t, "DELETE", srv.URL+"/v1/_types/empty", nil); code != 200 {
+		t.Fatalf("DELETE empty type %d %s", code, b)
+	}
+}
+
+func Test_Inventory_AssetIds(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+
+	// stored before the rules were given
+	for _, id := range []string{"Legacy.Example.com", "dup.example.com", "DUP.example.com", "bad_name"} {
+		ds.CreateAsset("host", id, map[string]interface{}{"status": "running", "environment": "dev"}, true)
+	}
+
+	rules := map[string]interface{}{"id_format": "fqdn", "id_max_length": 20}
+	if code, b := testRequest(t, "PUT", srv.URL+"/v1/_types/host", rules); code != 200 {
+		t.Fatalf("PUT type %d %s", code, b)
+	}
+
+	asset := map[string]interface{}{"status": "running", "environment": "dev"}
+	code, b := testRequest(t, "POST", srv.URL+"/v1/host/Web01.Example.com.", asset)
+	if code != 200 || !strings.Contains(string(b), `"web01.example.com"`) {
+		t.Fatalf("POST normalized %d %s", code, b)
+	}
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/host/WEB01.example.com", asset); code != 400 ||
+		!strings.Contains(string(b), "Asset already exists") {
+		t.Fatalf("POST duplicate %d %s", code, b)
+	}
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/host/web_02.example.com", asset); code != 400 {
+		t.Fatalf("POST invalid %d %s", code, b)
+	}
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/host/web-with-a-long-name.example.com", asset); code != 400 ||
+		!strings.Contains(string(b), "longer than 20") {
+		t.Fatalf("POST too long %d %s", code, b)
+	}
+
+	// reads and edits use the normalized id
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/host/WEB01.EXAMPLE.COM", nil); code != 200 {
+		t.Fatalf("GET normalized %d %s", code, b)
+	}
+	if code, b = testRequest(t, "PUT", srv.URL+"/v1/host/Web01.example.com.", map[string]interface{}{"os": "ubuntu"}); code != 200 {
+		t.Fatalf("PUT normalized %d %s", code, b)
+	}
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/host/web01.EXAMPLE.com/versions", nil); code != 200 ||
+		!strings.Contains(string(b), `"id":"web01.example.com"`) {
+		t.Fatalf("GET versions normalized %d %s", code, b)
+	}
+
+	// assets stored before the rules are still found
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/host/Legacy.Example.com", nil); code != 200 {
+		t.Fatalf("GET legacy %d %s", code, b)
+	}
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/host/bad_name", nil); code != 200 {
+		t.Fatalf("GET unnormalizable %d %s", code, b)
+	}
+
+	code, b = testRequest(t, "GET", srv.URL+"/v1/_admin/ids?type=host", nil)
+	var report IdReport
+	if json.Unmarshal(b, &report); code != 200 || report.Checked != 5 || report.Invalid != 3 {
+		t.Fatalf("Report %d %s", code, b)
+	}
+	expected := []InvalidId{
+		{Type: "host", Id: "DUP.example.com", Normalized: "dup.example.com", Conflict: true},
+		{Type: "host", Id: "Legacy.Example.com", Normalized: "legacy.example.com"},
+		{Type: "host", Id: "bad_name", Error: "Invalid host id: 'bad_name' is not a valid fqdn"},
+	}
+	for i, e := range expected {
+		if report.Assets[i] != e {
+			t.Fatalf("Report %d: %#v expected %#v", i, report.Assets[i], e)
+		}
+	}
+
+	// all types
+	ds.CreateAsset("other", "X", map[string]interface{}{}, true)
+	code, b = testRequest(t, "GET", srv.URL+"/v1/_admin/ids", nil)
+	if json.Unmarshal(b, &report); code != 200 || report.Checked != 6 || report.Invalid != 3 {
+		t.Fatalf("Report all types %d %s", code, b)
+	}
+}
+
+func Test_Inventory_GeneratedIds(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+
+	def := map[string]interface{}{"id_template": "{role}-{environment}-{seq:04d}", "required_fields": []string{"role"}}
+	if code, b := testRequest(t, "POST", srv.URL+"/v1/_types/host", def); code != 200 {
+		t.Fatalf("POST type %d %s", code, b)
+	}
+	if code, b := testRequest(t, "PUT", srv.URL+"/v1/_types/host", map[string]interface{}{"id_template": "{seq"}); code != 400 {
+		t.Fatalf("Invalid template %d %s", code, b)
+	}
+
+	// taken ids are skipped
+	ds.CreateAsset("host", "web-prod-0002", map[string]interface{}{}, false)
+
+	var ids []string
+	for _, env := range []string{"prod", "prod", "dev", "prod"} {
+		code, b := testRequest(t, "POST", srv.URL+"/v1/host", map[string]interface{}{"role": "web", "environment": env})
+		var rsp map[string]string
+		if json.Unmarshal(b, &rsp); code != 200 {
+			t.Fatalf("POST %d %s", code, b)
+		}
+		ids = append(ids, rsp["id"])
+	}
+	if strings.Join(ids, ",") != "web-prod-0001,web-prod-0003,web-dev-0001,web-prod-0004" {
+		t.Fatalf("Wrong ids: %v", ids)
+	}
+	if code, b := testRequest(t, "GET", srv.URL+"/v1/host/web-dev-0001", nil); code != 200 ||
+		!strings.Contains(string(b), `"environment":"dev"`) {
+		t.Fatalf("GET generated %d %s", code, b)
+	}
+	if code, b := testRequest(t, "POST", srv.URL+"/v1/host", map[string]interface{}{"role": "db"}); code != 400 ||
+		!strings.Contains(string(b), "'environment' field required to generate the id") {
+		t.Fatalf("Missing template field %d %s", code, b)
+	}
+	if code, b := testRequest(t, "POST", srv.URL+"/v1/host", map[string]interface{}{"environment": "dev"}); code != 400 ||
+		!strings.Contains(string(b), "'role' field required") {
+		t.Fatalf("Required fields not checked %d %s", code, b)
+	}
+
+	if code, b := testRequest(t, "POST", srv.URL+"/v1/host", map[string]interface{}{"role": "web/db", "environment": "dev"}); code != 400 ||
+		!strings.Contains(string(b), "'role' field may not contain") {
+		t.Fatalf("Unsafe template field %d %s", code, b)
+	}
+
+	// ids are normalized by the rules of the type
+	testRequest(t, "PUT", srv.URL+"/v1/_types/host", map[string]interface{}{"id_template": "{role}-{seq}", "id_case": "lower"})
+	code, b := testRequest(t, "POST", srv.URL+"/v1/host", map[string]interface{}{"role": "DB", "status": "up", "environment": "dev"})
+	if code != 200 || !strings.Contains(string(b), `"db-1"`) {
+		t.Fatalf("POST normalized %d %s", code, b)
+	}
+
+	// without a template ids are uuids
+	ds.CreateAsset("other", "seed", map[string]interface{}{}, true)
+	code, b = testRequest(t, "POST", srv.URL+"/v1/other", map[string]interface{}{"status": "up", "environment": "dev"})
+	var rsp map[string]string
+	if json.Unmarshal(b, &rsp); code != 200 || len(rsp["id"]) != 36 {
+		t.Fatalf("POST uuid %d %s", code, b)
+	}
+}
+
+func Test_Inventory_UniqueFields(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+
+	// duplicates from before the fields were unique
+	for id, ip := range map[string]string{"vs1": "10.0.0.1", "vs2": "10.0.0.1", "vs3": "10.0.0.2"} {
+		ds.CreateAsset("virtualserver", id, map[string]interface{}{"status": "running", "environment": "dev", "ip": ip}, true)
+	}
+
+	code, b := testRequest(t, "GET", srv.URL+"/v1/_types/virtualserver/unique", nil)
+	if code != 400 {
+		t.Fatalf("Report without unique fields %d %s", code, b)
+	}
+	code, b = testRequest(t, "GET", srv.URL+"/v1/_types/virtualserver/unique?fields=ip,mac", nil)
+	var report UniqueReport
+	if json.Unmarshal(b, &report); code != 200 || len(report.Violations) != 1 || report.Violations[0].Value != "10.0.0.1" ||
+		len(report.Violations[0].Ids) != 2 {
+		t.Fatalf("Report %d %s", code, b)
+	}
+
+	if code, b = testRequest(t, "PUT", srv.URL+"/v1/_types/virtualserver", map[string]interface{}{"unique_fields": []string{"ip", ""}}); code != 400 {
+		t.Fatalf("Invalid unique field %d %s", code, b)
+	}
+	if code, b = testRequest(t, "PUT", srv.URL+"/v1/_types/virtualserver", map[string]interface{}{"unique_fields": []string{"ip"}}); code != 200 {
+		t.Fatalf("PUT type %d %s", code, b)
+	}
+	code, b = testRequest(t, "GET", srv.URL+"/v1/_types/virtualserver/unique", nil)
+	if json.Unmarshal(b, &report); code != 200 || len(report.Violations) != 1 || report.Fields[0] != "ip" {
+		t.Fatalf("Report declared fields %d %s", code, b)
+	}
+
+	asset := map[string]interface{}{"status": "running", "environment": "dev", "ip": "10.0.0.2"}
+	code, b = testRequest(t, "POST", srv.URL+"/v1/virtualserver/vs4", asset)
+	var rsp struct {
+		Error    string        `json:"error"`
+		Conflict ConflictError `json:"conflict"`
+	}
+	if json.Unmarshal(b, &rsp); code != 409 || rsp.Conflict.Id != "vs3" || rsp.Conflict.Field != "ip" ||
+		!strings.Contains(rsp.Error, "virtualserver/vs3") {
+		t.Fatalf("POST conflict %d %s", code, b)
+	}
+	if code, b = testRequest(t, "PUT", srv.URL+"/v1/virtualserver/vs3", map[string]interface{}{"ip": "10.0.0.1"}); code != 409 {
+		t.Fatalf("PUT conflict %d %s", code, b)
+	}
+	if code, b = testRequest(t, "PUT", srv.URL+"/v1/virtualserver/vs3", map[string]interface{}{"ip": "10.0.0.3"}); code != 200 {
+		t.Fatalf("PUT %d %s", code, b)
+	}
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/virtualserver/vs4", asset); code != 200 {
+		t.Fatalf("POST freed value %d %s", code, b)
+	}
+
+	// restoring the old value of vs3 would duplicate vs4
+	req, _ := http.NewRequest("POST", srv.URL+"/v1/virtualserver/vs3/versions/1/restore", nil)
+	req.SetBasicAuth("admin", testUsers["admin"])
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	rsp.Conflict = ConflictError{}
+	if json.Unmarshal(b, &rsp); resp.StatusCode != 409 || resp.Header.Get("Content-Type") != "application/json" || rsp.Conflict.Id != "vs4" {
+		t.Fatalf("Restore conflict %d %v %s", resp.StatusCode, resp.Header, b)
+	}
+}
+
+func Test_Inventory_Relationships(t *testing.T) {
+	srv, _ := newTestInventoryServer(t)
+	defer srv.Close()
+
+	types := map[string]interface{}{
+		"rack":       map[string]interface{}{},
+		"hypervisor": map[string]interface{}{"relationships": map[string]interface{}{"member_of": map[string]interface{}{"targets": []string{"rack"}}}},
+		"vm":         map[string]interface{}{"relationships": map[string]interface{}{"runs_on": map[string]interface{}{"targets": []string{"hypervisor"}, "on_delete": "cascade"}}},
+		"service":    map[string]interface{}{"relationships": map[string]interface{}{"depends_on": map[string]interface{}{"on_delete": "unlink"}}},
+	}
+	for name, def := range types {
+		if code, b := testRequest(t, "POST", srv.URL+"/v1/_types/"+name, def); code != 200 {
+			t.Fatalf("POST type %s %d %s", name, code, b)
+		}
+	}
+	for _, rel := range []map[string]interface{}{{"Runs-On": map[string]interface{}{}}, {"runs_on": map[string]interface{}{"on_delete": "never"}}} {
+		if code, b := testRequest(t, "POST", srv.URL+"/v1/_types/bad", map[string]interface{}{"relationships": rel}); code != 400 {
+			t.Fatalf("Invalid relationship %v %d %s", rel, code, b)
+		}
+	}
+
+	asset := func(rels map[string]interface{}) map[string]interface{} {
+		a := map[string]interface{}{"status": "running", "environment": "prod"}
+		if rels != nil {
+			a["relationships"] = rels
+		}
+		return a
+	}
+	if code, b := testRequest(t, "POST", srv.URL+"/v1/rack/r1", asset(nil)); code != 200 {
+		t.Fatalf("POST %d %s", code, b)
+	}
+	if code, b := testRequest(t, "POST", srv.URL+"/v1/hypervisor/hv1", asset(map[string]interface{}{"member_of": []string{"rack/r1"}})); code != 200 {
+		t.Fatalf("POST with relationship %d %s", code, b)
+	}
+	for _, rels := range []map[string]interface{}{
+		{"runs_on": []string{"hypervisor/none"}},
+		{"runs_on": []string{"rack/r1"}},
+		{"member_of": []string{"rack/r1"}},
+		{"runs_on": "hypervisor/hv1"},
+	} {
+		if code, b := testRequest(t, "POST", srv.URL+"/v1/vm/vm1", asset(rels)); code != 400 {
+			t.Fatalf("Invalid relationship %v %d %s", rels, code, b)
+		}
+	}
+
+	if code, b := testRequest(t, "POST", srv.URL+"/v1/vm/vm1", asset(nil)); code != 200 {
+		t.Fatalf("POST %d %s", code, b)
+	}
+	rel := map[string]interface{}{"relationship": "runs_on", "type": "hypervisor", "id": "hv1"}
+	if code, b := testRequest(t, "POST", srv.URL+"/v1/vm/vm1/relationships", rel); code != 200 {
+		t.Fatalf("POST relationship %d %s", code, b)
+	}
+	if code, b := testRequest(t, "POST", srv.URL+"/v1/vm/vm1/relationships", rel); code != 200 {
+		t.Fatalf("POST existing relationship %d %s", code, b)
+	}
+	code, b := testRequest(t, "GET", srv.URL+"/v1/vm/vm1/versions", nil)
+	if code != 200 || strings.Count(string(b), `"version"`) != 1 {
+		t.Fatalf("Relationship versions %d %s", code, b)
+	}
+	if code, b := testRequest(t, "POST", srv.URL+"/v1/service/svc1", asset(map[string]interface{}{"depends_on": []string{"vm/vm1", "hypervisor/hv1"}})); code != 200 {
+		t.Fatalf("POST %d %s", code, b)
+	}
+
+	code, b = testRequest(t, "GET", srv.URL+"/v1/hypervisor/hv1/relationships", nil)
+	var rels AssetRelationships
+	json.Unmarshal(b, &rels)
+	expected := AssetRelationships{
+		Outgoing: []AssetRelationship{{Relationship: "member_of", Type: "rack", Id: "r1"}},
+		Incoming: []AssetRelationship{{Relationship: "depends_on", Type: "service", Id: "svc1"}, {Relationship: "runs_on", Type: "vm", Id: "vm1"}},
+	}
+	if code != 200 || !reflect.DeepEqual(rels, expected) {
+		t.Fatalf("GET relationships %d %s", code, b)
+	}
+	code, b = testRequest(t, "GET", srv.URL+"/v1/hypervisor/hv1/relationships?relationship=runs_on", nil)
+	if json.Unmarshal(b, &rels); code != 200 || len(rels.Outgoing) != 0 || len(rels.Incoming) != 1 {
+		t.Fatalf("GET relationships filtered %d %s", code, b)
+	}
+
+	code, b = testRequest(t, "DELETE", srv.URL+"/v1/rack/r1", nil)
+	if code != 409 || !strings.Contains(string(b), `"id":"hv1"`) {
+		t.Fatalf("DELETE restricted %d %s", code, b)
+	}
+	// nor can the assets go with their type
+	code, b = testRequest(t, "DELETE", srv.URL+"/v1/_types/rack?force=true", nil)
+	if code != 409 || !strings.Contains(string(b), `"target":"rack/r1"`) {
+		t.Fatalf("DELETE type restricted %d %s", code, b)
+	}
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/rack/r1", nil); code != 200 {
+		t.Fatalf("Asset of restricted type removed %d %s", code, b)
+	}
+
+	if code, b = testRequest(t, "DELETE", srv.URL+"/v1/service/svc1/relationships/depends_on/vm/vm1", nil); code != 200 {
+		t.Fatalf("DELETE relationship %d %s", code, b)
+	}
+	if code, b = testRequest(t, "DELETE", srv.URL+"/v1/service/svc1/relationships/depends_on/vm/vm1", nil); code != 404 {
+		t.Fatalf("DELETE removed relationship %d %s", code, b)
+	}
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/service/svc1/relationships", map[string]interface{}{"relationship": "depends_on", "type": "vm", "id": "vm1"}); code != 200 {
+		t.Fatalf("POST relationship %d %s", code, b)
+	}
+
+	// vm1 goes with hv1 and svc1 is unlinked from both
+	code, b = testRequest(t, "DELETE", srv.URL+"/v1/hypervisor/hv1", nil)
+	var deleted struct {
+		Deleted  []string            `json:"deleted"`
+		Unlinked []AssetRelationship `json:"unlinked"`
+	}
+	if json.Unmarshal(b, &deleted); code != 200 || !reflect.DeepEqual(deleted.Deleted, []string{"hypervisor/hv1", "vm/vm1"}) ||
+		len(deleted.Unlinked) != 2 {
+		t.Fatalf("DELETE cascade %d %s", code, b)
+	}
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/vm/vm1", nil); code != 404 {
+		t.Fatalf("Cascaded asset %d %s", code, b)
+	}
+	code, b = testRequest(t, "GET", srv.URL+"/v1/service/svc1/relationships", nil)
+	if json.Unmarshal(b, &rels); code != 200 || len(rels.Outgoing) != 0 {
+		t.Fatalf("Unlinked relationships %d %s", code, b)
+	}
+
+	// vm1 can not come back without its hypervisor
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/vm/vm1/undelete", nil); code != 409 {
+		t.Fatalf("Undelete without target %d %s", code, b)
+	}
+	if code, b = testRequest(t, "DELETE", srv.URL+"/v1/rack/r1", nil); code != 200 {
+		t.Fatalf("DELETE %d %s", code, b)
+	}
+
+	// relationships added are validated against the schema
+	sw := map[string]interface{}{
+		"relationships": map[string]interface{}{"uplink": map[string]interface{}{}},
+		"schema": map[string]interface{}{"properties": map[string]interface{}{"relationships": map[string]interface{}{
+			"properties": map[string]interface{}{"uplink": map[string]interface{}{"maxItems": 1}},
+		}}},
+	}
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/_types/switch", sw); code != 200 {
+		t.Fatalf("POST type %d %s", code, b)
+	}
+	testRequest(t, "POST", srv.URL+"/v1/rack/r2", asset(nil))
+	testRequest(t, "POST", srv.URL+"/v1/rack/r3", asset(nil))
+	if code, b = testRequest(t, "POST", srv.URL+"/v1/switch/sw1", map[string]interface{}{"relationships": map[string]interface{}{"uplink": []string{"rack/r2"}}}); code != 200 {
+		t.Fatalf("POST %d %s", code, b)
+	}
+	code, b = testRequest(t, "POST", srv.URL+"/v1/switch/sw1/relationships", map[string]interface{}{"relationship": "uplink", "type": "rack", "id": "r3"})
+	if code != 400 || !isSchemaErrorResponse(b) {
+		t.Fatalf("POST relationship failing schema %d %s", code, b)
+	}
+}
+
+func Test_Inventory_Graph(t *testing.T) {
+	srv, _ := newTestInventoryServer(t)
+	defer srv.Close()
+
+	types := map[string]interface{}{
+		"rack":       map[string]interface{}{},
+		"hypervisor": map[string]interface{}{"relationships": map[string]interface{}{"member_of": map[string]interface{}{"targets": []string{"rack"}}}},
+		"vm":         map[string]interface{}{"relationships": map[string]interface{}{"runs_on": map[string]interface{}{"targets": []string{"hypervisor"}}}},
+		"service":    map[string]interface{}{"relationships": map[string]interface{}{"depends_on": map[string]interface{}{}}},
+	}
+	for name, def := range types {
+		if code, b := testRequest(t, "POST", srv.URL+"/v1/_types/"+name, def); code != 200 {
+			t.Fatalf("POST type %s %d %s", name, code, b)
+		}
+	}
+
+	assets := []struct {
+		ref, env, rel, target string
+	}{
+		{"rack/r1", "prod", "", ""},
+		{"hypervisor/hv1", "prod", "member_of", "rack/r1"},
+		{"hypervisor/hv2", "prod", "member_of", "rack/r1"},
+		{"vm/vm1", "prod", "runs_on", "hypervisor/hv1"},
+		{"vm/vm2", "dev", "runs_on", "hypervisor/hv1"},
+		{"vm/vm3", "prod", "runs_on", "hypervisor/hv2"},
+		{"service/svc1", "prod", "depends_on", "vm/vm1"},
+		{"service/svc2", "prod", "depends_on", "service/svc1"},
+	}
+	for _, a := range assets {
+		data := map[string]interface{}{"status": "running", "environment": a.env}
+		if len(a.rel) > 0 {
+			data["relationships"] = map[string]interface{}{a.rel: []string{a.target}}
+		}
+		if code, b := testRequest(t, "POST", srv.URL+"/v1/"+a.ref, data); code != 200 {
+			t.Fatalf("POST %s %d %s", a.ref, code, b)
+		}
+	}
+	// a cycle
+	if code, b := testRequest(t, "POST", srv.URL+"/v1/service/svc1/relationships",
+		map[string]interface{}{"relationship": "depends_on", "type": "service", "id": "svc2"}); code != 200 {
+		t.Fatalf("POST relationship %d %s", code, b)
+	}
+
+	nodes := func(graph AssetGraph) []string {
+		refs := []string{}
+		for _, n := range graph.Nodes {
+			refs = append(refs, relationshipRef(n.Type, n.Id))
+		}
+		return refs
+	}
+	for query, expected := range map[string][]string{
+		"":                                 {"hypervisor/hv1", "rack/r1", "vm/vm1", "vm/vm2"},
+		"?depth=2&direction=in":            {"hypervisor/hv1", "vm/vm1", "vm/vm2", "service/svc1"},
+		"?depth=3&direction=out":           {"hypervisor/hv1", "rack/r1"},
+		"?depth=2&rel=member_of":           {"hypervisor/hv1", "rack/r1", "hypervisor/hv2"},
+		"?depth=10&rel=runs_on,depends_on": {"hypervisor/hv1", "vm/vm1", "vm/vm2", "service/svc1", "service/svc2"},
+		"?depth=0":                         {"hypervisor/hv1"},
+	} {
+		code, b := testRequest(t, "GET", srv.URL+"/v1/hypervisor/hv1/graph"+query, nil)
+		var graph AssetGraph
+		if json.Unmarshal(b, &graph); code != 200 || !reflect.DeepEqual(nodes(graph), expected) {
+			t.Fatalf("GET graph%s %d %s", query, code, b)
+		}
+	}
+
+	code, b := testRequest(t, "GET", srv.URL+"/v1/hypervisor/hv1/graph?format=dot", nil)
+	if code != 200 || !strings.HasPrefix(string(b), `digraph "hypervisor/hv1" {`) ||
+		!strings.Contains(string(b), `"vm/vm1" -> "hypervisor/hv1" [label="runs_on"];`) {
+		t.Fatalf("GET graph dot %d %s", code, b)
+	}
+	for _, query := range []string{"?direction=up", "?depth=11", "?depth=-1", "?format=svg"} {
+		if code, b = testRequest(t, "GET", srv.URL+"/v1/hypervisor/hv1/graph"+query, nil); code != 400 {
+			t.Fatalf("GET graph%s %d %s", query, code, b)
+		}
+	}
+	if code, b = testRequest(t, "GET", srv.URL+"/v1/hypervisor/none/graph", nil); code != 404 {
+		t.Fatalf("GET graph of missing asset %d %s", code, b)
+	}
+
+	code, b = testRequest(t, "GET", srv.URL+"/v1/rack/r1/impact", nil)
+	var report ImpactReport
+	expected := ImpactReport{Asset: "rack/r1", Count: 7, Groups: []ImpactGroup{
+		{Type: "hypervisor", Environment: "prod", Count: 2, Ids: []string{"hv1", "hv2"}},
+		{Type: "service", Environment: "prod", Count: 2, Ids: []string{"svc1", "svc2"}},
+		{Type: "vm", Environment: "dev", Count: 1, Ids: []string{"vm2"}},
+		{Type: "vm", Environment: "prod", Count: 2, Ids: []string{"vm1", "vm3"}},
+	}}
+	if json.Unmarshal(b, &report); code != 200 || !reflect.DeepEqual(report, expected) {
+		t.Fatalf("GET impact %d %s", code, b)
+	}
+	code, b = testRequest(t, "GET", srv.URL+"/v1/rack/r1/impact?rel=member_of", nil)
+	if json.Unmarshal(b, &report); code != 200 || report.Count != 2 {
+		t.Fatalf("GET impact of relationship %d %s", code, b)
+	}
+	code, b = testRequest(t, "GET", srv.URL+"/v1/service/svc2/impact", nil)
+	if json.Unmarshal(b, &report); code != 200 || report.Count != 1 || report.Groups[0].Ids[0] != "svc1" {
+		t.Fatalf("GET impact with cycle %d %s", code, b)
+	}
+}
+
+func Test_Inventory_AdminAuth(t *testing.T) {
+	srv, ds := newTestInventoryServer(t)
+	defer srv.Close()
+	ds.CreateAsset("virtualserver", "seed", map[string]interface{}{"status": "running", "environment": "dev"}, true)
+
+	asset := map[string]interface{}{"status": "running", "environment": "dev"}
+	admin := []struct{ method, url string }{
+		{"POST", "/v1/_types/rack"},
+		{"PUT", "/v1/_schemas/virtualserver"},
+		{"POST", "/v1/_admin/prune"},
+		{"GET", "/v1/_admin/ids"},
+	}
+	for _, req := range admin {
+		if code, b := testRequestAs(t, "user1", req.method, srv.URL+req.url, map[string]interface{}{}); code != 403 {
+			t.Fatalf("%s %s by non admin %d %s", req.method, req.url, code, b)
+		}
+		if code, b := testRequestAs(t, "", req.method, srv.URL+req.url, map[string]interface{}{}); code != 401 {
+			t.Fatalf("%s %s unauthenticated %d %s", req.method, req.url, code, b)
+		}
+	}
+	if code, b := testRequestAs(t, "user1", "POST", srv.URL+"/v1/newtype/a", asset); code != 400 {
+		t.Fatalf("Type created by non admin %d %s", code, b)
+	}
+	if code, b := testRequestAs(t, "user1", "POST", srv.URL+"/v1/virtualserver/a", asset); code != 200 {
+		t.Fatalf("POST by non admin %d %s", code, b)
+	}
+	if code, b := testRequest(t, "POST", srv.URL+"/v1/newtype/a", asset); code != 200 {
+		t.Fatalf("Type created by admin %d %s", code, b)
+	}
+
+	// nobody can be identified as an admin with auth disabled
+	noAuth, ds := newTestInventoryServerWithAuth(t, nil)
+	defer noAuth.Close()
+	ds.CreateAsset("virtualserver", "seed", asset, true)
+
+	for _, req := range admin {
+		if code, b := testRequest(t, req.method, noAuth.URL+req.url, map[string]interface{}{}); code != 403 {
+			t.Fatalf("%s %s with auth disabled %d %s", req.method, req.url, code, b)
+		}
+	}
+	if code, b := testRequest(t, "POST", noAuth.URL+"/v1/newtype/a", asset); code != 400 {
+		t.Fatalf("Type created with auth disabled %d %s", code, b)
+	}
+	if code, b := testRequest(t, "POST", noAuth.URL+"/v1/virtualserver/a", asset); code != 200 {
+		t.Fatalf("POST with auth disabled %d %s", code, b)
+	}
+}
@@ -0,0 +1,954 @@
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/golang/glog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	kvTypesBucket    = "types"
+	kvAssetsBucket   = "assets"
+	kvVersionsBucket = "versions"
+	kvSystemBucket   = "system"
+	kvSequenceBucket = "sequences"
+	kvUniqueBucket   = "unique"
+	kvMetaBucket     = "meta"
+)
+
+/* Marks version keys written with escaped ids, see migrateVersionKeys */
+const kvVersionKeysEscaped = "version_keys_escaped"
+
+/* Number of records read per transaction when iterating a bucket */
+const kvBatchSize = 500
+
+var errReadOnlyTx = fmt.Errorf("Read only transaction")
+
+/*
+   Minimal transactional key/value interface.  Keys within a bucket are
+   iterated in sorted order.
+*/
+type KVTx interface {
+	Get(bucket, key string) []byte
+	Put(bucket, key string, value []byte) error
+	Delete(bucket, key string) error
+	// Call fn for each key in bucket starting with prefix
+	ForEach(bucket, prefix string, fn func(key string, value []byte) error) error
+	// Up to limit keys in bucket starting with prefix that sort after the key after, and their values
+	Range(bucket, prefix, after string, limit int) (keys []string, values [][]byte)
+}
+
+type KVStore interface {
+	View(fn func(KVTx) error) error
+	Update(fn func(KVTx) error) error
+	Close() error
+}
+
+/* Record as stored in the assets and versions buckets */
+type kvRecord struct {
+	Id        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	Version   int64                  `json:"version,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+	Data      map[string]interface{} `json:"data"`
+
+	Deleted   bool       `json:"deleted,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+/*
+   IDatastore implementation on top of a KVStore.  Mirrors the behaviour of
+   InventoryDatastore.
+*/
+type KVDatastore struct {
+	Store KVStore
+}
+
+func NewKVDatastore(store KVStore) *KVDatastore {
+	return &KVDatastore{Store: store}
+}
+
+func (ds *KVDatastore) Close() error {
+	return ds.Store.Close()
+}
+
+/* KVStore running everything in one transaction, see Batch */
+type kvTxStore struct {
+	tx KVTx
+}
+
+func (s kvTxStore) View(fn func(KVTx) error) error {
+	return fn(s.tx)
+}
+
+func (s kvTxStore) Update(fn func(KVTx) error) error {
+	return fn(s.tx)
+}
+
+func (s kvTxStore) Close() error {
+	return nil
+}
+
+/* Run fn in a single write transaction, rolled back if fn returns an error */
+func (ds *KVDatastore) Batch(fn func(IDatastore) error) error {
+	return ds.Store.Update(func(tx KVTx) error {
+		return fn(NewKVDatastore(kvTxStore{tx}))
+	})
+}
+
+func kvAssetKey(assetType, assetId string) string {
+	return assetType + "/" + assetId
+}
+
+/*
+   Ids may contain / so they are escaped in version keys.  Otherwise the
+   versions of a/x would be listed with those of a.
+*/
+func kvVersionPrefix(assetType, assetId string) string {
+	return assetType + "/" + url.PathEscape(assetId) + "/"
+}
+
+func kvVersionKey(assetType, assetId string, version int64) string {
+	return fmt.Sprintf("%s%020d", kvVersionPrefix(assetType, assetId), version)
+}
+
+/*
+   Rewrite version keys stored before ids were escaped in them.  Done once,
+   the meta bucket records it.
+*/
+func (ds *KVDatastore) migrateVersionKeys() (migrated int, err error) {
+	err = ds.Store.Update(func(tx KVTx) error {
+		if tx.Get(kvMetaBucket, kvVersionKeysEscaped) != nil {
+			return nil
+		}
+
+		var (
+			oldKeys, newKeys []string
+			values           [][]byte
+		)
+		if err := tx.ForEach(kvVersionsBucket, "", func(k string, v []byte) error {
+			var rec kvRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			version, err := strconv.ParseInt(k[strings.LastIndex(k, "/")+1:], 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid version key: %s", k)
+			}
+			if key := kvVersionKey(rec.Type, rec.Id, version); key != k {
+				oldKeys, newKeys, values = append(oldKeys, k), append(newKeys, key), append(values, v)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		// an old key may be the new key of another so all are removed first
+		for _, k := range oldKeys {
+			if err := tx.Delete(kvVersionsBucket, k); err != nil {
+				return err
+			}
+		}
+		for i, k := range newKeys {
+			if err := tx.Put(kvVersionsBucket, k, values[i]); err != nil {
+				return err
+			}
+		}
+		migrated = len(oldKeys)
+		return tx.Put(kvMetaBucket, kvVersionKeysEscaped, []byte("true"))
+	})
+	return
+}
+
+func kvSystemKey(kind, name string) string {
+	return kind + "/" + name
+}
+
+func kvGetRecord(tx KVTx, bucket, key string) (rec *kvRecord, err error) {
+	b := tx.Get(bucket, key)
+	if b == nil {
+		return
+	}
+	rec = &kvRecord{}
+	err = json.Unmarshal(b, rec)
+	return
+}
+
+func kvPutRecord(tx KVTx, bucket, key string, rec *kvRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return tx.Put(bucket, key, b)
+}
+
+/* Deep copy of write data so later changes by the caller are not stored */
+func copyDocument(data map[string]interface{}) (m map[string]interface{}, err error) {
+	var b []byte
+	if b, err = json.Marshal(data); err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &m)
+	return
+}
+
+func (rec *kvRecord) asset() Asset {
+	asset := Asset{
+		Id:        rec.Id,
+		Type:      rec.Type,
+		Version:   rec.Version,
+		Timestamp: rec.Timestamp,
+		Data:      rec.Data,
+		Deleted:   rec.Deleted,
+		DeletedBy: rec.DeletedBy,
+		DeletedAt: rec.DeletedAt,
+	}
+	return asset
+}
+
+func (ds *KVDatastore) GetAsset(assetType, assetId string) (asset Asset, err error) {
+	var rec *kvRecord
+	err = ds.Store.View(func(tx KVTx) (err error) {
+		rec, err = kvGetRecord(tx, kvAssetsBucket, kvAssetKey(assetType, assetId))
+		return
+	})
+	if err == nil && rec != nil {
+		asset = rec.asset()
+		return
+	}
+	err = fmt.Errorf("Not found: %s/%s %v", assetType, assetId, err)
+	return
+}
+
+func (ds *KVDatastore) GetAssetVersion(assetType, assetId string, version int64) (asset Asset, err error) {
+	var rec *kvRecord
+	err = ds.Store.View(func(tx KVTx) (err error) {
+		rec, err = kvGetRecord(tx, kvVersionsBucket, kvVersionKey(assetType, assetId, version))
+		return
+	})
+	if err == nil && rec != nil {
+		asset = rec.asset()
+		return
+	}
+	err = fmt.Errorf("Not found (%s/%s.%d): %v", assetType, assetId, version, err)
+	return
+}
+
+func (ds *KVDatastore) assetVersions(tx KVTx, assetType, assetId string) (recs []*kvRecord, err error) {
+	err = tx.ForEach(kvVersionsBucket, kvVersionPrefix(assetType, assetId), func(k string, v []byte) error {
+		var rec kvRecord
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return err
+		}
+		recs = append(recs, &rec)
+		return nil
+	})
+	return
+}
+
+/* Get `count` versions, newest first, skipping the newest `offset` */
+func (ds *KVDatastore) GetAssetVersions(assetType, assetId string, count, offset int64) (rslt SearchResult, err error) {
+	var recs []*kvRecord
+	if err = ds.Store.View(func(tx KVTx) (err error) {
+		recs, err = ds.assetVersions(tx, assetType, assetId)
+		return
+	}); err != nil {
+		return
+	}
+
+	rslt.Total = int64(len(recs))
+	rslt.From = int(offset)
+	rslt.Assets = []Asset{}
+	// keys are sorted ascending by version
+	for i := int64(len(recs)) - 1 - offset; i >= 0 && int64(len(rslt.Assets)) < count; i-- {
+		rslt.Assets = append(rslt.Assets, recs[i].asset())
+	}
+	return
+}
+
+/*
+   Copy the current record into the versions bucket with the next version
+   number.  The version timestamp is when the record was replaced.
+*/
+func (ds *KVDatastore) createAssetVersion(tx KVTx, rec *kvRecord) (version int64, err error) {
+	var recs []*kvRecord
+	if recs, err = ds.assetVersions(tx, rec.Type, rec.Id); err != nil {
+		return
+	}
+	version = 1
+	if len(recs) > 0 {
+		version = recs[len(recs)-1].Version + 1
+	}
+
+	vrec := *rec
+	vrec.Version = version
+	vrec.Timestamp = time.Now().UTC()
+	if rec.DeletedAt != nil {
+		vrec.Timestamp = *rec.DeletedAt
+	}
+	err = kvPutRecord(tx, kvVersionsBucket, kvVersionKey(rec.Type, rec.Id, version), &vrec)
+	return
+}
+
+func (ds *KVDatastore) CreateAsset(assetType, assetId string, data map[string]interface{}, createType bool) (id string, err error) {
+	var dmap map[string]interface{}
+	if dmap, err = copyDocument(data); err != nil {
+		return
+	}
+
+	err = ds.Store.Update(func(tx KVTx) error {
+		if tx.Get(kvTypesBucket, assetType) == nil {
+			if !createType {
+				types, _ := ds.listAssetTypes(tx)
+				return fmt.Errorf("Invalid asset type: %s.  Available types: %v", assetType, types)
+			}
+			log.V(6).Infof("Auto creating asset type: %s\n", assetType)
+			if err := tx.Put(kvTypesBucket, assetType, []byte("{}")); err != nil {
+				return err
+			}
+		}
+
+		key := kvAssetKey(assetType, assetId)
+		if tx.Get(kvAssetsBucket, key) != nil {
+			return fmt.Errorf("Asset already exists: %s", assetId)
+		}
+		if err := kvPutUnique(tx, assetType, assetId, nil, dmap); err != nil {
+			return err
+		}
+		return kvPutRecord(tx, kvAssetsBucket, key, &kvRecord{
+			Id:        assetId,
+			Type:      assetType,
+			Timestamp: time.Now().UTC(),
+			Data:      dmap,
+		})
+	})
+	if err == nil {
+		id = assetId
+	}
+	return
+}
+
+/*
+   Values of unique fields are indexed in the unique bucket as
+   <type>/<hash of field and value>/<asset id> so a write only reads the
+   keys of its own values.  The <type> key holds the unique fields the index
+   was built for.  The first write after they change rebuilds it, which also
+   indexes assets written before the fields were unique.
+*/
+func kvUniquePrefix(assetType, field string, value interface{}) string {
+	return assetType + "/" + essUniqueClaimId(assetType, field, value) + "/"
+}
+
+/* Unique fields of the type from its definition, with their index up to date */
+func kvUniqueFields(tx KVTx, assetType string) (fields []string, err error) {
+	if b := tx.Get(kvSystemBucket, kvSystemKey(systemDocTypes, assetType)); b != nil {
+		var t AssetType
+		if err = json.Unmarshal(b, &t); err != nil {
+			return
+		}
+		fields = t.UniqueFields
+	}
+
+	indexed := tx.Get(kvUniqueBucket, assetType)
+	if len(fields) < 1 {
+		if indexed != nil {
+			err = kvRemoveUniqueIndex(tx, assetType)
+		}
+		return
+	}
+	b, _ := json.Marshal(fields)
+	if string(indexed) == string(b) {
+		return
+	}
+
+	log.V(6).Infof("Indexing unique fields of %s: %v\n", assetType, fields)
+	if err = kvRemoveUniqueIndex(tx, assetType); err != nil {
+		return
+	}
+	if err = tx.ForEach(kvAssetsBucket, assetType+"/", func(k string, v []byte) error {
+		var rec kvRecord
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return err
+		}
+		return kvIndexUnique(tx, fields, assetType, rec.Id, rec.Data, tx.Put)
+	}); err != nil {
+		return
+	}
+	err = tx.Put(kvUniqueBucket, assetType, b)
+	return
+}
+
+func kvRemoveUniqueIndex(tx KVTx, assetType string) error {
+	// collected first as keys may not be deleted while iterating
+	keys := []string{}
+	if err := tx.ForEach(kvUniqueBucket, assetType+"/", func(k string, v []byte) error {
+		keys = append(keys, k)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range append(keys, assetType) {
+		if err := tx.Delete(kvUniqueBucket, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Call put, or delete, with the index key of each unique value of data */
+func kvIndexUnique(tx KVTx, fields []string, assetType, assetId string, data map[string]interface{},
+	op func(bucket, key string, value []byte) error) error {
+	for _, field := range fields {
+		for _, value := range uniqueValues(data, field) {
+			if err := op(kvUniqueBucket, kvUniquePrefix(assetType, field, value)+assetId, []byte(assetId)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+   Check data against the other assets of the type for the unique fields of
+   its definition, then index its values in place of those of old.  Either
+   may be nil.  Done within the write transaction so it is atomic.
+*/
+func kvPutUnique(tx KVTx, assetType, assetId string, old, data map[string]interface{}) error {
+	fields, err := kvUniqueFields(tx, assetType)
+	if err != nil || len(fields) < 1 {
+		return err
+	}
+
+	for _, field := range fields {
+		for _, value := range uniqueValues(data, field) {
+			prefix := kvUniquePrefix(assetType, field, value)
+			if err := tx.ForEach(kvUniqueBucket, prefix, func(k string, v []byte) error {
+				if id := k[len(prefix):]; id != assetId {
+					return &ConflictError{Type: assetType, Id: id, Field: field, Value: value}
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	remove := func(bucket, key string, value []byte) error {
+		return tx.Delete(bucket, key)
+	}
+	if err = kvIndexUnique(tx, fields, assetType, assetId, old, remove); err != nil {
+		return err
+	}
+	return kvIndexUnique(tx, fields, assetType, assetId, data, tx.Put)
+}
+
+/* Recursively merge src into dst the way elasticsearch partial updates do */
+func mergeDocument(dst, src map[string]interface{}) {
+	for k, v := range src {
+		sv, sok := v.(map[string]interface{})
+		dv, dok := dst[k].(map[string]interface{})
+		if sok && dok {
+			mergeDocument(dv, sv)
+		} else {
+			dst[k] = v
+		}
+	}
+}
+
+func (ds *KVDatastore) EditAsset(assetType, assetId string, data map[string]interface{}) (id string, err error) {
+	var dmap map[string]interface{}
+	if dmap, err = copyDocument(data); err != nil {
+		return
+	}
+
+	err = ds.Store.Update(func(tx KVTx) error {
+		key := kvAssetKey(assetType, assetId)
+		rec, err := kvGetRecord(tx, kvAssetsBucket, key)
+		if err != nil {
+			return err
+		} else if rec == nil {
+			return fmt.Errorf("Not found: %s/%s", assetType, assetId)
+		}
+
+		nver, err := ds.createAssetVersion(tx, rec)
+		if err != nil {
+			return err
+		}
+		log.V(10).Infof("Version created: %s/%s.%d\n", assetType, assetId, nver)
+
+		old := rec.Data
+		if rec.Data, err = copyDocument(old); err != nil {
+			return err
+		}
+		mergeDocument(rec.Data, dmap)
+		if err = kvPutUnique(tx, assetType, assetId, old, rec.Data); err != nil {
+			return err
+		}
+		rec.Timestamp = time.Now().UTC()
+		return kvPutRecord(tx, kvAssetsBucket, key, rec)
+	})
+	if err == nil {
+		id = assetId
+	}
+	return
+}
+
+func (ds *KVDatastore) ReplaceAsset(assetType, assetId string, data map[string]interface{}) (id string, err error) {
+	var dmap map[string]interface{}
+	if dmap, err = copyDocument(data); err != nil {
+		return
+	}
+
+	err = ds.Store.Update(func(tx KVTx) error {
+		key := kvAssetKey(assetType, assetId)
+		rec, err := kvGetRecord(tx, kvAssetsBucket, key)
+		if err != nil {
+			return err
+		}
+		var old map[string]interface{}
+		if rec != nil {
+			old = rec.Data
+		}
+		if err = kvPutUnique(tx, assetType, assetId, old, dmap); err != nil {
+			return err
+		}
+
+		if rec != nil {
+			nver, err := ds.createAssetVersion(tx, rec)
+			if err != nil {
+				return err
+			}
+			log.V(10).Infof("Version created: %s/%s.%d\n", assetType, assetId, nver)
+		} else {
+			rec = &kvRecord{Id: assetId, Type: assetType}
+		}
+
+		rec.Data = dmap
+		rec.Timestamp = time.Now().UTC()
+		return kvPutRecord(tx, kvAssetsBucket, key, rec)
+	})
+	if err == nil {
+		id = assetId
+	}
+	return
+}
+
+func (ds *KVDatastore) RemoveAsset(assetType, assetId, deletedBy string) bool {
+	err := ds.Store.Update(func(tx KVTx) error {
+		key := kvAssetKey(assetType, assetId)
+		rec, err := kvGetRecord(tx, kvAssetsBucket, key)
+		if err != nil {
+			return err
+		} else if rec == nil {
+			return fmt.Errorf("Not found: %s/%s", assetType, assetId)
+		}
+
+		// Tombstone
+		now := time.Now().UTC()
+		rec.Deleted, rec.DeletedBy, rec.DeletedAt = true, deletedBy, &now
+
+		nver, err := ds.createAssetVersion(tx, rec)
+		if err != nil {
+			return err
+		}
+		log.V(10).Infof("Version created: %s/%s.%d\n", assetType, assetId, nver)
+
+		if err = kvPutUnique(tx, assetType, assetId, rec.Data, nil); err != nil {
+			return err
+		}
+		return tx.Delete(kvAssetsBucket, key)
+	})
+	if err != nil {
+		log.Errorf("%s\n", err)
+		return false
+	}
+	return true
+}
+
+func (ds *KVDatastore) ListDeletedAssets(assetType string) (assets []Asset, err error) {
+	assets = []Asset{}
+	err = ds.Store.View(func(tx KVTx) error {
+		var last *kvRecord
+		// Versions are sorted by asset then version so the last of each asset is its latest
+		collect := func() {
+			if last != nil && last.Deleted && tx.Get(kvAssetsBucket, kvAssetKey(assetType, last.Id)) == nil {
+				assets = append(assets, last.asset())
+			}
+		}
+		err := tx.ForEach(kvVersionsBucket, assetType+"/", func(k string, v []byte) error {
+			var rec kvRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if last != nil && last.Id != rec.Id {
+				collect()
+			}
+			last = &rec
+			return nil
+		})
+		collect()
+		return err
+	})
+	return
+}
+
+func (ds *KVDatastore) assetHistory(tx KVTx, assetType, assetId string) (h *assetHistory, err error) {
+	var (
+		rec  *kvRecord
+		recs []*kvRecord
+	)
+	if rec, err = kvGetRecord(tx, kvAssetsBucket, kvAssetKey(assetType, assetId)); err != nil {
+		return
+	}
+	if recs, err = ds.assetVersions(tx, assetType, assetId); err != nil {
+		return
+	}
+
+	h = &assetHistory{Versions: make([]Asset, len(recs))}
+	if rec != nil {
+		current := rec.asset()
+		h.Current = &current
+	}
+	for i, r := range recs {
+		h.Versions[i] = r.asset()
+	}
+	return
+}
+
+func (ds *KVDatastore) GetAssetAsOf(assetType, assetId string, asOf time.Time) (asset Asset, err error) {
+	var h *assetHistory
+	if err = ds.Store.View(func(tx KVTx) (err error) {
+		h, err = ds.assetHistory(tx, assetType, assetId)
+		return
+	}); err != nil {
+		return
+	}
+
+	var ok bool
+	if asset, ok = h.asOf(asOf); !ok {
+		err = fmt.Errorf("Not found: %s/%s as of %s", assetType, assetId, asOf.Format(time.RFC3339))
+	}
+	return
+}
+
+func (ds *KVDatastore) SearchAsOf(assetTypes []string, asOf time.Time, query Query) (rslt SearchResult, err error) {
+	histories := map[string]*assetHistory{}
+	// Ids are only unique within a type
+	history := func(rec *kvRecord) *assetHistory {
+		key := rec.Type + "/" + rec.Id
+		if _, ok := histories[key]; !ok {
+			histories[key] = &assetHistory{}
+		}
+		return histories[key]
+	}
+
+	err = ds.Store.View(func(tx KVTx) error {
+		for _, prefix := range kvTypePrefixes(assetTypes) {
+			if err := tx.ForEach(kvAssetsBucket, prefix, func(k string, v []byte) error {
+				var rec kvRecord
+				if err := json.Unmarshal(v, &rec); err != nil {
+					return err
+				}
+				current := rec.asset()
+				history(&rec).Current = &current
+				return nil
+			}); err != nil {
+				return err
+			}
+			// Sorted by asset then version
+			if err := tx.ForEach(kvVersionsBucket, prefix, func(k string, v []byte) error {
+				var rec kvRecord
+				if err := json.Unmarshal(v, &rec); err != nil {
+					return err
+				}
+				h := history(&rec)
+				h.Versions = append(h.Versions, rec.asset())
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	rslt = searchAsOf(histories, asOf, query)
+	return
+}
+
+func (ds *KVDatastore) ForEachAssetVersions(assetType string, fn func(assetId string, versions []Asset) error) error {
+	return ds.Store.View(func(tx KVTx) error {
+		var (
+			assetId  string
+			versions []Asset
+		)
+		// Versions are sorted by asset then version
+		if err := tx.ForEach(kvVersionsBucket, assetType+"/", func(k string, v []byte) error {
+			var rec kvRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if len(versions) > 0 && rec.Id != assetId {
+				if err := fn(assetId, versions); err != nil {
+					return err
+				}
+				versions = nil
+			}
+			assetId = rec.Id
+			versions = append(versions, rec.asset())
+			return nil
+		}); err != nil {
+			return err
+		}
+		if len(versions) > 0 {
+			return fn(assetId, versions)
+		}
+		return nil
+	})
+}
+
+func (ds *KVDatastore) RemoveAssetVersions(assetType, assetId string, versions ...int64) error {
+	return ds.Store.Update(func(tx KVTx) error {
+		for _, v := range versions {
+			if err := tx.Delete(kvVersionsBucket, kvVersionKey(assetType, assetId, v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (ds *KVDatastore) listAssetTypes(tx KVTx) (types []string, err error) {
+	types = []string{}
+	err = tx.ForEach(kvTypesBucket, "", func(k string, v []byte) error {
+		types = append(types, k)
+		return nil
+	})
+	return
+}
+
+func (ds *KVDatastore) ListAssetTypes() (types []string, err error) {
+	err = ds.Store.View(func(tx KVTx) (err error) {
+		types, err = ds.listAssetTypes(tx)
+		return
+	})
+	return
+}
+
+func (ds *KVDatastore) CreateAssetType(assetType string) error {
+	return ds.Store.Update(func(tx KVTx) error {
+		if tx.Get(kvTypesBucket, assetType) != nil {
+			return nil
+		}
+		return tx.Put(kvTypesBucket, assetType, []byte("{}"))
+	})
+}
+
+func (ds *KVDatastore) RemoveAssetType(assetType string) error {
+	return ds.Store.Update(func(tx KVTx) error {
+		if tx.Get(kvTypesBucket, assetType) == nil {
+			return &NotFoundError{assetType}
+		}
+
+		// collected first as keys may not be deleted while iterating
+		keys := map[string][]string{}
+		for _, bucket := range []string{kvAssetsBucket, kvVersionsBucket, kvUniqueBucket} {
+			if err := tx.ForEach(bucket, assetType+"/", func(k string, v []byte) error {
+				keys[bucket] = append(keys[bucket], k)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		for bucket, bkeys := range keys {
+			for _, k := range bkeys {
+				if err := tx.Delete(bucket, k); err != nil {
+					return err
+				}
+			}
+		}
+		if err := tx.Delete(kvUniqueBucket, assetType); err != nil {
+			return err
+		}
+		return tx.Delete(kvTypesBucket, assetType)
+	})
+}
+
+func (ds *KVDatastore) Search(assetTypes []string, query Query) (rslt SearchResult, err error) {
+	var assets []Asset
+	if assets, err = ds.filterAssets(assetTypes, query.Filter); err != nil {
+		return
+	}
+
+	rslt = pageAssets(assets, query)
+	return
+}
+
+/* Aggregated in process over the matching assets */
+func (ds *KVDatastore) Aggregate(assetTypes []string, filter *Filter, agg Aggregation) (rslt AggregationResult, err error) {
+	var assets []Asset
+	if assets, err = ds.filterAssets(assetTypes, filter); err != nil {
+		return
+	}
+
+	rslt = aggregateAssets(assets, agg)
+	return
+}
+
+/*
+   Assets are passed to fn as they are read unless the query is sorted, in
+   which case all matches are sorted first.
+*/
+func (ds *KVDatastore) ForEachAsset(assetTypes []string, query Query, fn func(Asset) error) error {
+	project := func(a Asset) Asset {
+		if len(query.Fields) > 0 {
+			a.Data = projectFields(a.Data, query.Fields)
+		}
+		return a
+	}
+
+	if len(query.Sort) > 0 {
+		assets, err := ds.filterAssets(assetTypes, query.Filter)
+		if err != nil {
+			return err
+		}
+		sortAssets(assets, query.Sort)
+		for _, a := range assets {
+			if err = fn(project(a)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Read in batches so fn is called outside of a transaction
+	for _, prefix := range kvTypePrefixes(assetTypes) {
+		after := ""
+		for {
+			var keys []string
+			var vals [][]byte
+			if err := ds.Store.View(func(tx KVTx) error {
+				keys, vals = tx.Range(kvAssetsBucket, prefix, after, kvBatchSize)
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			for _, v := range vals {
+				var rec kvRecord
+				if err := json.Unmarshal(v, &rec); err != nil {
+					return err
+				}
+				if !query.Filter.Match(rec.Data) {
+					continue
+				}
+				if err := fn(project(rec.asset())); err != nil {
+					return err
+				}
+			}
+			if len(keys) < kvBatchSize {
+				break
+			}
+			after = keys[len(keys)-1]
+		}
+	}
+	return nil
+}
+
+/* Current assets of the types matching filter */
+func (ds *KVDatastore) filterAssets(assetTypes []string, filter *Filter) (assets []Asset, err error) {
+	assets = []Asset{}
+	err = ds.Store.View(func(tx KVTx) error {
+		for _, prefix := range kvTypePrefixes(assetTypes) {
+			if err := tx.ForEach(kvAssetsBucket, prefix, func(k string, v []byte) error {
+				var rec kvRecord
+				if err := json.Unmarshal(v, &rec); err != nil {
+					return err
+				}
+				if filter.Match(rec.Data) {
+					assets = append(assets, rec.asset())
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+/* Key prefixes to iterate for the types.  No types is every key. */
+func kvTypePrefixes(assetTypes []string) []string {
+	if len(assetTypes) < 1 {
+		return []string{""}
+	}
+	prefixes := make([]string, len(assetTypes))
+	for i, t := range assetTypes {
+		prefixes[i] = t + "/"
+	}
+	return prefixes
+}
+
+func (ds *KVDatastore) GetSystemDoc(kind, name string, doc interface{}) error {
+	var b []byte
+	ds.Store.View(func(tx KVTx) error {
+		b = tx.Get(kvSystemBucket, kvSystemKey(kind, name))
+		return nil
+	})
+	if b == nil {
+		return &NotFoundError{kind + "/" + name}
+	}
+	return json.Unmarshal(b, doc)
+}
+
+func (ds *KVDatastore) PutSystemDoc(kind, name string, doc interface{}) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return ds.Store.Update(func(tx KVTx) error {
+		return tx.Put(kvSystemBucket, kvSystemKey(kind, name), b)
+	})
+}
+
+func (ds *KVDatastore) RemoveSystemDoc(kind, name string) error {
+	return ds.Store.Update(func(tx KVTx) error {
+		key := kvSystemKey(kind, name)
+		if tx.Get(kvSystemBucket, key) == nil {
+			return &NotFoundError{kind + "/" + name}
+		}
+		return tx.Delete(kvSystemBucket, key)
+	})
+}
+
+func (ds *KVDatastore) ListSystemDocs(kind string) (names []string, err error) {
+	names = []string{}
+	err = ds.Store.View(func(tx KVTx) error {
+		return tx.ForEach(kvSystemBucket, kind+"/", func(k string, v []byte) error {
+			names = append(names, k[len(kind)+1:])
+			return nil
+		})
+	})
+	return
+}
+
+func (ds *KVDatastore) NextSequence(name string) (seq int64, err error) {
+	err = ds.Store.Update(func(tx KVTx) (err error) {
+		if b := tx.Get(kvSequenceBucket, name); b != nil {
+			if seq, err = strconv.ParseInt(string(b), 10, 64); err != nil {
+				return
+			}
+		}
+		seq++
+		return tx.Put(kvSequenceBucket, name, []byte(strconv.FormatInt(seq, 10)))
+	})
+	return
+}
@@ -0,0 +1,194 @@
+package inventory
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+   In memory KVStore.  Nothing is persisted.  Used for tests and small
+   deployments.
+*/
+type MemoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string]*memoryBucket
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*memoryBucket{}}
+}
+
+/* Values by key, with the keys kept sorted for prefix scans */
+type memoryBucket struct {
+	values map[string][]byte
+	keys   []string
+}
+
+func (b *memoryBucket) put(key string, value []byte) {
+	if _, ok := b.values[key]; !ok {
+		i := sort.SearchStrings(b.keys, key)
+		b.keys = append(b.keys, "")
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = key
+	}
+	b.values[key] = value
+}
+
+func (b *memoryBucket) delete(key string) {
+	if _, ok := b.values[key]; !ok {
+		return
+	}
+	i := sort.SearchStrings(b.keys, key)
+	b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	delete(b.values, key)
+}
+
+/* Keys starting with prefix that sort after the key after, up to limit unless negative */
+func (b *memoryBucket) scan(prefix, after string, limit int) []string {
+	start := prefix
+	if after >= start {
+		start = after + "\x00"
+	}
+	keys := []string{}
+	for i := sort.SearchStrings(b.keys, start); i < len(b.keys) && strings.HasPrefix(b.keys[i], prefix); i++ {
+		if limit >= 0 && len(keys) >= limit {
+			break
+		}
+		keys = append(keys, b.keys[i])
+	}
+	return keys
+}
+
+/* IDatastore backed by memory */
+func NewMemoryDatastore() *KVDatastore {
+	return NewKVDatastore(NewMemoryStore())
+}
+
+func (m *MemoryStore) View(fn func(KVTx) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return fn(&memoryTx{store: m, readOnly: true})
+}
+
+/* Writes are rolled back if fn returns an error */
+func (m *MemoryStore) Update(fn func(KVTx) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := &memoryTx{store: m}
+	if err := fn(tx); err != nil {
+		tx.rollback()
+		return err
+	}
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+type memoryUndo struct {
+	bucket string
+	key    string
+	value  []byte
+}
+
+type memoryTx struct {
+	store    *MemoryStore
+	readOnly bool
+	undo     []memoryUndo
+}
+
+func (tx *memoryTx) Get(bucket, key string) []byte {
+	if b, ok := tx.store.buckets[bucket]; ok {
+		if v, ok := b.values[key]; ok {
+			cp := make([]byte, len(v))
+			copy(cp, v)
+			return cp
+		}
+	}
+	return nil
+}
+
+func (tx *memoryTx) record(bucket, key string) {
+	var prev []byte
+	if b, ok := tx.store.buckets[bucket]; ok {
+		prev = b.values[key]
+	}
+	tx.undo = append(tx.undo, memoryUndo{bucket, key, prev})
+}
+
+func (tx *memoryTx) Put(bucket, key string, value []byte) error {
+	if tx.readOnly {
+		return errReadOnlyTx
+	}
+	tx.record(bucket, key)
+
+	b, ok := tx.store.buckets[bucket]
+	if !ok {
+		b = &memoryBucket{values: map[string][]byte{}}
+		tx.store.buckets[bucket] = b
+	}
+	cp := make([]byte, len(value))
+	copy(cp, value)
+	b.put(key, cp)
+	return nil
+}
+
+func (tx *memoryTx) Delete(bucket, key string) error {
+	if tx.readOnly {
+		return errReadOnlyTx
+	}
+	tx.record(bucket, key)
+
+	if b, ok := tx.store.buckets[bucket]; ok {
+		b.delete(key)
+	}
+	return nil
+}
+
+func (tx *memoryTx) ForEach(bucket, prefix string, fn func(key string, value []byte) error) error {
+	b, ok := tx.store.buckets[bucket]
+	if !ok {
+		return nil
+	}
+	// fn may modify the bucket so the keys are collected first
+	for _, k := range b.scan(prefix, "", -1) {
+		v, ok := b.values[k]
+		if !ok {
+			continue
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *memoryTx) Range(bucket, prefix, after string, limit int) (keys []string, values [][]byte) {
+	b, ok := tx.store.buckets[bucket]
+	if !ok {
+		return
+	}
+	keys = b.scan(prefix, after, limit)
+	for _, k := range keys {
+		cp := make([]byte, len(b.values[k]))
+		copy(cp, b.values[k])
+		values = append(values, cp)
+	}
+	return
+}
+
+func (tx *memoryTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		u := tx.undo[i]
+		if u.value == nil {
+			tx.store.buckets[u.bucket].delete(u.key)
+		} else {
+			tx.store.buckets[u.bucket].put(u.key, u.value)
+		}
+	}
+	tx.undo = nil
+}
@@ -0,0 +1,249 @@
+package inventory
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+var (
+	testMemDs = NewMemoryDatastore()
+)
+
+func Test_MemoryDatastore_CreateAsset(t *testing.T) {
+	if _, err := testMemDs.CreateAsset(testAssetType, testAssetId, testData, false); err == nil {
+		t.Fatalf("Should fail without createType")
+	}
+
+	id, err := testMemDs.CreateAsset(testAssetType, testAssetId, testData, true)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if id != testAssetId {
+		t.Fatalf("Wrong id: %s", id)
+	}
+
+	if _, err = testMemDs.CreateAsset(testAssetType, testAssetId, testData, true); err == nil {
+		t.Fatalf("Should fail on existing asset")
+	}
+	if _, err = testMemDs.CreateAsset(testAssetType, testAssetId2, testData2, false); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func Test_MemoryDatastore_GetAsset(t *testing.T) {
+	asset, err := testMemDs.GetAsset(testAssetType, testAssetId)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	d := asset.Data
+	if d["host"] != testData["host"] {
+		t.Fatalf("Wrong data: %#v", d)
+	}
+
+	if _, err = testMemDs.GetAsset(testAssetType, "does-not-exist"); err == nil {
+		t.Fatalf("Should not be found")
+	}
+}
+
+func Test_MemoryDatastore_EditAsset(t *testing.T) {
+	if _, err := testMemDs.EditAsset(testAssetType, testAssetId, testUpdateData); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	asset, _ := testMemDs.GetAsset(testAssetType, testAssetId)
+	d := asset.Data
+	if _, ok := d["name"]; !ok {
+		t.Fatalf("Overwrote exising object")
+	}
+	if d["host"] != testUpdateData["host"] {
+		t.Fatalf("Not updated: %#v", d)
+	}
+
+	if _, err := testMemDs.EditAsset(testAssetType, "does-not-exist", testUpdateData); err == nil {
+		t.Fatalf("Should fail on missing asset")
+	}
+}
+
+func Test_MemoryDatastore_GetAssetVersions(t *testing.T) {
+	testMemDs.EditAsset(testAssetType, testAssetId, map[string]interface{}{"host": "v3"})
+
+	rslt, err := testMemDs.GetAssetVersions(testAssetType, testAssetId, 10, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(rslt.Assets) != 2 {
+		t.Fatalf("Wrong version count: %d", len(rslt.Assets))
+	}
+
+	if rslt.Assets[0].Version != 2 {
+		t.Fatalf("Versions not sorted: %d", rslt.Assets[0].Version)
+	}
+
+	asset, err := testMemDs.GetAssetVersion(testAssetType, testAssetId, 1)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	d := asset.Data
+	if d["host"] != testData["host"] {
+		t.Fatalf("Wrong version data: %#v", d)
+	}
+}
+
+func Test_MemoryDatastore_ConcurrentEdits(t *testing.T) {
+	testConcurrentEdits(t, testMemDs, testAssetType, testAssetId)
+}
+
+func Test_MemoryDatastore_VersionIsolation(t *testing.T) {
+	testVersionIsolation(t, NewMemoryDatastore(), testAssetType)
+}
+
+func Test_MemoryDatastore_Search(t *testing.T) {
+	testMemDs.CreateAsset(testAssetType, "search1", map[string]interface{}{"cpus": 2, "os": "ubuntu"}, false)
+	testMemDs.CreateAsset(testAssetType, "search2", map[string]interface{}{"cpus": 8, "os": "centos"}, false)
+
+	query := Query{Filter: And(Terms("os", "ubuntu", "centos"), Compare(FilterGt, "cpus", 4))}
+	rslt, err := testMemDs.Search([]string{testAssetType}, query)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(rslt.Assets) != 1 || rslt.Assets[0].Id != "search2" {
+		t.Fatalf("Wrong results: %#v", rslt.Assets)
+	}
+	if b, _ := json.Marshal(rslt.Assets[0]); strings.Contains(string(b), "deleted_at") {
+		t.Fatalf("Live asset with deleted_at: %s", b)
+	}
+}
+
+func Test_MemoryDatastore_ListAssetTypes(t *testing.T) {
+	types, err := testMemDs.ListAssetTypes()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(types) != 1 || types[0] != testAssetType {
+		t.Fatalf("Wrong types: %#v", types)
+	}
+}
+
+func Test_MemoryDatastore_RemoveAsset(t *testing.T) {
+	if !testMemDs.RemoveAsset(testAssetType, testAssetId, "tester") {
+		t.Fatalf("Failed to remove asset")
+	}
+	if _, err := testMemDs.GetAsset(testAssetType, testAssetId); err == nil {
+		t.Fatalf("Did not remove asset")
+	}
+	if testMemDs.RemoveAsset(testAssetType, testAssetId, "tester") {
+		t.Fatalf("Removed missing asset")
+	}
+
+	rslt, _ := testMemDs.GetAssetVersions(testAssetType, testAssetId, 100, 0)
+	if len(rslt.Assets) != 23 {
+		t.Fatalf("Removal not versioned: %d", len(rslt.Assets))
+	}
+	if tomb := rslt.Assets[0]; !tomb.Deleted || tomb.DeletedBy != "tester" || tomb.DeletedAt == nil {
+		t.Fatalf("No tombstone: %#v", tomb)
+	}
+
+	deleted, err := testMemDs.ListDeletedAssets(testAssetType)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(deleted) != 1 || deleted[0].Id != testAssetId {
+		t.Fatalf("Wrong deleted assets: %#v", deleted)
+	}
+}
+
+func Test_MemoryDatastore_AsOf(t *testing.T) {
+	testAsOf(t, NewMemoryDatastore(), testAssetType)
+}
+
+func Test_MemoryDatastore_SystemDocs(t *testing.T) {
+	testSystemDocs(t, NewMemoryDatastore())
+}
+
+func Test_MemoryDatastore_Sequences(t *testing.T) {
+	testSequences(t, NewMemoryDatastore())
+}
+
+func Test_MemoryDatastore_UniqueFields(t *testing.T) {
+	testUniqueFields(t, NewMemoryDatastore())
+}
+
+func Test_MemoryDatastore_ForEachAsset(t *testing.T) {
+	testForEachAsset(t, NewMemoryDatastore())
+}
+
+func Test_MemoryDatastore_SlashIds(t *testing.T) {
+	testSlashIds(t, NewMemoryDatastore())
+}
+
+func Test_MemoryDatastore_Batch(t *testing.T) {
+	testBatch(t, NewMemoryDatastore())
+}
+
+func Test_MemoryDatastore_AssetTypes(t *testing.T) {
+	ds := NewMemoryDatastore()
+	if err := ds.CreateAssetType("rack"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	// exists already
+	if err := ds.CreateAssetType("rack"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := ds.CreateAsset("rack", "r1", map[string]interface{}{"rows": 2}, false); err != nil {
+		t.Fatalf("%s", err)
+	}
+	ds.EditAsset("rack", "r1", map[string]interface{}{"rows": 3})
+	ds.CreateAsset("racks", "r1", map[string]interface{}{"rows": 2}, true)
+
+	if err := ds.RemoveAssetType("rack"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if types, _ := ds.ListAssetTypes(); len(types) != 1 || types[0] != "racks" {
+		t.Fatalf("Type not removed: %v", types)
+	}
+	if _, err := ds.GetAsset("rack", "r1"); err == nil {
+		t.Fatalf("Asset not removed")
+	}
+	if _, err := ds.GetAssetVersion("rack", "r1", 1); err == nil {
+		t.Fatalf("Version not removed")
+	}
+	if _, err := ds.GetAsset("racks", "r1"); err != nil {
+		t.Fatalf("Other type removed: %s", err)
+	}
+	if err := ds.RemoveAssetType("rack"); !isNotFound(err) {
+		t.Fatalf("Expected not found: %v", err)
+	}
+}
+
+func Test_MemoryStore_Scan(t *testing.T) {
+	store := NewMemoryStore()
+	store.Update(func(tx KVTx) error {
+		for _, k := range []string{"b/2", "a/1", "b/1", "c/1", "b/3"} {
+			tx.Put("bkt", k, []byte(k))
+		}
+		return tx.Delete("bkt", "b/2")
+	})
+	// rolled back
+	store.Update(func(tx KVTx) error {
+		tx.Put("bkt", "b/0", []byte("b/0"))
+		tx.Delete("bkt", "b/3")
+		return errReadOnlyTx
+	})
+
+	store.View(func(tx KVTx) error {
+		keys := []string{}
+		tx.ForEach("bkt", "b/", func(k string, v []byte) error {
+			keys = append(keys, k)
+			return nil
+		})
+		if strings.Join(keys, ",") != "b/1,b/3" {
+			t.Fatalf("Wrong keys: %v", keys)
+		}
+		if keys, _ = tx.Range("bkt", "", "a/1", 2); strings.Join(keys, ",") != "b/1,b/3" {
+			t.Fatalf("Wrong range: %v", keys)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,403 @@
+package inventory
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* Default number of results returned by a search */
+const DefaultSearchSize = 10
+
+/* Largest page of results a search may request */
+const MaxSearchSize = 1000
+
+/*
+   Backend neutral asset.  Version is 0 for the current asset.  Timestamp is
+   the time of the write that produced the record if the backend tracks it.
+   Versions recording a delete (tombstones) have Deleted set.
+*/
+type Asset struct {
+	Id        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	Version   int64                  `json:"version,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+	Data      map[string]interface{} `json:"data"`
+
+	Deleted   bool       `json:"deleted,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+/* Filter operations */
+const (
+	FilterAnd      = "and"
+	FilterOr       = "or"
+	FilterNot      = "not"
+	FilterTerms    = "terms"
+	FilterGt       = "gt"
+	FilterGte      = "gte"
+	FilterLt       = "lt"
+	FilterLte      = "lte"
+	FilterExists   = "exists"
+	FilterPrefix   = "prefix"
+	FilterWildcard = "wildcard"
+	FilterRegexp   = "regexp"
+)
+
+/*
+   Node in a filter tree.  Boolean operations (and, or, not) use Filters,
+   all others apply to Field using Values.
+*/
+type Filter struct {
+	Op      string        `json:"op"`
+	Field   string        `json:"field,omitempty"`
+	Values  []interface{} `json:"values,omitempty"`
+	Filters []*Filter     `json:"filters,omitempty"`
+}
+
+func And(filters ...*Filter) *Filter {
+	return &Filter{Op: FilterAnd, Filters: filters}
+}
+
+/* And of the filters that are not nil.  nil if there are none. */
+func andFilters(filters ...*Filter) *Filter {
+	set := []*Filter{}
+	for _, f := range filters {
+		if f != nil {
+			set = append(set, f)
+		}
+	}
+	switch len(set) {
+	case 0:
+		return nil
+	case 1:
+		return set[0]
+	}
+	return And(set...)
+}
+
+func Or(filters ...*Filter) *Filter {
+	return &Filter{Op: FilterOr, Filters: filters}
+}
+
+func Not(filter *Filter) *Filter {
+	return &Filter{Op: FilterNot, Filters: []*Filter{filter}}
+}
+
+/* Field matches any of the values */
+func Terms(field string, values ...interface{}) *Filter {
+	return &Filter{Op: FilterTerms, Field: field, Values: values}
+}
+
+/* Range comparison.  op is one of gt, gte, lt or lte */
+func Compare(op, field string, value interface{}) *Filter {
+	return &Filter{Op: op, Field: field, Values: []interface{}{value}}
+}
+
+/* Field has a non null value */
+func Exists(field string) *Filter {
+	return &Filter{Op: FilterExists, Field: field}
+}
+
+/* String field starts with prefix */
+func Prefix(field, prefix string) *Filter {
+	return &Filter{Op: FilterPrefix, Field: field, Values: []interface{}{prefix}}
+}
+
+/* String field matches the pattern.  * matches any characters, ? a single one. */
+func Wildcard(field, pattern string) *Filter {
+	return &Filter{Op: FilterWildcard, Field: field, Values: []interface{}{pattern}}
+}
+
+/* String field matches the regular expression as a whole */
+func Regexp(field, expr string) *Filter {
+	return &Filter{Op: FilterRegexp, Field: field, Values: []interface{}{expr}}
+}
+
+type SortField struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc,omitempty"`
+}
+
+type Query struct {
+	Filter *Filter
+	Sort   []SortField
+	From   int
+	// 0 uses DefaultSearchSize
+	Size int
+	// Only return these, possibly dotted, fields.  All fields if empty.
+	Fields []string
+}
+
+/* A page of results */
+type SearchResult struct {
+	Total  int64   `json:"total"`
+	From   int     `json:"from"`
+	Assets []Asset `json:"assets"`
+}
+
+/* Evaluate the filter against a document */
+func (f *Filter) Match(doc map[string]interface{}) bool {
+	if f == nil {
+		return true
+	}
+
+	switch f.Op {
+	case FilterAnd:
+		for _, sf := range f.Filters {
+			if !sf.Match(doc) {
+				return false
+			}
+		}
+		return true
+	case FilterOr:
+		for _, sf := range f.Filters {
+			if sf.Match(doc) {
+				return true
+			}
+		}
+		return false
+	case FilterNot:
+		return len(f.Filters) > 0 && !f.Filters[0].Match(doc)
+	case FilterTerms:
+		for _, have := range fieldValues(doc, f.Field) {
+			for _, want := range f.Values {
+				if c, ok := compareValues(have, want); ok && c == 0 {
+					return true
+				}
+			}
+		}
+		return false
+	case FilterGt, FilterGte, FilterLt, FilterLte:
+		if len(f.Values) < 1 {
+			return false
+		}
+		for _, have := range fieldValues(doc, f.Field) {
+			c, ok := compareValues(have, f.Values[0])
+			if !ok {
+				continue
+			}
+			if (f.Op == FilterGt && c > 0) || (f.Op == FilterGte && c >= 0) ||
+				(f.Op == FilterLt && c < 0) || (f.Op == FilterLte && c <= 0) {
+				return true
+			}
+		}
+		return false
+	case FilterExists:
+		return len(fieldValues(doc, f.Field)) > 0
+	case FilterPrefix, FilterWildcard, FilterRegexp:
+		re := f.stringMatcher()
+		if re == nil {
+			return false
+		}
+		for _, have := range fieldValues(doc, f.Field) {
+			if str, ok := have.(string); ok && re.MatchString(str) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+/* Anchored regular expression for prefix, wildcard and regexp filters */
+func (f *Filter) stringMatcher() *regexp.Regexp {
+	if len(f.Values) < 1 {
+		return nil
+	}
+	val, _ := f.Values[0].(string)
+
+	var expr string
+	switch f.Op {
+	case FilterPrefix:
+		expr = regexp.QuoteMeta(val) + ".*"
+	case FilterWildcard:
+		expr = strings.Replace(strings.Replace(regexp.QuoteMeta(val), `\*`, ".*", -1), `\?`, ".", -1)
+	default:
+		expr = val
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil
+	}
+	return re
+}
+
+/* Lookup a possibly dotted field path in a document */
+func lookupField(doc map[string]interface{}, field string) (val interface{}, ok bool) {
+	if val, ok = doc[field]; ok {
+		return
+	}
+	parts := strings.SplitN(field, ".", 2)
+	if len(parts) == 2 {
+		if sub, isMap := doc[parts[0]].(map[string]interface{}); isMap {
+			return lookupField(sub, parts[1])
+		}
+	}
+	return nil, false
+}
+
+/* Field values as a list.  Arrays match if any of their elements match. */
+func fieldValues(doc map[string]interface{}, field string) []interface{} {
+	val, ok := lookupField(doc, field)
+	if !ok || val == nil {
+		return nil
+	}
+	if arr, isArr := val.([]interface{}); isArr {
+		return arr
+	}
+	return []interface{}{val}
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case int64:
+		return float64(n)
+	case int:
+		return float64(n)
+	}
+	return 0
+}
+
+/* Compare 2 json values. ok is false if they are not comparable. */
+func compareValues(a, b interface{}) (cmp int, ok bool) {
+	switch av := a.(type) {
+	case float64, int64, int:
+		switch b.(type) {
+		case float64, int64, int:
+			af, bf := toFloat(av), toFloat(b)
+			if af < bf {
+				return -1, true
+			} else if af > bf {
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if bv, isStr := b.(string); isStr {
+			// Dates compare by time as their formats may differ
+			if at, aok := parseTime(av); aok {
+				if bt, bok := parseTime(bv); bok {
+					if at.Before(bt) {
+						return -1, true
+					} else if at.After(bt) {
+						return 1, true
+					}
+					return 0, true
+				}
+			}
+			return strings.Compare(av, bv), true
+		}
+	case bool:
+		if bv, isBool := b.(bool); isBool {
+			if av == bv {
+				return 0, true
+			} else if !av {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+/* Parse RFC3339 timestamps and plain dates */
+func parseTime(str string) (t time.Time, ok bool) {
+	// cheap check to skip strings that can't be dates
+	if len(str) < 10 || str[4] != '-' {
+		return
+	}
+	var err error
+	if t, err = time.Parse(time.RFC3339Nano, str); err == nil {
+		return t, true
+	}
+	if t, err = time.Parse("2006-01-02", str); err == nil {
+		return t, true
+	}
+	return
+}
+
+/*
+   Sort assets in place.  Assets missing the field sort last.  Ties are
+   broken by id to keep paging stable.
+*/
+func sortAssets(assets []Asset, fields []SortField) {
+	sort.SliceStable(assets, func(i, j int) bool {
+		for _, sf := range fields {
+			vi, iok := lookupField(assets[i].Data, sf.Field)
+			vj, jok := lookupField(assets[j].Data, sf.Field)
+			if !iok || !jok {
+				if iok != jok {
+					return iok
+				}
+				continue
+			}
+			c, ok := compareValues(vi, vj)
+			if !ok || c == 0 {
+				continue
+			}
+			if sf.Desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return assets[i].Id < assets[j].Id
+	})
+}
+
+/* Apply sorting and paging of a query to a full result set */
+func pageAssets(assets []Asset, q Query) SearchResult {
+	sortAssets(assets, q.Sort)
+
+	size := q.Size
+	if size <= 0 {
+		size = DefaultSearchSize
+	}
+	from := q.From
+	if from > len(assets) {
+		from = len(assets)
+	}
+	end := from + size
+	if end > len(assets) {
+		end = len(assets)
+	}
+	page := assets[from:end]
+	if len(q.Fields) > 0 {
+		for i := range page {
+			page[i].Data = projectFields(page[i].Data, q.Fields)
+		}
+	}
+	return SearchResult{Total: int64(len(assets)), From: from, Assets: page}
+}
+
+/* Copy of the document with only the given fields.  Dotted fields keep their nesting. */
+func projectFields(doc map[string]interface{}, fields []string) map[string]interface{} {
+	out := map[string]interface{}{}
+	for _, field := range fields {
+		val, ok := lookupField(doc, field)
+		if !ok {
+			continue
+		}
+		if _, literal := doc[field]; literal {
+			out[field] = val
+			continue
+		}
+
+		m := out
+		parts := strings.Split(field, ".")
+		for _, p := range parts[:len(parts)-1] {
+			sub, isMap := m[p].(map[string]interface{})
+			if !isMap {
+				sub = map[string]interface{}{}
+				m[p] = sub
+			}
+			m = sub
+		}
+		m[parts[len(parts)-1]] = val
+	}
+	return out
+}
@@ -0,0 +1,359 @@
+package inventory
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/* Error in a text query.  Pos is the 1 based character position. */
+type QuerySyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *QuerySyntaxError) Error() string {
+	return fmt.Sprintf("Syntax error at position %d: %s", e.Pos, e.Msg)
+}
+
+const (
+	qtokEOF = iota
+	qtokLParen
+	qtokRParen
+	qtokAnd
+	qtokOr
+	qtokNot
+	qtokTerm
+)
+
+type queryToken struct {
+	kind int
+	pos  int
+	// field:value terms
+	field string
+	value string
+	// value was quoted so is taken literally
+	quoted bool
+}
+
+/*
+   Parse a text query into a filter e.g.
+
+	status:running AND (env:prod OR env:qa) NOT name:"web 01"
+
+   Terms are <field>:<value>.  Adjacent terms are ANDed.  Values are the same
+   as in search bodies (see parseFilterValue) and may also be:
+
+	"quoted value"   taken literally, may contain spaces
+	[2 TO 8]         inclusive range, {2 TO 8} is exclusive.  Mixed
+	                 brackets and * for an open end are allowed
+
+   Unquoted numbers and true/false match numbers and booleans.
+*/
+func ParseQueryString(query string) (*Filter, error) {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != qtokEOF {
+		return nil, &QuerySyntaxError{tok.pos, "unexpected " + describeToken(tok)}
+	}
+	return f, nil
+}
+
+func describeToken(tok queryToken) string {
+	switch tok.kind {
+	case qtokEOF:
+		return "end of query"
+	case qtokLParen:
+		return "'('"
+	case qtokRParen:
+		return "')'"
+	case qtokAnd:
+		return "AND"
+	case qtokOr:
+		return "OR"
+	case qtokNot:
+		return "NOT"
+	}
+	return fmt.Sprintf("'%s:%s'", tok.field, tok.value)
+}
+
+func lexQuery(query string) (tokens []queryToken, err error) {
+	runes := []rune(query)
+	i := 0
+	for {
+		for i < len(runes) && isQuerySpace(runes[i]) {
+			i++
+		}
+		if i >= len(runes) {
+			break
+		}
+
+		pos := i + 1
+		switch runes[i] {
+		case '(':
+			tokens = append(tokens, queryToken{kind: qtokLParen, pos: pos})
+			i++
+			continue
+		case ')':
+			tokens = append(tokens, queryToken{kind: qtokRParen, pos: pos})
+			i++
+			continue
+		}
+
+		// field or keyword
+		start := i
+		for i < len(runes) && !isQuerySpace(runes[i]) && runes[i] != ':' && runes[i] != '(' && runes[i] != ')' {
+			i++
+		}
+		word := string(runes[start:i])
+		if i >= len(runes) || runes[i] != ':' {
+			switch word {
+			case "AND":
+				tokens = append(tokens, queryToken{kind: qtokAnd, pos: pos})
+				continue
+			case "OR":
+				tokens = append(tokens, queryToken{kind: qtokOr, pos: pos})
+				continue
+			case "NOT":
+				tokens = append(tokens, queryToken{kind: qtokNot, pos: pos})
+				continue
+			}
+			if len(word) < 1 {
+				return nil, &QuerySyntaxError{pos, fmt.Sprintf("unexpected '%c'", runes[i])}
+			}
+			return nil, &QuerySyntaxError{pos, fmt.Sprintf("expected <field>:<value> got '%s'", word)}
+		}
+		if len(word) < 1 {
+			return nil, &QuerySyntaxError{pos, "missing field name before ':'"}
+		}
+
+		// value
+		i++
+		tok := queryToken{kind: qtokTerm, pos: pos, field: word}
+		vstart := i
+		if i >= len(runes) || isQuerySpace(runes[i]) {
+			return nil, &QuerySyntaxError{i + 1, fmt.Sprintf("missing value for '%s'", word)}
+		}
+
+		switch runes[i] {
+		case '"':
+			var buf bytes.Buffer
+			for i++; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				buf.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, &QuerySyntaxError{vstart + 1, "unterminated quoted string"}
+			}
+			i++
+			tok.value, tok.quoted = buf.String(), true
+			break
+		case '[', '{':
+			for i < len(runes) && runes[i] != ']' && runes[i] != '}' {
+				i++
+			}
+			if i >= len(runes) {
+				return nil, &QuerySyntaxError{vstart + 1, "unterminated range"}
+			}
+			i++
+			tok.value = string(runes[vstart:i])
+			break
+		case '/':
+			for i++; i < len(runes) && runes[i] != '/'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+			}
+			if i >= len(runes) {
+				return nil, &QuerySyntaxError{vstart + 1, "unterminated regular expression"}
+			}
+			i++
+			tok.value = string(runes[vstart:i])
+			break
+		default:
+			for i < len(runes) && !isQuerySpace(runes[i]) && runes[i] != '(' && runes[i] != ')' {
+				i++
+			}
+			tok.value = string(runes[vstart:i])
+			break
+		}
+		tokens = append(tokens, tok)
+	}
+
+	tokens = append(tokens, queryToken{kind: qtokEOF, pos: len(runes) + 1})
+	return
+}
+
+func isQuerySpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+/* Recursive descent parser.  OR binds loosest then AND then NOT. */
+type queryParser struct {
+	tokens []queryToken
+	next   int
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.next]
+}
+
+func (p *queryParser) take() queryToken {
+	tok := p.tokens[p.next]
+	if tok.kind != qtokEOF {
+		p.next++
+	}
+	return tok
+}
+
+func (p *queryParser) parseOr() (*Filter, error) {
+	f, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	filters := []*Filter{f}
+	for p.peek().kind == qtokOr {
+		p.take()
+		if f, err = p.parseAnd(); err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return Or(filters...), nil
+}
+
+func (p *queryParser) parseAnd() (*Filter, error) {
+	f, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	filters := []*Filter{f}
+	for {
+		switch p.peek().kind {
+		case qtokAnd:
+			p.take()
+			break
+		case qtokNot, qtokLParen, qtokTerm:
+			// implicit AND
+			break
+		default:
+			if len(filters) == 1 {
+				return filters[0], nil
+			}
+			return And(filters...), nil
+		}
+		if f, err = p.parseNot(); err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+}
+
+func (p *queryParser) parseNot() (*Filter, error) {
+	if p.peek().kind == qtokNot {
+		p.take()
+		f, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return Not(f), nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (*Filter, error) {
+	tok := p.take()
+	switch tok.kind {
+	case qtokLParen:
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.take(); closing.kind != qtokRParen {
+			return nil, &QuerySyntaxError{closing.pos, "expected ')' got " + describeToken(closing)}
+		}
+		return f, nil
+	case qtokTerm:
+		f, err := termFilter(tok)
+		if err != nil {
+			return nil, &QuerySyntaxError{tok.pos, err.Error()}
+		}
+		return f, nil
+	}
+	return nil, &QuerySyntaxError{tok.pos, "expected <field>:<value> or '(' got " + describeToken(tok)}
+}
+
+func termFilter(tok queryToken) (*Filter, error) {
+	switch {
+	case tok.quoted:
+		return Terms(tok.field, tok.value), nil
+	case strings.HasPrefix(tok.value, "[") || strings.HasPrefix(tok.value, "{"):
+		return rangeFilter(tok.field, tok.value)
+	case strings.HasPrefix(tok.value, "!") && len(tok.value) > 1:
+		tok.value = tok.value[1:]
+		f, err := termFilter(tok)
+		if err != nil {
+			return nil, err
+		}
+		return Not(f), nil
+	case tok.value == "true" || tok.value == "false":
+		return Terms(tok.field, tok.value == "true"), nil
+	}
+	if n, err := strconv.ParseFloat(tok.value, 64); err == nil {
+		return Terms(tok.field, n), nil
+	}
+	return parseFilterString(tok.field, tok.value)
+}
+
+/* [low TO high] inclusive, {low TO high} exclusive.  * leaves an end open. */
+func rangeFilter(field, val string) (*Filter, error) {
+	if len(val) < 2 || (val[len(val)-1] != ']' && val[len(val)-1] != '}') {
+		return nil, fmt.Errorf("Invalid range for '%s': expected [<low> TO <high>] got %s", field, val)
+	}
+	parts := strings.Fields(val[1 : len(val)-1])
+	if len(parts) != 3 || parts[1] != "TO" {
+		return nil, fmt.Errorf("Invalid range for '%s': expected [<low> TO <high>] got %s", field, val)
+	}
+
+	lowOp, highOp := FilterGte, FilterLte
+	if val[0] == '{' {
+		lowOp = FilterGt
+	}
+	if val[len(val)-1] == '}' {
+		highOp = FilterLt
+	}
+
+	filters := []*Filter{}
+	for i, op := range []string{lowOp, highOp} {
+		if parts[i*2] == "*" {
+			continue
+		}
+		cval, err := parseRangeValue(parts[i*2])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid range for '%s': %s", field, err)
+		}
+		filters = append(filters, Compare(op, field, cval))
+	}
+
+	switch len(filters) {
+	case 0:
+		return Exists(field), nil
+	case 1:
+		return filters[0], nil
+	}
+	return And(filters...), nil
+}
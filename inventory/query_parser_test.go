@@ -0,0 +1,88 @@
+package inventory
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func Test_ParseQueryString(t *testing.T) {
+	tests := []struct {
+		query string
+		match bool
+	}{
+		{`status:running`, true},
+		{`status:stopped`, false},
+		{`status:running AND cpus:4`, true},
+		{`status:running cpus:>4`, false},
+		{`status:stopped OR online:true`, true},
+		{`NOT status:stopped`, true},
+		{`status:!running`, false},
+		{`cpus:!4`, false},
+		{`status:running AND NOT (hw.vendor:dell OR hw.vendor:hp)`, false},
+		{`(status:stopped OR status:running) AND hw.mem:>=16.5`, true},
+		{`cpus:[2 TO 4]`, true},
+		{`cpus:[2 TO 4}`, false},
+		{`cpus:{4 TO *]`, false},
+		{`cpus:[* TO *]`, true},
+		{`created:[2016-03-01 TO now]`, true},
+		{`name:web*.example.com`, true},
+		{`name:/web[0-9]+\..*/`, true},
+		{`name:"web01.example.com"`, true},
+		{`name:"web*"`, false},
+		{`tags:prod hw.serial:!*`, true},
+	}
+
+	for _, tst := range tests {
+		f, err := ParseQueryString(tst.query)
+		if err != nil {
+			t.Fatalf("%s: %s", tst.query, err)
+		}
+		if f.Match(testFilterDoc) != tst.match {
+			b, _ := json.Marshal(f)
+			t.Fatalf("%s => %s should be %v", tst.query, b, tst.match)
+		}
+	}
+}
+
+func Test_ParseQueryString_Errors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+	}{
+		{`status`, 1},
+		{`status:running AND`, 19},
+		{`status:running OR OR env:prod`, 19},
+		{`(status:running`, 16},
+		{`status:running)`, 15},
+		{`status: running`, 8},
+		{`:running`, 1},
+		{`name:"web`, 6},
+		{`cpus:[2 TO`, 6},
+		{`cpus:[2 8]`, 1},
+		{`host:![`, 1},
+		{`0:![`, 1},
+		{`cpus:![2`, 1},
+		{`env:prod cpus:>=`, 10},
+	}
+
+	for _, tst := range tests {
+		_, err := ParseQueryString(tst.query)
+		serr, ok := err.(*QuerySyntaxError)
+		if !ok || serr.Pos != tst.pos {
+			t.Fatalf("%s: expected error at %d got %v", tst.query, tst.pos, err)
+		}
+	}
+}
+
+func Fuzz_ParseQueryString(f *testing.F) {
+	for _, q := range []string{`status:running AND cpus:[2 TO 8]`, `name:"web" OR env:!prod`, `host:[`, `0:![`, `(a:/x.*/)`} {
+		f.Add(q)
+	}
+	f.Fuzz(func(t *testing.T, q string) {
+		if _, err := ParseQueryString(q); err != nil {
+			if _, ok := err.(*QuerySyntaxError); !ok {
+				t.Fatalf("%s: not a syntax error: %v", q, err)
+			}
+		}
+	})
+}
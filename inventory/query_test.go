@@ -0,0 +1,112 @@
+package inventory
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+var (
+	testQueryDoc = map[string]interface{}{
+		"os":     "ubuntu",
+		"cpus":   float64(4),
+		"tags":   []interface{}{"web", "prod"},
+		"online": true,
+		"net": map[string]interface{}{
+			"ip": "10.1.2.3",
+		},
+	}
+)
+
+func Test_Filter_Match(t *testing.T) {
+	tests := []struct {
+		filter *Filter
+		match  bool
+	}{
+		{nil, true},
+		{Terms("os", "ubuntu"), true},
+		{Terms("os", "centos", "ubuntu"), true},
+		{Terms("os", "centos"), false},
+		{Terms("tags", "prod"), true},
+		{Terms("online", true), true},
+		{Terms("net.ip", "10.1.2.3"), true},
+		{Terms("missing", "x"), false},
+		{Compare(FilterGt, "cpus", 4), false},
+		{Compare(FilterGte, "cpus", 4), true},
+		{Compare(FilterLt, "cpus", 8.5), true},
+		{Compare(FilterLte, "cpus", 3), false},
+		{Compare(FilterGt, "os", "abc"), true},
+		{And(Terms("os", "ubuntu"), Compare(FilterGt, "cpus", 2)), true},
+		{And(Terms("os", "ubuntu"), Compare(FilterGt, "cpus", 8)), false},
+		{Or(Terms("os", "centos"), Compare(FilterGt, "cpus", 2)), true},
+		{Not(Terms("os", "ubuntu")), false},
+		{Exists("net.ip"), true},
+		{Exists("missing"), false},
+		{Prefix("os", "ubu"), true},
+		{Prefix("os", "bun"), false},
+		{Wildcard("net.ip", "10.?.*.3"), true},
+		{Wildcard("os", "u*x"), false},
+		{Regexp("tags", "pro.+"), true},
+		{Regexp("os", "bun"), false},
+	}
+
+	for i, tst := range tests {
+		if tst.filter.Match(testQueryDoc) != tst.match {
+			b, _ := json.Marshal(tst.filter)
+			t.Fatalf("%d: %s should be %v", i, b, tst.match)
+		}
+	}
+}
+
+func Test_pageAssets(t *testing.T) {
+	assets := []Asset{
+		{Id: "a", Data: map[string]interface{}{"n": float64(3)}},
+		{Id: "b", Data: map[string]interface{}{"n": float64(1)}},
+		{Id: "c", Data: map[string]interface{}{}},
+		{Id: "d", Data: map[string]interface{}{"n": float64(2)}},
+	}
+
+	rslt := pageAssets(assets, Query{Sort: []SortField{{Field: "n", Desc: true}}, From: 1, Size: 2})
+	if rslt.Total != 4 || len(rslt.Assets) != 2 {
+		t.Fatalf("Wrong page: %#v", rslt)
+	}
+	if rslt.Assets[0].Id != "d" || rslt.Assets[1].Id != "b" {
+		t.Fatalf("Wrong order: %s %s", rslt.Assets[0].Id, rslt.Assets[1].Id)
+	}
+
+	if rslt = pageAssets(assets, Query{From: 10}); len(rslt.Assets) != 0 {
+		t.Fatalf("Page out of range: %#v", rslt)
+	}
+}
+
+func Test_projectFields(t *testing.T) {
+	doc := map[string]interface{}{
+		"os":     "ubuntu",
+		"hw":     map[string]interface{}{"cpus": 4, "mem": 8},
+		"a.b":    1,
+		"status": "running",
+	}
+	expected := map[string]interface{}{
+		"os":  "ubuntu",
+		"hw":  map[string]interface{}{"cpus": 4},
+		"a.b": 1,
+	}
+	if out := projectFields(doc, []string{"os", "hw.cpus", "a.b", "missing"}); !reflect.DeepEqual(out, expected) {
+		t.Fatalf("Wrong projection: %#v", out)
+	}
+}
+
+func Test_essSearchBody(t *testing.T) {
+	q := Query{
+		Filter: And(Terms("os", "ubuntu"), Not(Compare(FilterLt, "cpus", 2))),
+		Sort:   []SortField{{Field: "name", Desc: true}},
+		From:   20,
+	}
+	b, _ := json.Marshal(essSearchBody(q))
+
+	expected := `{"from":20,"query":{"filtered":{"filter":{"bool":{"must":[{"terms":{"os":["ubuntu"]}},` +
+		`{"bool":{"must_not":{"range":{"cpus":{"lt":2}}}}}]}}}},"size":10,"sort":[{"name":"desc"}]}`
+	if string(b) != expected {
+		t.Fatalf("Wrong body: %s", b)
+	}
+}
@@ -0,0 +1,499 @@
+package inventory
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+   Field of the asset data relationships are kept in, so they are versioned
+   along with the rest of the asset.  It maps each relationship to a list of
+   <type>/<id> references e.g. {"runs_on": ["hypervisor/hv01"]}
+*/
+const relationshipsField = "relationships"
+
+/* What deleting an asset does to the assets related to it */
+const (
+	OnDeleteRestrict = "restrict"
+	OnDeleteCascade  = "cascade"
+	OnDeleteUnlink   = "unlink"
+)
+
+var relationshipNameExpr = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+/*
+   Relationship assets of a type may have to other assets e.g. runs_on.
+   Targets are the types of assets it may point at, any if empty.  OnDelete
+   is what deleting a target does to the assets pointing at it: restrict,
+   the default, refuses the delete, cascade deletes them as well and unlink
+   removes the relationship from them.
+*/
+type Relationship struct {
+	Description string   `json:"description,omitempty"`
+	Targets     []string `json:"targets,omitempty"`
+	OnDelete    string   `json:"on_delete,omitempty"`
+}
+
+func (rel Relationship) validate(name string) error {
+	if !relationshipNameExpr.MatchString(name) {
+		return fmt.Errorf("Invalid relationship name: '%s'", name)
+	}
+	for _, t := range rel.Targets {
+		if !validAssetTypeName(t) {
+			return fmt.Errorf("Invalid relationship %s: invalid target type '%s'", name, t)
+		}
+	}
+	switch rel.OnDelete {
+	case "", OnDeleteRestrict, OnDeleteCascade, OnDeleteUnlink:
+		break
+	default:
+		return fmt.Errorf("Invalid relationship %s: on_delete '%s' expected restrict, cascade or unlink", name, rel.OnDelete)
+	}
+	return nil
+}
+
+func (rel Relationship) onDelete() string {
+	if len(rel.OnDelete) < 1 {
+		return OnDeleteRestrict
+	}
+	return rel.OnDelete
+}
+
+/* Whether assets of the type may be the target */
+func (rel Relationship) allows(assetType string) bool {
+	if len(rel.Targets) < 1 {
+		return true
+	}
+	for _, t := range rel.Targets {
+		if t == assetType {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+   Relationship of an asset with another.  Type and Id are the other asset
+   i.e. the target of outgoing and the source of incoming relationships.
+   Target is only set where the asset it relates to is not implied.
+*/
+type AssetRelationship struct {
+	Relationship string `json:"relationship"`
+	Type         string `json:"type"`
+	Id           string `json:"id"`
+	Target       string `json:"target,omitempty"`
+}
+
+/* Relationships of an asset, to and from other assets */
+type AssetRelationships struct {
+	Outgoing []AssetRelationship `json:"outgoing"`
+	Incoming []AssetRelationship `json:"incoming"`
+}
+
+func relationshipRef(assetType, assetId string) string {
+	return assetType + "/" + assetId
+}
+
+/* Split a <type>/<id> reference.  Ids may contain / but types may not. */
+func parseRelationshipRef(ref string) (assetType, assetId string, err error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || len(parts[0]) < 1 || len(parts[1]) < 1 {
+		return "", "", fmt.Errorf("Invalid relationship target: '%s' expected <type>/<id>", ref)
+	}
+	return parts[0], parts[1], nil
+}
+
+func sortRelationships(rels []AssetRelationship) {
+	sort.Slice(rels, func(i, j int) bool {
+		if rels[i].Relationship != rels[j].Relationship {
+			return rels[i].Relationship < rels[j].Relationship
+		}
+		if rels[i].Type != rels[j].Type {
+			return rels[i].Type < rels[j].Type
+		}
+		return rels[i].Id < rels[j].Id
+	})
+}
+
+/* Outgoing relationships kept in the asset data.  Malformed references are skipped. */
+func assetRelationships(data map[string]interface{}) []AssetRelationship {
+	rels := []AssetRelationship{}
+	stored, _ := data[relationshipsField].(map[string]interface{})
+	for name, refs := range stored {
+		list, _ := refs.([]interface{})
+		for _, r := range list {
+			ref, _ := r.(string)
+			if t, id, err := parseRelationshipRef(ref); err == nil {
+				rels = append(rels, AssetRelationship{Relationship: name, Type: t, Id: id})
+			}
+		}
+	}
+	sortRelationships(rels)
+	return rels
+}
+
+/* References of the relationship kept in the asset data */
+func relationshipRefs(data map[string]interface{}, name string) []interface{} {
+	stored, _ := data[relationshipsField].(map[string]interface{})
+	refs, _ := stored[name].([]interface{})
+	return refs
+}
+
+/*
+   Check the relationship may point at the asset and that the asset exists.
+   Returns the id of the target normalized by the rules of its type.
+*/
+func (ir *Inventory) relationshipTarget(t AssetType, name, targetType, targetId string) (string, error) {
+	rel, ok := t.Relationships[name]
+	if !ok {
+		return "", fmt.Errorf("Invalid relationship: %s does not declare %s", t.Name, name)
+	}
+	targetType = ir.normalizeAssetType(targetType)
+	if !rel.allows(targetType) {
+		return "", fmt.Errorf("Invalid relationship: %s %s can not point at %s", t.Name, name, targetType)
+	}
+
+	id, _, err := ir.resolveAssetId(targetType, targetId, false)
+	if err != nil {
+		return "", err
+	}
+	if _, err = ir.datastore.GetAsset(targetType, id); err != nil {
+		return "", fmt.Errorf("Invalid relationship: %s %s target not found: %s/%s", t.Name, name, targetType, targetId)
+	}
+	return id, nil
+}
+
+/*
+   Check the relationships given by a write to an asset of the type.  They
+   must be declared by the type and point at existing assets.  References
+   are rewritten with normalized ids and without duplicates.
+*/
+func (ir *Inventory) checkRelationships(t AssetType, data map[string]interface{}) error {
+	v, ok := data[relationshipsField]
+	if !ok {
+		return nil
+	}
+	rels, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("'%s' field must be an object", relationshipsField)
+	}
+
+	for name, refs := range rels {
+		list, ok := refs.([]interface{})
+		if !ok {
+			return fmt.Errorf("'%s.%s' field must be a list of <type>/<id>", relationshipsField, name)
+		}
+
+		seen := map[string]bool{}
+		checked := make([]interface{}, 0, len(list))
+		for _, r := range list {
+			ref, _ := r.(string)
+			targetType, targetId, err := parseRelationshipRef(ref)
+			if err != nil {
+				return err
+			}
+			if targetId, err = ir.relationshipTarget(t, name, targetType, targetId); err != nil {
+				return err
+			}
+			ref = relationshipRef(ir.normalizeAssetType(targetType), targetId)
+			if !seen[ref] {
+				seen[ref] = true
+				checked = append(checked, ref)
+			}
+		}
+		rels[name] = checked
+	}
+	return nil
+}
+
+/*
+   Defined types declaring relationships, loaded once to look up the
+   incoming relationships of many assets.
+*/
+type relationshipSources map[string]AssetType
+
+func (ir *Inventory) loadRelationshipSources() (relationshipSources, error) {
+	names, err := ir.datastore.ListSystemDocs(systemDocTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := relationshipSources{}
+	for _, name := range names {
+		t, _, err := ir.getAssetType(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(t.Relationships) > 0 {
+			sources[name] = t
+		}
+	}
+
+	// lookups would silently find nothing, so deletes would not be restricted
+	if idx, ok := ir.datastore.(IRelationshipIndex); ok && len(sources) > 0 {
+		fields, err := idx.AnalyzedRelationshipFields()
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fields {
+			for name, t := range sources {
+				for rel := range t.Relationships {
+					if f == name+"."+relationshipsField+"."+rel {
+						return nil, fmt.Errorf("Relationships can not be enforced: %s is analyzed.  Rebuild the index with the mapping of etc/mapping.json", f)
+					}
+				}
+			}
+		}
+	}
+	return sources, nil
+}
+
+/* Whether the type declares a relationship that may point at assets of the target type */
+func (sources relationshipSources) declares(name, targetType string) bool {
+	for _, rel := range sources[name].Relationships {
+		if rel.allows(targetType) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+   Relationships of other assets pointing at the asset.  Only types
+   declaring a relationship that may point at the asset are searched.
+*/
+func (ir *Inventory) incomingRelationships(assetType, assetId string) ([]AssetRelationship, error) {
+	sources, err := ir.loadRelationshipSources()
+	if err != nil {
+		return nil, err
+	}
+	ref := relationshipRef(assetType, assetId)
+	incoming, err := ir.incomingRelationshipsOf(sources, []string{ref})
+	if err != nil {
+		return nil, err
+	}
+	if rels, ok := incoming[ref]; ok {
+		return rels, nil
+	}
+	return []AssetRelationship{}, nil
+}
+
+/*
+   Incoming relationships of each of the <type>/<id> refs, keyed by ref,
+   found with a single search.  Refs without any are left out.
+*/
+func (ir *Inventory) incomingRelationshipsOf(sources relationshipSources, refs []string) (map[string][]AssetRelationship, error) {
+	var (
+		incoming = map[string][]AssetRelationship{}
+		wanted   = map[string]bool{}
+		filters  = []*Filter{}
+		types    = []string{}
+	)
+	for _, ref := range refs {
+		wanted[ref] = true
+	}
+
+	for name, t := range sources {
+		searched := false
+		for relName, rel := range t.Relationships {
+			values := []interface{}{}
+			for _, ref := range refs {
+				if targetType, _, _ := parseRelationshipRef(ref); sources.declares(name, targetType) && rel.allows(targetType) {
+					values = append(values, ref)
+				}
+			}
+			if len(values) > 0 {
+				filters = append(filters, Terms(relationshipsField+"."+relName, values...))
+				searched = true
+			}
+		}
+		if searched {
+			types = append(types, name)
+		}
+	}
+	if len(types) < 1 {
+		return incoming, nil
+	}
+	sort.Strings(types)
+
+	err := ir.datastore.ForEachAsset(types, Query{Filter: Or(filters...)}, func(a Asset) error {
+		for _, r := range assetRelationships(a.Data) {
+			ref := relationshipRef(r.Type, r.Id)
+			if _, ok := sources[a.Type].Relationships[r.Relationship]; ok && wanted[ref] && sources.declares(a.Type, r.Type) {
+				incoming[ref] = append(incoming[ref], AssetRelationship{Relationship: r.Relationship, Type: a.Type, Id: a.Id})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, rels := range incoming {
+		sortRelationships(rels)
+	}
+	return incoming, nil
+}
+
+/*
+   Relationships from assets of other types to assets of the type, with
+   Target set to the asset they point at.
+*/
+func (ir *Inventory) incomingTypeRelationships(assetType string) ([]AssetRelationship, error) {
+	rels := []AssetRelationship{}
+
+	sources, err := ir.loadRelationshipSources()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		prefix  = relationshipRef(assetType, "")
+		filters = []*Filter{}
+		types   = []string{}
+	)
+	for name, t := range sources {
+		if name == assetType || !sources.declares(name, assetType) {
+			continue
+		}
+		for relName, rel := range t.Relationships {
+			if rel.allows(assetType) {
+				filters = append(filters, Prefix(relationshipsField+"."+relName, prefix))
+			}
+		}
+		types = append(types, name)
+	}
+	if len(types) < 1 {
+		return rels, nil
+	}
+	sort.Strings(types)
+
+	err = ir.datastore.ForEachAsset(types, Query{Filter: Or(filters...)}, func(a Asset) error {
+		for _, r := range assetRelationships(a.Data) {
+			if _, ok := sources[a.Type].Relationships[r.Relationship]; ok && r.Type == assetType {
+				rels = append(rels, AssetRelationship{Relationship: r.Relationship, Type: a.Type, Id: a.Id,
+					Target: relationshipRef(r.Type, r.Id)})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortRelationships(rels)
+	return rels, nil
+}
+
+/*
+   Assets affected by deleting an asset.  Deletes starts with the asset
+   followed by those deleted by cascading relationships.  Unlinks are the
+   relationships to remove from the assets kept and Blocked those refusing
+   the delete, with Target set to the asset they point at.
+*/
+type deletePlan struct {
+	Deletes []string
+	Unlinks []AssetRelationship
+	Blocked []AssetRelationship
+}
+
+func (ir *Inventory) planAssetDelete(assetType, assetId string) (plan deletePlan, err error) {
+	var (
+		root    = relationshipRef(assetType, assetId)
+		deleted = map[string]bool{root: true}
+		unlinks []AssetRelationship
+		sources relationshipSources
+	)
+	plan.Deletes = []string{root}
+	if sources, err = ir.loadRelationshipSources(); err != nil {
+		return
+	}
+
+	// each pass looks up the assets the previous one cascaded to at once
+	for start := 0; start < len(plan.Deletes); {
+		level := plan.Deletes[start:]
+		start = len(plan.Deletes)
+
+		var incoming map[string][]AssetRelationship
+		if incoming, err = ir.incomingRelationshipsOf(sources, level); err != nil {
+			return
+		}
+		for _, target := range level {
+			for _, in := range incoming[target] {
+				in.Target = target
+				source := relationshipRef(in.Type, in.Id)
+				switch sources[in.Type].Relationships[in.Relationship].onDelete() {
+				case OnDeleteCascade:
+					if !deleted[source] {
+						deleted[source] = true
+						plan.Deletes = append(plan.Deletes, source)
+					}
+					break
+				case OnDeleteUnlink:
+					unlinks = append(unlinks, in)
+					break
+				default:
+					plan.Blocked = append(plan.Blocked, in)
+					break
+				}
+			}
+		}
+	}
+
+	// assets deleted anyway are not unlinked, nor do they block the delete
+	for _, rels := range []*[]AssetRelationship{&unlinks, &plan.Blocked} {
+		kept := []AssetRelationship{}
+		for _, r := range *rels {
+			if !deleted[relationshipRef(r.Type, r.Id)] {
+				kept = append(kept, r)
+			}
+		}
+		*rels = kept
+	}
+	plan.Unlinks = unlinks
+	return
+}
+
+/*
+   Remove the relationships pointing at Target from their assets.  The
+   assets are edited as with any other write, so the change is versioned.
+*/
+func (ir *Inventory) unlinkRelationships(rels []AssetRelationship, data map[string]interface{}) error {
+	bySource := map[string][]AssetRelationship{}
+	for _, r := range rels {
+		source := relationshipRef(r.Type, r.Id)
+		bySource[source] = append(bySource[source], r)
+	}
+
+	for source, srcRels := range bySource {
+		assetType, assetId, _ := parseRelationshipRef(source)
+		asset, err := ir.datastore.GetAsset(assetType, assetId)
+		if err != nil {
+			return err
+		}
+
+		changed := map[string]interface{}{}
+		for _, r := range srcRels {
+			refs, ok := changed[r.Relationship].([]interface{})
+			if !ok {
+				refs = relationshipRefs(asset.Data, r.Relationship)
+			}
+			kept := []interface{}{}
+			for _, ref := range refs {
+				if ref != r.Target {
+					kept = append(kept, ref)
+				}
+			}
+			changed[r.Relationship] = kept
+		}
+
+		edit := map[string]interface{}{relationshipsField: changed}
+		for k, v := range data {
+			edit[k] = v
+		}
+		if _, err = ir.datastore.EditAsset(assetType, assetId, edit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
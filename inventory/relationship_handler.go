@@ -0,0 +1,262 @@
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+/*
+   Handle relationships of an asset
+   GET /<asset_type>/<asset>/relationships?relationship=<name>
+   POST /<asset_type>/<asset>/relationships
+
+       {"relationship": "runs_on", "type": "hypervisor", "id": "hv01"}
+
+   Adding a relationship edits the asset, so it is versioned as with any
+   other write.
+*/
+func (ir *Inventory) AssetRelationshipsHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		headers = map[string]string{"Content-Type": "text/plain"}
+		code    int
+		data    []byte
+
+		restVars  = mux.Vars(r)
+		assetType = ir.normalizeAssetType(restVars["asset_type"])
+	)
+
+	assetId, code, err := ir.resolveAssetId(assetType, restVars["asset"], false)
+	if err != nil {
+		WriteAndLogResponse(w, r, code, headers, []byte(err.Error()))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		code, headers, data = ir.relationshipsGetHandler(assetType, assetId, r.URL.Query().Get("relationship"))
+		break
+	case "POST":
+		code, headers, data = ir.relationshipPostHandler(assetType, assetId, r)
+		break
+	}
+
+	WriteAndLogResponse(w, r, code, headers, data)
+}
+
+func (ir *Inventory) relationshipsGetHandler(assetType, assetId, name string) (code int, headers map[string]string, data []byte) {
+	asset, err := ir.datastore.GetAsset(assetType, assetId)
+	if err != nil {
+		return 404, textHeaders(), []byte(err.Error())
+	}
+
+	incoming, err := ir.incomingRelationships(assetType, assetId)
+	if err != nil {
+		return 500, textHeaders(), []byte(err.Error())
+	}
+
+	rels := AssetRelationships{Outgoing: []AssetRelationship{}, Incoming: []AssetRelationship{}}
+	for _, rel := range assetRelationships(asset.Data) {
+		if len(name) < 1 || rel.Relationship == name {
+			rels.Outgoing = append(rels.Outgoing, rel)
+		}
+	}
+	for _, rel := range incoming {
+		if len(name) < 1 || rel.Relationship == name {
+			rels.Incoming = append(rels.Incoming, rel)
+		}
+	}
+
+	data, _ = json.Marshal(rels)
+	return 200, jsonHeaders(), data
+}
+
+func (ir *Inventory) relationshipPostHandler(assetType, assetId string, r *http.Request) (code int, headers map[string]string, data []byte) {
+	reqUser, _, err := ir.authenticateRequest(r)
+	if err != nil {
+		return 401, textHeaders(), []byte(err.Error())
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return 400, textHeaders(), []byte(err.Error())
+	}
+	var rel AssetRelationship
+	if err = json.Unmarshal(body, &rel); err != nil {
+		return 400, textHeaders(), []byte(err.Error())
+	}
+	if len(rel.Relationship) < 1 || len(rel.Type) < 1 || len(rel.Id) < 1 {
+		return 400, textHeaders(), []byte("Invalid request: relationship, type and id required")
+	}
+
+	asset, err := ir.datastore.GetAsset(assetType, assetId)
+	if err != nil {
+		return 404, textHeaders(), []byte(err.Error())
+	}
+	t, _, err := ir.getAssetType(assetType)
+	if err != nil {
+		return 500, textHeaders(), []byte(err.Error())
+	}
+	rel.Type = ir.normalizeAssetType(rel.Type)
+	if rel.Id, err = ir.relationshipTarget(t, rel.Relationship, rel.Type, rel.Id); err != nil {
+		return 400, textHeaders(), []byte(err.Error())
+	}
+
+	ref := relationshipRef(rel.Type, rel.Id)
+	refs := relationshipRefs(asset.Data, rel.Relationship)
+	for _, existing := range refs {
+		if existing == ref {
+			data, _ = json.Marshal(rel)
+			return 200, jsonHeaders(), data
+		}
+	}
+
+	edit := map[string]interface{}{
+		relationshipsField: map[string]interface{}{rel.Relationship: append(refs, ref)},
+		"updated_by":       reqUser,
+		"updated_at":       time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	schema, err := t.CompiledSchema()
+	if err != nil {
+		return 500, textHeaders(), []byte(err.Error())
+	}
+	if schema != nil {
+		if code, headers, data = ir.validateAssetWrite(schema, assetType, assetId, "PUT", edit); code != 0 {
+			return
+		}
+	}
+	if _, err = ir.datastore.EditAsset(assetType, assetId, edit); err != nil {
+		return 400, textHeaders(), []byte(err.Error())
+	}
+	log.V(6).Infof("Relationship %s/%s %s %s added by '%s'\n", assetType, assetId, rel.Relationship, ref, reqUser)
+
+	data, _ = json.Marshal(rel)
+	return 200, jsonHeaders(), data
+}
+
+/*
+   Handle removing a relationship of an asset
+   DELETE /<asset_type>/<asset>/relationships/<relationship>/<target_type>/<target>
+   The removal is versioned as with any other write.
+*/
+func (ir *Inventory) AssetRelationshipHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		headers = map[string]string{"Content-Type": "text/plain"}
+
+		restVars   = mux.Vars(r)
+		assetType  = ir.normalizeAssetType(restVars["asset_type"])
+		targetType = ir.normalizeAssetType(restVars["target_type"])
+	)
+
+	reqUser, _, err := ir.authenticateRequest(r)
+	if err != nil {
+		WriteAndLogResponse(w, r, 401, headers, []byte(err.Error()))
+		return
+	}
+
+	assetId, code, err := ir.resolveAssetId(assetType, restVars["asset"], false)
+	if err != nil {
+		WriteAndLogResponse(w, r, code, headers, []byte(err.Error()))
+		return
+	}
+	targetId, code, err := ir.resolveAssetId(targetType, restVars["target"], false)
+	if err != nil {
+		WriteAndLogResponse(w, r, code, headers, []byte(err.Error()))
+		return
+	}
+
+	asset, err := ir.datastore.GetAsset(assetType, assetId)
+	if err != nil {
+		WriteAndLogResponse(w, r, 404, headers, []byte(err.Error()))
+		return
+	}
+
+	rel := AssetRelationship{Relationship: restVars["relationship"], Type: assetType, Id: assetId,
+		Target: relationshipRef(targetType, targetId)}
+	found := false
+	for _, ref := range relationshipRefs(asset.Data, rel.Relationship) {
+		found = found || ref == rel.Target
+	}
+	if !found {
+		WriteAndLogResponse(w, r, 404, headers, []byte(fmt.Sprintf("Not found: %s/%s %s %s", assetType, assetId, rel.Relationship, rel.Target)))
+		return
+	}
+
+	edit := map[string]interface{}{"updated_by": reqUser, "updated_at": time.Now().UTC().Format(time.RFC3339Nano)}
+	if err = ir.unlinkRelationships([]AssetRelationship{rel}, edit); err != nil {
+		WriteAndLogResponse(w, r, 500, headers, []byte(err.Error()))
+		return
+	}
+	log.V(6).Infof("Relationship %s/%s %s %s removed by '%s'\n", assetType, assetId, rel.Relationship, rel.Target, reqUser)
+
+	WriteAndLogResponse(w, r, 200, headers, nil)
+}
+
+/* Returned within a delete refused by restricting relationships */
+var errDeleteRestricted = fmt.Errorf("Delete restricted")
+
+/*
+   Handle removing assets DELETE /<asset_type>/<asset>
+   Assets with relationships to it are removed or unlinked by the on_delete
+   policy of the relationship.  Nothing is removed if any restrict it.  The
+   memory and bolt datastores plan and apply the whole delete in one
+   transaction.  On elasticsearch each asset is written separately, so a
+   failure part way leaves the writes made so far, and relationships added
+   while the delete runs are not seen.
+*/
+func (ir *Inventory) assetDeleteHandler(assetType, assetId string, r *http.Request) (code int, headers map[string]string, data []byte) {
+	headers = map[string]string{"Content-Type": "text/plain"}
+
+	reqUser, _, err := ir.authenticateRequest(r)
+	if err != nil {
+		return 401, headers, []byte(err.Error())
+	}
+
+	var plan deletePlan
+	err = ir.batch(func(tx *Inventory) error {
+		if _, err := tx.datastore.GetAsset(assetType, assetId); err != nil {
+			return err
+		}
+		var err error
+		if plan, err = tx.planAssetDelete(assetType, assetId); err != nil {
+			return err
+		}
+		if len(plan.Blocked) > 0 {
+			return errDeleteRestricted
+		}
+
+		edit := map[string]interface{}{"updated_by": reqUser, "updated_at": time.Now().UTC().Format(time.RFC3339Nano)}
+		if err = tx.unlinkRelationships(plan.Unlinks, edit); err != nil {
+			return err
+		}
+		// Assets cascaded to go first so none is left pointing at a removed one
+		for i := len(plan.Deletes) - 1; i >= 0; i-- {
+			t, id, _ := parseRelationshipRef(plan.Deletes[i])
+			if !tx.datastore.RemoveAsset(t, id, reqUser) {
+				return fmt.Errorf("Failed to remove %s", plan.Deletes[i])
+			}
+		}
+		return nil
+	})
+	if err == errDeleteRestricted {
+		headers["Content-Type"] = "application/json"
+		data, _ = json.Marshal(map[string]interface{}{
+			"error":         fmt.Sprintf("Conflict: %s/%s is the target of restricting relationships", assetType, assetId),
+			"restricted_by": plan.Blocked,
+		})
+		return 409, headers, data
+	} else if err != nil {
+		return 500, headers, []byte(err.Error())
+	}
+	if len(plan.Deletes) > 1 || len(plan.Unlinks) > 0 {
+		log.V(6).Infof("Removed %v and unlinked %d relationships by '%s'\n", plan.Deletes, len(plan.Unlinks), reqUser)
+	}
+
+	headers["Content-Type"] = "application/json"
+	data, _ = json.Marshal(map[string]interface{}{"deleted": plan.Deletes, "unlinked": plan.Unlinks})
+	return 200, headers, data
+}
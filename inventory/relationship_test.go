@@ -0,0 +1,39 @@
+package inventory
+
+import (
+	"strings"
+	"testing"
+)
+
+/* Reports relationship fields as analyzed like an old elasticsearch index */
+type analyzedRelationshipsDatastore struct {
+	IDatastore
+	fields []string
+}
+
+func (ds *analyzedRelationshipsDatastore) AnalyzedRelationshipFields() ([]string, error) {
+	return ds.fields, nil
+}
+
+func Test_Relationships_AnalyzedFields(t *testing.T) {
+	ds := &analyzedRelationshipsDatastore{IDatastore: NewMemoryDatastore()}
+	ds.PutSystemDoc(systemDocTypes, "rack", AssetType{Name: "rack"})
+	ds.PutSystemDoc(systemDocTypes, "hypervisor", AssetType{Name: "hypervisor", Relationships: map[string]Relationship{"member_of": {Targets: []string{"rack"}}}})
+	ds.CreateAsset("rack", "r1", map[string]interface{}{}, true)
+	ds.CreateAsset("hypervisor", "hv1", map[string]interface{}{"relationships": map[string]interface{}{"member_of": []interface{}{"rack/r1"}}}, true)
+
+	ir := &Inventory{datastore: ds}
+	ds.fields = []string{"vm.relationships.runs_on"}
+	plan, err := ir.planAssetDelete("rack", "r1")
+	if err != nil || len(plan.Blocked) != 1 {
+		t.Fatalf("Unrelated field refused the delete: %#v %v", plan, err)
+	}
+
+	ds.fields = append(ds.fields, "hypervisor.relationships.member_of")
+	if _, err = ir.planAssetDelete("rack", "r1"); err == nil || !strings.Contains(err.Error(), "member_of is analyzed") {
+		t.Fatalf("Delete planned with an analyzed field: %v", err)
+	}
+	if _, err = ir.incomingTypeRelationships("rack"); err == nil {
+		t.Fatalf("Type delete checked with an analyzed field")
+	}
+}
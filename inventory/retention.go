@@ -0,0 +1,126 @@
+package inventory
+
+import (
+	log "github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+/* Versions of an asset removed, or that would be removed, by pruning */
+type PrunedVersions struct {
+	Type     string  `json:"type"`
+	Id       string  `json:"id"`
+	Versions []int64 `json:"versions"`
+}
+
+type PruneReport struct {
+	DryRun bool `json:"dry_run"`
+	// Number of versions examined and removed
+	Examined int64            `json:"examined"`
+	Pruned   int64            `json:"pruned"`
+	Assets   []PrunedVersions `json:"assets"`
+}
+
+/*
+   Versions the policy does not keep.  versions must be ordered oldest
+   first.  Versions without a timestamp are only subject to KeepLast as
+   their age is unknown.
+*/
+func (p RetentionPolicy) Prune(versions []Asset, now time.Time) (drop []int64) {
+	n := len(versions)
+	if n < 2 {
+		return
+	}
+
+	var (
+		keepAfter = now.AddDate(0, 0, -int(p.KeepDays))
+		thinAfter = now.AddDate(0, 0, -int(p.ThinAfterDays))
+		keptDay   = versions[n-1].Timestamp.UTC().Format("2006-01-02")
+	)
+	// newest first so thinning keeps the newest version of each day
+	for i := n - 2; i >= 0; i-- {
+		v := versions[i]
+		known := !v.Timestamp.IsZero()
+		day := v.Timestamp.UTC().Format("2006-01-02")
+
+		if (p.KeepLast > 0 && int64(n-i) > p.KeepLast) ||
+			(p.KeepDays > 0 && known && v.Timestamp.Before(keepAfter)) ||
+			(p.ThinAfterDays > 0 && known && v.Timestamp.Before(thinAfter) && day == keptDay) {
+			drop = append([]int64{v.Version}, drop...)
+			continue
+		}
+		keptDay = day
+	}
+	return
+}
+
+/* Applies the configured retention policies to version history */
+type VersionPruner struct {
+	datastore IDatastore
+	cfg       *VersionsConfig
+	// one run at a time
+	mu sync.Mutex
+}
+
+func NewVersionPruner(datastore IDatastore, cfg *VersionsConfig) *VersionPruner {
+	return &VersionPruner{datastore: datastore, cfg: cfg}
+}
+
+/*
+   Prune versions of the given asset types or all types if none are given.
+   Nothing is removed if dryRun is set.
+*/
+func (vp *VersionPruner) Prune(dryRun bool, assetTypes ...string) (report PruneReport, err error) {
+	vp.mu.Lock()
+	defer vp.mu.Unlock()
+
+	if len(assetTypes) < 1 {
+		if assetTypes, err = vp.datastore.ListAssetTypes(); err != nil {
+			return
+		}
+	}
+
+	report = PruneReport{DryRun: dryRun, Assets: []PrunedVersions{}}
+	now := time.Now().UTC()
+
+	for _, assetType := range assetTypes {
+		policy := vp.cfg.Policy(assetType)
+
+		var pruned []PrunedVersions
+		if err = vp.datastore.ForEachAssetVersions(assetType, func(assetId string, versions []Asset) error {
+			report.Examined += int64(len(versions))
+			if drop := policy.Prune(versions, now); len(drop) > 0 {
+				pruned = append(pruned, PrunedVersions{Type: assetType, Id: assetId, Versions: drop})
+			}
+			return nil
+		}); err != nil {
+			return
+		}
+
+		for _, p := range pruned {
+			if !dryRun {
+				if err = vp.datastore.RemoveAssetVersions(p.Type, p.Id, p.Versions...); err != nil {
+					return
+				}
+				log.V(6).Infof("Pruned %s/%s versions: %v\n", p.Type, p.Id, p.Versions)
+			}
+			report.Pruned += int64(len(p.Versions))
+			report.Assets = append(report.Assets, p)
+		}
+	}
+	return
+}
+
+/* Prune all asset types every interval.  Does not return. */
+func (vp *VersionPruner) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		report, err := vp.Prune(false)
+		if err != nil {
+			log.Errorf("Pruning versions failed: %s\n", err)
+			continue
+		}
+		log.Infof("Pruned versions: %d of %d\n", report.Pruned, report.Examined)
+	}
+}
@@ -0,0 +1,49 @@
+package inventory
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testRetentionNow = time.Date(2016, 3, 31, 12, 0, 0, 0, time.UTC)
+
+/* Versions 1..n recorded at the given number of hours before now */
+func testRetentionVersions(hoursAgo ...int) []Asset {
+	versions := make([]Asset, len(hoursAgo))
+	for i, h := range hoursAgo {
+		versions[i] = Asset{Version: int64(i + 1), Timestamp: testRetentionNow.Add(-time.Duration(h) * time.Hour)}
+	}
+	return versions
+}
+
+func Test_RetentionPolicy_Prune(t *testing.T) {
+	versions := testRetentionVersions(24*40+2, 24*40+1, 24*35, 24*5, 2, 1)
+
+	tests := []struct {
+		policy   RetentionPolicy
+		expected []int64
+	}{
+		{RetentionPolicy{}, nil},
+		{RetentionPolicy{KeepLast: 2}, []int64{1, 2, 3, 4}},
+		{RetentionPolicy{KeepLast: 100}, nil},
+		{RetentionPolicy{KeepDays: 30}, []int64{1, 2, 3}},
+		{RetentionPolicy{ThinAfterDays: 30}, []int64{1}},
+		{RetentionPolicy{ThinAfterDays: 30, KeepLast: 4}, []int64{1, 2}},
+	}
+	for _, tst := range tests {
+		if drop := tst.policy.Prune(versions, testRetentionNow); !reflect.DeepEqual(drop, tst.expected) {
+			t.Fatalf("%#v: expected %v got %v", tst.policy, tst.expected, drop)
+		}
+	}
+
+	// the newest version is always kept
+	if drop := (RetentionPolicy{KeepDays: 1}).Prune(testRetentionVersions(48, 47), testRetentionNow); !reflect.DeepEqual(drop, []int64{1}) {
+		t.Fatalf("Newest version not kept: %v", drop)
+	}
+	// age of versions without a timestamp is unknown
+	versions[0].Timestamp = time.Time{}
+	if drop := (RetentionPolicy{KeepDays: 30}).Prune(versions, testRetentionNow); !reflect.DeepEqual(drop, []int64{2, 3}) {
+		t.Fatalf("Versions without timestamp: %v", drop)
+	}
+}
@@ -0,0 +1,587 @@
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/* Fields set by the inventory on every write.  They are not validated. */
+var managedFields = []string{"created_by", "created_at", "updated_by", "updated_at"}
+
+var schemaTypes = map[string]bool{
+	"string": true, "number": true, "integer": true, "boolean": true,
+	"object": true, "array": true, "null": true,
+}
+
+/* Validation keywords that are not supported.  Schemas using them are refused rather than not enforced. */
+var unsupportedSchemaKeywords = map[string]bool{
+	"patternProperties": true, "dependencies": true, "dependentRequired": true,
+	"dependentSchemas": true, "propertyNames": true, "contains": true, "minContains": true,
+	"maxContains": true, "additionalItems": true, "unevaluatedProperties": true,
+	"unevaluatedItems": true, "if": true, "then": true, "else": true,
+}
+
+var (
+	emailExpr    = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	hostnameExpr = regexp.MustCompile(`^(?i)[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+)
+
+/*
+   Compiled JSON Schema.  Supports the validation keywords of draft 4 to 7
+   apart from references, dependencies, patternProperties, propertyNames,
+   contains, additionalItems and if/then/else, which are refused:
+
+	type enum const
+	properties required additionalProperties minProperties maxProperties
+	minimum maximum exclusiveMinimum exclusiveMaximum multipleOf
+	minLength maxLength pattern format
+	items minItems maxItems uniqueItems
+	allOf anyOf oneOf not
+
+   format is one of date-time, date, ipv4, ipv6, email or hostname.  Other
+   keywords e.g. title and description are ignored.
+*/
+type Schema struct {
+	Types    []string
+	Enum     []interface{}
+	Const    interface{}
+	HasConst bool
+
+	Properties           map[string]*Schema
+	Required             []string
+	AdditionalProperties *Schema
+	NoAdditional         bool
+	MinProperties        *int
+	MaxProperties        *int
+
+	Minimum          *float64
+	Maximum          *float64
+	ExclusiveMinimum *float64
+	ExclusiveMaximum *float64
+	MultipleOf       *float64
+
+	MinLength *int
+	MaxLength *int
+	Pattern   *regexp.Regexp
+	Format    string
+
+	Items       *Schema
+	MinItems    *int
+	MaxItems    *int
+	UniqueItems bool
+
+	AllOf []*Schema
+	AnyOf []*Schema
+	OneOf []*Schema
+	Not   *Schema
+}
+
+/* Validation failure of a, dotted, field.  Field is empty for the document itself. */
+type SchemaError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e SchemaError) Error() string {
+	if len(e.Field) < 1 {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+/* Compile a schema document.  Errors describe the offending keyword. */
+func CompileSchema(doc map[string]interface{}) (*Schema, error) {
+	return compileSchema("", doc)
+}
+
+func compileSchema(path string, doc map[string]interface{}) (s *Schema, err error) {
+	s = &Schema{}
+	fail := func(keyword, msg string) error {
+		return fmt.Errorf("Invalid schema at '%s%s': %s", path, keyword, msg)
+	}
+
+	for _, k := range sortedFields(doc) {
+		v := doc[k]
+		switch k {
+		case "type":
+			switch t := v.(type) {
+			case string:
+				s.Types = []string{t}
+				break
+			case []interface{}:
+				for _, e := range t {
+					str, _ := e.(string)
+					s.Types = append(s.Types, str)
+				}
+				break
+			}
+			if len(s.Types) < 1 {
+				return nil, fail(k, "must be a type name or a list of them")
+			}
+			for _, t := range s.Types {
+				if !schemaTypes[t] {
+					return nil, fail(k, fmt.Sprintf("unknown type '%s'", t))
+				}
+			}
+			break
+		case "enum":
+			if s.Enum, _ = v.([]interface{}); len(s.Enum) < 1 {
+				return nil, fail(k, "must be a non empty list")
+			}
+			break
+		case "const":
+			s.Const, s.HasConst = v, true
+			break
+		case "properties":
+			props, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fail(k, "must be an object")
+			}
+			s.Properties = map[string]*Schema{}
+			for _, name := range sortedFields(props) {
+				sub, ok := props[name].(map[string]interface{})
+				if !ok {
+					return nil, fail(k+"."+name, "must be a schema")
+				}
+				if s.Properties[name], err = compileSchema(path+k+"."+name+".", sub); err != nil {
+					return nil, err
+				}
+			}
+			break
+		case "required":
+			list, ok := v.([]interface{})
+			if !ok {
+				return nil, fail(k, "must be a list of field names")
+			}
+			for _, e := range list {
+				name, ok := e.(string)
+				if !ok {
+					return nil, fail(k, "must be a list of field names")
+				}
+				s.Required = append(s.Required, name)
+			}
+			break
+		case "additionalProperties":
+			switch a := v.(type) {
+			case bool:
+				s.NoAdditional = !a
+				break
+			case map[string]interface{}:
+				if s.AdditionalProperties, err = compileSchema(path+k+".", a); err != nil {
+					return nil, err
+				}
+				break
+			default:
+				return nil, fail(k, "must be a boolean or a schema")
+			}
+			break
+		case "minProperties", "maxProperties", "minLength", "maxLength", "minItems", "maxItems":
+			n, ok := v.(float64)
+			if !ok || n < 0 || n != math.Trunc(n) {
+				return nil, fail(k, "must be a non negative integer")
+			}
+			i := int(n)
+			switch k {
+			case "minProperties":
+				s.MinProperties = &i
+				break
+			case "maxProperties":
+				s.MaxProperties = &i
+				break
+			case "minLength":
+				s.MinLength = &i
+				break
+			case "maxLength":
+				s.MaxLength = &i
+				break
+			case "minItems":
+				s.MinItems = &i
+				break
+			case "maxItems":
+				s.MaxItems = &i
+				break
+			}
+			break
+		case "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "multipleOf":
+			// draft 4 boolean exclusive limits apply to minimum and maximum
+			if b, ok := v.(bool); ok && (k == "exclusiveMinimum" || k == "exclusiveMaximum") {
+				if b {
+					limit := strings.ToLower(k[9:10]) + k[10:]
+					n, ok := doc[limit].(float64)
+					if !ok {
+						return nil, fail(k, "requires "+limit)
+					}
+					if k == "exclusiveMinimum" {
+						s.ExclusiveMinimum = &n
+					} else {
+						s.ExclusiveMaximum = &n
+					}
+				}
+				continue
+			}
+			n, ok := v.(float64)
+			if !ok {
+				return nil, fail(k, "must be a number")
+			}
+			switch k {
+			case "minimum":
+				s.Minimum = &n
+				break
+			case "maximum":
+				s.Maximum = &n
+				break
+			case "exclusiveMinimum":
+				s.ExclusiveMinimum = &n
+				break
+			case "exclusiveMaximum":
+				s.ExclusiveMaximum = &n
+				break
+			case "multipleOf":
+				if n <= 0 {
+					return nil, fail(k, "must be greater than 0")
+				}
+				s.MultipleOf = &n
+				break
+			}
+			break
+		case "pattern":
+			str, ok := v.(string)
+			if !ok {
+				return nil, fail(k, "must be a string")
+			}
+			if s.Pattern, err = regexp.Compile(str); err != nil {
+				return nil, fail(k, err.Error())
+			}
+			break
+		case "format":
+			str, _ := v.(string)
+			switch str {
+			case "date-time", "date", "ipv4", "ipv6", "email", "hostname":
+				s.Format = str
+				break
+			default:
+				return nil, fail(k, fmt.Sprintf("unsupported format '%v'", v))
+			}
+			break
+		case "items":
+			sub, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fail(k, "must be a schema")
+			}
+			if s.Items, err = compileSchema(path+k+".", sub); err != nil {
+				return nil, err
+			}
+			break
+		case "uniqueItems":
+			s.UniqueItems, _ = v.(bool)
+			break
+		case "allOf", "anyOf", "oneOf":
+			list, ok := v.([]interface{})
+			if !ok || len(list) < 1 {
+				return nil, fail(k, "must be a non empty list of schemas")
+			}
+			subs := make([]*Schema, len(list))
+			for i, e := range list {
+				sub, ok := e.(map[string]interface{})
+				if !ok {
+					return nil, fail(k, "must be a non empty list of schemas")
+				}
+				if subs[i], err = compileSchema(fmt.Sprintf("%s%s.%d.", path, k, i), sub); err != nil {
+					return nil, err
+				}
+			}
+			switch k {
+			case "allOf":
+				s.AllOf = subs
+				break
+			case "anyOf":
+				s.AnyOf = subs
+				break
+			case "oneOf":
+				s.OneOf = subs
+				break
+			}
+			break
+		case "not":
+			sub, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fail(k, "must be a schema")
+			}
+			if s.Not, err = compileSchema(path+k+".", sub); err != nil {
+				return nil, err
+			}
+			break
+		case "$ref":
+			return nil, fail(k, "references are not supported")
+		default:
+			if unsupportedSchemaKeywords[k] {
+				return nil, fail(k, "keyword is not supported")
+			}
+			break
+		}
+	}
+	return s, nil
+}
+
+/*
+   Validate an asset document.  Fields managed by the inventory are not
+   checked.  Returns all failures, nil if the document is valid.
+*/
+func (s *Schema) ValidateAsset(data map[string]interface{}) []SchemaError {
+	doc := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		doc[k] = v
+	}
+	for _, f := range managedFields {
+		delete(doc, f)
+	}
+	return s.Validate(doc)
+}
+
+func (s *Schema) Validate(doc interface{}) []SchemaError {
+	return s.validate("", doc, nil)
+}
+
+func (s *Schema) validate(field string, v interface{}, errs []SchemaError) []SchemaError {
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, SchemaError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(s.Types) > 0 && !schemaTypeMatches(s.Types, v) {
+		fail("must be %s got %s", strings.Join(s.Types, " or "), schemaTypeOf(v))
+		// other keywords would only repeat the problem
+		return errs
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if jsonEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			b, _ := json.Marshal(s.Enum)
+			fail("must be one of %s", b)
+		}
+	}
+	if s.HasConst && !jsonEqual(s.Const, v) {
+		b, _ := json.Marshal(s.Const)
+		fail("must be %s", b)
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := val[name]; !ok {
+				errs = append(errs, SchemaError{Field: joinField(field, name), Message: "is required"})
+			}
+		}
+		for _, name := range sortedFields(val) {
+			if sub, ok := s.Properties[name]; ok {
+				errs = sub.validate(joinField(field, name), val[name], errs)
+			} else if s.NoAdditional {
+				errs = append(errs, SchemaError{Field: joinField(field, name), Message: "is not allowed"})
+			} else if s.AdditionalProperties != nil {
+				errs = s.AdditionalProperties.validate(joinField(field, name), val[name], errs)
+			}
+		}
+		if s.MinProperties != nil && len(val) < *s.MinProperties {
+			fail("must have at least %d fields", *s.MinProperties)
+		}
+		if s.MaxProperties != nil && len(val) > *s.MaxProperties {
+			fail("must have at most %d fields", *s.MaxProperties)
+		}
+		break
+	case []interface{}:
+		if s.MinItems != nil && len(val) < *s.MinItems {
+			fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(val) > *s.MaxItems {
+			fail("must have at most %d items", *s.MaxItems)
+		}
+		if s.UniqueItems {
+		dups:
+			for i := range val {
+				for j := 0; j < i; j++ {
+					if jsonEqual(val[i], val[j]) {
+						fail("items %d and %d must be unique", j, i)
+						break dups
+					}
+				}
+			}
+		}
+		if s.Items != nil {
+			for i, e := range val {
+				errs = s.Items.validate(joinField(field, fmt.Sprint(i)), e, errs)
+			}
+		}
+		break
+	case string:
+		n := len([]rune(val))
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("must be at most %d characters", *s.MaxLength)
+		}
+		if s.Pattern != nil && !s.Pattern.MatchString(val) {
+			fail("must match %s", s.Pattern)
+		}
+		if len(s.Format) > 0 && !formatMatches(s.Format, val) {
+			fail("must be a valid %s", s.Format)
+		}
+		break
+	case float64, int64, int:
+		n := toFloat(val)
+		if s.Minimum != nil && n < *s.Minimum {
+			fail("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			fail("must be at most %v", *s.Maximum)
+		}
+		if s.ExclusiveMinimum != nil && n <= *s.ExclusiveMinimum {
+			fail("must be greater than %v", *s.ExclusiveMinimum)
+		}
+		if s.ExclusiveMaximum != nil && n >= *s.ExclusiveMaximum {
+			fail("must be less than %v", *s.ExclusiveMaximum)
+		}
+		if s.MultipleOf != nil {
+			if q := n / *s.MultipleOf; math.Abs(q-math.Round(q)) > 1e-9 {
+				fail("must be a multiple of %v", *s.MultipleOf)
+			}
+		}
+		break
+	}
+
+	for _, sub := range s.AllOf {
+		errs = sub.validate(field, v, errs)
+	}
+	if len(s.AnyOf) > 0 {
+		matched := false
+		for _, sub := range s.AnyOf {
+			if len(sub.validate(field, v, nil)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must match at least one of the anyOf schemas")
+		}
+	}
+	if len(s.OneOf) > 0 {
+		matched := 0
+		for _, sub := range s.OneOf {
+			if len(sub.validate(field, v, nil)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("must match exactly one of the oneOf schemas, matched %d", matched)
+		}
+	}
+	if s.Not != nil && len(s.Not.validate(field, v, nil)) == 0 {
+		fail("must not match the not schema")
+	}
+	return errs
+}
+
+func joinField(prefix, name string) string {
+	if len(prefix) < 1 {
+		return name
+	}
+	return prefix + "." + name
+}
+
+func schemaTypeOf(v interface{}) string {
+	switch n := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64, int64, int:
+		if f := toFloat(n); f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func schemaTypeMatches(types []string, v interface{}) bool {
+	actual := schemaTypeOf(v)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func formatMatches(format, val string) bool {
+	switch format {
+	case "date-time":
+		_, err := time.Parse(time.RFC3339Nano, val)
+		return err == nil
+	case "date":
+		_, err := time.Parse("2006-01-02", val)
+		return err == nil
+	case "ipv4":
+		ip := net.ParseIP(val)
+		return ip != nil && ip.To4() != nil && !strings.Contains(val, ":")
+	case "ipv6":
+		return net.ParseIP(val) != nil && strings.Contains(val, ":")
+	case "email":
+		return emailExpr.MatchString(val)
+	case "hostname":
+		return len(val) <= 253 && hostnameExpr.MatchString(val)
+	}
+	return true
+}
+
+/* Equality of json values.  Numbers compare by value and objects by content. */
+func jsonEqual(a, b interface{}) bool {
+	if c, ok := compareValues(a, b); ok {
+		_, aStr := a.(string)
+		// dates compare by time but must match exactly here
+		return c == 0 && (!aStr || a == b)
+	}
+	switch av := a.(type) {
+	case nil:
+		return b == nil
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k := range av {
+			if _, ok := bv[k]; !ok || !jsonEqual(av[k], bv[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/* Assets failing validation against the schema of their type */
+type SchemaAuditReport struct {
+	Type    string         `json:"type"`
+	Checked int            `json:"checked"`
+	Invalid int            `json:"invalid"`
+	Assets  []InvalidAsset `json:"assets"`
+}
+
+type InvalidAsset struct {
+	Id     string        `json:"id"`
+	Errors []SchemaError `json:"errors"`
+}
+
+/* Response to a write that fails validation */
+type SchemaErrorResponse struct {
+	Error  string        `json:"error"`
+	Errors []SchemaError `json:"errors"`
+}
+
+/* Compiled schema of the asset type.  nil if the type has none. */
+func (ir *Inventory) assetTypeSchema(assetType string) (*Schema, error) {
+	t, _, err := ir.getAssetType(assetType)
+	if err != nil {
+		return nil, err
+	}
+	return t.CompiledSchema()
+}
+
+/* Read and compile a schema from the request body */
+func readSchemaBody(r *http.Request) (doc map[string]interface{}, schema *Schema, err error) {
+	var body []byte
+	if body, err = ioutil.ReadAll(r.Body); err != nil {
+		return
+	}
+	defer r.Body.Close()
+
+	if err = json.Unmarshal(body, &doc); err != nil {
+		err = fmt.Errorf("Invalid schema: %s", err)
+		return
+	}
+	schema, err = CompileSchema(doc)
+	return
+}
+
+/*
+   Handle asset type schemas i.e. GET, PUT and DELETE /_schemas/<asset_type>
+   The schema is part of the type definition, see TypeHandler.  Only admins
+   may change schemas.  A PUT defines the type if needed.
+*/
+func (ir *Inventory) SchemaHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		assetType = ir.normalizeAssetType(mux.Vars(r)["asset_type"])
+		headers   = map[string]string{"Content-Type": "text/plain"}
+	)
+
+	t, defined, err := ir.getAssetType(assetType)
+	if err != nil {
+		WriteAndLogResponse(w, r, 500, headers, []byte(err.Error()))
+		return
+	}
+
+	if r.Method == "GET" {
+		if t.Schema == nil {
+			WriteAndLogResponse(w, r, 404, headers, []byte("Not found: no schema for "+assetType))
+			return
+		}
+		headers["Content-Type"] = "application/json"
+		b, _ := json.Marshal(t.Schema)
+		WriteAndLogResponse(w, r, 200, headers, b)
+		return
+	}
+
+	reqUser, code, err := ir.authorizeAdmin(r)
+	if err != nil {
+		WriteAndLogResponse(w, r, code, headers, []byte(err.Error()))
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		if t.Schema, _, err = readSchemaBody(r); err != nil {
+			code = 400
+			break
+		}
+		if err = t.Validate(); err != nil {
+			code = 400
+			break
+		}
+		break
+	case "DELETE":
+		if t.Schema == nil {
+			code, err = 404, fmt.Errorf("Not found: no schema for %s", assetType)
+			break
+		}
+		t.Schema = nil
+		break
+	}
+	if err != nil {
+		WriteAndLogResponse(w, r, code, headers, []byte(err.Error()))
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if !defined {
+		t.Owner, t.CreatedAt, t.CreatedBy = reqUser, now, reqUser
+	}
+	t.UpdatedAt, t.UpdatedBy = now, reqUser
+
+	if err = ir.datastore.CreateAssetType(assetType); err == nil {
+		err = ir.datastore.PutSystemDoc(systemDocTypes, assetType, t)
+		ir.invalidateAssetType(assetType)
+	}
+	if err != nil {
+		WriteAndLogResponse(w, r, 500, headers, []byte(err.Error()))
+		return
+	}
+	log.V(6).Infof("Schema for '%s' updated by '%s'\n", assetType, reqUser)
+	WriteAndLogResponse(w, r, 200, headers, nil)
+}
+
+/*
+   Handle checking existing assets against the schema of their type
+   i.e. GET /_schemas/<asset_type>/audit?q=<query>
+   A schema in the body is checked instead of the stored one so changes can
+   be tried before they are made.
+*/
+func (ir *Inventory) SchemaAuditHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		assetType = ir.normalizeAssetType(mux.Vars(r)["asset_type"])
+		headers   = map[string]string{"Content-Type": "text/plain"}
+		schema    *Schema
+		err       error
+	)
+
+	if r.ContentLength != 0 {
+		if _, schema, err = readSchemaBody(r); err != nil {
+			WriteAndLogResponse(w, r, 400, headers, []byte(err.Error()))
+			return
+		}
+	} else if schema, err = ir.assetTypeSchema(assetType); err != nil {
+		WriteAndLogResponse(w, r, 500, headers, []byte(err.Error()))
+		return
+	} else if schema == nil {
+		WriteAndLogResponse(w, r, 404, headers, []byte("Not found: no schema for "+assetType))
+		return
+	}
+
+	var filter *Filter
+	if qstr := r.URL.Query().Get("q"); len(qstr) > 0 {
+		if filter, err = ParseQueryString(qstr); err != nil {
+			WriteAndLogResponse(w, r, 400, headers, []byte(err.Error()))
+			return
+		}
+	}
+
+	report := SchemaAuditReport{Type: assetType, Assets: []InvalidAsset{}}
+	err = ir.datastore.ForEachAsset([]string{assetType}, Query{Filter: filter}, func(a Asset) error {
+		report.Checked++
+		if errs := schema.ValidateAsset(a.Data); len(errs) > 0 {
+			report.Invalid++
+			report.Assets = append(report.Assets, InvalidAsset{Id: a.Id, Errors: errs})
+		}
+		return nil
+	})
+	if err != nil {
+		WriteAndLogResponse(w, r, 500, headers, []byte(err.Error()))
+		return
+	}
+
+	headers["Content-Type"] = "application/json"
+	b, _ := json.Marshal(report)
+	WriteAndLogResponse(w, r, 200, headers, b)
+}
+
+/*
+   Validate a write against the schema of the asset type.  PUTs are merged
+   with the current asset first so the stored document is what is checked.
+   Returns nil data if the write may go ahead.
+*/
+func (ir *Inventory) validateAssetWrite(schema *Schema, assetType, assetId, method string, reqData map[string]interface{}) (code int, headers map[string]string, data []byte) {
+	doc := reqData
+	if method == "PUT" {
+		current, err := ir.datastore.GetAsset(assetType, assetId)
+		if err != nil {
+			// the edit reports it
+			return 0, nil, nil
+		}
+		if doc, err = copyDocument(current.Data); err != nil {
+			return 500, textHeaders(), []byte(err.Error())
+		}
+		patch, err := copyDocument(reqData)
+		if err != nil {
+			return 500, textHeaders(), []byte(err.Error())
+		}
+		mergeDocument(doc, patch)
+	}
+
+	errs := schema.ValidateAsset(doc)
+	if len(errs) < 1 {
+		return 0, nil, nil
+	}
+
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	log.V(6).Infof("%s/%s failed validation: %s\n", assetType, assetId, strings.Join(msgs, "; "))
+
+	data, _ = json.Marshal(SchemaErrorResponse{
+		Error:  fmt.Sprintf("Invalid %s: %s", assetType, strings.Join(msgs, "; ")),
+		Errors: errs,
+	})
+	return 400, jsonHeaders(), data
+}
@@ -0,0 +1,117 @@
+package inventory
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+var testSchemaDoc = `{
+	"type": "object",
+	"required": ["name", "ttl"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {"type": "string", "format": "hostname"},
+		"ttl": {"type": "integer", "minimum": 60, "maximum": 86400},
+		"kind": {"enum": ["A", "AAAA", "CNAME"]},
+		"ip": {"anyOf": [{"format": "ipv4"}, {"format": "ipv6"}]},
+		"owner": {"type": "string", "pattern": "^[a-z]+$", "maxLength": 8},
+		"tags": {"type": "array", "items": {"type": "string"}, "uniqueItems": true, "maxItems": 3},
+		"meta": {"type": "object", "additionalProperties": {"type": ["string", "null"]}},
+		"weight": {"type": "number", "exclusiveMinimum": 0, "multipleOf": 0.5},
+		"legacy": {"not": {"const": true}}
+	}
+}`
+
+func testSchema(t *testing.T, doc string) *Schema {
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(doc), &m); err != nil {
+		t.Fatalf("%s", err)
+	}
+	s, err := CompileSchema(m)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return s
+}
+
+func Test_Schema_Validate(t *testing.T) {
+	s := testSchema(t, testSchemaDoc)
+
+	tests := []struct {
+		doc    string
+		errors []string
+	}{
+		{`{"name": "www.foo.org", "ttl": 300, "kind": "A", "ip": "10.1.2.3", "tags": ["a", "b"],
+			"meta": {"x": "y", "z": null}, "weight": 1.5, "legacy": false}`, nil},
+		{`{"name": "www.foo.org", "ttl": 300, "ip": "::1", "created_by": "x", "updated_at": "now"}`, nil},
+		{`{}`, []string{"name: is required", "ttl: is required"}},
+		{`{"name": 5, "ttl": 30.5}`, []string{"name: must be string got integer", "ttl: must be integer got number"}},
+		{`{"name": "-bad-", "ttl": 30}`, []string{"name: must be a valid hostname", "ttl: must be at least 60"}},
+		{`{"name": "a", "ttl": 60, "kind": "MX", "ip": "10.1.2"}`,
+			[]string{"ip: must match at least one of the anyOf schemas", `kind: must be one of ["A","AAAA","CNAME"]`}},
+		{`{"name": "a", "ttl": 60, "owner": "BobSmithJones"}`,
+			[]string{"owner: must be at most 8 characters", "owner: must match ^[a-z]+$"}},
+		{`{"name": "a", "ttl": 60, "tags": ["a", 1, "a", "b"]}`,
+			[]string{"tags: must have at most 3 items", "tags: items 0 and 2 must be unique", "tags.1: must be string got integer"}},
+		{`{"name": "a", "ttl": 60, "meta": {"x": 1}, "weight": 0, "legacy": true, "extra": 1}`,
+			[]string{"extra: is not allowed", "legacy: must not match the not schema", "meta.x: must be string or null got integer",
+				"weight: must be greater than 0"}},
+		{`{"name": "a", "ttl": 60, "weight": 1.2}`, []string{"weight: must be a multiple of 0.5"}},
+		{`[]`, []string{"must be object got array"}},
+	}
+	for i, tst := range tests {
+		var doc interface{}
+		json.Unmarshal([]byte(tst.doc), &doc)
+
+		var errs []SchemaError
+		if m, ok := doc.(map[string]interface{}); ok {
+			errs = s.ValidateAsset(m)
+		} else {
+			errs = s.Validate(doc)
+		}
+
+		msgs := make([]string, len(errs))
+		for j, e := range errs {
+			msgs[j] = e.Error()
+		}
+		if strings.Join(msgs, "\n") != strings.Join(tst.errors, "\n") {
+			t.Fatalf("t%d: wrong errors:\n%s\nexpected:\n%s", i, strings.Join(msgs, "\n"), strings.Join(tst.errors, "\n"))
+		}
+	}
+}
+
+func Test_CompileSchema_Errors(t *testing.T) {
+	for doc, msg := range map[string]string{
+		`{"type": "text"}`:                                  "'type': unknown type 'text'",
+		`{"properties": {"a": {"pattern": "("}}}`:           "'properties.a.pattern'",
+		`{"required": "a"}`:                                 "'required': must be a list of field names",
+		`{"items": {"minItems": -1}}`:                       "'items.minItems': must be a non negative integer",
+		`{"format": "uuid"}`:                                "'format': unsupported format 'uuid'",
+		`{"oneOf": []}`:                                     "'oneOf': must be a non empty list of schemas",
+		`{"$ref": "#/definitions/a"}`:                       "'$ref': references are not supported",
+		`{"exclusiveMinimum": true}`:                        "'exclusiveMinimum': requires minimum",
+		`{"additionalProperties": {"type": ["string", 1]}}`: "'additionalProperties.type': unknown type ''",
+		`{"patternProperties": {"^a": {"type": "string"}}}`: "'patternProperties': keyword is not supported",
+		`{"properties": {"a": {"contains": {}}}}`:           "'properties.a.contains': keyword is not supported",
+		`{"if": {}, "then": {}}`:                            "'if': keyword is not supported",
+	} {
+		var m map[string]interface{}
+		json.Unmarshal([]byte(doc), &m)
+		if _, err := CompileSchema(m); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("%s: wrong error %v", doc, err)
+		}
+	}
+
+	// draft 4 style exclusive limits
+	s := testSchema(t, `{"minimum": 1, "exclusiveMinimum": true}`)
+	if len(s.Validate(1.0)) != 1 || len(s.Validate(1.5)) != 0 {
+		t.Fatalf("Draft 4 exclusiveMinimum not applied")
+	}
+}
+
+/* Whether a response body is a SchemaErrorResponse rather than plain text */
+func isSchemaErrorResponse(data []byte) bool {
+	var resp SchemaErrorResponse
+	return json.Unmarshal(data, &resp) == nil && len(resp.Errors) > 0
+}
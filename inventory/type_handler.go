@@ -0,0 +1,357 @@
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+   How long type definitions are cached.  Changes made through this
+   instance are seen at once, those made through other instances sharing
+   the datastore within the TTL.
+*/
+const assetTypeCacheTTL = time.Minute
+
+/* Type definitions read by getAssetType, by name */
+type assetTypeCache struct {
+	mu    sync.RWMutex
+	types map[string]cachedAssetType
+}
+
+type cachedAssetType struct {
+	t       AssetType
+	defined bool
+	expires time.Time
+}
+
+/*
+   Definition of the asset type.  Types that exist without one get an empty
+   definition.  defined is false in that case.
+*/
+func (ir *Inventory) getAssetType(name string) (t AssetType, defined bool, err error) {
+	ir.typeCache.mu.RLock()
+	c, ok := ir.typeCache.types[name]
+	ir.typeCache.mu.RUnlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.t, c.defined, nil
+	}
+
+	if err = ir.datastore.GetSystemDoc(systemDocTypes, name, &t); err == nil {
+		defined = true
+	} else if isNotFound(err) {
+		t, err = AssetType{Name: name}, nil
+	} else {
+		return
+	}
+
+	ir.typeCache.mu.Lock()
+	if ir.typeCache.types == nil {
+		ir.typeCache.types = map[string]cachedAssetType{}
+	}
+	ir.typeCache.types[name] = cachedAssetType{t: t, defined: defined, expires: time.Now().Add(assetTypeCacheTTL)}
+	ir.typeCache.mu.Unlock()
+	return
+}
+
+/* Drop the cached definition of the type.  Called on every change to it. */
+func (ir *Inventory) invalidateAssetType(name string) {
+	ir.typeCache.mu.Lock()
+	delete(ir.typeCache.types, name)
+	ir.typeCache.mu.Unlock()
+}
+
+func (ir *Inventory) assetTypeExists(name string) (bool, error) {
+	types, err := ir.datastore.ListAssetTypes()
+	if err != nil {
+		return false, err
+	}
+	for _, t := range types {
+		if t == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (ir *Inventory) countAssets(assetType string) (int64, error) {
+	rslt, err := ir.datastore.Aggregate([]string{assetType}, nil, Aggregation{})
+	return rslt.Count, err
+}
+
+/*
+   Every asset type, with or without a definition, along with its number of
+   assets.  Sorted by name.
+*/
+func (ir *Inventory) listAssetTypes() ([]AssetTypeInfo, error) {
+	names, err := ir.datastore.ListAssetTypes()
+	if err != nil {
+		return nil, err
+	}
+	defined, err := ir.datastore.ListSystemDocs(systemDocTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, n := range append(names, defined...) {
+		seen[n] = true
+	}
+	names = make([]string, 0, len(seen))
+	for n := range seen {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	types := make([]AssetTypeInfo, len(names))
+	for i, n := range names {
+		if types[i].AssetType, _, err = ir.getAssetType(n); err != nil {
+			return nil, err
+		}
+		if types[i].Count, err = ir.countAssets(n); err != nil {
+			return nil, err
+		}
+	}
+	return types, nil
+}
+
+/*
+   Handle asset type definitions i.e. GET, POST, PUT and DELETE /_types/<name>
+   Only admins may create, change or remove types.  A DELETE is refused
+   while the type has assets unless force=true is given, which removes them
+   along with their versions.
+*/
+func (ir *Inventory) TypeHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		name    = ir.normalizeAssetType(mux.Vars(r)["name"])
+		headers = map[string]string{"Content-Type": "text/plain"}
+		code    int
+		data    []byte
+	)
+
+	if r.Method == "GET" {
+		code, data = ir.typeGetHandler(name)
+		if code == 200 {
+			headers["Content-Type"] = "application/json"
+		}
+		WriteAndLogResponse(w, r, code, headers, data)
+		return
+	}
+
+	reqUser, code, err := ir.authorizeAdmin(r)
+	if err != nil {
+		WriteAndLogResponse(w, r, code, headers, []byte(err.Error()))
+		return
+	}
+
+	switch r.Method {
+	case "POST", "PUT":
+		code, data = ir.typePostPutHandler(name, reqUser, r)
+		if code == 200 {
+			headers["Content-Type"] = "application/json"
+		}
+		break
+	case "DELETE":
+		code, headers, data = ir.typeDeleteHandler(name, reqUser, r.URL.Query().Get("force") == "true")
+		break
+	default:
+		code, data = 405, []byte("Method not allowed")
+		break
+	}
+
+	WriteAndLogResponse(w, r, code, headers, data)
+}
+
+func (ir *Inventory) typeGetHandler(name string) (code int, data []byte) {
+	t, defined, err := ir.getAssetType(name)
+	if err != nil {
+		return 500, []byte(err.Error())
+	}
+	if !defined {
+		exists, err := ir.assetTypeExists(name)
+		if err != nil {
+			return 500, []byte(err.Error())
+		}
+		if !exists {
+			return 404, []byte("Not found: " + name)
+		}
+	}
+
+	info := AssetTypeInfo{AssetType: t}
+	if info.Count, err = ir.countAssets(name); err != nil {
+		return 500, []byte(err.Error())
+	}
+	data, _ = json.Marshal(info)
+	return 200, data
+}
+
+/* POST creates the definition, PUT replaces it */
+func (ir *Inventory) typePostPutHandler(name, reqUser string, r *http.Request) (code int, data []byte) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return 400, []byte(err.Error())
+	}
+	var t AssetType
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &t); err != nil {
+			return 400, []byte(err.Error())
+		}
+	}
+
+	t.Name = name
+	if err = t.Validate(); err != nil {
+		return 400, []byte(err.Error())
+	}
+
+	existing, defined, err := ir.getAssetType(name)
+	if err != nil {
+		return 500, []byte(err.Error())
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	switch r.Method {
+	case "POST":
+		if defined {
+			return 409, []byte(fmt.Sprintf("Asset type already exists: %s", name))
+		}
+		t.CreatedAt, t.CreatedBy = now, reqUser
+		break
+	case "PUT":
+		if !defined {
+			exists, err := ir.assetTypeExists(name)
+			if err != nil {
+				return 500, []byte(err.Error())
+			}
+			if !exists {
+				return 404, []byte("Not found: " + name)
+			}
+		}
+		t.CreatedAt, t.CreatedBy = existing.CreatedAt, existing.CreatedBy
+		break
+	}
+	t.UpdatedAt, t.UpdatedBy = now, reqUser
+	if len(t.Owner) < 1 {
+		t.Owner = reqUser
+	}
+
+	if err = ir.datastore.CreateAssetType(name); err != nil {
+		return 500, []byte(err.Error())
+	}
+	err = ir.datastore.PutSystemDoc(systemDocTypes, name, t)
+	ir.invalidateAssetType(name)
+	if err != nil {
+		return 500, []byte(err.Error())
+	}
+	log.V(6).Infof("Asset type '%s' saved by '%s'\n", name, reqUser)
+
+	data, _ = json.Marshal(t)
+	return 200, data
+}
+
+/*
+   Remove the asset type and its definition.  Assets are only removed with
+   force and never while assets of other types have relationships to them,
+   as deleting them one by one would.  The check and the removal are one
+   transaction on the memory and bolt datastores, see assetDeleteHandler.
+*/
+func (ir *Inventory) typeDeleteHandler(name, reqUser string, force bool) (code int, headers map[string]string, data []byte) {
+	var (
+		count      int64
+		restricted []AssetRelationship
+		removed    bool
+	)
+	err := ir.batch(func(tx *Inventory) error {
+		var err error
+		if count, err = tx.countAssets(name); err != nil {
+			return err
+		}
+		if count > 0 && !force {
+			return errDeleteRestricted
+		}
+		if count > 0 {
+			if restricted, err = tx.incomingTypeRelationships(name); err != nil {
+				return err
+			}
+			if len(restricted) > 0 {
+				return errDeleteRestricted
+			}
+		}
+
+		if err = tx.datastore.RemoveAssetType(name); err == nil {
+			removed = true
+		} else if !isNotFound(err) {
+			return err
+		}
+		if err = tx.datastore.RemoveSystemDoc(systemDocTypes, name); err == nil {
+			removed = true
+		} else if !isNotFound(err) {
+			return err
+		}
+		return nil
+	})
+	ir.invalidateAssetType(name)
+
+	if err == errDeleteRestricted {
+		if len(restricted) < 1 {
+			return 409, textHeaders(), []byte(fmt.Sprintf("Asset type %s has %d assets.  Use force=true to remove them", name, count))
+		}
+		data, _ = json.Marshal(map[string]interface{}{
+			"error":         fmt.Sprintf("Conflict: assets of %s are the target of relationships from other types", name),
+			"restricted_by": restricted,
+		})
+		return 409, jsonHeaders(), data
+	} else if err != nil {
+		return 500, textHeaders(), []byte(err.Error())
+	}
+
+	if !removed {
+		return 404, textHeaders(), []byte("Not found: " + name)
+	}
+	log.V(6).Infof("Asset type '%s' removed with %d assets by '%s'\n", name, count, reqUser)
+	return 200, textHeaders(), nil
+}
+
+/*
+   Handle listing assets sharing values of unique fields i.e.
+   GET /_types/<name>/unique?fields=<field>,<field>
+   The unique fields of the type are checked unless fields are given, so
+   fields can be checked before they are made unique.
+*/
+func (ir *Inventory) TypeUniqueHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		name    = ir.normalizeAssetType(mux.Vars(r)["name"])
+		headers = map[string]string{"Content-Type": "text/plain"}
+	)
+
+	t, _, err := ir.getAssetType(name)
+	if err != nil {
+		WriteAndLogResponse(w, r, 500, headers, []byte(err.Error()))
+		return
+	}
+
+	fields := t.UniqueFields
+	if param := r.URL.Query().Get("fields"); len(param) > 0 {
+		fields = strings.Split(param, ",")
+	}
+	if len(fields) < 1 {
+		WriteAndLogResponse(w, r, 400, headers, []byte(fmt.Sprintf("Invalid request: %s has no unique fields and none were given", name)))
+		return
+	}
+
+	report, err := ir.ReportUniqueViolations(name, fields)
+	if err != nil {
+		WriteAndLogResponse(w, r, 500, headers, []byte(err.Error()))
+		return
+	}
+
+	headers["Content-Type"] = "application/json"
+	b, _ := json.Marshal(report)
+	WriteAndLogResponse(w, r, 200, headers, b)
+}
@@ -0,0 +1,111 @@
+package inventory
+
+import (
+	"fmt"
+)
+
+/*
+   Returned by writes that would give an asset the same value of a unique
+   field as another asset of the type.  Type and Id are the other asset.
+*/
+type ConflictError struct {
+	Type  string      `json:"type"`
+	Id    string      `json:"id"`
+	Field string      `json:"field"`
+	Value interface{} `json:"value"`
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("Conflict: %s %v is already used by %s/%s", e.Field, e.Value, e.Type, e.Id)
+}
+
+func isConflict(err error) bool {
+	_, ok := err.(*ConflictError)
+	return ok
+}
+
+/* Existing assets sharing the value of a unique field */
+type UniqueReport struct {
+	Type       string            `json:"type"`
+	Fields     []string          `json:"fields"`
+	Violations []UniqueViolation `json:"violations"`
+}
+
+type UniqueViolation struct {
+	Field string      `json:"field"`
+	Value interface{} `json:"value"`
+	Ids   []string    `json:"ids"`
+}
+
+/*
+   Values of the field that must be unique.  Each element of an array is a
+   value.  Objects and nulls are ignored.
+*/
+func uniqueValues(doc map[string]interface{}, field string) []interface{} {
+	values := []interface{}{}
+	for _, v := range fieldValues(doc, field) {
+		switch v.(type) {
+		case string, float64, int64, int, bool:
+			values = append(values, v)
+			break
+		}
+	}
+	return values
+}
+
+/* Conflict if other has any of the unique values of doc.  Type and Id are left to the caller. */
+func findUniqueConflict(fields []string, doc, other map[string]interface{}) *ConflictError {
+	for _, field := range fields {
+		for _, v := range uniqueValues(doc, field) {
+			for _, ov := range uniqueValues(other, field) {
+				if jsonEqual(v, ov) {
+					return &ConflictError{Field: field, Value: v}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+/* Unique fields of the asset type from its definition */
+func datastoreUniqueFields(ds IDatastore, assetType string) ([]string, error) {
+	var t AssetType
+	if err := ds.GetSystemDoc(systemDocTypes, assetType, &t); err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return t.UniqueFields, nil
+}
+
+/*
+   Find assets of the type sharing values of the fields.  Values are found
+   by aggregating so only duplicated ones are looked up.
+*/
+func (ir *Inventory) ReportUniqueViolations(assetType string, fields []string) (report UniqueReport, err error) {
+	report = UniqueReport{Type: assetType, Fields: fields, Violations: []UniqueViolation{}}
+
+	for _, field := range fields {
+		var counts AggregationResult
+		// only values held by more than one asset
+		if counts, err = ir.datastore.Aggregate([]string{assetType}, nil, Aggregation{By: []string{field}, MinCount: 2}); err != nil {
+			return
+		}
+
+		for _, bucket := range counts.Buckets {
+			var rslt SearchResult
+			q := Query{Filter: Terms(field, bucket.Key), Size: MaxSearchSize, Fields: []string{field}}
+			if rslt, err = ir.datastore.Search([]string{assetType}, q); err != nil {
+				return
+			}
+
+			violation := UniqueViolation{Field: field, Value: bucket.Key, Ids: []string{}}
+			for _, a := range rslt.Assets {
+				violation.Ids = append(violation.Ids, a.Id)
+			}
+			report.Violations = append(report.Violations, violation)
+		}
+	}
+	return
+}
@@ -4,12 +4,110 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/pmezard/go-difflib/difflib"
+	"reflect"
+	"sort"
+	"strings"
 )
 
 type VersionDiff struct {
-	Version        int64  `json:"version"`
-	AgainstVersion int64  `json:"against_version"`
-	Diff           string `json:"diff"`
+	Version        int64            `json:"version"`
+	AgainstVersion int64            `json:"against_version"`
+	Diff           string           `json:"diff"`
+	Patch          []PatchOperation `json:"patch,omitempty"`
+}
+
+/* Diff between 2 arbitrary versions of an asset */
+type AssetDiff struct {
+	From  string           `json:"from"`
+	To    string           `json:"to"`
+	Diff  string           `json:"diff"`
+	Patch []PatchOperation `json:"patch"`
+}
+
+/* JSON Patch (RFC 6902) operation */
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+/* remove operations have no value */
+func (p PatchOperation) MarshalJSON() ([]byte, error) {
+	if p.Op == "remove" {
+		return json.Marshal(map[string]string{"op": p.Op, "path": p.Path})
+	}
+	return json.Marshal(map[string]interface{}{"op": p.Op, "path": p.Path, "value": p.Value})
+}
+
+/* Escape a key for use in a JSON pointer (RFC 6901) */
+func jsonPointerEscape(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+/*
+   Generate the JSON Patch transforming prev into curr.  Objects and arrays
+   are compared recursively so only changed leaves are reported.  Key order
+   does not matter.
+*/
+func GeneratePatch(prev, curr interface{}) []PatchOperation {
+	return appendPatch([]PatchOperation{}, "", prev, curr)
+}
+
+func appendPatch(ops []PatchOperation, path string, prev, curr interface{}) []PatchOperation {
+	switch pv := prev.(type) {
+	case map[string]interface{}:
+		cv, ok := curr.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(pv)+len(cv))
+		for k := range pv {
+			keys = append(keys, k)
+		}
+		for k := range cv {
+			if _, ok := pv[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			kpath := path + "/" + jsonPointerEscape(k)
+			pval, pok := pv[k]
+			cval, cok := cv[k]
+			if !cok {
+				ops = append(ops, PatchOperation{Op: "remove", Path: kpath})
+			} else if !pok {
+				ops = append(ops, PatchOperation{Op: "add", Path: kpath, Value: cval})
+			} else {
+				ops = appendPatch(ops, kpath, pval, cval)
+			}
+		}
+		return ops
+
+	case []interface{}:
+		cv, ok := curr.([]interface{})
+		if !ok {
+			break
+		}
+		i := 0
+		for ; i < len(pv) && i < len(cv); i++ {
+			ops = appendPatch(ops, fmt.Sprintf("%s/%d", path, i), pv[i], cv[i])
+		}
+		for j := i; j < len(cv); j++ {
+			ops = append(ops, PatchOperation{Op: "add", Path: fmt.Sprintf("%s/%d", path, j), Value: cv[j]})
+		}
+		// Remove from the end so earlier indexes stay valid
+		for j := len(pv) - 1; j >= i; j-- {
+			ops = append(ops, PatchOperation{Op: "remove", Path: fmt.Sprintf("%s/%d", path, j)})
+		}
+		return ops
+	}
+
+	if !reflect.DeepEqual(prev, curr) {
+		ops = append(ops, PatchOperation{Op: "replace", Path: path, Value: curr})
+	}
+	return ops
 }
 
 func GenerateDiff(prevName, prevStr, currName, currStr string) (string, error) {
@@ -23,6 +121,21 @@ func GenerateDiff(prevName, prevStr, currName, currStr string) (string, error) {
 	return difflib.GetUnifiedDiffString(diff)
 }
 
+/* Text and JSON Patch diff of 2 documents */
+func GenerateAssetDiff(fromName string, from map[string]interface{}, toName string, to map[string]interface{}) (diff AssetDiff, err error) {
+	var bf, bt []byte
+	if bf, err = json.MarshalIndent(from, "", " "); err != nil {
+		return
+	}
+	if bt, err = json.MarshalIndent(to, "", " "); err != nil {
+		return
+	}
+
+	diff = AssetDiff{From: fromName, To: toName, Patch: GeneratePatch(from, to)}
+	diff.Diff, err = GenerateDiff(fromName, string(bf), toName, string(bt))
+	return
+}
+
 func parseVersion(ver interface{}) (verInt int64, err error) {
 	switch ver.(type) {
 	case float64:
@@ -42,7 +155,15 @@ func parseVersion(ver interface{}) (verInt int64, err error) {
 	}
 }
 
+/*
+   Diff each version against the next one in the list.  Versions are
+   expected newest first.  Both the text diff and the JSON Patch are
+   generated.
+*/
 func GenerateVersionDiffs(versions ...map[string]interface{}) (list []VersionDiff, err error) {
+	if len(versions) < 2 {
+		return []VersionDiff{}, nil
+	}
 	list = make([]VersionDiff, len(versions)-1)
 
 	for i, version := range versions {
@@ -82,7 +203,8 @@ func GenerateVersionDiffs(versions ...map[string]interface{}) (list []VersionDif
 			return
 		}
 		//list[fmt.Sprintf("v%d", i+1)] = text
-		list[i] = VersionDiff{Version: verInt, AgainstVersion: verInt1, Diff: text}
+		list[i] = VersionDiff{Version: verInt, AgainstVersion: verInt1, Diff: text,
+			Patch: GeneratePatch(versions[i+1], version)}
 		// put next version back after the diff is calculated
 		versions[i+1]["version"] = verInt1
 	}
@@ -3,6 +3,7 @@ package inventory
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -51,3 +52,46 @@ func Test_GenerateDiff(t *testing.T) {
 	}
 	t.Logf("%s\n", diffText)
 }
+
+func Test_GeneratePatch(t *testing.T) {
+	var prev, curr map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"a": "x", "b": 1, "gone": true, "a/b": "slash",
+		"nested": {"k": "v", "deep": {"n": 1}},
+		"list": [1, 2, 3],
+		"short": [1, 2, 3],
+		"objs": [{"id": 1}, {"id": 2}]
+	}`), &prev)
+	json.Unmarshal([]byte(`{
+		"b": 1, "a": "y", "new": null, "a/b": "slash2",
+		"nested": {"k": "v", "deep": {"n": 2}, "added": [1]},
+		"list": [1, 2, 3, 4],
+		"short": [1],
+		"objs": [{"id": 1}, {"id": 3}]
+	}`), &curr)
+
+	patch := GeneratePatch(prev, curr)
+	b, _ := json.Marshal(patch)
+
+	expected := `[{"op":"replace","path":"/a","value":"y"},` +
+		`{"op":"replace","path":"/a~1b","value":"slash2"},` +
+		`{"op":"remove","path":"/gone"},` +
+		`{"op":"add","path":"/list/3","value":4},` +
+		`{"op":"add","path":"/nested/added","value":[1]},` +
+		`{"op":"replace","path":"/nested/deep/n","value":2},` +
+		`{"op":"add","path":"/new","value":null},` +
+		`{"op":"replace","path":"/objs/1/id","value":3},` +
+		`{"op":"remove","path":"/short/2"},` +
+		`{"op":"remove","path":"/short/1"}]`
+	if string(b) != expected {
+		t.Fatalf("Wrong patch:\n%s\n%s", b, expected)
+	}
+
+	if patch = GeneratePatch(prev, prev); len(patch) != 0 {
+		t.Fatalf("Patch of identical documents: %#v", patch)
+	}
+	if patch = GeneratePatch("a", map[string]interface{}{}); !reflect.DeepEqual(patch,
+		[]PatchOperation{{Op: "replace", Path: "", Value: map[string]interface{}{}}}) {
+		t.Fatalf("Wrong root patch: %#v", patch)
+	}
+}
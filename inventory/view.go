@@ -0,0 +1,88 @@
+package inventory
+
+import (
+	"fmt"
+	"regexp"
+)
+
+/* System document kind saved views are stored under */
+const systemDocViews = "views"
+
+var viewNameExpr = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+/*
+   Named search stored server side.  Filter is a search body and Query a
+   text query, both must match if given.  Types are the asset types searched,
+   all of them if empty.  Sort and Fields are defaults a request running the
+   view may override.
+*/
+type View struct {
+	Name        string                 `json:"name"`
+	Owner       string                 `json:"owner"`
+	Description string                 `json:"description,omitempty"`
+	Types       []string               `json:"types,omitempty"`
+	Filter      map[string]interface{} `json:"filter,omitempty"`
+	Query       string                 `json:"q,omitempty"`
+	Sort        []string               `json:"sortby,omitempty"`
+	Fields      []string               `json:"fields,omitempty"`
+
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+	UpdatedBy string `json:"updated_by"`
+}
+
+func (v *View) Validate() error {
+	if !viewNameExpr.MatchString(v.Name) {
+		return fmt.Errorf("Invalid view name: '%s'", v.Name)
+	}
+	if _, err := v.SearchFilter(); err != nil {
+		return err
+	}
+	if _, err := parseSortParams(v.Sort); err != nil {
+		return err
+	}
+	return nil
+}
+
+/* Filter of the view.  nil matches everything. */
+func (v *View) SearchFilter() (*Filter, error) {
+	var filter *Filter
+	if len(v.Filter) > 0 {
+		f, err := ParseFilterDocument(v.Filter)
+		if err != nil {
+			return nil, err
+		}
+		filter = f
+	}
+	if len(v.Query) > 0 {
+		qf, err := ParseQueryString(v.Query)
+		if err != nil {
+			return nil, err
+		}
+		filter = andFilters(filter, qf)
+	}
+	return filter, nil
+}
+
+/*
+   Apply the view to a query parsed from a request.  The view filter is
+   ANDed with any from the request.  The view sort order and fields are
+   used unless the request has its own.
+*/
+func (v *View) Apply(q Query) (Query, error) {
+	filter, err := v.SearchFilter()
+	if err != nil {
+		return q, err
+	}
+	q.Filter = andFilters(filter, q.Filter)
+
+	if len(q.Sort) < 1 {
+		if q.Sort, err = parseSortParams(v.Sort); err != nil {
+			return q, err
+		}
+	}
+	if len(q.Fields) < 1 {
+		q.Fields = v.Fields
+	}
+	return q, nil
+}
@@ -0,0 +1,191 @@
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+/*
+   Handle listing saved views i.e. GET /_views
+*/
+func (ir *Inventory) ListViewsHandler(w http.ResponseWriter, r *http.Request) {
+	headers := map[string]string{"Content-Type": "text/plain"}
+
+	names, err := ir.datastore.ListSystemDocs(systemDocViews)
+	if err != nil {
+		WriteAndLogResponse(w, r, 500, headers, []byte(err.Error()))
+		return
+	}
+
+	views := make([]View, 0, len(names))
+	for _, name := range names {
+		var view View
+		if err = ir.datastore.GetSystemDoc(systemDocViews, name, &view); err != nil {
+			// removed since listing
+			log.V(6).Infof("Skipping view '%s': %s\n", name, err)
+			continue
+		}
+		views = append(views, view)
+	}
+
+	headers["Content-Type"] = "application/json"
+	b, _ := json.Marshal(views)
+	WriteAndLogResponse(w, r, 200, headers, b)
+}
+
+/*
+   Handle saved views i.e. GET, PUT and DELETE /_views/<name>
+   A PUT creates the view owned by the requesting user or replaces it.  Only
+   the owner or an admin may change or remove a view.
+*/
+func (ir *Inventory) ViewHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		name    = mux.Vars(r)["name"]
+		headers = map[string]string{"Content-Type": "text/plain"}
+		code    int
+		data    []byte
+	)
+
+	switch r.Method {
+	case "GET":
+		var view View
+		if err := ir.datastore.GetSystemDoc(systemDocViews, name, &view); err != nil {
+			code, data = 404, []byte(err.Error())
+			break
+		}
+		headers["Content-Type"] = "application/json"
+		code = 200
+		data, _ = json.Marshal(view)
+		break
+	case "PUT":
+		code, data = ir.viewPutHandler(name, r)
+		if code == 200 {
+			headers["Content-Type"] = "application/json"
+		}
+		break
+	case "DELETE":
+		code, data = ir.viewDeleteHandler(name, r)
+		break
+	default:
+		code, data = 405, []byte("Method not allowed")
+		break
+	}
+
+	WriteAndLogResponse(w, r, code, headers, data)
+}
+
+/* Owners and admins may change a view.  With auth disabled anyone can. */
+func (ir *Inventory) canEditView(user string, view View) bool {
+	return ir.authClient == nil || view.Owner == user || ir.isAdmin(user)
+}
+
+func (ir *Inventory) viewPutHandler(name string, r *http.Request) (code int, data []byte) {
+	reqUser, _, err := ir.authenticateRequest(r)
+	if err != nil {
+		return 401, []byte(err.Error())
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return 400, []byte(err.Error())
+	}
+	var view View
+	if err = json.Unmarshal(body, &view); err != nil {
+		return 400, []byte(err.Error())
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	view.Name, view.Owner, view.CreatedAt = name, reqUser, now
+	view.UpdatedBy, view.UpdatedAt = reqUser, now
+	for i, t := range view.Types {
+		view.Types[i] = ir.normalizeAssetType(t)
+	}
+	if err = view.Validate(); err != nil {
+		return 400, []byte(err.Error())
+	}
+
+	var existing View
+	if ir.datastore.GetSystemDoc(systemDocViews, name, &existing) == nil {
+		if !ir.canEditView(reqUser, existing) {
+			return 403, []byte(fmt.Sprintf("Forbidden: view '%s' is owned by %s", name, existing.Owner))
+		}
+		view.Owner, view.CreatedAt = existing.Owner, existing.CreatedAt
+	}
+
+	if err = ir.datastore.PutSystemDoc(systemDocViews, name, view); err != nil {
+		return 500, []byte(err.Error())
+	}
+	log.V(6).Infof("View '%s' saved by '%s'\n", name, reqUser)
+
+	data, _ = json.Marshal(view)
+	return 200, data
+}
+
+func (ir *Inventory) viewDeleteHandler(name string, r *http.Request) (code int, data []byte) {
+	reqUser, _, err := ir.authenticateRequest(r)
+	if err != nil {
+		return 401, []byte(err.Error())
+	}
+
+	var existing View
+	if err = ir.datastore.GetSystemDoc(systemDocViews, name, &existing); err != nil {
+		return 404, []byte(err.Error())
+	}
+	if !ir.canEditView(reqUser, existing) {
+		return 403, []byte(fmt.Sprintf("Forbidden: view '%s' is owned by %s", name, existing.Owner))
+	}
+
+	if err = ir.datastore.RemoveSystemDoc(systemDocViews, name); err != nil {
+		return 404, []byte(err.Error())
+	}
+	log.V(6).Infof("View '%s' removed by '%s'\n", name, reqUser)
+	return 200, nil
+}
+
+/*
+   Handle running a saved view i.e. GET /_views/<name>/results
+   Takes the same parameters as a search including format.  A body or q
+   further narrows the results.
+*/
+func (ir *Inventory) ViewResultsHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		name    = mux.Vars(r)["name"]
+		headers = map[string]string{"Content-Type": "text/plain"}
+		view    View
+	)
+
+	if err := ir.datastore.GetSystemDoc(systemDocViews, name, &view); err != nil {
+		WriteAndLogResponse(w, r, 404, headers, []byte(err.Error()))
+		return
+	}
+
+	q, err := ir.parseSearchQuery(r)
+	if err == nil {
+		q, err = view.Apply(q)
+	}
+	if err != nil {
+		WriteAndLogResponse(w, r, 400, headers, []byte(err.Error()))
+		return
+	}
+
+	if format := r.URL.Query().Get("format"); len(format) > 0 && format != "json" {
+		ir.exportAssets(view.Types, format, q, w, r)
+		return
+	}
+
+	rslt, err := ir.runSearchQuery(view.Types, q, r)
+	if err != nil {
+		WriteAndLogResponse(w, r, 400, headers, []byte(err.Error()))
+		return
+	}
+
+	headers["Content-Type"] = "application/json"
+	setSearchResultHeaders(r, rslt, headers)
+	b, _ := json.Marshal(AssembleResponseFromAssets(rslt.Assets))
+	WriteAndLogResponse(w, r, 200, headers, b)
+}
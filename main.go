@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/euforia/infra-inventory/inventory"
 	log "github.com/golang/glog"
 	"github.com/gorilla/mux"
@@ -12,6 +14,11 @@ var (
 	listenAddr = flag.String("l", ":5454", "Address to start HTTP Server on")
 	enableAuth = flag.Bool("enable-auth", false, "Enable auth on write requests")
 
+	migrateVersions = flag.Bool("migrate-versions", false,
+		"Rewrite elasticsearch version documents to store the asset id and version as fields then exit")
+	reportIds = flag.Bool("report-ids", false,
+		"Print the asset ids breaking the id rules of their type as JSON then exit")
+
 	configFile = flag.String("c", "infra-inventory.json", "Config file")
 	// global config
 	cfg *inventory.InventoryConfig
@@ -41,15 +48,78 @@ func startServer(inv *inventory.Inventory) {
 	rtr.HandleFunc(cfg.Endpoints.Prefix+"/",
 		inv.ListAssetTypesHandler).Methods("GET")
 
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/_search",
+		inv.SearchHandler).Methods("GET", "POST")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/_aggregate",
+		inv.AggregateHandler).Methods("GET", "POST")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/_views",
+		inv.ListViewsHandler).Methods("GET")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/_views/{name}",
+		inv.ViewHandler).Methods("GET", "PUT", "DELETE")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/_views/{name}/results",
+		inv.ViewResultsHandler).Methods("GET", "POST")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/_types",
+		inv.ListAssetTypesHandler).Methods("GET")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/_types/{name}",
+		inv.TypeHandler).Methods("GET", "POST", "PUT", "DELETE")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/_types/{name}/unique",
+		inv.TypeUniqueHandler).Methods("GET")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/_schemas/{asset_type}",
+		inv.SchemaHandler).Methods("GET", "PUT", "DELETE")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/_schemas/{asset_type}/audit",
+		inv.SchemaAuditHandler).Methods("GET", "POST")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/_admin/prune",
+		inv.VersionPruneHandler).Methods("POST")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/_admin/ids",
+		inv.AssetIdReportHandler).Methods("GET")
+
 	rtr.HandleFunc(cfg.Endpoints.Prefix+"/{asset_type}",
 		inv.AssetTypeHandler).Methods("GET")
 
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/{asset_type}",
+		inv.AssetCreateHandler).Methods("POST")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/{asset_type}/_aggregate",
+		inv.AggregateHandler).Methods("GET", "POST")
+
 	rtr.HandleFunc(cfg.Endpoints.Prefix+"/{asset_type}/{asset}",
 		inv.AssetHandler).Methods("GET", "POST", "PUT", "DELETE")
 
 	rtr.HandleFunc(cfg.Endpoints.Prefix+"/{asset_type}/{asset}/versions",
 		inv.AssetVersionsHandler).Methods("GET")
 
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/{asset_type}/{asset}/diff",
+		inv.AssetDiffHandler).Methods("GET")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/{asset_type}/{asset}/undelete",
+		inv.AssetUndeleteHandler).Methods("POST")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/{asset_type}/{asset}/versions/{version}/restore",
+		inv.AssetVersionRestoreHandler).Methods("POST")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/{asset_type}/{asset}/relationships",
+		inv.AssetRelationshipsHandler).Methods("GET", "POST")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/{asset_type}/{asset}/relationships/{relationship}/{target_type}/{target}",
+		inv.AssetRelationshipHandler).Methods("DELETE")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/{asset_type}/{asset}/graph",
+		inv.AssetGraphHandler).Methods("GET")
+
+	rtr.HandleFunc(cfg.Endpoints.Prefix+"/{asset_type}/{asset}/impact",
+		inv.AssetImpactHandler).Methods("GET")
+
 	http.Handle("/", rtr)
 
 	log.Infof("Starting server on %s%s\n", *listenAddr, cfg.Endpoints.Prefix)
@@ -60,15 +130,40 @@ func startServer(inv *inventory.Inventory) {
 
 func initializeInventory() (inv *inventory.Inventory) {
 	var (
-		dstore    *inventory.ElasticsearchDatastore
-		invDstore *inventory.InventoryDatastore
-		err       error
+		dstore inventory.IDatastore
+		err    error
 	)
 
-	if dstore, err = inventory.NewElasticsearchDatastore(
-		cfg.Datastore.Config.Host, cfg.Datastore.Config.Port,
-		cfg.Datastore.Config.Index, cfg.Datastore.Config.MappingFile); err != nil {
+	switch cfg.Datastore.Type {
+	case "memory":
+		log.Infof("Datastore: memory (not persisted)\n")
+		dstore = inventory.NewMemoryDatastore()
+		break
+	case "bolt":
+		log.Infof("Datastore: bolt %s\n", cfg.Datastore.Bolt.Path)
+		if dstore, err = inventory.NewBoltDatastore(cfg.Datastore.Bolt.Path); err != nil {
+			log.Fatalf("%s\n", err)
+		}
+		break
+	case "elasticsearch", "":
+		dstore = initializeEssDatastore()
+		break
+	default:
+		log.Fatalf("Datastore type not supported: %s\n", cfg.Datastore.Type)
+	}
+
+	// New inventory instance (api etc.)
+	if inv, err = inventory.NewInventory(cfg, dstore); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	return
+}
 
+func initializeEssDatastore() *inventory.InventoryDatastore {
+	dstore, err := inventory.NewElasticsearchDatastore(
+		cfg.Datastore.Config.Host, cfg.Datastore.Config.Port,
+		cfg.Datastore.Config.Index, cfg.Datastore.Config.MappingFile)
+	if err != nil {
 		log.Fatalf("%s\n", err)
 	}
 
@@ -78,17 +173,46 @@ func initializeInventory() (inv *inventory.Inventory) {
 		cfg.Datastore.Config.Port, dstore.VersionIndex)
 
 	// inventory datastore
-	invDstore = inventory.NewInventoryDatastore(dstore)
-	// New inventory instance (api etc.)
-	if inv, err = inventory.NewInventory(cfg, invDstore); err != nil {
+	return inventory.NewInventoryDatastore(dstore)
+}
+
+func runVersionMigration() {
+	dstore := initializeEssDatastore()
+
+	migrated, err := dstore.MigrateVersions()
+	if err != nil {
+		log.Fatalf("Migrated %d versions before failing: %s\n", migrated, err)
+	}
+	log.Infof("Migrated versions: %d\n", migrated)
+}
+
+func runIdReport() {
+	inv := initializeInventory()
+
+	report, err := inv.ReportAssetIds(flag.Args()...)
+	if err != nil {
 		log.Fatalf("%s\n", err)
 	}
-	return
+	b, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(b))
+	log.Infof("Asset ids breaking rules: %d of %d\n", report.Invalid, report.Checked)
 }
 
 func main() {
 	loadConfig()
 
+	if *migrateVersions {
+		runVersionMigration()
+		log.Flush()
+		return
+	}
+	if *reportIds {
+		runIdReport()
+		log.Flush()
+		return
+	}
+
 	inv := initializeInventory()
+	inv.StartVersionPruner()
 	startServer(inv)
 }